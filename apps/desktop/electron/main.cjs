@@ -229,6 +229,7 @@ function createWindow() {
       httpServer = server;
     },
   });
+  decoderService.attachServerAuth(mainWindow.webContents.session);
 }
 
 function startDecoderServerInBackground() {
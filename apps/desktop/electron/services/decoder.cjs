@@ -1,8 +1,11 @@
 const http = require("http");
+const crypto = require("crypto");
 
 function createDecoderService({ isDev, path, fs, spawn, logToFile, baseDir }) {
   let goServer = null;
   let cleanupInProgress = false;
+  // Per-launch bearer token the playback server requires on every request.
+  const serverToken = process.env.RAFFI_SERVER_TOKEN || crypto.randomBytes(32).toString("hex");
   let decoderStatus = {
     state: "idle",
     reason: "idle",
@@ -102,6 +105,28 @@ function createDecoderService({ isDev, path, fs, spawn, logToFile, baseDir }) {
     return serverAddr.startsWith("http") ? serverAddr : `http://${serverAddr}`;
   }
 
+  function getServerToken() {
+    return serverToken;
+  }
+
+  // Adds the bearer token to every renderer request that targets the playback
+  // server, including media element and hls.js loads that cannot set headers.
+  function attachServerAuth(session) {
+    if (!session?.webRequest?.onBeforeSendHeaders) {
+      return;
+    }
+    const serverUrl = getDecoderServerUrl();
+    session.webRequest.onBeforeSendHeaders({ urls: [`${serverUrl}/*`] }, (details, callback) => {
+      callback({
+        requestHeaders: {
+          ...details.requestHeaders,
+          Authorization: `Bearer ${serverToken}`,
+        },
+      });
+    });
+    logToFile("Playback server auth registered");
+  }
+
   function getDecoderPath() {
     const platform = process.platform;
     const arch = process.arch;
@@ -169,6 +194,34 @@ function createDecoderService({ isDev, path, fs, spawn, logToFile, baseDir }) {
     }
   }
 
+  // Reports whether a running playback server accepts this launch's token. A
+  // server left by another launch was started with a different one.
+  async function isDecoderServerAuthorized({ timeoutMs = 500 } = {}) {
+    const serverUrl = getDecoderServerUrl();
+
+    try {
+      const statusCode = await new Promise((resolve, reject) => {
+        const req = http.get(
+          `${serverUrl}/lan/status`,
+          { headers: { Authorization: `Bearer ${serverToken}` } },
+          (res) => {
+            res.resume();
+            resolve(res.statusCode);
+          },
+        );
+        req.on("error", reject);
+        req.setTimeout(timeoutMs, () => {
+          req.destroy();
+          reject(new Error("Timeout"));
+        });
+      });
+      return statusCode !== 401 && statusCode !== 403;
+    } catch (err) {
+      logToFile(`Decoder auth check failed`, err);
+      return false;
+    }
+  }
+
   async function waitForDecoderReady(maxRetries = 30, retryDelayMs = 500) {
     const serverUrl = getDecoderServerUrl();
 
@@ -229,6 +282,17 @@ function createDecoderService({ isDev, path, fs, spawn, logToFile, baseDir }) {
 
     const alreadyRunning = await isDecoderServerHealthy({ timeoutMs: 500 });
     if (alreadyRunning) {
+      if (!(await isDecoderServerAuthorized({ timeoutMs: 500 }))) {
+        const detail = `Another playback server is already listening on ${getDecoderServerUrl()} and does not accept this launch's access token. Close it and restart Raffi.`;
+        logToFile("Existing playback server rejected our token, not attaching");
+        setDecoderStatus({
+          state: "unavailable",
+          reason: "auth_mismatch",
+          message: "Raffi could not use the running playback server.",
+          detail,
+        });
+        throw new Error(detail);
+      }
       logToFile("Found existing playback server, attaching instead of spawning");
       setDecoderStatus({
         state: "ready",
@@ -262,6 +326,7 @@ function createDecoderService({ isDev, path, fs, spawn, logToFile, baseDir }) {
       const decoderEnv = {
         ...process.env,
         RAFFI_SERVER_ADDR: process.env.RAFFI_SERVER_ADDR || "127.0.0.1:6969",
+        RAFFI_SERVER_TOKEN: serverToken,
         GODEBUG: inheritedGoDebug.includes("netdns=")
           ? inheritedGoDebug
           : [inheritedGoDebug, "netdns=go"].filter(Boolean).join(","),
@@ -381,6 +446,8 @@ function createDecoderService({ isDev, path, fs, spawn, logToFile, baseDir }) {
     cleanupDecoder,
     getDecoderStatus,
     onDecoderStatusChange,
+    getServerToken,
+    attachServerAuth,
   };
 }
 
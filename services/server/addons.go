@@ -0,0 +1,254 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"raffi-server/src/addons"
+	"strings"
+)
+
+// /addons/installed                               GET/PUT -> installed transport URLs
+// /addons/streams/{type}/{id}                     GET -> merged streams from installed addons
+// /addons/{transportUrlEncoded}/manifest.json     GET -> validated manifest
+// /addons/{transportUrlEncoded}/{resource}/...    GET -> proxied catalog/meta/stream/subtitles
+//
+// Paired LAN devices only reach installed addons; any other transport URL
+// would let them make the server fetch arbitrary hosts on the owner's network.
+func (s *Server) handleAddons(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	// Use the escaped path so an encoded transport URL stays a single segment.
+	rest := strings.TrimPrefix(r.URL.EscapedPath(), "/addons/")
+	parts := strings.Split(rest, "/")
+	if len(parts) == 0 || parts[0] == "" {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch parts[0] {
+	case "installed":
+		s.handleInstalledAddons(w, r)
+		return
+	case "streams":
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if len(parts) != 3 {
+			http.NotFound(w, r)
+			return
+		}
+		contentType, err1 := url.PathUnescape(parts[1])
+		id, err2 := url.PathUnescape(strings.TrimSuffix(parts[2], ".json"))
+		if err1 != nil || err2 != nil {
+			http.Error(w, "invalid path", http.StatusBadRequest)
+			return
+		}
+		s.handleAggregateStreams(w, r, contentType, id)
+		return
+	}
+
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	transport, err := url.PathUnescape(parts[0])
+	if err != nil {
+		http.Error(w, "invalid transport URL", http.StatusBadRequest)
+		return
+	}
+	if requestDevice(r) != nil && !s.addonInstalled(transport) {
+		http.Error(w, "forbidden: addon is not installed", http.StatusForbidden)
+		return
+	}
+
+	if len(parts) == 2 && parts[1] == "manifest.json" {
+		_, body, err := s.addonClient.Manifest(r.Context(), transport)
+		if err != nil {
+			writeAddonError(w, err)
+			return
+		}
+		writeAddonJSON(w, body)
+		return
+	}
+
+	// {resource}/{type}/{id}.json or {resource}/{type}/{id}/{extra}.json
+	if len(parts) != 4 && len(parts) != 5 {
+		http.NotFound(w, r)
+		return
+	}
+	last := len(parts) - 1
+	if !strings.HasSuffix(parts[last], ".json") {
+		http.NotFound(w, r)
+		return
+	}
+	parts[last] = strings.TrimSuffix(parts[last], ".json")
+
+	resource := parts[1]
+	switch resource {
+	case "catalog", "meta", "stream", "subtitles":
+	default:
+		http.Error(w, "unsupported addon resource", http.StatusBadRequest)
+		return
+	}
+	contentType, err1 := url.PathUnescape(parts[2])
+	id, err2 := url.PathUnescape(parts[3])
+	if err1 != nil || err2 != nil {
+		http.Error(w, "invalid path", http.StatusBadRequest)
+		return
+	}
+	extra := ""
+	if len(parts) == 5 {
+		extra = parts[4]
+	}
+
+	body, err := s.addonClient.Resource(r.Context(), transport, resource, contentType, id, extra)
+	if err != nil {
+		writeAddonError(w, err)
+		return
+	}
+	writeAddonJSON(w, body)
+}
+
+func (s *Server) handleInstalledAddons(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		s.addonsMu.Lock()
+		list := append([]string{}, s.installedAddons...)
+		s.addonsMu.Unlock()
+		writeJSON(w, list)
+	case http.MethodPut, http.MethodPost:
+		var req []string
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "invalid JSON", http.StatusBadRequest)
+			return
+		}
+		list := make([]string, 0, len(req))
+		seen := make(map[string]struct{}, len(req))
+		for _, raw := range req {
+			manifestURL, _, err := addons.NormalizeTransportURL(raw)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if _, ok := seen[manifestURL]; ok {
+				continue
+			}
+			seen[manifestURL] = struct{}{}
+			list = append(list, manifestURL)
+		}
+		s.addonsMu.Lock()
+		s.installedAddons = list
+		s.saveInstalledAddonsLocked()
+		s.addonsMu.Unlock()
+		writeJSON(w, list)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *Server) handleAggregateStreams(w http.ResponseWriter, r *http.Request, contentType, id string) {
+	// Explicit transportUrl query parameters override the installed list, for
+	// the owner only.
+	var transports []string
+	if requestDevice(r) == nil {
+		transports = r.URL.Query()["transportUrl"]
+	}
+	if len(transports) == 0 {
+		s.addonsMu.Lock()
+		transports = append([]string{}, s.installedAddons...)
+		s.addonsMu.Unlock()
+	}
+	if len(transports) == 0 {
+		http.Error(w, "no addons installed", http.StatusBadRequest)
+		return
+	}
+
+	writeJSON(w, s.addonClient.Streams(r.Context(), transports, contentType, id))
+}
+
+// addonInstalled reports whether transport names an installed addon.
+func (s *Server) addonInstalled(transport string) bool {
+	manifestURL, _, err := addons.NormalizeTransportURL(transport)
+	if err != nil {
+		return false
+	}
+	s.addonsMu.Lock()
+	defer s.addonsMu.Unlock()
+	for _, installed := range s.installedAddons {
+		if installed == manifestURL {
+			return true
+		}
+	}
+	return false
+}
+
+// loadInstalledAddons reads the installed list saved in stateDir.
+func (s *Server) loadInstalledAddons(stateDir string) {
+	s.addonsPath = filepath.Join(stateDir, "addons.json")
+	data, err := os.ReadFile(s.addonsPath)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			log.Printf("addons: failed to read installed addons: %v", err)
+		}
+		return
+	}
+	var list []string
+	if err := json.Unmarshal(data, &list); err != nil {
+		log.Printf("addons: failed to decode installed addons: %v", err)
+		return
+	}
+	s.addonsMu.Lock()
+	s.installedAddons = list
+	s.addonsMu.Unlock()
+}
+
+func (s *Server) saveInstalledAddonsLocked() {
+	if s.addonsPath == "" {
+		return
+	}
+	data, err := json.MarshalIndent(s.installedAddons, "", "  ")
+	if err != nil {
+		log.Printf("addons: failed to encode installed addons: %v", err)
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(s.addonsPath), 0o700); err != nil {
+		log.Printf("addons: failed to create state dir: %v", err)
+		return
+	}
+	tmp := s.addonsPath + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		log.Printf("addons: failed to write installed addons: %v", err)
+		return
+	}
+	if err := os.Rename(tmp, s.addonsPath); err != nil {
+		log.Printf("addons: failed to save installed addons: %v", err)
+	}
+}
+
+func writeAddonJSON(w http.ResponseWriter, body []byte) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(body)
+}
+
+func writeAddonError(w http.ResponseWriter, err error) {
+	var unsupported *addons.UnsupportedError
+	switch {
+	case errors.Is(err, addons.ErrInvalidTransport):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.As(err, &unsupported):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	default:
+		http.Error(w, err.Error(), http.StatusBadGateway)
+	}
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"raffi-server/src/lan"
+	"raffi-server/src/session"
+	"strings"
+	"sync"
+)
+
+// Origins the desktop renderer is served from (vite dev server and the
+// bundled express server). Extend with RAFFI_ALLOWED_ORIGINS.
+var defaultAllowedOrigins = []string{
+	"http://localhost:5173",
+	"http://127.0.0.1:5173",
+	"http://127.0.0.1:11420",
+	"http://localhost:11420",
+}
+
+type accessPolicy struct {
+	token   string
+	origins map[string]struct{}
+	// pairing resolves scoped tokens issued to LAN devices. Nil unless LAN
+	// mode is enabled.
+	pairing *lan.Pairing
+
+	// grants are media-only tokens for clients that cannot be paired, such as
+	// DLNA renderers. Each one is bound to a single session.
+	grantsMu sync.Mutex
+	grants   map[string]string
+}
+
+type principalKey struct{}
+
+// requestDevice returns the paired device a request was authenticated as, or
+// nil for the owner token.
+func requestDevice(r *http.Request) *lan.Device {
+	dev, _ := r.Context().Value(principalKey{}).(*lan.Device)
+	return dev
+}
+
+// loadAccessPolicy reads the per-launch bearer token from RAFFI_SERVER_TOKEN.
+// When it is unset a random token is generated so the API is never left open
+// and written to a file only the current user can read; the desktop shell
+// always provides one.
+func loadAccessPolicy() *accessPolicy {
+	p := &accessPolicy{
+		token:   strings.TrimSpace(os.Getenv("RAFFI_SERVER_TOKEN")),
+		origins: make(map[string]struct{}),
+		grants:  make(map[string]string),
+	}
+	if p.token == "" {
+		p.token = randomToken()
+		path := filepath.Join(serverStateDir(), "access-token")
+		if err := writeTokenFile(path, p.token); err != nil {
+			log.Printf("RAFFI_SERVER_TOKEN not set, failed to save generated access token: %v", err)
+		} else {
+			log.Printf("RAFFI_SERVER_TOKEN not set, generated access token saved to %s", path)
+		}
+	}
+
+	for _, o := range defaultAllowedOrigins {
+		p.origins[o] = struct{}{}
+	}
+	for _, o := range strings.Split(os.Getenv("RAFFI_ALLOWED_ORIGINS"), ",") {
+		if o = normalizeOrigin(o); o != "" {
+			p.origins[o] = struct{}{}
+		}
+	}
+	return p
+}
+
+func writeTokenFile(path, token string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(token+"\n"), 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func randomToken() string {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		log.Fatalf("failed to generate access token: %v", err)
+	}
+	return hex.EncodeToString(b)
+}
+
+func normalizeOrigin(o string) string {
+	o = strings.TrimSpace(o)
+	if o == "" {
+		return ""
+	}
+	u, err := url.Parse(o)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return ""
+	}
+	return strings.ToLower(u.Scheme + "://" + u.Host)
+}
+
+func (p *accessPolicy) originAllowed(origin string) bool {
+	_, ok := p.origins[normalizeOrigin(origin)]
+	return ok
+}
+
+// authenticate accepts the token as a bearer Authorization header or, for
+// clients that cannot set headers (media elements, ffmpeg), as ?token=.
+// A nil device with ok=true means the owner token was presented.
+func (p *accessPolicy) authenticate(r *http.Request) (dev *lan.Device, ok bool) {
+	presented := presentedToken(r)
+	if presented == "" {
+		return nil, false
+	}
+	if subtle.ConstantTimeCompare([]byte(presented), []byte(p.token)) == 1 {
+		return nil, true
+	}
+	if p.pairing != nil {
+		if dev, ok := p.pairing.Authenticate(presented); ok {
+			return dev, true
+		}
+	}
+	return nil, false
+}
+
+func presentedToken(r *http.Request) string {
+	if h := r.Header.Get("Authorization"); h != "" {
+		if scheme, value, ok := strings.Cut(h, " "); ok && strings.EqualFold(scheme, "Bearer") {
+			return strings.TrimSpace(value)
+		}
+	}
+	return r.URL.Query().Get("token")
+}
+
+// devicePermitted limits paired devices to playback: browsing addons and the
+// library, creating and watching sessions, joining watch parties. Clip export,
+// LAN management, casting and addon installation stay owner-only. Which
+// sessions a device may use is checked by deviceSessionPermitted.
+func devicePermitted(r *http.Request, dev *lan.Device) bool {
+	if !dev.HasScope(lan.ScopePlayback) {
+		return false
+	}
+	p := r.URL.Path
+	read := r.Method == http.MethodGet || r.Method == http.MethodHead
+	switch {
+	case p == "/sessions":
+		return r.Method == http.MethodPost
+	case strings.HasPrefix(p, "/sessions/"):
+		if strings.HasSuffix(p, "/clip") {
+			return false
+		}
+		if strings.HasSuffix(p, "/party") {
+			// Joining only; opening and ending a party stay with the owner.
+			return r.Method == http.MethodGet
+		}
+		return read || (r.Method == http.MethodPost && strings.HasSuffix(p, "/audio"))
+	case p == "/cleanup":
+		return r.Method == http.MethodPost || r.Method == http.MethodDelete
+	case strings.HasPrefix(p, "/torrents/"), p == "/community-addons":
+		return read
+	case strings.HasPrefix(p, "/addons/"), strings.HasPrefix(p, "/party/"):
+		return read
+	case p == "/library", strings.HasPrefix(p, "/library/"):
+		return read
+	}
+	return false
+}
+
+// deviceSessionPermitted limits a paired device to the sessions it created.
+// Guests of an open watch party, who found the session through its share code,
+// may also read it; switching the audio track and cleaning up stay with the
+// device that created the session.
+func deviceSessionPermitted(r *http.Request, dev *lan.Device, sess session.Session, partyOpen bool) bool {
+	if sess.DeviceID == dev.ID {
+		return true
+	}
+	if !partyOpen || strings.HasPrefix(r.URL.Path, "/cleanup") {
+		return false
+	}
+	return r.Method == http.MethodGet || r.Method == http.MethodHead
+}
+
+// grantSession issues a token that can only fetch the media of one session.
+func (p *accessPolicy) grantSession(sessionID string) string {
+	token := randomToken()
+	p.grantsMu.Lock()
+	p.grants[token] = sessionID
+	p.grantsMu.Unlock()
+	return token
+}
+
+func (p *accessPolicy) revokeSession(sessionID string) {
+	p.grantsMu.Lock()
+	defer p.grantsMu.Unlock()
+	for token, id := range p.grants {
+		if id == sessionID {
+			delete(p.grants, token)
+		}
+	}
+}
+
+func (p *accessPolicy) grantedSession(r *http.Request) (string, bool) {
+	presented := presentedToken(r)
+	if presented == "" {
+		return "", false
+	}
+	p.grantsMu.Lock()
+	defer p.grantsMu.Unlock()
+	id, ok := p.grants[presented]
+	return id, ok
+}
+
+// grantPermitted allows a session grant to read that session's media only.
+func grantPermitted(r *http.Request, sessionID string) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+	prefix := "/sessions/" + sessionID + "/"
+	if !strings.HasPrefix(r.URL.Path, prefix) {
+		return false
+	}
+	rest := strings.TrimPrefix(r.URL.Path, prefix)
+	return strings.HasPrefix(rest, "stream/") || rest == "direct" || rest == "rendition.mp4"
+}
+
+// withToken appends the access token to a server URL handed to ffmpeg or
+// ffprobe, which reach back into this server for torrent streams.
+func (p *accessPolicy) withToken(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+	q := u.Query()
+	q.Set("token", p.token)
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+func withAuth(policy *accessPolicy, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := strings.TrimSpace(r.Header.Get("Origin"))
+		if origin != "" && !policy.originAllowed(origin) {
+			http.Error(w, "origin not allowed", http.StatusForbidden)
+			return
+		}
+
+		if r.Method == http.MethodOptions || isPublicRoute(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if sessionID, ok := policy.grantedSession(r); ok {
+			if !grantPermitted(r, sessionID) {
+				http.Error(w, "forbidden: token is limited to session media", http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		dev, ok := policy.authenticate(r)
+		if !ok {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="raffi"`)
+			http.Error(w, "unauthorized: missing or invalid access token", http.StatusUnauthorized)
+			return
+		}
+		if dev != nil {
+			if !devicePermitted(r, dev) {
+				http.Error(w, "forbidden: this device is not allowed to use this endpoint", http.StatusForbidden)
+				return
+			}
+			r = r.WithContext(context.WithValue(r.Context(), principalKey{}, dev))
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// isPublicRoute reports routes that must work before a device has a token.
+func isPublicRoute(r *http.Request) bool {
+	return r.URL.Path == "/lan/pair/claim" && r.Method == http.MethodPost
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+
+	"raffi-server/src/lan"
+	"raffi-server/src/party"
+	"raffi-server/src/session"
+)
+
+func asDevice(r *http.Request, dev *lan.Device) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), principalKey{}, dev))
+}
+
+func TestDeviceSessionPermitted(t *testing.T) {
+	dev := &lan.Device{ID: "phone", Scopes: []string{lan.ScopePlayback}}
+	own := session.Session{ID: "a", DeviceID: "phone"}
+	other := session.Session{ID: "b", DeviceID: "tablet"}
+	owner := session.Session{ID: "c"}
+
+	tests := []struct {
+		name      string
+		method    string
+		path      string
+		sess      session.Session
+		partyOpen bool
+		want      bool
+	}{
+		{"own session info", http.MethodGet, "/sessions/a", own, false, true},
+		{"own audio switch", http.MethodPost, "/sessions/a/audio", own, false, true},
+		{"own cleanup", http.MethodPost, "/cleanup", own, false, true},
+		{"other device session", http.MethodGet, "/sessions/b", other, false, false},
+		{"owner session stream", http.MethodGet, "/sessions/c/stream/master.m3u8", owner, false, false},
+		{"owner session cleanup", http.MethodDelete, "/cleanup", owner, false, false},
+		{"party guest stream", http.MethodGet, "/sessions/c/stream/master.m3u8", owner, true, true},
+		{"party guest join", http.MethodGet, "/sessions/c/party", owner, true, true},
+		{"party guest audio switch", http.MethodPost, "/sessions/c/audio", owner, true, false},
+		{"party guest cleanup", http.MethodPost, "/cleanup", owner, true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, tt.path, nil)
+			if got := deviceSessionPermitted(r, dev, tt.sess, tt.partyOpen); got != tt.want {
+				t.Errorf("deviceSessionPermitted = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDeviceCannotUseOthersSessions(t *testing.T) {
+	s := &Server{sessions: session.NewMemoryStore(), parties: party.NewManager()}
+	sess, err := s.sessions.Create("http://example.com/movie.mkv", session.SessionKindTorrent, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = s.sessions.Update(sess.ID, func(sess *session.Session) { sess.DeviceID = "tablet" })
+	dev := &lan.Device{ID: "phone", Scopes: []string{lan.ScopePlayback}}
+
+	for _, r := range []*http.Request{
+		httptest.NewRequest(http.MethodGet, "/sessions/"+sess.ID, nil),
+		httptest.NewRequest(http.MethodPost, "/sessions/"+sess.ID+"/audio", strings.NewReader(`{"index":1}`)),
+	} {
+		rec := httptest.NewRecorder()
+		s.handleSessionByID(rec, asDevice(r, dev))
+		if rec.Code != http.StatusForbidden {
+			t.Errorf("%s %s = %d, want 403", r.Method, r.URL.Path, rec.Code)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	s.handleCleanup(rec, asDevice(httptest.NewRequest(http.MethodPost, "/cleanup?id="+sess.ID, nil), dev))
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("POST /cleanup = %d, want 403", rec.Code)
+	}
+	if _, err := s.sessions.Snapshot(sess.ID); err != nil {
+		t.Errorf("session was removed by another device: %v", err)
+	}
+
+	rec = httptest.NewRecorder()
+	s.handleSessionByID(rec, asDevice(httptest.NewRequest(http.MethodGet, "/sessions/missing", nil), dev))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("GET unknown session = %d, want 404", rec.Code)
+	}
+}
+
+func TestPartyUpgradeChecksOrigin(t *testing.T) {
+	s := &Server{sessions: session.NewMemoryStore(), parties: party.NewManager()}
+	sess, err := s.sessions.Create("http://example.com/movie.mkv", session.SessionKindTorrent, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.parties.Open(sess.ID); err != nil {
+		t.Fatal(err)
+	}
+	policy := &accessPolicy{token: "secret", origins: map[string]struct{}{"http://localhost:5173": {}}, grants: map[string]string{}}
+	srv := httptest.NewServer(withAuth(policy, http.HandlerFunc(s.handleSessionByID)))
+	defer srv.Close()
+	u := "ws" + strings.TrimPrefix(srv.URL, "http") + "/sessions/" + sess.ID + "/party?token=secret"
+
+	header := http.Header{"Origin": {"https://evil.example"}}
+	if conn, resp, err := websocket.DefaultDialer.Dial(u, header); err == nil {
+		conn.Close()
+		t.Fatal("cross-origin upgrade succeeded")
+	} else if resp == nil || resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("cross-origin upgrade: %v, want 403", err)
+	}
+
+	header.Set("Origin", "http://localhost:5173")
+	conn, _, err := websocket.DefaultDialer.Dial(u, header)
+	if err != nil {
+		t.Fatalf("upgrade from an allowed origin: %v", err)
+	}
+	conn.Close()
+}
@@ -0,0 +1,469 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os/exec"
+	"path/filepath"
+	"raffi-server/src/cast"
+	"raffi-server/src/session"
+	"raffi-server/src/source"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	castFormatDirect = "direct"
+	castFormatHLS    = "hls"
+	castFormatMP4    = "mp4"
+)
+
+type castTarget struct {
+	controller *cast.Controller
+	format     string
+	title      string
+	url        string
+	// offset is where an mp4 rendition starts; the renderer reports
+	// positions relative to it.
+	offset    float64
+	startedAt time.Time
+}
+
+type castStatus struct {
+	Device    *cast.Device        `json:"device"`
+	Format    string              `json:"format"`
+	URL       string              `json:"url"`
+	StartedAt time.Time           `json:"startedAt"`
+	Transport *cast.TransportInfo `json:"transport,omitempty"`
+	Error     string              `json:"error,omitempty"`
+}
+
+// /cast/devices  GET -> discovered renderers (?refresh=1 forces a new scan)
+func (s *Server) handleCastDevices(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if r.URL.Path != "/cast/devices" {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	refresh := r.URL.Query().Get("refresh") == "1"
+	devices, err := s.castManager.Devices(r.Context(), refresh)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("discovery failed: %v", err), http.StatusBadGateway)
+		return
+	}
+	writeJSON(w, devices)
+}
+
+// /sessions/{id}/cast           POST   -> start casting {deviceId, format, startTime, title}
+// /sessions/{id}/cast           GET    -> cast status
+// /sessions/{id}/cast           DELETE -> stop casting
+// /sessions/{id}/cast/{action}  POST   -> play | pause | stop | seek {position} | volume {volume}
+func (s *Server) handleCast(w http.ResponseWriter, r *http.Request, id, action string) {
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	sess, err := s.sessions.Get(id)
+	if err != nil {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+
+	if action == "" {
+		switch r.Method {
+		case http.MethodPost:
+			s.startCast(w, r, sess)
+		case http.MethodGet:
+			s.castStatus(w, r, id)
+		case http.MethodDelete:
+			if err := s.stopCast(r.Context(), id); err != nil {
+				writeCastError(w, err)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	target := s.castTargetFor(id)
+	if target == nil {
+		http.Error(w, "session is not being cast", http.StatusConflict)
+		return
+	}
+
+	var req struct {
+		Position *float64 `json:"position"`
+		Volume   *int     `json:"volume"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "invalid JSON", http.StatusBadRequest)
+			return
+		}
+	}
+
+	ctx := r.Context()
+	switch action {
+	case "play":
+		err = target.controller.Play(ctx)
+	case "pause":
+		err = target.controller.Pause(ctx)
+	case "stop":
+		err = s.stopCast(ctx, id)
+	case "seek":
+		if req.Position == nil || *req.Position < 0 {
+			http.Error(w, "position required", http.StatusBadRequest)
+			return
+		}
+		err = s.seekCast(ctx, target, *req.Position)
+	case "volume":
+		if req.Volume == nil {
+			http.Error(w, "volume required", http.StatusBadRequest)
+			return
+		}
+		err = target.controller.SetVolume(ctx, *req.Volume)
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		writeCastError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) startCast(w http.ResponseWriter, r *http.Request, sess *session.Session) {
+	var req struct {
+		DeviceID  string  `json:"deviceId"`
+		Format    string  `json:"format"`
+		StartTime float64 `json:"startTime"`
+		Title     string  `json:"title"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if req.DeviceID == "" {
+		http.Error(w, "deviceId required", http.StatusBadRequest)
+		return
+	}
+	format := strings.ToLower(strings.TrimSpace(req.Format))
+	switch format {
+	case "":
+		format = castFormatMP4
+	case castFormatDirect, castFormatHLS, castFormatMP4:
+	default:
+		http.Error(w, fmt.Sprintf("unsupported format %q", req.Format), http.StatusBadRequest)
+		return
+	}
+	// Renderers fetch media over the network, so the server has to listen on
+	// more than loopback.
+	if !s.lanMode {
+		http.Error(w, "casting requires LAN mode (RAFFI_LAN_MODE=1)", http.StatusConflict)
+		return
+	}
+
+	dev, err := s.castManager.Device(r.Context(), req.DeviceID)
+	if err != nil {
+		writeCastError(w, err)
+		return
+	}
+	ip, err := cast.LocalAddrFor(dev.Host())
+	if err != nil {
+		http.Error(w, fmt.Sprintf("cannot reach renderer: %v", err), http.StatusBadGateway)
+		return
+	}
+
+	// Replace any previous cast of this session.
+	_ = s.stopCast(r.Context(), sess.ID)
+
+	target := &castTarget{
+		controller: cast.NewController(dev, nil),
+		format:     format,
+		title:      req.Title,
+		startedAt:  time.Now(),
+	}
+	base := "http://" + net.JoinHostPort(ip.String(), s.listenPort)
+	token := s.access.grantSession(sess.ID)
+	media, offset := castMedia(base, token, sess, format, req.StartTime)
+	media.Title = req.Title
+	target.url = media.URL
+	target.offset = offset
+
+	if err := target.controller.Load(r.Context(), media); err != nil {
+		s.access.revokeSession(sess.ID)
+		writeCastError(w, err)
+		return
+	}
+	if format != castFormatMP4 && req.StartTime > 0 {
+		if err := target.controller.Seek(r.Context(), req.StartTime); err != nil {
+			log.Printf("cast: initial seek failed for %s: %v", sess.ID, err)
+		}
+	}
+
+	s.castMu.Lock()
+	s.casts[sess.ID] = target
+	s.castMu.Unlock()
+	log.Printf("cast: session %s -> %s (%s)", sess.ID, dev.Name, format)
+
+	writeJSON(w, castStatus{Device: dev, Format: format, URL: redactToken(media.URL), StartedAt: target.startedAt})
+}
+
+// castMedia builds the URL handed to the renderer. mp4 renditions are live
+// remuxes that cannot be seeked by the renderer, so the start time is baked
+// into the URL and returned as the position offset.
+func castMedia(base, token string, sess *session.Session, format string, start float64) (cast.Media, float64) {
+	q := url.Values{"token": {token}}
+	switch format {
+	case castFormatDirect:
+		return cast.Media{
+			URL:      fmt.Sprintf("%s/sessions/%s/direct?%s", base, sess.ID, q.Encode()),
+			MimeType: directMimeType(sess.Source),
+		}, 0
+	case castFormatHLS:
+		return cast.Media{
+			URL:      fmt.Sprintf("%s/sessions/%s/stream/child.m3u8?%s", base, sess.ID, q.Encode()),
+			MimeType: "application/vnd.apple.mpegurl",
+		}, 0
+	default:
+		if start > 0 {
+			q.Set("start", strconv.FormatFloat(start, 'f', 3, 64))
+		}
+		return cast.Media{
+			URL:      fmt.Sprintf("%s/sessions/%s/rendition.mp4?%s", base, sess.ID, q.Encode()),
+			MimeType: "video/mp4",
+		}, start
+	}
+}
+
+func (s *Server) seekCast(ctx context.Context, target *castTarget, position float64) error {
+	if target.format != castFormatMP4 {
+		return target.controller.Seek(ctx, position)
+	}
+	u, err := url.Parse(target.url)
+	if err != nil {
+		return err
+	}
+	q := u.Query()
+	q.Set("start", strconv.FormatFloat(position, 'f', 3, 64))
+	u.RawQuery = q.Encode()
+	if err := target.controller.Load(ctx, cast.Media{URL: u.String(), Title: target.title, MimeType: "video/mp4"}); err != nil {
+		return err
+	}
+	s.castMu.Lock()
+	target.url = u.String()
+	target.offset = position
+	s.castMu.Unlock()
+	return nil
+}
+
+func (s *Server) castStatus(w http.ResponseWriter, r *http.Request, id string) {
+	target := s.castTargetFor(id)
+	if target == nil {
+		http.Error(w, "session is not being cast", http.StatusNotFound)
+		return
+	}
+	s.castMu.Lock()
+	status := castStatus{
+		Device:    target.controller.Device(),
+		Format:    target.format,
+		URL:       redactToken(target.url),
+		StartedAt: target.startedAt,
+	}
+	offset := target.offset
+	s.castMu.Unlock()
+
+	info, err := target.controller.Status(r.Context())
+	if err != nil {
+		status.Error = err.Error()
+	} else {
+		info.Position += offset
+		status.Transport = &info
+	}
+	writeJSON(w, status)
+}
+
+func (s *Server) castTargetFor(id string) *castTarget {
+	s.castMu.Lock()
+	defer s.castMu.Unlock()
+	return s.casts[id]
+}
+
+// stopCast stops the renderer and revokes its media token. It is a no-op when
+// the session is not being cast.
+func (s *Server) stopCast(ctx context.Context, id string) error {
+	s.castMu.Lock()
+	target := s.casts[id]
+	delete(s.casts, id)
+	s.castMu.Unlock()
+	s.access.revokeSession(id)
+	if target == nil {
+		return nil
+	}
+	return target.controller.Stop(ctx)
+}
+
+func writeCastError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, cast.ErrDeviceNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, cast.ErrVolumeUnsupported):
+		http.Error(w, err.Error(), http.StatusNotImplemented)
+	default:
+		http.Error(w, err.Error(), http.StatusBadGateway)
+	}
+}
+
+func redactToken(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return raw
+	}
+	q := u.Query()
+	if q.Has("token") {
+		q.Set("token", "redacted")
+		u.RawQuery = q.Encode()
+	}
+	return u.String()
+}
+
+func directMimeType(src string) string {
+	u, err := url.Parse(src)
+	p := src
+	if err == nil && u.Path != "" {
+		p = u.Path
+	}
+	switch strings.ToLower(filepath.Ext(p)) {
+	case ".mkv":
+		return "video/x-matroska"
+	case ".webm":
+		return "video/webm"
+	case ".avi":
+		return "video/x-msvideo"
+	case ".ts", ".m2ts", ".mts":
+		return "video/mp2t"
+	case ".mov":
+		return "video/quicktime"
+	default:
+		return "video/mp4"
+	}
+}
+
+// /sessions/{id}/direct  GET -> the original media: local files and torrent
+// streams are served directly, remote URLs are redirected to.
+func (s *Server) handleDirect(w http.ResponseWriter, r *http.Request, id string) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	sess, err := s.sessions.Get(id)
+	if err != nil {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+
+	switch {
+	case sess.IsTorrent && sess.TorrentInfoHash != "":
+		r2 := r.Clone(r.Context())
+		r2.URL.Path = "/torrents/" + sess.TorrentInfoHash
+		r2.URL.RawQuery = ""
+		s.torrentStreamer.ServeHTTP(w, r2)
+	case filepath.IsAbs(sess.Source):
+		http.ServeFile(w, r, sess.Source)
+	default:
+		http.Redirect(w, r, sess.Source, http.StatusFound)
+	}
+}
+
+// /sessions/{id}/rendition.mp4  GET -> fragmented H.264/AAC MP4 remux for
+// renderers without HLS support (?start= seconds).
+func (s *Server) handleRendition(w http.ResponseWriter, r *http.Request, id string) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	sess, err := s.sessions.Get(id)
+	if err != nil {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	start := 0.0
+	if v := r.URL.Query().Get("start"); v != "" {
+		if f, err := strconv.ParseFloat(v, 64); err == nil && f >= 0 {
+			start = f
+		}
+	}
+
+	w.Header().Set("Content-Type", "video/mp4")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("transferMode.dlna.org", "Streaming")
+	if r.Method == http.MethodHead {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	input := s.mediaInput(sess)
+	args := []string{"-hide_banner", "-loglevel", "error"}
+	if strings.HasPrefix(input, "http://") || strings.HasPrefix(input, "https://") {
+		args = append(args,
+			"-reconnect", "1",
+			"-reconnect_streamed", "1",
+			"-reconnect_delay_max", "5",
+		)
+	}
+	audioMap := "0:a:0?"
+	if sess.AudioIndex > 0 {
+		audioMap = fmt.Sprintf("0:a:%d?", sess.AudioIndex)
+	}
+	args = append(args,
+		"-ss", fmt.Sprintf("%.3f", start),
+		"-protocol_whitelist", source.ProtocolWhitelist(input),
+		"-i", input,
+		"-map", "0:v:0",
+		"-map", audioMap,
+		"-map_metadata", "-1",
+		"-map_chapters", "-1",
+		"-c:v", "libx264",
+		"-preset", "veryfast",
+		"-crf", "23",
+		"-pix_fmt", "yuv420p",
+		"-profile:v", "main",
+		"-level:v", "4.1",
+		"-c:a", "aac",
+		"-ac", "2",
+		"-ar", "48000",
+		"-b:a", "160k",
+		"-movflags", "frag_keyframe+empty_moov+default_base_moof",
+		"-f", "mp4",
+		"pipe:1",
+	)
+
+	cmd := exec.CommandContext(r.Context(), s.ffmpegPath, args...)
+	cmd.Stdout = w
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil && r.Context().Err() == nil {
+		log.Printf("rendition for session %s failed: %v: %s", id, err, strings.TrimSpace(stderr.String()))
+	}
+}
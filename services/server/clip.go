@@ -7,8 +7,10 @@ import (
 	"fmt"
 	"net/http"
 	"os"
-	"os/exec"
 	"path/filepath"
+	"raffi-server/src/session"
+	"raffi-server/src/source"
+	"raffi-server/src/stream/hls"
 	"strings"
 	"time"
 )
@@ -29,6 +31,8 @@ func (s *Server) handleClip(w http.ResponseWriter, r *http.Request, id string) {
 		Name  string  `json:"name,omitempty"`
 		// Optional absolute output file path (renderer Save-As). If omitted, server chooses a default clips dir.
 		OutputPath string `json:"outputPath,omitempty"`
+		// AudioProfile overrides the session's audio profile for this clip.
+		AudioProfile string `json:"audioProfile,omitempty"`
 	}
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		http.Error(w, "invalid JSON", http.StatusBadRequest)
@@ -46,7 +50,14 @@ func (s *Server) handleClip(w http.ResponseWriter, r *http.Request, id string) {
 		return
 	}
 
-	input := strings.TrimSpace(sess.Source)
+	sessionProfile, _ := hls.ParseAudioProfile(sess.AudioProfile)
+	audioProfile, err := requestAudioProfile(req.AudioProfile, sessionProfile)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	input := strings.TrimSpace(s.mediaInput(sess))
 	if input == "" {
 		http.Error(w, "missing session source", http.StatusBadRequest)
 		return
@@ -97,8 +108,56 @@ func (s *Server) handleClip(w http.ResponseWriter, r *http.Request, id string) {
 	ctx, cancel := context.WithTimeout(r.Context(), timeout)
 	defer cancel()
 
+	job := clipJob{
+		Input:        input,
+		Start:        req.Start,
+		Duration:     clipDur,
+		AudioIndex:   sess.AudioIndex,
+		AudioProfile: audioProfile,
+		OutputPath:   outputPath,
+	}
+	job.AudioCodec, job.AudioChannels = clipAudioStream(sess)
+	job.ToneMap = s.clipToneMap(ctx, sess)
+
+	cmd := hls.CommandContext(ctx, s.ffmpegPath, job.args()...)
+	var stderr bytes.Buffer
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		errText := strings.TrimSpace(stderr.String())
+		if errText == "" {
+			errText = err.Error()
+		}
+		http.Error(w, fmt.Sprintf("ffmpeg failed: %s", errText), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, struct {
+		OutputPath string `json:"outputPath"`
+	}{OutputPath: outputPath})
+}
+
+// clipJob is one clip export: Duration seconds of Input from Start, written
+// to OutputPath as MP4.
+type clipJob struct {
+	Input           string
+	Start, Duration float64
+	AudioIndex      int
+	AudioProfile    hls.AudioProfile
+	// AudioCodec and AudioChannels describe the source audio stream.
+	AudioCodec    string
+	AudioChannels int
+	// ToneMap maps HDR video to SDR.
+	ToneMap    hls.ToneMap
+	OutputPath string
+}
+
+// args builds the ffmpeg command line for the clip.
+func (j clipJob) args() []string {
 	args := []string{"-y", "-hide_banner", "-loglevel", "error"}
-	if strings.HasPrefix(input, "http://") || strings.HasPrefix(input, "https://") {
+	args = append(args, j.ToneMap.InputArgs()...)
+	if strings.HasPrefix(j.Input, "http://") || strings.HasPrefix(j.Input, "https://") {
 		args = append(args,
 			"-reconnect", "1",
 			"-reconnect_at_eof", "1",
@@ -109,14 +168,15 @@ func (s *Server) handleClip(w http.ResponseWriter, r *http.Request, id string) {
 
 	// Place -ss/-to before -i for speed.
 	audioMap := "0:a:0?"
-	if sess.AudioIndex > 0 {
-		audioMap = fmt.Sprintf("0:a:%d?", sess.AudioIndex)
+	if j.AudioIndex > 0 {
+		audioMap = fmt.Sprintf("0:a:%d?", j.AudioIndex)
 	}
 	args = append(args,
 		"-fflags", "+genpts",
-		"-ss", fmt.Sprintf("%.3f", req.Start),
-		"-i", input,
-		"-t", fmt.Sprintf("%.3f", clipDur),
+		"-ss", fmt.Sprintf("%.3f", j.Start),
+		"-protocol_whitelist", source.ProtocolWhitelist(j.Input),
+		"-i", j.Input,
+		"-t", fmt.Sprintf("%.3f", j.Duration),
 		"-map", "0:v:0",
 		"-map", audioMap,
 		"-map_metadata", "-1",
@@ -124,37 +184,61 @@ func (s *Server) handleClip(w http.ResponseWriter, r *http.Request, id string) {
 		"-c:v", "libx264",
 		"-preset", "veryfast",
 		"-crf", "23",
+	)
+	if tm := j.ToneMap.Filter(); tm != "" {
+		args = append(args, "-vf", tm)
+	}
+	args = append(args,
 		"-pix_fmt", "yuv420p",
 		"-profile:v", "main",
 		"-level:v", "4.1",
 		"-tune", "fastdecode",
 		"-tag:v", "avc1",
-		"-c:a", "aac",
-		"-ac", "2",
-		"-ar", "48000",
-		"-b:a", "160k",
+	)
+	args = append(args, j.ToneMap.OutputArgs()...)
+	args = append(args, j.AudioProfile.ClipEncoderArgs(j.AudioCodec, j.AudioChannels)...)
+	return append(args,
 		"-avoid_negative_ts", "make_zero",
 		"-movflags", "+faststart",
-		outputPath,
+		j.OutputPath,
 	)
+}
 
-	cmd := exec.CommandContext(ctx, s.ffmpegPath, args...)
-	var stderr bytes.Buffer
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = &stderr
-
-	if err := cmd.Run(); err != nil {
-		errText := strings.TrimSpace(stderr.String())
-		if errText == "" {
-			errText = err.Error()
+// clipAudioStream returns the codec and channel count of the session's
+// selected audio stream, as far as the probe knows them.
+func clipAudioStream(sess *session.Session) (codec string, channels int) {
+	for _, st := range sess.AvailableStreams {
+		if st.Type == "audio" && st.Index == sess.AudioIndex {
+			return st.Codec, st.Channels
+		}
+	}
+	if sess.Media != nil {
+		for _, a := range sess.Media.Audio {
+			if a.Index == sess.AudioIndex {
+				return a.Codec, a.Channels
+			}
 		}
-		http.Error(w, fmt.Sprintf("ffmpeg failed: %s", errText), http.StatusInternalServerError)
-		return
 	}
+	return "", 0
+}
 
-	writeJSON(w, struct {
-		OutputPath string `json:"outputPath"`
-	}{OutputPath: outputPath})
+// clipToneMap returns the tone mapping the session's video needs, probing
+// the source if the session has not been probed yet.
+func (s *Server) clipToneMap(ctx context.Context, sess *session.Session) hls.ToneMap {
+	media := sess.Media
+	if media == nil && s.hlsController != nil {
+		if meta, err := s.hlsController.ProbeMetadata(ctx, sess.ID, s.mediaInput(sess)); err == nil {
+			media = meta.MediaInfo()
+		}
+	}
+	if media == nil {
+		return hls.ToneMap{}
+	}
+	tm := hls.ToneMapFor(media.Video)
+	if tm.Transfer != "" {
+		tm.Hardware = hls.HardwareToneMap(s.ffmpegPath)
+	}
+	return tm
 }
 
 func defaultClipsDir() (string, error) {
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"raffi-server/src/stream/hls"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+func TestClipArgs(t *testing.T) {
+	tests := []struct {
+		name string
+		job  clipJob
+	}{
+		{"clip_local", clipJob{
+			Input:         "/media/movie.mkv",
+			Start:         61.25,
+			Duration:      30,
+			AudioProfile:  hls.AudioProfileAuto,
+			AudioCodec:    "ac3",
+			AudioChannels: 6,
+			OutputPath:    "/clips/movie_61.mp4",
+		}},
+		{"clip_http_second_audio", clipJob{
+			Input:         "https://cdn.example.com/movie.mkv?token=abc",
+			Start:         0,
+			Duration:      12.5,
+			AudioIndex:    1,
+			AudioProfile:  hls.AudioProfileNight,
+			AudioCodec:    "aac",
+			AudioChannels: 2,
+			OutputPath:    "/clips/movie_0.mp4",
+		}},
+		{"clip_voice_profile", clipJob{
+			Input:         "/media/movie.mkv",
+			Start:         61.25,
+			Duration:      30,
+			AudioProfile:  hls.AudioProfileVoice,
+			AudioCodec:    "dts",
+			AudioChannels: 6,
+			OutputPath:    "/clips/movie_61.mp4",
+		}},
+		{"clip_hdr_tonemap", clipJob{
+			Input:         "/media/hdr.mkv",
+			Start:         5,
+			Duration:      10,
+			AudioProfile:  hls.AudioProfileAuto,
+			AudioCodec:    "eac3",
+			AudioChannels: 6,
+			ToneMap:       hls.ToneMap{Transfer: "smpte2084"},
+			OutputPath:    "/clips/hdr_5.mp4",
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := strings.Join(tt.job.args(), "\n") + "\n"
+			path := filepath.Join("testdata", tt.name+".golden")
+			if *update {
+				if err := os.MkdirAll("testdata", 0o755); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(path, []byte(got), 0o644); err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			want, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatalf("%v (run go test -update to create it)", err)
+			}
+			if got != string(want) {
+				t.Errorf("arguments differ from %s (run go test -update if the change is intended)\nwant:\n%s\ngot:\n%s", path, want, got)
+			}
+		})
+	}
+}
@@ -1,10 +1,15 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"log"
 	"net/http"
+	"raffi-server/src/addons"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -13,15 +18,46 @@ import (
 type communityAddonsCache struct {
 	mu      sync.Mutex
 	fetched time.Time
-	payload []byte
+	entries []addons.CommunityAddon
 	lastErr string
+	// reachability holds results of live manifest checks keyed by transport URL.
+	reachability map[string]reachabilityResult
 }
 
+type reachabilityResult struct {
+	reachable bool
+	issue     string
+	checkedAt time.Time
+}
+
+const (
+	communityCacheTTL   = 30 * time.Minute
+	reachabilityTTL     = time.Hour
+	communityMaxLimit   = 500
+	reachabilityWorkers = 8
+	// reachabilityChecks caps the manifests one request checks; later
+	// requests check the rest.
+	reachabilityChecks = 50
+)
+
 var communityCache communityAddonsCache
 
 // GET /community-addons
 // Proxies Stremio community addon catalogs server-side to avoid renderer CORS limitations.
-// Response is a JSON array (same general shape as stremio-addons.com/catalog.json).
+// Response is a JSON array of typed addon records that keep the original
+// manifest. Supported query parameters:
+//
+//	q         text search over name, description and id
+//	resource  stream | catalog | subtitles | meta
+//	type      movie | series | ...
+//	adult     true | false
+//	valid     1 to drop entries flagged invalid or unreachable
+//	check     1 to verify the manifests of the returned page are reachable
+//	          (up to 50 unchecked entries per request)
+//	offset    pagination offset (default 0)
+//	limit     page size (max 500; all matches if absent)
+//
+// The total number of matches is returned in X-Total-Count.
 func (s *Server) handleCommunityAddons(w http.ResponseWriter, r *http.Request) {
 	if r.Method == http.MethodOptions {
 		w.WriteHeader(http.StatusNoContent)
@@ -32,15 +68,80 @@ func (s *Server) handleCommunityAddons(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	q := r.URL.Query()
+	filter := addons.CommunityFilter{
+		Query:     q.Get("q"),
+		Resource:  strings.ToLower(strings.TrimSpace(q.Get("resource"))),
+		Type:      strings.ToLower(strings.TrimSpace(q.Get("type"))),
+		ValidOnly: q.Get("valid") == "1" || q.Get("valid") == "true",
+	}
+	if raw := strings.TrimSpace(q.Get("adult")); raw != "" {
+		adult, err := strconv.ParseBool(raw)
+		if err != nil {
+			http.Error(w, "invalid adult flag", http.StatusBadRequest)
+			return
+		}
+		filter.Adult = &adult
+	}
+	offset, err := parseNonNegativeInt(q.Get("offset"), 0)
+	if err != nil {
+		http.Error(w, "invalid offset", http.StatusBadRequest)
+		return
+	}
+	limit := -1
+	if raw := q.Get("limit"); raw != "" {
+		limit, err = parseNonNegativeInt(raw, 0)
+		if err != nil || limit == 0 {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = min(limit, communityMaxLimit)
+	}
+
+	entries, err := s.loadCommunityAddons(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
 	communityCache.mu.Lock()
-	if communityCache.payload != nil && time.Since(communityCache.fetched) < 30*time.Minute {
-		payload := communityCache.payload
+	applyReachabilityLocked(entries)
+	communityCache.mu.Unlock()
+
+	matched := make([]addons.CommunityAddon, 0, len(entries))
+	for i := range entries {
+		if filter.Match(&entries[i]) {
+			matched = append(matched, entries[i])
+		}
+	}
+	total := len(matched)
+
+	if offset > len(matched) {
+		offset = len(matched)
+	}
+	page := matched[offset:]
+	if limit > 0 && limit < len(page) {
+		page = page[:limit]
+	}
+
+	if q.Get("check") == "1" || q.Get("check") == "true" {
+		s.checkCommunityReachability(r.Context(), page)
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Cache-Control", "private, max-age=300")
+	w.Header().Set("X-Total-Count", strconv.Itoa(total))
+	writeJSON(w, page)
+}
+
+// loadCommunityAddons returns a copy of the parsed community catalog, fetching
+// the upstream collections when the cache is cold or stale.
+func (s *Server) loadCommunityAddons(ctx context.Context) ([]addons.CommunityAddon, error) {
+	communityCache.mu.Lock()
+	if communityCache.entries != nil && time.Since(communityCache.fetched) < communityCacheTTL {
+		entries := append([]addons.CommunityAddon(nil), communityCache.entries...)
 		communityCache.mu.Unlock()
-		w.Header().Set("Content-Type", "application/json; charset=utf-8")
-		w.Header().Set("Cache-Control", "public, max-age=1800")
-		w.WriteHeader(http.StatusOK)
-		_, _ = w.Write(payload)
-		return
+		return entries, nil
 	}
 	communityCache.mu.Unlock()
 
@@ -50,11 +151,11 @@ func (s *Server) handleCommunityAddons(w http.ResponseWriter, r *http.Request) {
 	}
 
 	client := &http.Client{Timeout: 25 * time.Second}
-	var merged []any
+	var merged []json.RawMessage
 	var lastErr error
 
 	for _, u := range upstreams {
-		req, err := http.NewRequestWithContext(r.Context(), http.MethodGet, u, nil)
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
 		if err != nil {
 			lastErr = err
 			continue
@@ -77,7 +178,7 @@ func (s *Server) handleCommunityAddons(w http.ResponseWriter, r *http.Request) {
 			continue
 		}
 
-		var arr []any
+		var arr []json.RawMessage
 		if err := json.Unmarshal(body, &arr); err != nil {
 			lastErr = fmt.Errorf("invalid JSON from %s: %w", u, err)
 			continue
@@ -90,61 +191,128 @@ func (s *Server) handleCommunityAddons(w http.ResponseWriter, r *http.Request) {
 		if lastErr != nil {
 			msg = msg + ": " + lastErr.Error()
 		}
-		http.Error(w, msg, http.StatusBadGateway)
 		communityCache.mu.Lock()
 		communityCache.lastErr = msg
 		communityCache.mu.Unlock()
-		return
+		return nil, errors.New(msg)
 	}
 
 	// Deduplicate by transportUrl/transport_url then manifest.id.
 	seen := make(map[string]struct{}, len(merged))
-	deduped := make([]any, 0, len(merged))
+	deduped := make([]addons.CommunityAddon, 0, len(merged))
+	invalid := 0
 	for _, raw := range merged {
-		obj, ok := raw.(map[string]any)
+		entry, ok := addons.ParseCommunityEntry(raw)
 		if !ok {
 			continue
 		}
-
-		transport := ""
-		if v, ok := obj["transportUrl"].(string); ok {
-			transport = strings.TrimSpace(v)
-		} else if v, ok := obj["transport_url"].(string); ok {
-			transport = strings.TrimSpace(v)
-		}
-		key := transport
-
-		if key == "" {
-			if m, ok := obj["manifest"].(map[string]any); ok {
-				if id, ok := m["id"].(string); ok {
-					key = strings.TrimSpace(id)
-				}
-			}
-		}
-		if key == "" {
-			continue
-		}
+		key := entry.Key()
 		if _, ok := seen[key]; ok {
 			continue
 		}
 		seen[key] = struct{}{}
-		deduped = append(deduped, obj)
+		if !entry.Valid {
+			invalid++
+		}
+		deduped = append(deduped, entry)
 	}
-
-	payload, err := json.Marshal(deduped)
-	if err != nil {
-		http.Error(w, "failed to encode response", http.StatusInternalServerError)
-		return
+	if invalid > 0 {
+		log.Printf("community addons: %d of %d entries have invalid manifests", invalid, len(deduped))
 	}
 
 	communityCache.mu.Lock()
-	communityCache.payload = payload
+	communityCache.entries = deduped
 	communityCache.fetched = time.Now()
 	communityCache.lastErr = ""
 	communityCache.mu.Unlock()
 
-	w.Header().Set("Content-Type", "application/json; charset=utf-8")
-	w.Header().Set("Cache-Control", "public, max-age=1800")
-	w.WriteHeader(http.StatusOK)
-	_, _ = w.Write(payload)
+	return append([]addons.CommunityAddon(nil), deduped...), nil
+}
+
+func applyReachabilityLocked(entries []addons.CommunityAddon) {
+	for i := range entries {
+		res, ok := communityCache.reachability[entries[i].TransportURL]
+		if !ok || time.Since(res.checkedAt) > reachabilityTTL {
+			continue
+		}
+		applyReachability(&entries[i], res)
+	}
+}
+
+func applyReachability(entry *addons.CommunityAddon, res reachabilityResult) {
+	reachable := res.reachable
+	checkedAt := res.checkedAt
+	entry.Reachable = &reachable
+	entry.CheckedAt = &checkedAt
+	if !reachable && entry.Issue == "" {
+		entry.Issue = res.issue
+	}
+}
+
+// checkCommunityReachability fetches the live manifest of up to
+// reachabilityChecks valid entries in page that have no recent result and
+// records whether it could be loaded.
+func (s *Server) checkCommunityReachability(ctx context.Context, page []addons.CommunityAddon) {
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, reachabilityWorkers)
+	started := 0
+	for i := range page {
+		if !page[i].Valid || page[i].Reachable != nil {
+			continue
+		}
+		if started == reachabilityChecks {
+			break
+		}
+		started++
+		wg.Add(1)
+		go func(entry *addons.CommunityAddon) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			res := reachabilityResult{reachable: true, checkedAt: time.Now()}
+			if _, _, err := s.addonClient.Manifest(ctx, entry.TransportURL); err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				res.reachable = false
+				res.issue = "manifest unreachable: " + err.Error()
+			}
+
+			communityCache.mu.Lock()
+			if communityCache.reachability == nil {
+				communityCache.reachability = make(map[string]reachabilityResult)
+			}
+			communityCache.reachability[entry.TransportURL] = res
+			communityCache.mu.Unlock()
+
+			applyReachability(entry, res)
+		}(&page[i])
+	}
+	wg.Wait()
+
+	communityCache.mu.Lock()
+	pruneReachabilityLocked()
+	communityCache.mu.Unlock()
+}
+
+// pruneReachabilityLocked drops expired reachability results.
+func pruneReachabilityLocked() {
+	for url, res := range communityCache.reachability {
+		if time.Since(res.checkedAt) > reachabilityTTL {
+			delete(communityCache.reachability, url)
+		}
+	}
+}
+
+func parseNonNegativeInt(raw string, def int) (int, error) {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return def, nil
+	}
+	v, err := strconv.Atoi(raw)
+	if err != nil || v < 0 {
+		return 0, fmt.Errorf("invalid value %q", raw)
+	}
+	return v, nil
 }
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"raffi-server/src/addons"
+)
+
+// seedCommunityCache makes entries the cached community catalog for the test.
+func seedCommunityCache(t *testing.T, raw []string) {
+	t.Helper()
+	entries := make([]addons.CommunityAddon, 0, len(raw))
+	for _, r := range raw {
+		entry, ok := addons.ParseCommunityEntry(json.RawMessage(r))
+		if !ok {
+			t.Fatalf("unparsable entry %s", r)
+		}
+		entries = append(entries, entry)
+	}
+	communityCache.mu.Lock()
+	communityCache.entries = entries
+	communityCache.fetched = time.Now()
+	communityCache.reachability = nil
+	communityCache.mu.Unlock()
+	t.Cleanup(func() {
+		communityCache.mu.Lock()
+		communityCache.entries = nil
+		communityCache.reachability = nil
+		communityCache.mu.Unlock()
+	})
+}
+
+func communityEntry(transport, id, name string, types []string, resource string) string {
+	manifest := map[string]any{
+		"id": id, "name": name, "version": "1.0.0",
+		"types": types, "resources": []string{resource},
+	}
+	b, _ := json.Marshal(map[string]any{"transportUrl": transport, "manifest": manifest})
+	return string(b)
+}
+
+func getCommunityAddons(t *testing.T, s *Server, query string) ([]addons.CommunityAddon, *httptest.ResponseRecorder) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	s.handleCommunityAddons(rec, httptest.NewRequest(http.MethodGet, "/community-addons?"+query, nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET /community-addons?%s = %d %s", query, rec.Code, rec.Body)
+	}
+	var page []addons.CommunityAddon
+	if err := json.Unmarshal(rec.Body.Bytes(), &page); err != nil {
+		t.Fatal(err)
+	}
+	return page, rec
+}
+
+func TestCommunityAddonsFilterAndPagination(t *testing.T) {
+	var raw []string
+	for i := range 150 {
+		types, resource := []string{"movie"}, "stream"
+		if i%3 == 0 {
+			types, resource = []string{"series"}, "subtitles"
+		}
+		raw = append(raw, communityEntry(fmt.Sprintf("https://addon%d.example.com/manifest.json", i), fmt.Sprintf("org.addon%d", i), fmt.Sprintf("Addon %d", i), types, resource))
+	}
+	raw = append(raw, `{"transportUrl":"https://broken.example.com/manifest.json","manifest":{"id":"broken"}}`)
+	seedCommunityCache(t, raw)
+	s := &Server{}
+
+	tests := []struct {
+		query string
+		total int
+		first string
+		count int
+	}{
+		// No limit returns every entry, past the old default of 100.
+		{query: "", total: 151, first: "org.addon0", count: 151},
+		{query: "valid=1", total: 150, first: "org.addon0", count: 150},
+		{query: "resource=subtitles&type=series", total: 50, first: "org.addon0", count: 50},
+		{query: "resource=stream&offset=10&limit=5", total: 100, first: "org.addon16", count: 5},
+		{query: "q=addon+149", total: 1, first: "org.addon149", count: 1},
+		{query: "offset=1000", total: 151, count: 0},
+	}
+	for _, tt := range tests {
+		page, rec := getCommunityAddons(t, s, tt.query)
+		if got := rec.Header().Get("X-Total-Count"); got != fmt.Sprint(tt.total) {
+			t.Errorf("%q: X-Total-Count = %s, want %d", tt.query, got, tt.total)
+		}
+		if len(page) != tt.count {
+			t.Errorf("%q: %d entries, want %d", tt.query, len(page), tt.count)
+			continue
+		}
+		if tt.count > 0 && page[0].ID != tt.first {
+			t.Errorf("%q: first entry %s, want %s", tt.query, page[0].ID, tt.first)
+		}
+	}
+
+	for _, query := range []string{"limit=0", "limit=x", "offset=-1", "adult=maybe"} {
+		rec := httptest.NewRecorder()
+		s.handleCommunityAddons(rec, httptest.NewRequest(http.MethodGet, "/community-addons?"+query, nil))
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("%q: status %d, want 400", query, rec.Code)
+		}
+	}
+}
+
+func TestCommunityAddonsCapsReachabilityChecks(t *testing.T) {
+	var fetched atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetched.Add(1)
+		id := strings.Trim(strings.TrimSuffix(r.URL.Path, "/manifest.json"), "/")
+		_ = json.NewEncoder(w).Encode(map[string]any{
+			"id": id, "name": id, "version": "1.0.0",
+			"types": []string{"movie"}, "resources": []string{"stream"},
+		})
+	}))
+	defer upstream.Close()
+
+	var raw []string
+	for i := range reachabilityChecks + 10 {
+		id := fmt.Sprintf("a%d", i)
+		raw = append(raw, communityEntry(upstream.URL+"/"+id+"/manifest.json", id, id, []string{"movie"}, "stream"))
+	}
+	seedCommunityCache(t, raw)
+	s := &Server{addonClient: addons.NewClient()}
+
+	page, _ := getCommunityAddons(t, s, "check=1")
+	if n := fetched.Load(); n != reachabilityChecks {
+		t.Fatalf("first request fetched %d manifests, want %d", n, reachabilityChecks)
+	}
+	checked := 0
+	for _, a := range page {
+		if a.Reachable != nil {
+			checked++
+		}
+	}
+	if checked != reachabilityChecks {
+		t.Errorf("%d entries report reachability, want %d", checked, reachabilityChecks)
+	}
+
+	// The next request checks the rest; known results are reused.
+	getCommunityAddons(t, s, "check=1")
+	if n := fetched.Load(); n != reachabilityChecks+10 {
+		t.Errorf("manifests fetched after two requests = %d, want %d", n, reachabilityChecks+10)
+	}
+}
+
+func TestPruneReachabilityDropsExpired(t *testing.T) {
+	communityCache.mu.Lock()
+	defer communityCache.mu.Unlock()
+	communityCache.reachability = map[string]reachabilityResult{
+		"fresh": {reachable: true, checkedAt: time.Now()},
+		"stale": {reachable: true, checkedAt: time.Now().Add(-2 * reachabilityTTL)},
+	}
+	defer func() { communityCache.reachability = nil }()
+
+	pruneReachabilityLocked()
+	if _, ok := communityCache.reachability["stale"]; ok {
+		t.Error("expired result kept")
+	}
+	if _, ok := communityCache.reachability["fresh"]; !ok {
+		t.Error("fresh result dropped")
+	}
+}
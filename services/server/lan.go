@@ -0,0 +1,252 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"raffi-server/src/lan"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// LAN mode (RAFFI_LAN_MODE=1) listens on every interface over IPv4 and IPv6,
+// advertises the server over mDNS and lets other devices pair for playback.
+func lanModeEnabled() bool {
+	switch strings.ToLower(strings.TrimSpace(os.Getenv("RAFFI_LAN_MODE"))) {
+	case "1", "true", "yes", "on":
+		return true
+	}
+	return false
+}
+
+func serverStateDir() string {
+	if dir, err := os.UserConfigDir(); err == nil && dir != "" {
+		return filepath.Join(dir, "Raffi")
+	}
+	return filepath.Join(os.TempDir(), "raffi-state")
+}
+
+// listenAddrs opens the server listeners. Outside LAN mode only addr is bound
+// (IPv4, loopback by default); in LAN mode the port of addr is bound on all
+// IPv4 and IPv6 interfaces.
+func listenAddrs(addr string, lanMode bool) ([]net.Listener, error) {
+	if !lanMode {
+		l, err := net.Listen("tcp4", addr)
+		if err != nil {
+			return nil, err
+		}
+		return []net.Listener{l}, nil
+	}
+
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	l4, err := net.Listen("tcp4", net.JoinHostPort("0.0.0.0", port))
+	if err != nil {
+		return nil, err
+	}
+	listeners := []net.Listener{l4}
+	if l6, err := net.Listen("tcp6", net.JoinHostPort("::", port)); err == nil {
+		listeners = append(listeners, l6)
+	} else {
+		log.Printf("LAN mode: IPv6 listener unavailable: %v", err)
+	}
+	return listeners, nil
+}
+
+// internalBaseURL is the origin ffmpeg uses to read torrent streams back from
+// this server. Wildcard binds are reached through loopback.
+func internalBaseURL(addr string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "http://" + addr
+	}
+	if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+		host = "127.0.0.1"
+	}
+	return "http://" + net.JoinHostPort(host, port)
+}
+
+func lanURLs(port string) []string {
+	var urls []string
+	for _, ip := range lan.LocalAddrs() {
+		host := ip.String()
+		if ip.To4() == nil && ip.IsLinkLocalUnicast() {
+			// Link-local IPv6 needs a zone and is not useful in a shareable URL.
+			continue
+		}
+		urls = append(urls, "http://"+net.JoinHostPort(host, port))
+	}
+	return urls
+}
+
+// /lan/status          GET    -> LAN mode state and reachable URLs
+// /lan/pair            POST   -> create a pairing code (owner only)
+// /lan/pair/claim      POST   -> exchange a pairing code for a device token
+// /lan/devices         GET    -> paired devices (owner only)
+// /lan/devices/{id}    DELETE -> revoke a device (owner only)
+func (s *Server) handleLAN(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/lan/"), "/")
+
+	if path == "status" {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		resp := struct {
+			Enabled bool     `json:"enabled"`
+			Service string   `json:"service,omitempty"`
+			URLs    []string `json:"urls,omitempty"`
+		}{Enabled: s.access.pairing != nil}
+		if s.access.pairing != nil {
+			resp.Service = lan.ServiceType
+			resp.URLs = lanURLs(s.listenPort)
+		}
+		writeJSON(w, resp)
+		return
+	}
+
+	if s.access.pairing == nil {
+		http.Error(w, "LAN mode is disabled", http.StatusNotFound)
+		return
+	}
+
+	if path == "pair/claim" {
+		s.handlePairClaim(w, r)
+		return
+	}
+
+	if requestDevice(r) != nil {
+		http.Error(w, "forbidden: owner access required", http.StatusForbidden)
+		return
+	}
+
+	switch {
+	case path == "pair":
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		code, err := s.access.pairing.NewCode(nil)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, code)
+	case path == "devices":
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		writeJSON(w, s.access.pairing.Devices())
+	case strings.HasPrefix(path, "devices/"):
+		if r.Method != http.MethodDelete {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if err := s.access.pairing.Revoke(strings.TrimPrefix(path, "devices/")); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (s *Server) handlePairClaim(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req struct {
+		Code string `json:"code"`
+		Name string `json:"name"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	dev, token, err := s.access.pairing.Claim(req.Code, req.Name)
+	switch {
+	case errors.Is(err, lan.ErrRateLimited):
+		http.Error(w, err.Error(), http.StatusTooManyRequests)
+		return
+	case errors.Is(err, lan.ErrInvalidCode):
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("LAN: paired device %q (%s)", dev.Name, dev.ID)
+	writeJSON(w, struct {
+		Device lan.Device `json:"device"`
+		Token  string     `json:"token"`
+	}{Device: *dev, Token: token})
+}
+
+// startLANAdvertiser publishes the server over mDNS/DNS-SD. Failures are
+// logged; discovery is a convenience and the server keeps running.
+func startLANAdvertiser(port string) *lan.Advertiser {
+	p, err := strconv.Atoi(port)
+	if err != nil {
+		log.Printf("LAN mode: invalid port %q, not advertising", port)
+		return nil
+	}
+	adv, err := lan.Advertise("", p, map[string]string{
+		"path": "/",
+		"pair": "/lan/pair/claim",
+		"v":    "1",
+	})
+	if err != nil {
+		log.Printf("LAN mode: mDNS advertisement unavailable: %v", err)
+		return nil
+	}
+	log.Printf("LAN mode: advertising %s on port %d", lan.ServiceType, p)
+	return adv
+}
+
+// appendPlaylistToken carries a query-string token over to the URIs in a
+// playlist so clients that authenticate with ?token= can fetch segments.
+func appendPlaylistToken(lines []string, token string) []string {
+	for i, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" {
+			continue
+		}
+		if strings.HasPrefix(trimmed, "#") {
+			// Tags such as EXT-X-MEDIA reference playlists in a URI attribute.
+			lines[i] = reURIAttr.ReplaceAllStringFunc(trimmed, func(attr string) string {
+				uri := strings.TrimSuffix(strings.TrimPrefix(attr, `URI="`), `"`)
+				return `URI="` + withTokenParam(uri, token) + `"`
+			})
+			continue
+		}
+		lines[i] = withTokenParam(trimmed, token)
+	}
+	return lines
+}
+
+var reURIAttr = regexp.MustCompile(`URI="[^"]*"`)
+
+func withTokenParam(uri, token string) string {
+	sep := "?"
+	if strings.Contains(uri, "?") {
+		sep = "&"
+	}
+	return fmt.Sprintf("%s%stoken=%s", uri, sep, token)
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"raffi-server/src/library"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	libraryDefaultLimit = 200
+	libraryMaxLimit     = 1000
+)
+
+// libraryRootsFromEnv reads RAFFI_LIBRARY_ROOTS, an OS path list. When unset
+// the roots saved with the index are used.
+func libraryRootsFromEnv() []string {
+	if configured := strings.TrimSpace(os.Getenv("RAFFI_LIBRARY_ROOTS")); configured != "" {
+		return filepath.SplitList(configured)
+	}
+	return nil
+}
+
+func libraryPollInterval() time.Duration {
+	if raw := strings.TrimSpace(os.Getenv("RAFFI_LIBRARY_POLL_SECONDS")); raw != "" {
+		if secs, err := strconv.Atoi(raw); err == nil && secs > 0 {
+			return time.Duration(secs) * time.Second
+		}
+	}
+	return library.DefaultPollGap
+}
+
+// applyLibraryRoots lets local playback reach everything in the library in
+// addition to the configured media roots.
+func (s *Server) applyLibraryRoots() {
+	s.sources.SetRoots(append(mediaRootsFromEnv(), s.library.Roots()...))
+}
+
+// GET /library
+// Lists indexed local media. Supported query parameters:
+//
+//	q       text search over parsed title and file name
+//	kind    movie | episode
+//	sort    title (default) | added | modified | year | duration | size
+//	order   asc (default) | desc
+//	offset  pagination offset (default 0)
+//	limit   page size (default 200, max 1000)
+//
+// The total number of matches is returned in X-Total-Count.
+//
+// GET  /library/status -> roots and scan state
+// GET  /library/{id}   -> one item
+// PUT  /library/roots  -> replace the library roots {roots: [...]} (owner only)
+// POST /library/scan   -> start a rescan (owner only)
+func (s *Server) handleLibrary(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/library"), "/")
+
+	switch path {
+	case "":
+		s.handleLibraryList(w, r)
+		return
+	case "status":
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		writeJSON(w, s.library.Status())
+		return
+	case "roots":
+		s.handleLibraryRoots(w, r)
+		return
+	case "scan":
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if requestDevice(r) != nil {
+			http.Error(w, "forbidden: owner access required", http.StatusForbidden)
+			return
+		}
+		s.startLibraryScan()
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	item, ok := s.library.Get(path)
+	if !ok {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, item)
+}
+
+func (s *Server) handleLibraryList(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	q := r.URL.Query()
+	query := library.Query{
+		Search: q.Get("q"),
+		Kind:   strings.ToLower(strings.TrimSpace(q.Get("kind"))),
+		Sort:   strings.ToLower(strings.TrimSpace(q.Get("sort"))),
+		Desc:   strings.EqualFold(q.Get("order"), "desc"),
+	}
+	switch query.Sort {
+	case "", "title", "added", "modified", "year", "duration", "size":
+	default:
+		http.Error(w, "invalid sort", http.StatusBadRequest)
+		return
+	}
+	offset, err := parseNonNegativeInt(q.Get("offset"), 0)
+	if err != nil {
+		http.Error(w, "invalid offset", http.StatusBadRequest)
+		return
+	}
+	limit, err := parseNonNegativeInt(q.Get("limit"), libraryDefaultLimit)
+	if err != nil || limit == 0 {
+		http.Error(w, "invalid limit", http.StatusBadRequest)
+		return
+	}
+	query.Offset = offset
+	query.Limit = min(limit, libraryMaxLimit)
+
+	items, total := s.library.Query(query)
+	w.Header().Set("X-Total-Count", strconv.Itoa(total))
+	writeJSON(w, items)
+}
+
+func (s *Server) handleLibraryRoots(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, s.library.Roots())
+	case http.MethodPut:
+		if requestDevice(r) != nil {
+			http.Error(w, "forbidden: owner access required", http.StatusForbidden)
+			return
+		}
+		var req struct {
+			Roots []string `json:"roots"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "invalid JSON", http.StatusBadRequest)
+			return
+		}
+		for _, root := range req.Roots {
+			if !filepath.IsAbs(strings.TrimSpace(root)) {
+				http.Error(w, "library roots must be absolute paths", http.StatusBadRequest)
+				return
+			}
+		}
+		s.library.SetRoots(req.Roots)
+		s.applyLibraryRoots()
+		s.startLibraryScan()
+		writeJSON(w, s.library.Roots())
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *Server) startLibraryScan() {
+	go func() {
+		if _, err := s.library.Scan(context.Background()); err != nil && !errors.Is(err, library.ErrScanInProgress) {
+			log.Printf("library: scan failed: %v", err)
+		}
+	}()
+}
@@ -5,15 +5,24 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
 	"os/signal"
 	"path"
 	"path/filepath"
+	"raffi-server/src/addons"
+	"raffi-server/src/analysis"
+	"raffi-server/src/cast"
+	"raffi-server/src/lan"
+	"raffi-server/src/library"
+	"raffi-server/src/party"
 	"raffi-server/src/session"
+	"raffi-server/src/source"
 	"raffi-server/src/stream"
 	"raffi-server/src/stream/hls"
 	"runtime"
@@ -33,6 +42,25 @@ type Server struct {
 	ffprobePath     string
 	probeMu         sync.Mutex
 	probeCooldown   map[string]time.Time
+	addonClient     *addons.Client
+	addonsMu        sync.Mutex
+	installedAddons []string
+	addonsPath      string
+	access          *accessPolicy
+	sources         *source.Policy
+	listenPort      string
+	lanAdvertiser   *lan.Advertiser
+	parties         *party.Manager
+	lanMode         bool
+	trackPrefs      session.TrackPreferences
+	audioRenditions int
+	audioProfile    hls.AudioProfile
+	encoding        *hls.ProfileRegistry
+	castManager     *cast.Manager
+	castMu          sync.Mutex
+	casts           map[string]*castTarget
+	library         *library.Library
+	analyzer        *analysis.Analyzer
 }
 
 func main() {
@@ -51,11 +79,38 @@ func main() {
 		ffmpegPath:      ffmpegPath,
 		ffprobePath:     ffprobePath,
 		probeCooldown:   make(map[string]time.Time),
+		addonClient:     addons.NewClient(),
+		access:          loadAccessPolicy(),
+		sources:         source.NewPolicy(mediaRootsFromEnv(), ""),
+		parties:         party.NewManager(),
+		castManager:     cast.NewManager(nil),
+		casts:           make(map[string]*castTarget),
+		trackPrefs:      trackPreferencesFromEnv(),
+		audioRenditions: audioRenditionsFromEnv(),
+		audioProfile:    audioProfileFromEnv(),
+		encoding:        encodingProfilesFromEnv(),
+	}
+
+	srv.loadInstalledAddons(serverStateDir())
+	srv.hlsController.UseProbeCache(hls.NewProbeCache(filepath.Join(serverStateDir(), "probe-cache.json"), hls.DefaultProbeCacheSize))
+
+	srv.library = library.New(serverStateDir(), libraryRootsFromEnv(), hls.NewProbeDuration(ffprobePath))
+	srv.applyLibraryRoots()
+	go srv.library.Watch(context.Background(), libraryPollInterval())
+
+	if skipDetectionEnabled() {
+		srv.analyzer = analysis.New(serverStateDir(), ffmpegPath)
 	}
 
 	log.Printf("Using ffmpeg: %s", ffmpegPath)
 	log.Printf("Using ffprobe: %s", ffprobePath)
 
+	// A server that crashed or was killed may have left ffmpeg running,
+	// possibly stopped by the throttle.
+	if n := hls.ReapStaleTranscoders(); n > 0 {
+		log.Printf("Killed %d stale ffmpeg process(es) from a previous run", n)
+	}
+
 	// Set up cleanup on exit
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
@@ -64,6 +119,23 @@ func main() {
 		<-sigChan
 		log.Println("\nReceived shutdown signal, cleaning up...")
 
+		if srv.lanAdvertiser != nil {
+			srv.lanAdvertiser.Close()
+		}
+
+		// os.Exit does not stop children; paused ones would linger.
+		srv.hlsController.Shutdown(5 * time.Second)
+		hls.StopCommands(5 * time.Second)
+
+		if err := srv.hlsController.ProbeCache().Save(); err != nil {
+			log.Printf("Warning: failed to save probe cache: %v", err)
+		}
+		if srv.analyzer != nil {
+			if err := srv.analyzer.Save(); err != nil {
+				log.Printf("Warning: failed to save skip segments: %v", err)
+			}
+		}
+
 		// Close torrent client
 		if srv.torrentStreamer != nil {
 			srv.torrentStreamer.Close()
@@ -95,6 +167,7 @@ func main() {
 		defer ticker.Stop()
 		for range ticker.C {
 			srv.hlsController.CleanupOrphanedSessions()
+			srv.parties.Prune()
 		}
 	}()
 
@@ -104,17 +177,47 @@ func main() {
 	mux.HandleFunc("/cleanup", srv.handleCleanup)
 	mux.HandleFunc("/torrents/", srv.torrentStreamer.ServeHTTP)
 	mux.HandleFunc("/community-addons", srv.handleCommunityAddons)
+	mux.HandleFunc("/addons/", srv.handleAddons)
+	mux.HandleFunc("/lan/", srv.handleLAN)
+	mux.HandleFunc("/party/", srv.handlePartyCode)
+	mux.HandleFunc("/cast/", srv.handleCastDevices)
+	mux.HandleFunc("/library", srv.handleLibrary)
+	mux.HandleFunc("/library/", srv.handleLibrary)
+	mux.HandleFunc("/probe-cache", srv.handleProbeCache)
 
 	addr := strings.TrimSpace(os.Getenv("RAFFI_SERVER_ADDR"))
 	if addr == "" {
 		addr = "127.0.0.1:6969"
 	}
-	listener, err := net.Listen("tcp4", addr)
+	lanMode := lanModeEnabled()
+	srv.lanMode = lanMode
+	srv.sources.AddServerAddr(addr)
+	srv.torrentStreamer.SetBaseURL(internalBaseURL(addr))
+	if _, port, err := net.SplitHostPort(addr); err == nil {
+		srv.listenPort = port
+	}
+
+	listeners, err := listenAddrs(addr, lanMode)
 	if err != nil {
 		log.Fatalf("failed to bind to %s: %v", addr, err)
 	}
-	log.Printf("Server listening on http://%s\n", listener.Addr().String())
-	if err := http.Serve(listener, withCORS(mux)); err != nil {
+	if lanMode {
+		srv.access.pairing = lan.NewPairing(serverStateDir())
+		srv.lanAdvertiser = startLANAdvertiser(srv.listenPort)
+		for _, u := range lanURLs(srv.listenPort) {
+			log.Printf("LAN mode: reachable at %s", u)
+		}
+	}
+
+	handler := withCORS(srv.access, withAuth(srv.access, mux))
+	errc := make(chan error, len(listeners))
+	for _, l := range listeners {
+		log.Printf("Server listening on http://%s\n", l.Addr().String())
+		go func(l net.Listener) {
+			errc <- http.Serve(l, handler)
+		}(l)
+	}
+	if err := <-errc; err != nil {
 		log.Fatal(err)
 	}
 }
@@ -178,6 +281,30 @@ func preferGoDNSResolver() {
 	}
 }
 
+// mediaRootsFromEnv returns the directories local sources may be read from.
+// RAFFI_MEDIA_ROOTS is an OS path list; it replaces the defaults when set.
+func mediaRootsFromEnv() []string {
+	if configured := strings.TrimSpace(os.Getenv("RAFFI_MEDIA_ROOTS")); configured != "" {
+		return filepath.SplitList(configured)
+	}
+	return source.DefaultRoots()
+}
+
+func writeSourceViolation(w http.ResponseWriter, err error) {
+	var v *source.Violation
+	if !errors.As(err, &v) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	_ = json.NewEncoder(w).Encode(struct {
+		Error  string `json:"error"`
+		Rule   string `json:"rule"`
+		Detail string `json:"detail"`
+	}{Error: "source rejected", Rule: v.Rule, Detail: v.Detail})
+}
+
 func (s *Server) handleAudioTrack(w http.ResponseWriter, r *http.Request, id string) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
@@ -192,8 +319,12 @@ func (s *Server) handleAudioTrack(w http.ResponseWriter, r *http.Request, id str
 		return
 	}
 
+	// inPlace means the track is an HLS rendition the player can switch to
+	// without reloading the stream.
+	inPlace := false
 	if s.hlsController != nil {
-		if err := s.hlsController.SetAudioTrack(id, req.Index); err != nil {
+		var err error
+		if inPlace, err = s.hlsController.SetAudioTrack(id, req.Index); err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
@@ -202,7 +333,19 @@ func (s *Server) handleAudioTrack(w http.ResponseWriter, r *http.Request, id str
 	if sess, err := s.sessions.Get(id); err == nil {
 		sess.AudioIndex = req.Index
 	}
-	w.WriteHeader(http.StatusOK)
+	writeJSON(w, struct {
+		InPlace bool `json:"inPlace"`
+	}{InPlace: inPlace})
+}
+
+// mediaInput is the input ffmpeg and ffprobe read for sess. Torrent streams
+// are served back by this server, so their URL gets the access token here;
+// the session itself keeps the URL without it.
+func (s *Server) mediaInput(sess *session.Session) string {
+	if sess.IsTorrent {
+		return s.access.withToken(sess.Source)
+	}
+	return sess.Source
 }
 
 // POST /sessions  -> create session
@@ -223,14 +366,81 @@ func (s *Server) handleSessions(w http.ResponseWriter, r *http.Request) {
 		Kind      session.SessionKind `json:"kind"`
 		StartTime float64             `json:"startTime"`
 		FileIdx   *int                `json:"fileIdx,omitempty"`
+		// LibraryItemID plays an indexed local file instead of Source.
+		LibraryItemID string `json:"libraryItemId,omitempty"`
+		// Preferences override the server's track preferences for this session.
+		Preferences json.RawMessage `json:"preferences,omitempty"`
+		// AudioRenditions publishes up to N audio streams as separate HLS
+		// renditions (see master.m3u8); 0 muxes one stream into the video.
+		AudioRenditions *int `json:"audioRenditions,omitempty"`
+		// AudioProfile selects the audio processing (see hls.AudioProfiles).
+		AudioProfile string `json:"audioProfile,omitempty"`
+		// SegmentFormat is "ts" (default) or "cmaf"; manifest.mpd needs cmaf
+		// and switches the session to it on first request.
+		SegmentFormat string `json:"segmentFormat,omitempty"`
+		// LowLatency starts playback after a few short segments instead of
+		// two full ones, for faster time-to-first-frame.
+		LowLatency bool `json:"lowLatency,omitempty"`
+		// EncodingProfile names the video encoding settings; empty is the
+		// default profile.
+		EncodingProfile string `json:"encodingProfile,omitempty"`
+		// DisplayHDR is set by clients that can show HDR video; HDR sources
+		// are tone-mapped to SDR for everyone else.
+		DisplayHDR bool `json:"displayHdr,omitempty"`
+		// SkipDetection opts a torrent session into intro and credits
+		// analysis. Other sources are analysed unless the server disables it.
+		SkipDetection bool `json:"skipDetection,omitempty"`
 	}
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		http.Error(w, "invalid JSON", http.StatusBadRequest)
 		return
 	}
+	prefs, err := s.sessionTrackPreferences(req.Preferences)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	renditions := s.audioRenditions
+	if req.AudioRenditions != nil {
+		if *req.AudioRenditions < 0 || *req.AudioRenditions > maxAudioRenditions {
+			http.Error(w, fmt.Sprintf("audioRenditions must be between 0 and %d", maxAudioRenditions), http.StatusBadRequest)
+			return
+		}
+		renditions = *req.AudioRenditions
+	}
+	encoding, err := s.encoding.Get(req.EncodingProfile)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defaultAudioProfile := s.audioProfile
+	if encoding.AudioProfile != "" {
+		defaultAudioProfile = encoding.AudioProfile
+	}
+	audioProfile, err := requestAudioProfile(req.AudioProfile, defaultAudioProfile)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	segmentFormat, err := hls.ParseSegmentFormat(req.SegmentFormat)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
 	var sess *session.Session
-	var err error
+
+	var item library.Item
+	fromLibrary := req.LibraryItemID != ""
+	if fromLibrary {
+		var ok bool
+		if item, ok = s.library.Get(req.LibraryItemID); !ok {
+			http.Error(w, "library item not found", http.StatusNotFound)
+			return
+		}
+		req.Source = item.Path
+		req.Kind = session.SessionKindHTTP
+	}
 
 	if req.Kind == session.SessionKindTorrent {
 		streamURL, infoHash, err := s.torrentStreamer.AddTorrent(req.Source, req.FileIdx)
@@ -245,7 +455,12 @@ func (s *Server) handleSessions(w http.ResponseWriter, r *http.Request) {
 			sess.TorrentInfoHash = infoHash
 		}
 	} else {
-		sess, err = s.sessions.Create(req.Source, req.Kind, req.StartTime)
+		src, verr := s.sources.Classify(req.Source)
+		if verr != nil {
+			writeSourceViolation(w, verr)
+			return
+		}
+		sess, err = s.sessions.Create(src.Input(), req.Kind, req.StartTime)
 	}
 
 	if err != nil {
@@ -253,6 +468,42 @@ func (s *Server) handleSessions(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if dev := requestDevice(r); dev != nil {
+		sess.DeviceID = dev.ID
+	}
+	sess.Preferences = &prefs
+	sess.AudioProfile = string(audioProfile)
+	sess.SegmentFormat = string(segmentFormat)
+	sess.LowLatency = req.LowLatency
+	sess.EncodingProfile = encoding.Name
+	sess.SkipDetection = req.SkipDetection
+	if s.hlsController != nil {
+		s.hlsController.Configure(sess.ID, hls.SessionOptions{
+			Preferences:     prefs,
+			AudioRenditions: renditions,
+			AudioProfile:    audioProfile,
+			SegmentFormat:   segmentFormat,
+			LowLatency:      req.LowLatency,
+			Profile:         encoding,
+			DisplayHDR:      req.DisplayHDR,
+		})
+	}
+
+	// The library already probed the file; reuse that instead of probing again.
+	if fromLibrary && item.ProbeError == "" && item.Duration > 0 {
+		_ = s.sessions.Update(sess.ID, func(sess *session.Session) {
+			sess.DurationSeconds = item.Duration
+			sess.Chapters = item.Chapters
+			sess.Media = item.Media
+			for _, st := range item.Streams {
+				if st.Type == "audio" {
+					sess.AvailableStreams = append(sess.AvailableStreams, st)
+				}
+			}
+			applyTrackSelection(sess, prefs)
+		})
+	}
+
 	writeJSON(w, struct {
 		ID string `json:"id"`
 	}{ID: sess.ID})
@@ -271,6 +522,19 @@ func (s *Server) handleSessionByID(w http.ResponseWriter, r *http.Request) {
 	parts := strings.Split(path, "/")
 	id := parts[0]
 
+	if dev := requestDevice(r); dev != nil {
+		snap, err := s.sessions.Snapshot(id)
+		if err != nil {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		_, partyOpen := s.parties.Get(id)
+		if !deviceSessionPermitted(r, dev, snap, partyOpen) {
+			http.Error(w, "forbidden: session belongs to another client", http.StatusForbidden)
+			return
+		}
+	}
+
 	// /sessions/{id}/clip
 	if len(parts) == 2 && parts[1] == "clip" {
 		s.handleClip(w, r, id)
@@ -310,6 +574,34 @@ func (s *Server) handleSessionByID(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// /sessions/{id}/party
+	if len(parts) == 2 && parts[1] == "party" {
+		s.handleParty(w, r, id)
+		return
+	}
+
+	// /sessions/{id}/cast and /sessions/{id}/cast/{action}
+	if len(parts) >= 2 && len(parts) <= 3 && parts[1] == "cast" {
+		action := ""
+		if len(parts) == 3 {
+			action = parts[2]
+		}
+		s.handleCast(w, r, id, action)
+		return
+	}
+
+	// /sessions/{id}/direct
+	if len(parts) == 2 && parts[1] == "direct" {
+		s.handleDirect(w, r, id)
+		return
+	}
+
+	// /sessions/{id}/rendition.mp4
+	if len(parts) == 2 && parts[1] == "rendition.mp4" {
+		s.handleRendition(w, r, id)
+		return
+	}
+
 	http.NotFound(w, r)
 }
 
@@ -321,22 +613,29 @@ func (s *Server) handleGetSession(w http.ResponseWriter, r *http.Request, id str
 	}
 
 	if sess.Kind == session.SessionKindHTTP && s.hlsController != nil {
-		if audioIdx, streams, ok := s.hlsController.DescribeSession(sess.ID); ok {
-			sess.AudioIndex = audioIdx
-			if len(streams) > 0 {
-				sess.AvailableStreams = streams
-			}
+		// Once the transcoder runs, its audio stream is authoritative: it may
+		// have been switched since the defaults were chosen.
+		audioIdx, streams, transcoding := s.hlsController.DescribeSession(sess.ID)
+		if transcoding {
+			qualityCap := s.hlsController.QualityCap(sess.ID)
+			_ = s.sessions.Update(sess.ID, func(sess *session.Session) {
+				sess.AudioIndex = audioIdx
+				if len(streams) > 0 {
+					sess.AvailableStreams = streams
+				}
+				sess.QualityCap = qualityCap
+			})
 		}
 
-		if sess.DurationSeconds == 0 || len(sess.Chapters) == 0 || len(sess.AvailableStreams) == 0 {
+		if sess.DurationSeconds == 0 || len(sess.Chapters) == 0 || len(sess.AvailableStreams) == 0 || sess.Media == nil {
 			if sess.IsTorrent && sess.TorrentInfoHash != "" {
 				status, ok := s.torrentStreamer.GetStatus(sess.TorrentInfoHash)
 				if !ok || !status.Ready {
-					writeJSON(w, sess)
+					s.writeSession(w, sess.ID)
 					return
 				}
 				if status.PiecesComplete <= 0 {
-					writeJSON(w, sess)
+					s.writeSession(w, sess.ID)
 					return
 				}
 
@@ -344,7 +643,7 @@ func (s *Server) handleGetSession(w http.ResponseWriter, r *http.Request, id str
 				cooldownUntil := s.probeCooldown[sess.ID]
 				s.probeMu.Unlock()
 				if !cooldownUntil.IsZero() && time.Now().Before(cooldownUntil) {
-					writeJSON(w, sess)
+					s.writeSession(w, sess.ID)
 					return
 				}
 			}
@@ -361,7 +660,7 @@ func (s *Server) handleGetSession(w http.ResponseWriter, r *http.Request, id str
 			for attempt := 0; attempt < maxAttempts; attempt++ {
 				ctx := r.Context()
 				ctx, cancel := context.WithTimeout(ctx, probeTimeout)
-				meta, probeErr = s.hlsController.ProbeMetadata(ctx, sess.ID, sess.Source)
+				meta, probeErr = s.hlsController.ProbeMetadata(ctx, sess.ID, s.mediaInput(sess))
 				cancel()
 				if probeErr == nil && meta != nil {
 					break
@@ -380,39 +679,42 @@ func (s *Server) handleGetSession(w http.ResponseWriter, r *http.Request, id str
 				delete(s.probeCooldown, sess.ID)
 				s.probeMu.Unlock()
 
-				sess.DurationSeconds = meta.Format.DurationSeconds
-				sess.Chapters = make([]session.Chapter, len(meta.Chapters))
+				chapters := make([]session.Chapter, len(meta.Chapters))
 				for i, c := range meta.Chapters {
-					sess.Chapters[i] = session.Chapter{
+					chapters[i] = session.Chapter{
 						StartTime: c.StartTime,
 						EndTime:   c.EndTime,
 						Title:     c.Tags.Title,
 					}
 				}
 
-				sess.AvailableStreams = nil
+				var streams []session.StreamInfo
 				audioCount := 0
-				preferredIndex := 0
-				foundEng := false
 				for _, st := range meta.Streams {
 					if st.CodecType == "audio" {
-						sess.AvailableStreams = append(sess.AvailableStreams, session.StreamInfo{
+						streams = append(streams, session.StreamInfo{
 							Index:    audioCount,
 							Type:     "audio",
 							Codec:    st.CodecName,
 							Language: st.Tags.Language,
 							Title:    st.Tags.Title,
+							Channels: st.Channels,
 						})
-						if !foundEng && strings.EqualFold(st.Tags.Language, "eng") {
-							preferredIndex = audioCount
-							foundEng = true
-						}
 						audioCount++
 					}
 				}
-				if len(sess.AvailableStreams) > 0 {
-					sess.AudioIndex = preferredIndex
-				}
+				media := meta.MediaInfo()
+				_ = s.sessions.Update(sess.ID, func(sess *session.Session) {
+					sess.DurationSeconds = meta.Format.DurationSeconds
+					sess.Media = media
+					sess.Chapters = chapters
+					sess.AvailableStreams = streams
+					current := sess.AudioIndex
+					applyTrackSelection(sess, s.preferencesFor(sess))
+					if transcoding {
+						sess.AudioIndex = current
+					}
+				})
 			} else if probeErr != nil {
 				if sess.IsTorrent {
 					s.probeMu.Lock()
@@ -422,8 +724,25 @@ func (s *Server) handleGetSession(w http.ResponseWriter, r *http.Request, id str
 				log.Printf("metadata probe failed for session %s: %v", sess.ID, probeErr)
 			}
 		}
+		if snap, err := s.sessions.Snapshot(sess.ID); err == nil {
+			segments := s.skipSegments(&snap)
+			_ = s.sessions.Update(sess.ID, func(sess *session.Session) {
+				sess.SkipSegments = segments
+			})
+		}
 	}
-	writeJSON(w, sess)
+	s.writeSession(w, sess.ID)
+}
+
+// writeSession writes session id as read under the store's lock, so fields
+// changed through Store.Update are never read halfway.
+func (s *Server) writeSession(w http.ResponseWriter, id string) {
+	snap, err := s.sessions.Snapshot(id)
+	if err != nil {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, snap)
 }
 
 func (s *Server) handleStreamSession(w http.ResponseWriter, r *http.Request, id string) {
@@ -449,6 +768,36 @@ func (s *Server) handleHLSSession(w http.ResponseWriter, r *http.Request, sess *
 	s.handleHLSSessionAsset(w, r, sess, "child.m3u8")
 }
 
+// handleMasterPlaylist serves /sessions/{id}/stream/master.m3u8. Seek
+// parameters are passed on to the media playlists so the video and audio
+// renditions seek together. With vod=1 the variants are the VOD playlists,
+// which need no seek parameters.
+func (s *Server) handleMasterPlaylist(w http.ResponseWriter, r *http.Request, sess *session.Session) {
+	vod := r.URL.Query().Get("vod") == "1"
+	forward := url.Values{}
+	for _, key := range []string{"seek", "seek_id", "force_slice"} {
+		if v := r.URL.Query().Get(key); v != "" && !vod {
+			forward.Set(key, v)
+		}
+	}
+
+	playlist, err := s.hlsController.MasterPlaylist(r.Context(), sess.ID, s.mediaInput(sess), sess.StartTime, forward.Encode(), vod)
+	if err != nil {
+		log.Printf("failed to build master playlist for session %s: %v", sess.ID, err)
+		http.Error(w, "failed to prepare stream", http.StatusInternalServerError)
+		return
+	}
+
+	lines := strings.Split(playlist, "\n")
+	if token := r.URL.Query().Get("token"); token != "" {
+		lines = appendPlaylistToken(lines, token)
+	}
+
+	w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+	w.Header().Set("Cache-Control", "no-store, no-cache, must-revalidate, max-age=0")
+	_, _ = io.WriteString(w, strings.Join(lines, "\n"))
+}
+
 func (s *Server) handleStreamAsset(w http.ResponseWriter, r *http.Request, id, asset string) {
 	sess, err := s.sessions.Get(id)
 	if err != nil {
@@ -464,7 +813,23 @@ func (s *Server) handleStreamAsset(w http.ResponseWriter, r *http.Request, id, a
 }
 
 func (s *Server) handleHLSSessionAsset(w http.ResponseWriter, r *http.Request, sess *session.Session, asset string) {
-	if asset == "child.m3u8" {
+	if asset == "master.m3u8" {
+		s.handleMasterPlaylist(w, r, sess)
+		return
+	}
+	if asset == hls.DASHManifestName {
+		s.handleDASHManifest(w, r, sess)
+		return
+	}
+	if hls.IsVODPlaylist(asset) {
+		s.handleVODPlaylist(w, r, sess, asset)
+		return
+	}
+	if name, ok := strings.CutPrefix(asset, hls.VODSegmentPrefix); ok {
+		s.handleVODSegment(w, r, sess, name)
+		return
+	}
+	if asset == "child.m3u8" || hls.IsAudioPlaylist(asset) {
 		if s.hlsController != nil {
 			s.hlsController.NotifyClientPlaylistRequest(sess.ID)
 		}
@@ -481,7 +846,7 @@ func (s *Server) handleHLSSessionAsset(w http.ResponseWriter, r *http.Request, s
 			if val, err := strconv.ParseFloat(start, 64); err == nil && val >= 0 {
 				shouldSeek := forceSlice || !s.hlsController.IsDuplicateSeek(sess.ID, seekID)
 				if shouldSeek {
-					dur, actualStart, _, err := s.hlsController.Seek(r.Context(), sess.ID, sess.Source, val, seekID, forceSlice)
+					dur, actualStart, _, err := s.hlsController.Seek(r.Context(), sess.ID, s.mediaInput(sess), val, seekID, forceSlice)
 					if err != nil {
 						log.Printf("seek error for %s: %v", sess.ID, err)
 						http.Error(w, "failed to seek", http.StatusInternalServerError)
@@ -494,7 +859,7 @@ func (s *Server) handleHLSSessionAsset(w http.ResponseWriter, r *http.Request, s
 				}
 			}
 		} else {
-			if _, _, err := s.hlsController.EnsureSession(r.Context(), sess.ID, sess.Source, sess.StartTime); err != nil {
+			if _, _, err := s.hlsController.EnsureSession(r.Context(), sess.ID, s.mediaInput(sess), sess.StartTime); err != nil {
 				log.Printf("failed to prepare stream for session %s (source=%s): %v", sess.ID, sess.Source, err)
 				http.Error(w, "failed to prepare stream", http.StatusInternalServerError)
 				return
@@ -504,20 +869,27 @@ func (s *Server) handleHLSSessionAsset(w http.ResponseWriter, r *http.Request, s
 
 		w.Header().Set("X-Raffi-Slice-Start", fmt.Sprintf("%.3f", sliceStart))
 
-		sliceDir := s.hlsController.CurrentSliceDir(sess.ID)
-		if sliceDir == "" {
+		fullPath := s.hlsController.AssetPath(sess.ID, asset)
+		if fullPath == "" {
 			http.Error(w, "no active slice", http.StatusInternalServerError)
 			return
 		}
-		fullPath := filepath.Clean(filepath.Join(sliceDir, asset))
+		if asset != "child.m3u8" {
+			// Rendition playlists are written by the same ffmpeg but may trail
+			// the video playlist slightly.
+			if err := waitForFile(r.Context(), fullPath, 10*time.Second); err != nil {
+				http.Error(w, "playlist unavailable", http.StatusServiceUnavailable)
+				return
+			}
+		}
 
-		content, err := os.ReadFile(fullPath)
+		content, err := s.hlsController.MediaPlaylist(sess.ID, asset)
 		if err != nil {
 			http.Error(w, "failed to read playlist", http.StatusInternalServerError)
 			return
 		}
 
-		lines := strings.Split(string(content), "\n")
+		lines := strings.Split(content, "\n")
 		if start != "" {
 			if val, err := strconv.ParseFloat(start, 64); err == nil && val >= 0 {
 				offset := val - sliceStart
@@ -537,6 +909,10 @@ func (s *Server) handleHLSSessionAsset(w http.ResponseWriter, r *http.Request, s
 			}
 		}
 
+		if token := r.URL.Query().Get("token"); token != "" {
+			lines = appendPlaylistToken(lines, token)
+		}
+
 		finalContent := strings.Join(lines, "\n")
 		w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
 		w.Header().Set("Cache-Control", "no-store, no-cache, must-revalidate, max-age=0")
@@ -546,27 +922,22 @@ func (s *Server) handleHLSSessionAsset(w http.ResponseWriter, r *http.Request, s
 		return
 	}
 
-	if _, _, err := s.hlsController.EnsureSession(r.Context(), sess.ID, sess.Source, sess.StartTime); err != nil {
+	if _, _, err := s.hlsController.EnsureSession(r.Context(), sess.ID, s.mediaInput(sess), sess.StartTime); err != nil {
 		log.Printf("failed to prepare stream for session %s (source=%s): %v", sess.ID, sess.Source, err)
 		http.Error(w, "failed to prepare stream", http.StatusInternalServerError)
 		return
 	}
 
-	sliceDir := s.hlsController.CurrentSliceDir(sess.ID)
-	if sliceDir == "" {
-		http.Error(w, "no active slice", http.StatusInternalServerError)
-		return
-	}
-
-	fullPath := filepath.Clean(filepath.Join(sliceDir, asset))
-	if !strings.HasPrefix(fullPath, sliceDir) {
+	// Stitched playlists name segments of other slices as slice_NNN/name.
+	fullPath := s.hlsController.AssetPath(sess.ID, asset)
+	if fullPath == "" {
 		http.Error(w, "invalid path", http.StatusBadRequest)
 		return
 	}
 
 	if s.hlsController != nil {
 		ext := strings.ToLower(filepath.Ext(fullPath))
-		if ext == ".ts" {
+		if ext == ".ts" || ext == ".m4s" {
 			s.hlsController.NotifyClientAssetRequest(sess.ID)
 		}
 	}
@@ -591,14 +962,39 @@ func (s *Server) handleHLSSessionAsset(w http.ResponseWriter, r *http.Request, s
 		return
 	}
 
+	// Playback position is tracked on the video segments; rendition
+	// segments follow the same timeline.
 	ext := strings.ToLower(filepath.Ext(fullPath))
-	if ext == ".ts" {
-		s.hlsController.MarkSegmentServed(sess.ID, path.Base(fullPath))
+	if (ext == ".ts" || ext == ".m4s") && strings.HasPrefix(path.Base(fullPath), "segment") {
+		s.hlsController.MarkSegmentServed(sess.ID, asset)
+		s.serveSegment(w, r, sess.ID, asset, fullPath)
+		return
 	}
 
 	http.ServeFile(w, r, fullPath)
 }
 
+// serveSegment serves video segment asset and reports how long the client
+// took to download it, for the session's bandwidth estimate.
+func (s *Server) serveSegment(w http.ResponseWriter, r *http.Request, id, asset, fullPath string) {
+	cw := &countingWriter{ResponseWriter: w}
+	began := time.Now()
+	http.ServeFile(cw, r, fullPath)
+	s.hlsController.RecordSegmentDelivery(id, asset, cw.n, time.Since(began))
+}
+
+// countingWriter counts the body bytes written through it.
+type countingWriter struct {
+	http.ResponseWriter
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(p)
+	w.n += int64(n)
+	return n, err
+}
+
 func waitForFile(ctx context.Context, p string, timeout time.Duration) error {
 	deadline := time.NewTimer(timeout)
 	ticker := time.NewTicker(100 * time.Millisecond)
@@ -630,16 +1026,16 @@ func writeJSON(w http.ResponseWriter, v any) {
 	_ = json.NewEncoder(w).Encode(v)
 }
 
-func withCORS(next http.Handler) http.Handler {
+func withCORS(policy *accessPolicy, next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		origin := strings.TrimSpace(r.Header.Get("Origin"))
-		if origin != "" {
+		if origin != "" && policy.originAllowed(origin) {
 			w.Header().Set("Access-Control-Allow-Origin", origin)
 			w.Header().Set("Vary", "Origin")
 		}
 		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS, DELETE, HEAD")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Accept-Encoding, Range, Origin, Accept")
-		w.Header().Set("Access-Control-Expose-Headers", "X-Raffi-Slice-Start, Accept-Ranges, Content-Range, Content-Length")
+		w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type, Accept-Encoding, Range, Origin, Accept")
+		w.Header().Set("Access-Control-Expose-Headers", "X-Raffi-Slice-Start, X-Total-Count, Accept-Ranges, Content-Range, Content-Length")
 		w.Header().Set("Access-Control-Max-Age", "86400")
 
 		if r.Method == http.MethodOptions {
@@ -671,6 +1067,13 @@ func (s *Server) handleCleanup(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "id required", http.StatusBadRequest)
 		return
 	}
+	if dev := requestDevice(r); dev != nil {
+		snap, err := s.sessions.Snapshot(id)
+		if err != nil || !deviceSessionPermitted(r, dev, snap, false) {
+			http.Error(w, "forbidden: session belongs to another client", http.StatusForbidden)
+			return
+		}
+	}
 
 	log.Printf("Cleaning up session %s", id)
 
@@ -684,6 +1087,12 @@ func (s *Server) handleCleanup(w http.ResponseWriter, r *http.Request) {
 	if s.hlsController != nil {
 		_ = s.hlsController.StopSession(id)
 	}
+	s.parties.Close(id)
+	stopCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	if err := s.stopCast(stopCtx, id); err != nil {
+		log.Printf("cast: failed to stop renderer for %s: %v", id, err)
+	}
+	cancel()
 	_ = s.sessions.Delete(id)
 	w.WriteHeader(http.StatusOK)
 }
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"raffi-server/src/party"
+	"strings"
+
+	"github.com/gorilla/websocket"
+)
+
+// /sessions/{id}/party  POST   -> open a watch party and get its share code (owner only)
+// /sessions/{id}/party  GET    -> WebSocket: ?role=host (owner only) or follower (LAN devices pass ?code=)
+// /sessions/{id}/party  GET    -> without an upgrade: room state and members
+// /sessions/{id}/party  DELETE -> end the party (owner only)
+func (s *Server) handleParty(w http.ResponseWriter, r *http.Request, id string) {
+	dev := requestDevice(r)
+
+	switch r.Method {
+	case http.MethodPost:
+		if dev != nil {
+			http.Error(w, "forbidden: owner access required", http.StatusForbidden)
+			return
+		}
+		if _, err := s.sessions.Get(id); err != nil {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		room, err := s.parties.Open(id)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, room.Info())
+		return
+	case http.MethodDelete:
+		if dev != nil {
+			http.Error(w, "forbidden: owner access required", http.StatusForbidden)
+			return
+		}
+		s.parties.Close(id)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	case http.MethodGet:
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	room, ok := s.parties.Get(id)
+	if !ok {
+		http.Error(w, party.ErrRoomNotFound.Error(), http.StatusNotFound)
+		return
+	}
+
+	// Paired devices only get in with the share code the host handed out.
+	if dev != nil && !strings.EqualFold(strings.TrimSpace(r.URL.Query().Get("code")), room.Code()) {
+		http.Error(w, party.ErrInvalidCode.Error(), http.StatusForbidden)
+		return
+	}
+
+	if !websocket.IsWebSocketUpgrade(r) {
+		writeJSON(w, room.Info())
+		return
+	}
+
+	role := party.RoleFollower
+	if r.URL.Query().Get("role") == party.RoleHost {
+		if dev != nil {
+			http.Error(w, "forbidden: only the owner can host", http.StatusForbidden)
+			return
+		}
+		role = party.RoleHost
+	}
+	name := r.URL.Query().Get("name")
+	if name == "" && dev != nil {
+		name = dev.Name
+	}
+
+	if err := room.Serve(w, r, role, name); err != nil {
+		log.Printf("party: connection for session %s failed: %v", id, err)
+	}
+}
+
+// /party/{code}  GET -> resolve a share code to the session it belongs to
+func (s *Server) handlePartyCode(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	code := strings.Trim(strings.TrimPrefix(r.URL.Path, "/party/"), "/")
+	room, err := s.parties.Lookup(code)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	writeJSON(w, room.Info())
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"raffi-server/src/session"
+	"raffi-server/src/stream/hls"
+	"strconv"
+	"strings"
+)
+
+// trackPreferencesFromEnv builds the server-wide defaults for audio and
+// subtitle selection:
+//
+//	RAFFI_AUDIO_LANGUAGES        ordered list, e.g. "jpn,eng"
+//	RAFFI_PREFER_ORIGINAL_AUDIO  "1" to prefer the original language
+//	RAFFI_AUDIO_CHANNELS         surround | stereo
+//	RAFFI_SUBTITLE_LANGUAGES     ordered list; defaults to the audio languages
+//	RAFFI_SUBTITLE_MODE          off (default) | forced | always
+func trackPreferencesFromEnv() session.TrackPreferences {
+	prefs := session.DefaultTrackPreferences()
+	if langs := splitList(os.Getenv("RAFFI_AUDIO_LANGUAGES")); len(langs) > 0 {
+		prefs.AudioLanguages = langs
+	}
+	if v := strings.TrimSpace(os.Getenv("RAFFI_PREFER_ORIGINAL_AUDIO")); v == "1" || strings.EqualFold(v, "true") {
+		prefs.PreferOriginal = true
+	}
+	if v := strings.ToLower(strings.TrimSpace(os.Getenv("RAFFI_AUDIO_CHANNELS"))); v != "" {
+		prefs.Channels = v
+	}
+	if langs := splitList(os.Getenv("RAFFI_SUBTITLE_LANGUAGES")); len(langs) > 0 {
+		prefs.SubtitleLanguages = langs
+	}
+	if v := strings.ToLower(strings.TrimSpace(os.Getenv("RAFFI_SUBTITLE_MODE"))); v != "" {
+		prefs.SubtitleMode = v
+	}
+	if err := validateTrackPreferences(prefs); err != nil {
+		log.Printf("Warning: ignoring track preferences from environment: %v", err)
+		return session.DefaultTrackPreferences()
+	}
+	return prefs
+}
+
+// sessionTrackPreferences overlays the preferences a client sent with a new
+// session on the server defaults. Fields the client omits keep their default.
+func (s *Server) sessionTrackPreferences(raw json.RawMessage) (session.TrackPreferences, error) {
+	prefs := s.trackPrefs
+	prefs.AudioLanguages = append([]string(nil), s.trackPrefs.AudioLanguages...)
+	prefs.SubtitleLanguages = append([]string(nil), s.trackPrefs.SubtitleLanguages...)
+	if len(raw) == 0 || string(raw) == "null" {
+		return prefs, nil
+	}
+	if err := json.Unmarshal(raw, &prefs); err != nil {
+		return prefs, fmt.Errorf("invalid preferences: %w", err)
+	}
+	return prefs, validateTrackPreferences(prefs)
+}
+
+func validateTrackPreferences(prefs session.TrackPreferences) error {
+	switch prefs.SubtitleMode {
+	case "", session.SubtitlesOff, session.SubtitlesForced, session.SubtitlesAlways:
+	default:
+		return fmt.Errorf("invalid subtitleMode %q", prefs.SubtitleMode)
+	}
+	switch prefs.Channels {
+	case session.ChannelsAny, session.ChannelsSurround, session.ChannelsStereo:
+	default:
+		return fmt.Errorf("invalid channels %q", prefs.Channels)
+	}
+	return nil
+}
+
+// applyTrackSelection sets the default audio and subtitle streams of sess
+// from its media info. It is the only place the API picks tracks, so it
+// always agrees with what the transcoder chose for the same preferences. Call
+// it from Store.Update.
+func applyTrackSelection(sess *session.Session, prefs session.TrackPreferences) {
+	if sess.Media == nil {
+		return
+	}
+	sel := session.SelectTracks(sess.Media, prefs)
+	sess.AudioIndex = sel.AudioIndex
+	sess.SubtitleIndex = nil
+	if sel.SubtitleIndex >= 0 {
+		idx := sel.SubtitleIndex
+		sess.SubtitleIndex = &idx
+	}
+}
+
+func (s *Server) preferencesFor(sess *session.Session) session.TrackPreferences {
+	if sess.Preferences != nil {
+		return *sess.Preferences
+	}
+	return s.trackPrefs
+}
+
+func splitList(raw string) []string {
+	var out []string
+	for _, part := range strings.FieldsFunc(raw, func(r rune) bool { return r == ',' || r == ';' || r == ' ' }) {
+		out = append(out, strings.ToLower(part))
+	}
+	return out
+}
+
+const maxAudioRenditions = 8
+
+// audioRenditionsFromEnv reads RAFFI_HLS_AUDIO_RENDITIONS, the default number
+// of audio renditions per session. 0 (the default) keeps muxed audio.
+func audioRenditionsFromEnv() int {
+	raw := strings.TrimSpace(os.Getenv("RAFFI_HLS_AUDIO_RENDITIONS"))
+	if raw == "" {
+		return 0
+	}
+	n, err := strconv.Atoi(raw)
+	if err != nil || n < 0 {
+		log.Printf("Warning: ignoring invalid RAFFI_HLS_AUDIO_RENDITIONS=%q", raw)
+		return 0
+	}
+	return min(n, maxAudioRenditions)
+}
+
+// audioProfileFromEnv reads RAFFI_AUDIO_PROFILE, the default audio processing
+// profile (see hls.AudioProfiles). Unset or invalid values give "auto".
+func audioProfileFromEnv() hls.AudioProfile {
+	raw := os.Getenv("RAFFI_AUDIO_PROFILE")
+	profile, err := hls.ParseAudioProfile(raw)
+	if err != nil {
+		log.Printf("Warning: ignoring RAFFI_AUDIO_PROFILE: %v", err)
+		return hls.AudioProfileAuto
+	}
+	return profile
+}
+
+// encodingProfilesFromEnv returns the default encoding profile plus those
+// in the JSON file named by RAFFI_ENCODING_PROFILES, if set.
+func encodingProfilesFromEnv() *hls.ProfileRegistry {
+	registry := hls.NewProfileRegistry()
+	if path := strings.TrimSpace(os.Getenv("RAFFI_ENCODING_PROFILES")); path != "" {
+		if err := registry.Load(path); err != nil {
+			log.Printf("Warning: ignoring RAFFI_ENCODING_PROFILES: %v", err)
+		}
+	}
+	return registry
+}
+
+// requestAudioProfile resolves the profile a request asks for, falling back
+// to def when it names none.
+func requestAudioProfile(name string, def hls.AudioProfile) (hls.AudioProfile, error) {
+	if strings.TrimSpace(name) == "" {
+		return def, nil
+	}
+	return hls.ParseAudioProfile(name)
+}
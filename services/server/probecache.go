@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// DELETE /probe-cache?source=...
+// Drops the cached ffprobe result for a source so the next playback probes it
+// again. The source is normalized the same way the cache keys it, so any
+// variant of a rotating debrid link clears the same entry. ?all=1 clears the
+// whole cache. Owner only.
+func (s *Server) handleProbeCache(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if r.Method != http.MethodDelete {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if requestDevice(r) != nil {
+		http.Error(w, "forbidden: owner access required", http.StatusForbidden)
+		return
+	}
+
+	cache := s.hlsController.ProbeCache()
+	q := r.URL.Query()
+	if q.Get("all") == "1" || strings.EqualFold(q.Get("all"), "true") {
+		n := cache.Clear()
+		s.clearProbeCooldowns("")
+		writeJSON(w, map[string]any{"removed": n})
+		return
+	}
+
+	source := strings.TrimSpace(q.Get("source"))
+	if source == "" {
+		http.Error(w, "source is required", http.StatusBadRequest)
+		return
+	}
+	key, removed := cache.Invalidate(source)
+	s.clearProbeCooldowns(source)
+	n := 0
+	if removed {
+		n = 1
+	}
+	writeJSON(w, map[string]any{"removed": n, "key": key})
+}
+
+// clearProbeCooldowns lifts the retry backoff for sessions playing source (all
+// sessions when source is empty) so an invalidated probe is retried at once.
+func (s *Server) clearProbeCooldowns(source string) {
+	s.probeMu.Lock()
+	defer s.probeMu.Unlock()
+	for id := range s.probeCooldown {
+		if source == "" {
+			delete(s.probeCooldown, id)
+			continue
+		}
+		if sess, err := s.sessions.Get(id); err == nil && sess.Source == source {
+			delete(s.probeCooldown, id)
+		}
+	}
+}
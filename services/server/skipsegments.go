@@ -0,0 +1,118 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"raffi-server/src/analysis"
+	"raffi-server/src/session"
+	"raffi-server/src/source"
+	"raffi-server/src/stream/hls"
+	"sort"
+	"strings"
+)
+
+// skipDetectionEnabled reads RAFFI_SKIP_DETECTION. Intro and credits
+// detection is on unless it is set to 0, false or off.
+func skipDetectionEnabled() bool {
+	switch strings.ToLower(strings.TrimSpace(os.Getenv("RAFFI_SKIP_DETECTION"))) {
+	case "0", "false", "no", "off":
+		return false
+	}
+	return true
+}
+
+// skipSegments returns the known intro and credits of sess: chapter titles
+// first, then cached analysis results. If the source has not been analysed
+// yet the analysis starts in the background and a later GET picks it up.
+// Torrent sources are only analysed when the session opted in, since the
+// analysis downloads the end of the file and parts of other episodes.
+func (s *Server) skipSegments(sess *session.Session) []session.SkipSegment {
+	segments := analysis.FromChapters(sess.Chapters)
+	if s.analyzer == nil || sess.DurationSeconds <= 0 {
+		return segments
+	}
+	if hasSkipSegment(segments, session.SkipIntro) && hasSkipSegment(segments, session.SkipCredits) {
+		return segments
+	}
+
+	key := hls.ProbeCacheKey(sess.Source)
+	found, ok := s.analyzer.Segments(key)
+	if !ok {
+		if (!sess.IsTorrent || sess.SkipDetection) && s.analyzer.Wants(key) {
+			if req, ready := s.analysisRequest(sess, key); ready {
+				s.analyzer.Analyze(req)
+			}
+		}
+		return segments
+	}
+	for _, seg := range found {
+		if !hasSkipSegment(segments, seg.Type) {
+			segments = append(segments, seg)
+		}
+	}
+	sort.Slice(segments, func(i, j int) bool { return segments[i].StartTime < segments[j].StartTime })
+	return segments
+}
+
+func hasSkipSegment(segments []session.SkipSegment, kind string) bool {
+	for _, seg := range segments {
+		if seg.Type == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// analysisRequest describes sess and its neighbouring episodes: other files
+// of the same torrent or the same folder. ready is false while a torrent's
+// file list is not known yet.
+func (s *Server) analysisRequest(sess *session.Session, key string) (analysis.Request, bool) {
+	req := analysis.Request{
+		Episode:  analysis.Episode{Key: key, Source: s.mediaInput(sess), Name: sess.Source},
+		Duration: sess.DurationSeconds,
+	}
+
+	var candidates []analysis.Episode
+	switch {
+	case sess.IsTorrent:
+		files, ok := s.torrentStreamer.Files(sess.TorrentInfoHash)
+		if !ok {
+			return req, false
+		}
+		for _, f := range files {
+			if f.Selected {
+				req.Name = f.Path
+				continue
+			}
+			if !source.IsMediaFile(f.Path) {
+				continue
+			}
+			fileURL := s.access.withToken(s.torrentStreamer.FileURL(sess.TorrentInfoHash, f.Index))
+			candidates = append(candidates, analysis.Episode{
+				Key:    hls.ProbeCacheKey(fileURL),
+				Source: fileURL,
+				Name:   f.Path,
+			})
+		}
+	case filepath.IsAbs(sess.Source):
+		entries, err := os.ReadDir(filepath.Dir(sess.Source))
+		if err != nil {
+			break
+		}
+		for _, e := range entries {
+			name := e.Name()
+			if e.IsDir() || strings.HasPrefix(name, ".") || !source.IsMediaFile(name) {
+				continue
+			}
+			p := filepath.Join(filepath.Dir(sess.Source), name)
+			candidates = append(candidates, analysis.Episode{
+				Key:    hls.ProbeCacheKey(p),
+				Source: p,
+				Name:   p,
+			})
+		}
+	}
+
+	req.Siblings = analysis.Neighbours(req.Name, candidates, analysis.DefaultSiblings)
+	return req, true
+}
@@ -0,0 +1,245 @@
+package addons
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+const (
+	maxResponseBytes = 8 << 20
+	maxCacheEntries  = 512
+)
+
+// Default per-request timeouts and cache lifetimes by resource. Addons can
+// extend the cache lifetime of a response through cacheMaxAge.
+var (
+	resourceTimeouts = map[string]time.Duration{
+		"manifest":  10 * time.Second,
+		"catalog":   15 * time.Second,
+		"meta":      12 * time.Second,
+		"stream":    10 * time.Second,
+		"subtitles": 8 * time.Second,
+	}
+	resourceTTLs = map[string]time.Duration{
+		"manifest":  6 * time.Hour,
+		"catalog":   15 * time.Minute,
+		"meta":      time.Hour,
+		"stream":    5 * time.Minute,
+		"subtitles": 30 * time.Minute,
+	}
+)
+
+type Client struct {
+	http *http.Client
+
+	mu      sync.Mutex
+	cache   map[string]cacheEntry
+	timeout map[string]time.Duration
+}
+
+type cacheEntry struct {
+	body    []byte
+	expires time.Time
+}
+
+func NewClient() *Client {
+	return &Client{
+		http:    &http.Client{},
+		cache:   make(map[string]cacheEntry),
+		timeout: make(map[string]time.Duration),
+	}
+}
+
+// SetTimeout overrides the request timeout for a single addon, identified by
+// its base transport URL.
+func (c *Client) SetTimeout(baseURL string, d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if d <= 0 {
+		delete(c.timeout, baseURL)
+		return
+	}
+	c.timeout[baseURL] = d
+}
+
+func (c *Client) timeoutFor(baseURL, resource string) time.Duration {
+	c.mu.Lock()
+	d, ok := c.timeout[baseURL]
+	c.mu.Unlock()
+	if ok {
+		return d
+	}
+	if d, ok := resourceTimeouts[resource]; ok {
+		return d
+	}
+	return 10 * time.Second
+}
+
+// Manifest fetches and validates the manifest for a transport URL.
+func (c *Client) Manifest(ctx context.Context, transportURL string) (*Manifest, []byte, error) {
+	manifestURL, baseURL, err := NormalizeTransportURL(transportURL)
+	if err != nil {
+		return nil, nil, err
+	}
+	body, err := c.get(ctx, baseURL, "manifest", manifestURL)
+	if err != nil {
+		return nil, nil, err
+	}
+	m, err := ParseManifest(body)
+	if err != nil {
+		c.invalidate(manifestURL)
+		return nil, nil, err
+	}
+	return m, body, nil
+}
+
+// Resource fetches {base}/{resource}/{type}/{id}[/{extra}].json after checking
+// the addon's manifest declares support for it. The response must be a JSON
+// object; it is returned verbatim.
+func (c *Client) Resource(ctx context.Context, transportURL, resource, contentType, id, extra string) ([]byte, error) {
+	manifestURL, baseURL, err := NormalizeTransportURL(transportURL)
+	if err != nil {
+		return nil, err
+	}
+	m, _, err := c.Manifest(ctx, transportURL)
+	if err != nil {
+		return nil, err
+	}
+	if !m.Supports(resource, contentType, id) {
+		return nil, &UnsupportedError{Addon: m.ID, Resource: resource, Type: contentType, ID: id}
+	}
+
+	path := "/" + resource + "/" + url.PathEscape(contentType) + "/" + url.PathEscape(id)
+	if extra != "" {
+		path += "/" + extra
+	}
+	p := resourceURL(manifestURL, baseURL, path+".json")
+
+	body, err := c.get(ctx, baseURL, resource, p)
+	if err != nil {
+		return nil, err
+	}
+	var obj map[string]json.RawMessage
+	if err := json.Unmarshal(body, &obj); err != nil {
+		c.invalidate(p)
+		return nil, fmt.Errorf("addon %s returned invalid %s response: %w", m.ID, resource, err)
+	}
+	return body, nil
+}
+
+type UnsupportedError struct {
+	Addon    string
+	Resource string
+	Type     string
+	ID       string
+}
+
+func (e *UnsupportedError) Error() string {
+	return fmt.Sprintf("addon %s does not provide %s for %s/%s", e.Addon, e.Resource, e.Type, e.ID)
+}
+
+func (c *Client) get(ctx context.Context, baseURL, resource, u string) ([]byte, error) {
+	if body, ok := c.cached(u); ok {
+		return body, nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, c.timeoutFor(baseURL, resource))
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxResponseBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(body) > maxResponseBytes {
+		return nil, fmt.Errorf("addon response from %s exceeds %d bytes", u, maxResponseBytes)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, &StatusError{URL: u, Status: resp.StatusCode}
+	}
+
+	ttl := resourceTTLs[resource]
+	var hint struct {
+		CacheMaxAge int `json:"cacheMaxAge"`
+	}
+	if resource != "manifest" && json.Unmarshal(body, &hint) == nil && hint.CacheMaxAge > 0 {
+		ttl = time.Duration(hint.CacheMaxAge) * time.Second
+		if ttl > 24*time.Hour {
+			ttl = 24 * time.Hour
+		}
+	}
+	if ttl > 0 {
+		c.store(u, body, ttl)
+	}
+	return body, nil
+}
+
+type StatusError struct {
+	URL    string
+	Status int
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("addon request %s returned %d", e.URL, e.Status)
+}
+
+func (c *Client) cached(u string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.cache[u]
+	if !ok {
+		return nil, false
+	}
+	if time.Now().After(entry.expires) {
+		delete(c.cache, u)
+		return nil, false
+	}
+	return entry.body, true
+}
+
+func (c *Client) store(u string, body []byte, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	if len(c.cache) >= maxCacheEntries {
+		var oldestKey string
+		var oldest time.Time
+		for k, e := range c.cache {
+			if now.After(e.expires) {
+				delete(c.cache, k)
+				continue
+			}
+			if oldestKey == "" || e.expires.Before(oldest) {
+				oldestKey = k
+				oldest = e.expires
+			}
+		}
+		if len(c.cache) >= maxCacheEntries && oldestKey != "" {
+			delete(c.cache, oldestKey)
+		}
+	}
+	c.cache[u] = cacheEntry{body: body, expires: now.Add(ttl)}
+}
+
+func (c *Client) invalidate(u string) {
+	c.mu.Lock()
+	delete(c.cache, u)
+	c.mu.Unlock()
+}
@@ -0,0 +1,146 @@
+package addons
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+)
+
+// CommunityAddon is a catalog entry from the community addon collections.
+// Manifest is kept verbatim so clients can install it as-is; the remaining
+// fields are derived from it for filtering.
+type CommunityAddon struct {
+	TransportURL string          `json:"transportUrl"`
+	Manifest     json.RawMessage `json:"manifest,omitempty"`
+
+	ID          string   `json:"id"`
+	Name        string   `json:"name"`
+	Version     string   `json:"version,omitempty"`
+	Description string   `json:"description,omitempty"`
+	Logo        string   `json:"logo,omitempty"`
+	Types       []string `json:"types"`
+	Resources   []string `json:"resources"`
+	Adult       bool     `json:"adult"`
+
+	Valid     bool       `json:"valid"`
+	Issue     string     `json:"issue,omitempty"`
+	Reachable *bool      `json:"reachable,omitempty"`
+	CheckedAt *time.Time `json:"checkedAt,omitempty"`
+
+	parsed *Manifest
+}
+
+// ParseCommunityEntry converts a raw catalog entry. ok is false when the entry
+// has neither a transport URL nor a manifest id to identify it by. Entries
+// with a broken manifest are returned with Valid=false and an Issue.
+func ParseCommunityEntry(raw json.RawMessage) (CommunityAddon, bool) {
+	var entry struct {
+		TransportURL  string          `json:"transportUrl"`
+		TransportURL2 string          `json:"transport_url"`
+		Manifest      json.RawMessage `json:"manifest"`
+	}
+	if err := json.Unmarshal(raw, &entry); err != nil {
+		return CommunityAddon{}, false
+	}
+
+	a := CommunityAddon{
+		TransportURL: strings.TrimSpace(entry.TransportURL),
+		Manifest:     entry.Manifest,
+		Types:        []string{},
+		Resources:    []string{},
+	}
+	if a.TransportURL == "" {
+		a.TransportURL = strings.TrimSpace(entry.TransportURL2)
+	}
+
+	var m Manifest
+	if len(entry.Manifest) == 0 || string(entry.Manifest) == "null" {
+		a.Issue = "missing manifest"
+	} else if err := json.Unmarshal(entry.Manifest, &m); err != nil {
+		a.Issue = "invalid manifest JSON: " + err.Error()
+	} else {
+		a.ID = m.ID
+		a.Name = m.Name
+		a.Version = m.Version
+		a.Description = m.Description
+		a.Logo = m.Logo
+		a.Types = append(a.Types, m.Types...)
+		for _, r := range m.Resources {
+			a.Resources = append(a.Resources, r.Name)
+		}
+		if adult, ok := m.BehaviorHints["adult"].(bool); ok {
+			a.Adult = adult
+		}
+		if err := m.Validate(); err != nil {
+			a.Issue = err.Error()
+		} else {
+			a.parsed = &m
+		}
+	}
+
+	if a.TransportURL != "" {
+		if manifestURL, _, err := NormalizeTransportURL(a.TransportURL); err != nil {
+			if a.Issue == "" {
+				a.Issue = err.Error()
+			}
+		} else {
+			a.TransportURL = manifestURL
+		}
+	} else if a.Issue == "" {
+		a.Issue = "missing transport URL"
+	}
+
+	a.Valid = a.Issue == ""
+	if a.TransportURL == "" && a.ID == "" {
+		return a, false
+	}
+	return a, true
+}
+
+// Key is used to deduplicate entries across upstream collections.
+func (a *CommunityAddon) Key() string {
+	if a.TransportURL != "" {
+		return a.TransportURL
+	}
+	return a.ID
+}
+
+type CommunityFilter struct {
+	Query    string
+	Resource string
+	Type     string
+	// Adult filters on the adult behavior hint when non-nil.
+	Adult *bool
+	// ValidOnly drops entries flagged invalid or unreachable.
+	ValidOnly bool
+}
+
+func (f CommunityFilter) Match(a *CommunityAddon) bool {
+	if f.ValidOnly && (!a.Valid || (a.Reachable != nil && !*a.Reachable)) {
+		return false
+	}
+	if f.Adult != nil && a.Adult != *f.Adult {
+		return false
+	}
+	if f.Resource != "" && !containsFold(a.Resources, f.Resource) {
+		return false
+	}
+	if f.Type != "" {
+		if f.Resource != "" && a.parsed != nil {
+			if !a.parsed.Supports(f.Resource, f.Type, "") {
+				return false
+			}
+		} else if !containsFold(a.Types, f.Type) {
+			return false
+		}
+	}
+	if q := strings.ToLower(strings.TrimSpace(f.Query)); q != "" {
+		haystack := strings.ToLower(a.Name + "\n" + a.Description + "\n" + a.ID)
+		for _, term := range strings.Fields(q) {
+			if !strings.Contains(haystack, term) {
+				return false
+			}
+		}
+	}
+	return true
+}
@@ -0,0 +1,189 @@
+package addons
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// Manifest is the subset of the Stremio addon manifest the server relies on.
+type Manifest struct {
+	ID            string         `json:"id"`
+	Version       string         `json:"version"`
+	Name          string         `json:"name"`
+	Description   string         `json:"description,omitempty"`
+	Logo          string         `json:"logo,omitempty"`
+	Types         []string       `json:"types"`
+	Resources     []Resource     `json:"resources"`
+	IDPrefixes    []string       `json:"idPrefixes,omitempty"`
+	Catalogs      []Catalog      `json:"catalogs,omitempty"`
+	BehaviorHints map[string]any `json:"behaviorHints,omitempty"`
+}
+
+type Catalog struct {
+	Type string `json:"type"`
+	ID   string `json:"id"`
+	Name string `json:"name,omitempty"`
+}
+
+// Resource is either a bare name ("stream") or an object that narrows the
+// types and id prefixes it applies to.
+type Resource struct {
+	Name       string   `json:"name"`
+	Types      []string `json:"types,omitempty"`
+	IDPrefixes []string `json:"idPrefixes,omitempty"`
+}
+
+func (r *Resource) UnmarshalJSON(data []byte) error {
+	var name string
+	if err := json.Unmarshal(data, &name); err == nil {
+		r.Name = name
+		return nil
+	}
+	type plain Resource
+	var p plain
+	if err := json.Unmarshal(data, &p); err != nil {
+		return err
+	}
+	*r = Resource(p)
+	return nil
+}
+
+func ParseManifest(data []byte) (*Manifest, error) {
+	var m Manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("invalid manifest JSON: %w", err)
+	}
+	if err := m.Validate(); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+func (m *Manifest) Validate() error {
+	if strings.TrimSpace(m.ID) == "" {
+		return errors.New("manifest is missing id")
+	}
+	if strings.TrimSpace(m.Name) == "" {
+		return errors.New("manifest is missing name")
+	}
+	if strings.TrimSpace(m.Version) == "" {
+		return errors.New("manifest is missing version")
+	}
+	if len(m.Resources) == 0 {
+		return errors.New("manifest declares no resources")
+	}
+	for _, r := range m.Resources {
+		if strings.TrimSpace(r.Name) == "" {
+			return errors.New("manifest has a resource without a name")
+		}
+	}
+	if len(m.Types) == 0 {
+		return errors.New("manifest declares no types")
+	}
+	return nil
+}
+
+// Supports reports whether the addon claims to serve resource for the given
+// content type and id. Catalog requests are matched against the declared
+// catalogs instead of id prefixes.
+func (m *Manifest) Supports(resource, contentType, id string) bool {
+	for _, r := range m.Resources {
+		if r.Name != resource {
+			continue
+		}
+		types := r.Types
+		if len(types) == 0 {
+			types = m.Types
+		}
+		// Object resources may list the same name once per type.
+		if contentType != "" && !containsFold(types, contentType) {
+			continue
+		}
+		if resource == "catalog" {
+			if len(m.Catalogs) == 0 {
+				return true
+			}
+			for _, c := range m.Catalogs {
+				if (contentType == "" || c.Type == contentType) && (id == "" || c.ID == id) {
+					return true
+				}
+			}
+			continue
+		}
+		prefixes := r.IDPrefixes
+		if len(prefixes) == 0 {
+			prefixes = m.IDPrefixes
+		}
+		if id == "" || len(prefixes) == 0 {
+			return true
+		}
+		for _, p := range prefixes {
+			if strings.HasPrefix(id, p) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (m *Manifest) HasResource(resource string) bool {
+	for _, r := range m.Resources {
+		if r.Name == resource {
+			return true
+		}
+	}
+	return false
+}
+
+var ErrInvalidTransport = errors.New("invalid transport URL")
+
+// NormalizeTransportURL validates a transport URL and returns the canonical
+// manifest URL together with the base URL resource paths are appended to. A
+// query string, which configured addons may rely on, stays on the manifest
+// URL; resourceURL carries it over to resource requests.
+func NormalizeTransportURL(raw string) (manifestURL, baseURL string, err error) {
+	raw = strings.TrimSpace(raw)
+	if strings.HasPrefix(raw, "stremio://") {
+		raw = "https://" + strings.TrimPrefix(raw, "stremio://")
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "", "", fmt.Errorf("%w: %v", ErrInvalidTransport, err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return "", "", fmt.Errorf("%w: unsupported scheme %q", ErrInvalidTransport, u.Scheme)
+	}
+	if u.Host == "" {
+		return "", "", fmt.Errorf("%w: missing host", ErrInvalidTransport)
+	}
+	p := strings.TrimSuffix(u.EscapedPath(), "/")
+	p = strings.TrimSuffix(p, "/manifest.json")
+	base := u.Scheme + "://" + u.Host + p
+	manifestURL = base + "/manifest.json"
+	if u.RawQuery != "" {
+		manifestURL += "?" + u.RawQuery
+	}
+	return manifestURL, base, nil
+}
+
+// resourceURL appends path to baseURL, keeping the query string of
+// manifestURL.
+func resourceURL(manifestURL, baseURL, path string) string {
+	u := baseURL + path
+	if _, query, ok := strings.Cut(manifestURL, "?"); ok {
+		u += "?" + query
+	}
+	return u
+}
+
+func containsFold(list []string, v string) bool {
+	for _, s := range list {
+		if strings.EqualFold(s, v) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,76 @@
+package addons
+
+import "testing"
+
+func TestNormalizeTransportURL(t *testing.T) {
+	tests := []struct {
+		raw, manifest, base string
+		wantErr             bool
+	}{
+		{raw: "https://addon.example.com/manifest.json", manifest: "https://addon.example.com/manifest.json", base: "https://addon.example.com"},
+		{raw: "  https://addon.example.com/  ", manifest: "https://addon.example.com/manifest.json", base: "https://addon.example.com"},
+		{raw: "stremio://addon.example.com/cfg/abc/manifest.json", manifest: "https://addon.example.com/cfg/abc/manifest.json", base: "https://addon.example.com/cfg/abc"},
+		{raw: "http://127.0.0.1:7000/manifest.json?key=abc&lang=en", manifest: "http://127.0.0.1:7000/manifest.json?key=abc&lang=en", base: "http://127.0.0.1:7000"},
+		{raw: "ftp://addon.example.com/manifest.json", wantErr: true},
+		{raw: "https:///manifest.json", wantErr: true},
+		{raw: "::", wantErr: true},
+	}
+	for _, tt := range tests {
+		manifest, base, err := NormalizeTransportURL(tt.raw)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("NormalizeTransportURL(%q) = %q, %q; want an error", tt.raw, manifest, base)
+			}
+			continue
+		}
+		if err != nil || manifest != tt.manifest || base != tt.base {
+			t.Errorf("NormalizeTransportURL(%q) = %q, %q, %v; want %q, %q", tt.raw, manifest, base, err, tt.manifest, tt.base)
+		}
+	}
+}
+
+func TestResourceURLKeepsQuery(t *testing.T) {
+	manifest, base, err := NormalizeTransportURL("https://addon.example.com/manifest.json?key=abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := resourceURL(manifest, base, "/stream/movie/tt1.json")
+	if want := "https://addon.example.com/stream/movie/tt1.json?key=abc"; got != want {
+		t.Errorf("resourceURL = %q, want %q", got, want)
+	}
+}
+
+func TestManifestSupports(t *testing.T) {
+	m := &Manifest{
+		Types:      []string{"movie", "series", "tv"},
+		IDPrefixes: []string{"tt"},
+		Resources: []Resource{
+			{Name: "stream", Types: []string{"movie"}},
+			{Name: "stream", Types: []string{"series"}, IDPrefixes: []string{"kitsu:"}},
+			{Name: "meta"},
+			{Name: "catalog"},
+		},
+		Catalogs: []Catalog{{Type: "movie", ID: "top"}},
+	}
+	tests := []struct {
+		resource, contentType, id string
+		want                      bool
+	}{
+		{"stream", "movie", "tt0111161", true},
+		// The second stream entry declares series.
+		{"stream", "series", "kitsu:1", true},
+		{"stream", "series", "tt0903747", false},
+		{"stream", "tv", "tt1", false},
+		{"meta", "tv", "tt1", true},
+		{"meta", "movie", "kitsu:1", false},
+		{"meta", "channel", "tt1", false},
+		{"catalog", "movie", "top", true},
+		{"catalog", "movie", "new", false},
+		{"subtitles", "movie", "tt1", false},
+	}
+	for _, tt := range tests {
+		if got := m.Supports(tt.resource, tt.contentType, tt.id); got != tt.want {
+			t.Errorf("Supports(%q, %q, %q) = %v, want %v", tt.resource, tt.contentType, tt.id, got, tt.want)
+		}
+	}
+}
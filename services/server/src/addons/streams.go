@@ -0,0 +1,131 @@
+package addons
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+type Stream struct {
+	Name          string            `json:"name,omitempty"`
+	Title         string            `json:"title,omitempty"`
+	Description   string            `json:"description,omitempty"`
+	URL           string            `json:"url,omitempty"`
+	YtID          string            `json:"ytId,omitempty"`
+	InfoHash      string            `json:"infoHash,omitempty"`
+	FileIdx       *int              `json:"fileIdx,omitempty"`
+	ExternalURL   string            `json:"externalUrl,omitempty"`
+	Sources       []string          `json:"sources,omitempty"`
+	Subtitles     []json.RawMessage `json:"subtitles,omitempty"`
+	BehaviorHints map[string]any    `json:"behaviorHints,omitempty"`
+
+	AddonID   string `json:"addonId"`
+	AddonName string `json:"addonName"`
+}
+
+// Key identifies the underlying media of a stream so the same torrent file or
+// URL offered by several addons collapses into one entry.
+func (s *Stream) Key() string {
+	switch {
+	case s.InfoHash != "":
+		idx := "-"
+		if s.FileIdx != nil {
+			idx = strconv.Itoa(*s.FileIdx)
+		}
+		return "bt:" + strings.ToLower(s.InfoHash) + ":" + idx
+	case s.URL != "":
+		return "url:" + s.URL
+	case s.YtID != "":
+		return "yt:" + s.YtID
+	case s.ExternalURL != "":
+		return "ext:" + s.ExternalURL
+	}
+	return ""
+}
+
+type AddonError struct {
+	TransportURL string `json:"transportUrl"`
+	AddonID      string `json:"addonId,omitempty"`
+	Error        string `json:"error"`
+}
+
+type AggregateResult struct {
+	Streams []Stream     `json:"streams"`
+	Errors  []AddonError `json:"errors,omitempty"`
+	Skipped []string     `json:"skipped,omitempty"`
+}
+
+// Streams queries every addon that declares the stream resource for the given
+// type and id in parallel. Results keep the order of transportURLs and are
+// deduplicated, the first addon to offer a stream wins.
+func (c *Client) Streams(ctx context.Context, transportURLs []string, contentType, id string) AggregateResult {
+	type result struct {
+		streams []Stream
+		err     *AddonError
+		skipped bool
+	}
+	results := make([]result, len(transportURLs))
+
+	var wg sync.WaitGroup
+	for i, transport := range transportURLs {
+		wg.Add(1)
+		go func(i int, transport string) {
+			defer wg.Done()
+			m, _, err := c.Manifest(ctx, transport)
+			if err != nil {
+				results[i].err = &AddonError{TransportURL: transport, Error: err.Error()}
+				return
+			}
+			if !m.Supports("stream", contentType, id) {
+				results[i].skipped = true
+				return
+			}
+			body, err := c.Resource(ctx, transport, "stream", contentType, id, "")
+			if err != nil {
+				results[i].err = &AddonError{TransportURL: transport, AddonID: m.ID, Error: err.Error()}
+				return
+			}
+			var payload struct {
+				Streams []Stream `json:"streams"`
+			}
+			if err := json.Unmarshal(body, &payload); err != nil {
+				results[i].err = &AddonError{TransportURL: transport, AddonID: m.ID, Error: fmt.Sprintf("invalid streams: %v", err)}
+				return
+			}
+			for j := range payload.Streams {
+				payload.Streams[j].AddonID = m.ID
+				payload.Streams[j].AddonName = m.Name
+			}
+			results[i].streams = payload.Streams
+		}(i, transport)
+	}
+	wg.Wait()
+
+	out := AggregateResult{Streams: []Stream{}}
+	seen := make(map[string]struct{})
+	for i, r := range results {
+		if r.err != nil {
+			out.Errors = append(out.Errors, *r.err)
+			continue
+		}
+		if r.skipped {
+			out.Skipped = append(out.Skipped, transportURLs[i])
+			continue
+		}
+		for _, st := range r.streams {
+			key := st.Key()
+			if key == "" {
+				continue
+			}
+			if _, ok := seen[key]; ok {
+				continue
+			}
+			seen[key] = struct{}{}
+			out.Streams = append(out.Streams, st)
+		}
+	}
+	return out
+}
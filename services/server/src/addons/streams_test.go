@@ -0,0 +1,80 @@
+package addons
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// fakeAddon serves manifest and stream responses for an httptest server.
+func fakeAddon(t *testing.T, manifest Manifest, streams map[string]string) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/manifest.json" {
+			_ = json.NewEncoder(w).Encode(manifest)
+			return
+		}
+		body, ok := streams[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		_, _ = w.Write([]byte(body))
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestStreamsAggregatesInOrder(t *testing.T) {
+	first := fakeAddon(t, Manifest{ID: "first", Name: "First", Version: "1.0.0", Types: []string{"movie"}, Resources: []Resource{{Name: "stream"}}},
+		map[string]string{"/stream/movie/tt1.json": `{"streams":[{"url":"https://cdn.example.com/a.mkv"},{"infoHash":"ABC","fileIdx":1}]}`})
+	second := fakeAddon(t, Manifest{ID: "second", Name: "Second", Version: "1.0.0", Types: []string{"movie"}, Resources: []Resource{{Name: "stream"}}},
+		map[string]string{"/stream/movie/tt1.json": `{"streams":[{"infoHash":"abc","fileIdx":1},{"url":"https://cdn.example.com/b.mkv"}]}`})
+	seriesOnly := fakeAddon(t, Manifest{ID: "series", Name: "Series", Version: "1.0.0", Types: []string{"series"}, Resources: []Resource{{Name: "stream"}}}, nil)
+	broken := fakeAddon(t, Manifest{ID: "broken", Name: "Broken", Version: "1.0.0", Types: []string{"movie"}, Resources: []Resource{{Name: "stream"}}}, nil)
+
+	transports := []string{first.URL + "/manifest.json", seriesOnly.URL, second.URL, broken.URL}
+	got := NewClient().Streams(context.Background(), transports, "movie", "tt1")
+
+	var urls []string
+	for _, st := range got.Streams {
+		urls = append(urls, st.Key()+"@"+st.AddonID)
+	}
+	want := []string{"url:https://cdn.example.com/a.mkv@first", "bt:abc:1@first", "url:https://cdn.example.com/b.mkv@second"}
+	if len(urls) != len(want) {
+		t.Fatalf("streams = %q, want %q", urls, want)
+	}
+	for i := range want {
+		if urls[i] != want[i] {
+			t.Errorf("stream %d = %q, want %q", i, urls[i], want[i])
+		}
+	}
+	if len(got.Skipped) != 1 || got.Skipped[0] != seriesOnly.URL {
+		t.Errorf("skipped = %q, want the series-only addon", got.Skipped)
+	}
+	if len(got.Errors) != 1 || got.Errors[0].AddonID != "broken" {
+		t.Errorf("errors = %+v, want one from the broken addon", got.Errors)
+	}
+}
+
+func TestResourceKeepsTransportQuery(t *testing.T) {
+	var query string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/manifest.json" {
+			_ = json.NewEncoder(w).Encode(Manifest{ID: "cfg", Name: "Configured", Version: "1.0.0", Types: []string{"movie"}, Resources: []Resource{{Name: "stream"}}})
+			return
+		}
+		query = r.URL.RawQuery
+		_, _ = w.Write([]byte(`{"streams":[]}`))
+	}))
+	defer srv.Close()
+
+	if _, err := NewClient().Resource(context.Background(), srv.URL+"/manifest.json?key=abc", "stream", "movie", "tt1", ""); err != nil {
+		t.Fatal(err)
+	}
+	if query != "key=abc" {
+		t.Errorf("stream request query = %q, want key=abc", query)
+	}
+}
@@ -0,0 +1,427 @@
+// Package analysis finds intros and end credits so players can offer to skip
+// them. Intros are found by matching audio fingerprints of neighbouring
+// episodes, credits by black frames that coincide with silence near the end.
+package analysis
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"raffi-server/src/library"
+	"raffi-server/src/session"
+)
+
+const (
+	cacheFileName  = "skip-segments.json"
+	cacheVersion   = 1
+	maxCacheSize   = 2048
+	cacheSaveDelay = 2 * time.Second
+
+	// Intros are searched for in the first introWindow seconds.
+	introWindow = 5 * 60.0
+	minIntro    = 15.0
+	maxIntro    = 150.0
+	// An intro this close to the start is taken to start at 0.
+	introSnap = 3.0
+
+	// DefaultSiblings is how many neighbouring episodes are compared before
+	// giving up on an intro.
+	DefaultSiblings = 2
+
+	analyzeTimeout = 15 * time.Minute
+	// Failed analyses (torrent stalls, network errors) are retried after
+	// this long.
+	retryAfter = 10 * time.Minute
+	// Fingerprints are kept in memory so the next episode does not decode
+	// the previous one again.
+	maxFingerprints = 16
+)
+
+// Episode is a video taking part in an analysis.
+type Episode struct {
+	// Key identifies the content across sessions (see hls.ProbeCacheKey).
+	Key string
+	// Source is the ffmpeg input.
+	Source string
+	// Name is the file name or path, used to find neighbouring episodes.
+	Name string
+}
+
+// Request asks for the skip segments of one video.
+type Request struct {
+	Episode
+	Duration float64
+	// Siblings are other episodes of the same season, nearest first.
+	Siblings []Episode
+}
+
+type result struct {
+	Key        string                `json:"key"`
+	Segments   []session.SkipSegment `json:"segments"`
+	AnalyzedAt time.Time             `json:"analyzedAt"`
+}
+
+type persistedCache struct {
+	Version int       `json:"version"`
+	Results []*result `json:"results"`
+}
+
+// Analyzer runs analyses one at a time in the background and caches their
+// results on disk, keyed by content.
+type Analyzer struct {
+	ffmpegPath    string
+	path          string
+	sem           chan struct{}
+	fingerprintFn func(ctx context.Context, source string) (*fingerprint, error)
+	creditsFn     func(ctx context.Context, source string, duration float64) (float64, bool, error)
+
+	mu         sync.Mutex
+	results    map[string]*result
+	running    map[string]bool
+	failed     map[string]time.Time
+	prints     map[string]*fingerprint
+	printOrder []string
+	saveTimer  *time.Timer
+}
+
+// New loads cached results from stateDir, if given.
+func New(stateDir, ffmpegPath string) *Analyzer {
+	a := &Analyzer{
+		ffmpegPath: ffmpegPath,
+		sem:        make(chan struct{}, 1),
+		results:    make(map[string]*result),
+		running:    make(map[string]bool),
+		failed:     make(map[string]time.Time),
+		prints:     make(map[string]*fingerprint),
+	}
+	a.fingerprintFn = func(ctx context.Context, source string) (*fingerprint, error) {
+		return fingerprintAudio(ctx, a.ffmpegPath, source, introWindow)
+	}
+	a.creditsFn = func(ctx context.Context, source string, duration float64) (float64, bool, error) {
+		return detectCredits(ctx, a.ffmpegPath, source, duration)
+	}
+	if stateDir != "" {
+		a.path = filepath.Join(stateDir, cacheFileName)
+		if err := a.load(); err != nil && !errors.Is(err, os.ErrNotExist) {
+			log.Printf("analysis: failed to load %s: %v", a.path, err)
+		}
+	}
+	return a
+}
+
+// Segments returns the cached segments for key. ok is false until key has
+// been analysed; an analysis that found nothing returns ok with no segments.
+func (a *Analyzer) Segments(key string) ([]session.SkipSegment, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	r, ok := a.results[key]
+	if !ok {
+		return nil, false
+	}
+	return append([]session.SkipSegment(nil), r.Segments...), true
+}
+
+// Wants reports whether Analyze would start work for key: it has no result,
+// is not running and did not fail recently.
+func (a *Analyzer) Wants(key string) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.wantsLocked(key)
+}
+
+func (a *Analyzer) wantsLocked(key string) bool {
+	if _, ok := a.results[key]; ok || a.running[key] {
+		return false
+	}
+	if failedAt, ok := a.failed[key]; ok && time.Since(failedAt) < retryAfter {
+		return false
+	}
+	return true
+}
+
+// Analyze starts a background analysis for req unless Wants says otherwise.
+func (a *Analyzer) Analyze(req Request) {
+	if req.Key == "" || req.Duration <= 0 {
+		return
+	}
+	a.mu.Lock()
+	if !a.wantsLocked(req.Key) {
+		a.mu.Unlock()
+		return
+	}
+	a.running[req.Key] = true
+	a.mu.Unlock()
+
+	go func() {
+		a.sem <- struct{}{}
+		defer func() { <-a.sem }()
+
+		ctx, cancel := context.WithTimeout(context.Background(), analyzeTimeout)
+		defer cancel()
+		started := time.Now()
+		segments, err := a.analyze(ctx, req)
+
+		a.mu.Lock()
+		delete(a.running, req.Key)
+		if err != nil {
+			a.failed[req.Key] = time.Now()
+		} else {
+			delete(a.failed, req.Key)
+			a.results[req.Key] = &result{Key: req.Key, Segments: segments, AnalyzedAt: time.Now()}
+			a.evictLocked()
+			a.scheduleSaveLocked()
+		}
+		a.mu.Unlock()
+
+		if err != nil {
+			log.Printf("analysis: %s failed: %v", req.Name, err)
+			return
+		}
+		log.Printf("analysis: %s: %d skip segments in %s", req.Name, len(segments), time.Since(started).Round(time.Second))
+	}()
+}
+
+func (a *Analyzer) analyze(ctx context.Context, req Request) ([]session.SkipSegment, error) {
+	var segments []session.SkipSegment
+
+	if len(req.Siblings) > 0 {
+		intro, err := a.detectIntro(ctx, req)
+		if err != nil {
+			return nil, err
+		}
+		if intro != nil {
+			segments = append(segments, *intro)
+		}
+	}
+
+	start, ok, err := a.creditsFn(ctx, req.Source, req.Duration)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		segments = append(segments, session.SkipSegment{
+			Type:      session.SkipCredits,
+			StartTime: start,
+			EndTime:   req.Duration,
+			Source:    "blackframe",
+		})
+	}
+	return segments, nil
+}
+
+// detectIntro compares req with its siblings until one shares a stretch of
+// audio of intro length near the start.
+func (a *Analyzer) detectIntro(ctx context.Context, req Request) (*session.SkipSegment, error) {
+	own, err := a.fingerprint(ctx, req.Episode)
+	if err != nil {
+		return nil, err
+	}
+	for _, sib := range req.Siblings {
+		other, err := a.fingerprint(ctx, sib)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			log.Printf("analysis: skipping %s: %v", sib.Name, err)
+			continue
+		}
+		m := longestMatch(own, other)
+		length := float64(m.length) * frameSeconds
+		if length < minIntro || length > maxIntro {
+			continue
+		}
+		start := float64(m.aStart) * frameSeconds
+		if start < introSnap {
+			start = 0
+		}
+		end := float64(m.aStart+m.length) * frameSeconds
+		return &session.SkipSegment{
+			Type:      session.SkipIntro,
+			StartTime: start,
+			EndTime:   min(end, req.Duration),
+			Source:    "fingerprint",
+		}, nil
+	}
+	return nil, nil
+}
+
+func (a *Analyzer) fingerprint(ctx context.Context, ep Episode) (*fingerprint, error) {
+	a.mu.Lock()
+	fp, ok := a.prints[ep.Key]
+	a.mu.Unlock()
+	if ok {
+		return fp, nil
+	}
+
+	fp, err := a.fingerprintFn(ctx, ep.Source)
+	if err != nil {
+		return nil, err
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, ok := a.prints[ep.Key]; !ok {
+		a.prints[ep.Key] = fp
+		a.printOrder = append(a.printOrder, ep.Key)
+		if len(a.printOrder) > maxFingerprints {
+			delete(a.prints, a.printOrder[0])
+			a.printOrder = a.printOrder[1:]
+		}
+	}
+	return fp, nil
+}
+
+// evictLocked drops the oldest results beyond maxCacheSize.
+func (a *Analyzer) evictLocked() {
+	if len(a.results) <= maxCacheSize {
+		return
+	}
+	all := make([]*result, 0, len(a.results))
+	for _, r := range a.results {
+		all = append(all, r)
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].AnalyzedAt.Before(all[j].AnalyzedAt) })
+	for _, r := range all[:len(all)-maxCacheSize] {
+		delete(a.results, r.Key)
+	}
+}
+
+func (a *Analyzer) scheduleSaveLocked() {
+	if a.path == "" || a.saveTimer != nil {
+		return
+	}
+	a.saveTimer = time.AfterFunc(cacheSaveDelay, func() {
+		a.mu.Lock()
+		a.saveTimer = nil
+		a.mu.Unlock()
+		if err := a.Save(); err != nil {
+			log.Printf("analysis: save failed: %v", err)
+		}
+	})
+}
+
+// Save writes the cached results to disk.
+func (a *Analyzer) Save() error {
+	if a.path == "" {
+		return nil
+	}
+	a.mu.Lock()
+	snapshot := persistedCache{Version: cacheVersion}
+	for _, r := range a.results {
+		snapshot.Results = append(snapshot.Results, r)
+	}
+	data, err := json.Marshal(snapshot)
+	a.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(a.path), 0o755); err != nil {
+		return err
+	}
+	tmp := a.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, a.path)
+}
+
+func (a *Analyzer) load() error {
+	data, err := os.ReadFile(a.path)
+	if err != nil {
+		return err
+	}
+	var snapshot persistedCache
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return err
+	}
+	if snapshot.Version != cacheVersion {
+		return nil
+	}
+	for _, r := range snapshot.Results {
+		if r != nil && r.Key != "" {
+			a.results[r.Key] = r
+		}
+	}
+	a.evictLocked()
+	return nil
+}
+
+// Neighbours returns the candidates that are other episodes of the same show
+// and season as name, nearest episode number first, at most n of them.
+func Neighbours(name string, candidates []Episode, n int) []Episode {
+	current := library.ParseName(name)
+	if current.Kind != library.KindEpisode || current.Episode == 0 {
+		return nil
+	}
+
+	type ranked struct {
+		ep       Episode
+		distance int
+	}
+	var out []ranked
+	for _, c := range candidates {
+		if c.Name == name {
+			continue
+		}
+		p := library.ParseName(c.Name)
+		if p.Kind != library.KindEpisode || p.Season != current.Season || p.Episode == 0 || p.Episode == current.Episode {
+			continue
+		}
+		if !strings.EqualFold(p.Title, current.Title) {
+			continue
+		}
+		d := p.Episode - current.Episode
+		if d < 0 {
+			d = -d
+		}
+		out = append(out, ranked{c, d})
+	}
+	sort.SliceStable(out, func(i, j int) bool { return out[i].distance < out[j].distance })
+
+	eps := make([]Episode, 0, min(n, len(out)))
+	for _, r := range out[:min(n, len(out))] {
+		eps = append(eps, r.ep)
+	}
+	return eps
+}
+
+var (
+	reIntroChapter   = regexp.MustCompile(`(?i)^\s*(intro|introduction|opening|op\s*\d*|opening (credits|theme|titles?)|title sequence)\s*$`)
+	reCreditsChapter = regexp.MustCompile(`(?i)^\s*(credits|end credits|ending|ending (credits|theme)|ed\s*\d*|outro|closing credits)\s*$`)
+)
+
+// FromChapters derives skip segments from chapter titles such as "Opening"
+// or "End Credits".
+func FromChapters(chapters []session.Chapter) []session.SkipSegment {
+	var segments []session.SkipSegment
+	seen := map[string]bool{}
+	for _, c := range chapters {
+		kind := ""
+		switch {
+		case reIntroChapter.MatchString(c.Title):
+			kind = session.SkipIntro
+		case reCreditsChapter.MatchString(c.Title):
+			kind = session.SkipCredits
+		}
+		if kind == "" || seen[kind] || c.EndTime <= c.StartTime {
+			continue
+		}
+		seen[kind] = true
+		segments = append(segments, session.SkipSegment{
+			Type:      kind,
+			StartTime: c.StartTime,
+			EndTime:   c.EndTime,
+			Source:    "chapter",
+		})
+	}
+	return segments
+}
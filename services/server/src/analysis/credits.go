@@ -0,0 +1,136 @@
+package analysis
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	sourcepolicy "raffi-server/src/source"
+	"raffi-server/src/stream/hls"
+)
+
+const (
+	// Credits are searched for in the last creditsWindow seconds, or the
+	// last creditsShare of the video if that is shorter.
+	creditsWindow = 5 * 60.0
+	creditsShare  = 0.15
+	// Videos shorter than this are not searched.
+	minCreditsDuration = 10 * 60.0
+	// A black frame counts when silence starts or ends within this many
+	// seconds of it.
+	creditsSilenceSlack = 2.0
+	// Fade-outs in the last seconds are not the start of credits.
+	minCreditsLength = 15.0
+)
+
+var (
+	reBlackFrame   = regexp.MustCompile(`black_start:\s*(-?[\d.]+)\s+black_end:\s*(-?[\d.]+)`)
+	reSilenceStart = regexp.MustCompile(`silence_start:\s*(-?[\d.]+)`)
+	reSilenceEnd   = regexp.MustCompile(`silence_end:\s*(-?[\d.]+)`)
+	// "Stream #0:1 -> #0:1 (...)" lines under "Stream mapping:".
+	reStreamMapping = regexp.MustCompile(`(?m)^\s*Stream #\d+:\d+ -> #\d+:\d+`)
+)
+
+type interval struct{ start, end float64 }
+
+// detectCredits looks for the start of the end credits: the earliest cut to
+// black that coincides with silence near the end of the video. The result is
+// in seconds from the start of the video.
+func detectCredits(ctx context.Context, ffmpegPath, source string, duration float64) (float64, bool, error) {
+	if duration < minCreditsDuration {
+		return 0, false, nil
+	}
+	window := min(creditsWindow, duration*creditsShare)
+	from := duration - window
+
+	args := []string{"-hide_banner", "-nostdin", "-nostats"}
+	if strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://") {
+		args = append(args,
+			"-reconnect", "1",
+			"-reconnect_streamed", "1",
+			"-reconnect_delay_max", "5",
+		)
+	}
+	args = append(args,
+		"-ss", fmt.Sprintf("%.3f", from),
+		"-protocol_whitelist", sourcepolicy.ProtocolWhitelist(source),
+		"-i", source,
+		"-t", fmt.Sprintf("%.3f", window),
+		"-map", "0:v:0",
+		"-map", "0:a:0?",
+		"-vf", "scale=320:-2,blackdetect=d=0.4:pix_th=0.10",
+		"-af", "silencedetect=noise=-45dB:d=0.8",
+		"-f", "null",
+		"-",
+	)
+
+	out, err := hls.CommandContext(ctx, ffmpegPath, args...).CombinedOutput()
+	if err != nil {
+		if ctx.Err() != nil {
+			return 0, false, ctx.Err()
+		}
+		return 0, false, fmt.Errorf("ffmpeg: %v: %s", err, lastLine(string(out)))
+	}
+
+	black, silence := parseDetectOutput(string(out))
+	hasAudio := len(reStreamMapping.FindAllString(string(out), -1)) > 1
+	start, ok := creditsStart(black, silence, hasAudio, window)
+	if !ok {
+		return 0, false, nil
+	}
+	return from + start, true, nil
+}
+
+// parseDetectOutput reads blackdetect and silencedetect log lines. Times are
+// relative to the start of the analysed window.
+func parseDetectOutput(out string) (black, silence []interval) {
+	for _, m := range reBlackFrame.FindAllStringSubmatch(out, -1) {
+		start, _ := strconv.ParseFloat(m[1], 64)
+		end, _ := strconv.ParseFloat(m[2], 64)
+		black = append(black, interval{start, end})
+	}
+
+	open := -1.0
+	for _, line := range strings.Split(out, "\n") {
+		if m := reSilenceStart.FindStringSubmatch(line); m != nil {
+			open, _ = strconv.ParseFloat(m[1], 64)
+			open = max(open, 0)
+		} else if m := reSilenceEnd.FindStringSubmatch(line); m != nil && open >= 0 {
+			end, _ := strconv.ParseFloat(m[1], 64)
+			silence = append(silence, interval{open, end})
+			open = -1
+		}
+	}
+	if open >= 0 {
+		// Silence that runs to the end of the window is never closed.
+		silence = append(silence, interval{open, open + creditsWindow})
+	}
+	return black, silence
+}
+
+// creditsStart picks the earliest black interval that silence overlaps and
+// that leaves enough of the window for credits. Without an audio stream any
+// black interval will do.
+func creditsStart(black, silence []interval, hasAudio bool, window float64) (float64, bool) {
+	for _, b := range black {
+		if window-b.start < minCreditsLength {
+			break
+		}
+		if !hasAudio {
+			return b.start, true
+		}
+		for _, s := range silence {
+			if s.start <= b.end+creditsSilenceSlack && s.end >= b.start-creditsSilenceSlack {
+				return b.start, true
+			}
+		}
+	}
+	return 0, false
+}
+
+func lastLine(s string) string {
+	lines := strings.Split(strings.TrimSpace(s), "\n")
+	return strings.TrimSpace(lines[len(lines)-1])
+}
@@ -0,0 +1,108 @@
+package analysis
+
+import (
+	"reflect"
+	"testing"
+)
+
+const detectLog = `Stream mapping:
+  Stream #0:0 -> #0:0 (h264 (native) -> wrapped_avframe (native))
+  Stream #0:1 -> #0:1 (aac (native) -> pcm_s16le (native))
+[silencedetect @ 0x5601] silence_start: -0.0213
+[silencedetect @ 0x5601] silence_end: 1.5 | silence_duration: 1.52
+[blackdetect @ 0x5602] black_start:42.4 black_end:43.16 black_duration:0.76
+[silencedetect @ 0x5601] silence_start: 41.9
+[silencedetect @ 0x5601] silence_end: 44.02 | silence_duration: 2.12
+[blackdetect @ 0x5602] black_start:150 black_end:151.5 black_duration:1.5
+[silencedetect @ 0x5601] silence_start: 290.25
+`
+
+func TestParseDetectOutput(t *testing.T) {
+	black, silence := parseDetectOutput(detectLog)
+
+	wantBlack := []interval{{42.4, 43.16}, {150, 151.5}}
+	if !reflect.DeepEqual(black, wantBlack) {
+		t.Errorf("black = %v, want %v", black, wantBlack)
+	}
+	// A silence starting before the window is clamped to 0, and one that is
+	// never closed runs past the end of the window.
+	wantSilence := []interval{{0, 1.5}, {41.9, 44.02}, {290.25, 290.25 + creditsWindow}}
+	if !reflect.DeepEqual(silence, wantSilence) {
+		t.Errorf("silence = %v, want %v", silence, wantSilence)
+	}
+	if n := len(reStreamMapping.FindAllString(detectLog, -1)); n != 2 {
+		t.Errorf("stream mappings = %d, want 2", n)
+	}
+}
+
+func TestParseDetectOutputIgnoresStrayEnd(t *testing.T) {
+	_, silence := parseDetectOutput("[silencedetect @ 0x1] silence_end: 3 | silence_duration: 3\n")
+	if len(silence) != 0 {
+		t.Errorf("silence = %v, want none", silence)
+	}
+}
+
+func TestCreditsStart(t *testing.T) {
+	const window = 300.0
+	tests := []struct {
+		name     string
+		black    []interval
+		silence  []interval
+		hasAudio bool
+		want     float64
+		wantOK   bool
+	}{
+		{
+			name:     "black with silence",
+			black:    []interval{{42.4, 43.16}},
+			silence:  []interval{{41.9, 44.02}},
+			hasAudio: true,
+			want:     42.4, wantOK: true,
+		},
+		{
+			name:     "earliest match wins",
+			black:    []interval{{10, 11}, {42.4, 43.16}, {150, 151}},
+			silence:  []interval{{42, 44}, {150, 152}},
+			hasAudio: true,
+			want:     42.4, wantOK: true,
+		},
+		{
+			name:     "silence within slack",
+			black:    []interval{{100, 101}},
+			silence:  []interval{{102.5, 110}},
+			hasAudio: true,
+			want:     100, wantOK: true,
+		},
+		{
+			name:     "silence too far away",
+			black:    []interval{{100, 101}},
+			silence:  []interval{{104, 110}},
+			hasAudio: true,
+		},
+		{
+			name:     "no audio takes any black",
+			black:    []interval{{60, 61}},
+			hasAudio: false,
+			want:     60, wantOK: true,
+		},
+		{
+			name:     "fade-out at the very end",
+			black:    []interval{{window - 5, window}},
+			silence:  []interval{{window - 6, window}},
+			hasAudio: true,
+		},
+		{
+			name:     "nothing black",
+			silence:  []interval{{0, 10}},
+			hasAudio: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := creditsStart(tt.black, tt.silence, tt.hasAudio, window)
+			if ok != tt.wantOK || got != tt.want {
+				t.Errorf("creditsStart = %v, %v; want %v, %v", got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
@@ -0,0 +1,254 @@
+package analysis
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/bits"
+	"math/cmplx"
+	"strings"
+
+	sourcepolicy "raffi-server/src/source"
+	"raffi-server/src/stream/hls"
+)
+
+const (
+	sampleRate = 8000
+	// Frames overlap heavily so that two copies of the same audio produce
+	// similar frames whatever their alignment.
+	frameSamples = 2000 // 250 ms, a multiple of hopSamples
+	hopSamples   = 400  // 50 ms
+	fftSize      = 2048
+	frameSeconds = float64(hopSamples) / sampleRate
+
+	// numBands energies give numBands-1 bits per frame.
+	numBands = 17
+	minFreq  = 250.0
+	maxFreq  = 3000.0
+
+	// Frames quieter than this RMS (about -50 dBFS) are not compared; every
+	// episode starts and ends with silence.
+	silenceRMS = 100.0
+)
+
+// fingerprint is an audio fingerprint with one sub-fingerprint per 50 ms
+// hop. Bit b of a frame is set when the energy difference between bands b
+// and b+1 grew since the previous frame, which survives re-encoding and level
+// changes (Haitsma and Kalker).
+type fingerprint struct {
+	frames []uint32
+	silent []bool
+}
+
+func (f *fingerprint) len() int { return len(f.frames) }
+
+// fingerprintAudio decodes the first seconds of the first audio stream of
+// source and fingerprints it.
+func fingerprintAudio(ctx context.Context, ffmpegPath, source string, seconds float64) (*fingerprint, error) {
+	args := []string{"-hide_banner", "-loglevel", "error", "-nostdin"}
+	if strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://") {
+		args = append(args,
+			"-reconnect", "1",
+			"-reconnect_streamed", "1",
+			"-reconnect_delay_max", "5",
+		)
+	}
+	args = append(args,
+		"-protocol_whitelist", sourcepolicy.ProtocolWhitelist(source),
+		"-i", source,
+		"-t", fmt.Sprintf("%.3f", seconds),
+		"-map", "0:a:0",
+		"-vn",
+		"-ac", "1",
+		"-ar", fmt.Sprint(sampleRate),
+		"-f", "s16le",
+		"pipe:1",
+	)
+
+	cmd := hls.CommandContext(ctx, ffmpegPath, args...)
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	fp, readErr := computeFingerprint(bufio.NewReaderSize(stdout, 64*1024))
+	if err := cmd.Wait(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, fmt.Errorf("ffmpeg: %s", msg)
+		}
+		return nil, err
+	}
+	if readErr != nil {
+		return nil, readErr
+	}
+	if fp.len() == 0 {
+		return nil, errors.New("no audio decoded")
+	}
+	return fp, nil
+}
+
+// computeFingerprint reads mono 16-bit little-endian PCM at sampleRate.
+func computeFingerprint(r io.Reader) (*fingerprint, error) {
+	window := make([]float64, frameSamples)
+	for i := range window {
+		window[i] = 0.5 - 0.5*math.Cos(2*math.Pi*float64(i)/float64(frameSamples-1))
+	}
+	// Band b spans FFT bins edges[b] to edges[b+1], spaced logarithmically.
+	var edges [numBands + 1]int
+	for b := range edges {
+		freq := minFreq * math.Pow(maxFreq/minFreq, float64(b)/float64(numBands))
+		edges[b] = int(math.Round(freq * fftSize / sampleRate))
+	}
+
+	fp := &fingerprint{}
+	raw := make([]byte, hopSamples*2)
+	buf := make([]float64, 0, frameSamples)
+	spectrum := make([]complex128, fftSize)
+	var prev [numBands]float64
+	havePrev := false
+	for {
+		if _, err := io.ReadFull(r, raw); err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				return fp, nil
+			}
+			return nil, err
+		}
+		if len(buf) == frameSamples {
+			buf = append(buf[:0], buf[hopSamples:]...)
+		}
+		for i := 0; i < hopSamples; i++ {
+			buf = append(buf, float64(int16(binary.LittleEndian.Uint16(raw[2*i:]))))
+		}
+		if len(buf) < frameSamples {
+			continue
+		}
+
+		var sumSquares float64
+		clear(spectrum)
+		for i, v := range buf {
+			sumSquares += v * v
+			spectrum[i] = complex(v*window[i], 0)
+		}
+		fft(spectrum)
+
+		var energy [numBands]float64
+		for b := range energy {
+			for k := edges[b]; k < edges[b+1]; k++ {
+				re, im := real(spectrum[k]), imag(spectrum[k])
+				energy[b] += re*re + im*im
+			}
+		}
+
+		var word uint32
+		if havePrev {
+			for b := 0; b < numBands-1; b++ {
+				if (energy[b]-energy[b+1])-(prev[b]-prev[b+1]) > 0 {
+					word |= 1 << b
+				}
+			}
+		}
+		fp.frames = append(fp.frames, word)
+		fp.silent = append(fp.silent, !havePrev || math.Sqrt(sumSquares/frameSamples) < silenceRMS)
+		prev = energy
+		havePrev = true
+	}
+}
+
+// fft is an in-place radix-2 FFT; len(x) must be a power of two.
+func fft(x []complex128) {
+	n := len(x)
+	for i, j := 1, 0; i < n; i++ {
+		bit := n >> 1
+		for ; j&bit != 0; bit >>= 1 {
+			j ^= bit
+		}
+		j ^= bit
+		if i < j {
+			x[i], x[j] = x[j], x[i]
+		}
+	}
+	for size := 2; size <= n; size <<= 1 {
+		step := cmplx.Exp(complex(0, -2*math.Pi/float64(size)))
+		for start := 0; start < n; start += size {
+			w := complex(1, 0)
+			for k := 0; k < size/2; k++ {
+				u, v := x[start+k], w*x[start+k+size/2]
+				x[start+k], x[start+k+size/2] = u+v, u-v
+				w *= step
+			}
+		}
+	}
+}
+
+const (
+	bitsPerFrame = numBands - 1
+	// Two stretches match when their bit error rate over a block of frames
+	// stays below maxBitErrorRate; unrelated audio sits around 0.5.
+	blockFrames     = 40 // 2 s
+	maxBitErrorRate = 0.35
+)
+
+// span is an aligned stretch of two fingerprints, in frames.
+type span struct {
+	aStart, bStart, length int
+}
+
+// longestMatch finds the longest stretch of a that also occurs in b, at any
+// offset. Silent frames count as unrelated.
+func longestMatch(a, b *fingerprint) span {
+	var best span
+	maxErrors := int(maxBitErrorRate * bitsPerFrame * blockFrames)
+	errs := make([]int, blockFrames)
+	for offset := -(a.len() - 1); offset < b.len(); offset++ {
+		start := max(0, -offset)
+		end := min(a.len(), b.len()-offset)
+		if end-start < blockFrames {
+			continue
+		}
+
+		sum, runStart, runEnd := 0, -1, -1
+		closeRun := func() {
+			// Blocks straddling either end of the match still pass, so the
+			// run overshoots by about half a block on each side.
+			length := runEnd - runStart + 1 - blockFrames
+			if runStart >= 0 && length > best.length {
+				aStart := runStart + blockFrames/2
+				best = span{aStart: aStart, bStart: aStart + offset, length: length}
+			}
+			runStart = -1
+		}
+		for i := start; i < end; i++ {
+			j := i + offset
+			e := bitsPerFrame / 2
+			if !a.silent[i] && !b.silent[j] {
+				e = bits.OnesCount32(a.frames[i] ^ b.frames[j])
+			}
+			slot := (i - start) % blockFrames
+			sum += e - errs[slot]
+			errs[slot] = e
+			if i-start+1 < blockFrames {
+				continue
+			}
+			// The block is frames i-blockFrames+1 through i.
+			if sum <= maxErrors {
+				if runStart < 0 {
+					runStart = i - blockFrames + 1
+				}
+				runEnd = i
+			} else {
+				closeRun()
+			}
+		}
+		closeRun()
+		clear(errs)
+	}
+	return best
+}
@@ -0,0 +1,89 @@
+package analysis
+
+import (
+	"math/rand"
+	"testing"
+)
+
+func randomFingerprint(rng *rand.Rand, n int) *fingerprint {
+	f := &fingerprint{frames: make([]uint32, n), silent: make([]bool, n)}
+	for i := range f.frames {
+		f.frames[i] = rng.Uint32() & (1<<bitsPerFrame - 1)
+	}
+	return f
+}
+
+// withShared copies length frames of src starting at from into dst at at,
+// flipping a couple of bits per frame as re-encoding would.
+func withShared(rng *rand.Rand, dst, src *fingerprint, from, at, length int) {
+	for k := 0; k < length; k++ {
+		frame := src.frames[from+k]
+		frame ^= 1 << rng.Intn(bitsPerFrame)
+		frame ^= 1 << rng.Intn(bitsPerFrame)
+		dst.frames[at+k] = frame
+		dst.silent[at+k] = src.silent[from+k]
+	}
+}
+
+func TestLongestMatchFindsSharedStretch(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	a := randomFingerprint(rng, 600)
+	b := randomFingerprint(rng, 800)
+	withShared(rng, b, a, 100, 350, 300)
+
+	got := longestMatch(a, b)
+	if got.bStart-got.aStart != 250 {
+		t.Fatalf("match %+v is not at offset 250", got)
+	}
+	// The run edges are only known to within half a block.
+	if d := got.aStart - 100; d < -blockFrames/2 || d > blockFrames/2 {
+		t.Errorf("aStart = %d, want about 100", got.aStart)
+	}
+	if d := got.length - 300; d < -blockFrames || d > blockFrames {
+		t.Errorf("length = %d, want about 300", got.length)
+	}
+}
+
+func TestLongestMatchPrefersLongerStretch(t *testing.T) {
+	rng := rand.New(rand.NewSource(2))
+	a := randomFingerprint(rng, 600)
+	b := randomFingerprint(rng, 600)
+	withShared(rng, b, a, 0, 0, 100)
+	withShared(rng, b, a, 300, 200, 250)
+
+	got := longestMatch(a, b)
+	if got.bStart-got.aStart != -100 {
+		t.Errorf("match %+v, want the longer stretch at offset -100", got)
+	}
+}
+
+func TestLongestMatchUnrelated(t *testing.T) {
+	rng := rand.New(rand.NewSource(3))
+	a := randomFingerprint(rng, 400)
+	b := randomFingerprint(rng, 400)
+	if got := longestMatch(a, b); got.length > 0 {
+		t.Errorf("unrelated audio matched: %+v", got)
+	}
+}
+
+func TestLongestMatchIgnoresSilence(t *testing.T) {
+	rng := rand.New(rand.NewSource(4))
+	a := randomFingerprint(rng, 400)
+	b := randomFingerprint(rng, 400)
+	// Identical silent stretches, as at the start of every episode.
+	for i := 0; i < 200; i++ {
+		a.frames[i], a.silent[i] = 0, true
+		b.frames[i], b.silent[i] = 0, true
+	}
+	if got := longestMatch(a, b); got.length > 0 {
+		t.Errorf("silence matched: %+v", got)
+	}
+}
+
+func TestLongestMatchShortInput(t *testing.T) {
+	rng := rand.New(rand.NewSource(5))
+	a := randomFingerprint(rng, blockFrames-1)
+	if got := longestMatch(a, a); got.length != 0 {
+		t.Errorf("input shorter than a block matched: %+v", got)
+	}
+}
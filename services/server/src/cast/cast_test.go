@@ -0,0 +1,301 @@
+package cast
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeRenderer is a minimal UPnP MediaRenderer: an SSDP responder on a local
+// UDP port plus an HTTP server for the description and SOAP control URLs.
+type fakeRenderer struct {
+	t    *testing.T
+	http *httptest.Server
+	ssdp *net.UDPConn
+
+	mu      sync.Mutex
+	actions []soapCall
+	fail    map[string]int
+}
+
+type soapCall struct {
+	Service string
+	Action  string
+	Args    map[string]string
+}
+
+const fakeDescription = `<?xml version="1.0"?>
+<root xmlns="urn:schemas-upnp-org:device-1-0">
+  <device>
+    <deviceType>urn:schemas-upnp-org:device:MediaServer:1</deviceType>
+    <friendlyName>Root</friendlyName>
+    <UDN>uuid:root</UDN>
+    <deviceList>
+      <device>
+        <deviceType>urn:schemas-upnp-org:device:MediaRenderer:1</deviceType>
+        <friendlyName>Living Room TV</friendlyName>
+        <manufacturer>Fake</manufacturer>
+        <modelName>Renderer 1</modelName>
+        <UDN>uuid:fake-tv</UDN>
+        <serviceList>
+          <service>
+            <serviceType>urn:schemas-upnp-org:service:AVTransport:1</serviceType>
+            <controlURL>/ctl/avt</controlURL>
+          </service>
+          <service>
+            <serviceType>urn:schemas-upnp-org:service:RenderingControl:1</serviceType>
+            <controlURL>ctl/rc</controlURL>
+          </service>
+        </serviceList>
+      </device>
+    </deviceList>
+  </device>
+</root>`
+
+func newFakeRenderer(t *testing.T) *fakeRenderer {
+	t.Helper()
+	f := &fakeRenderer{t: t, fail: make(map[string]int)}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/desc.xml", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/xml")
+		io.WriteString(w, fakeDescription)
+	})
+	mux.HandleFunc("/ctl/", f.handleSOAP)
+	f.http = httptest.NewServer(mux)
+
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("listen ssdp: %v", err)
+	}
+	f.ssdp = conn
+	go f.serveSSDP()
+
+	t.Cleanup(func() {
+		f.ssdp.Close()
+		f.http.Close()
+	})
+	return f
+}
+
+func (f *fakeRenderer) serveSSDP() {
+	buf := make([]byte, 2048)
+	for {
+		n, from, err := f.ssdp.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		req := string(buf[:n])
+		if !strings.HasPrefix(req, "M-SEARCH") || !strings.Contains(req, AVTransportService) {
+			continue
+		}
+		resp := "HTTP/1.1 200 OK\r\n" +
+			"CACHE-CONTROL: max-age=1800\r\n" +
+			"EXT:\r\n" +
+			"LOCATION: " + f.http.URL + "/desc.xml\r\n" +
+			"ST: " + AVTransportService + "\r\n" +
+			"USN: uuid:fake-tv::" + AVTransportService + "\r\n\r\n"
+		f.ssdp.WriteToUDP([]byte(resp), from)
+	}
+}
+
+func (f *fakeRenderer) handleSOAP(w http.ResponseWriter, r *http.Request) {
+	soapAction := strings.Trim(r.Header.Get("SOAPAction"), `"`)
+	service, action, _ := strings.Cut(soapAction, "#")
+
+	var env struct {
+		Body struct {
+			Inner struct {
+				XMLName xml.Name
+				Args    []struct {
+					XMLName xml.Name
+					Value   string `xml:",chardata"`
+				} `xml:",any"`
+			} `xml:",any"`
+		} `xml:"Body"`
+	}
+	if err := xml.NewDecoder(r.Body).Decode(&env); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if env.Body.Inner.XMLName.Local != action {
+		http.Error(w, "action mismatch", http.StatusBadRequest)
+		return
+	}
+	call := soapCall{Service: service, Action: action, Args: make(map[string]string)}
+	for _, a := range env.Body.Inner.Args {
+		call.Args[a.XMLName.Local] = a.Value
+	}
+
+	f.mu.Lock()
+	f.actions = append(f.actions, call)
+	code := f.fail[action]
+	f.mu.Unlock()
+
+	w.Header().Set("Content-Type", `text/xml; charset="utf-8"`)
+	if code != 0 {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, `<?xml version="1.0"?><s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body><s:Fault><faultcode>s:Client</faultcode><faultstring>UPnPError</faultstring><detail><UPnPError xmlns="urn:schemas-upnp-org:control-1-0"><errorCode>%d</errorCode><errorDescription>Transition not available</errorDescription></UPnPError></detail></s:Fault></s:Body></s:Envelope>`, code)
+		return
+	}
+
+	var out string
+	switch action {
+	case "GetTransportInfo":
+		out = `<CurrentTransportState>PLAYING</CurrentTransportState><CurrentTransportStatus>OK</CurrentTransportStatus>`
+	case "GetPositionInfo":
+		out = `<Track>1</Track><TrackDuration>01:02:03</TrackDuration><RelTime>0:00:42.500</RelTime>`
+	}
+	fmt.Fprintf(w, `<?xml version="1.0"?><s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body><u:%sResponse xmlns:u="%s">%s</u:%sResponse></s:Body></s:Envelope>`, action, service, out, action)
+}
+
+func (f *fakeRenderer) calls() []soapCall {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]soapCall(nil), f.actions...)
+}
+
+func (f *fakeRenderer) discover(t *testing.T) *Device {
+	t.Helper()
+	d := &Discoverer{Addr: f.ssdp.LocalAddr().String(), Window: 300 * time.Millisecond}
+	devices, err := d.Discover(context.Background())
+	if err != nil {
+		t.Fatalf("Discover: %v", err)
+	}
+	if len(devices) != 1 {
+		t.Fatalf("Discover found %d devices, want 1", len(devices))
+	}
+	return devices[0]
+}
+
+func TestDiscoverFindsEmbeddedRenderer(t *testing.T) {
+	f := newFakeRenderer(t)
+	dev := f.discover(t)
+
+	if dev.ID != "uuid:fake-tv" || dev.Name != "Living Room TV" || dev.Model != "Renderer 1" {
+		t.Fatalf("unexpected device: %+v", dev)
+	}
+	if want := f.http.URL + "/ctl/avt"; dev.avTransportURL != want {
+		t.Errorf("avTransportURL = %q, want %q", dev.avTransportURL, want)
+	}
+	// Relative control URLs resolve against the description location.
+	if want := f.http.URL + "/ctl/rc"; dev.renderingControlURL != want {
+		t.Errorf("renderingControlURL = %q, want %q", dev.renderingControlURL, want)
+	}
+	if !dev.SupportsVolume {
+		t.Error("SupportsVolume = false, want true")
+	}
+}
+
+func TestManagerCachesAndLooksUpDevices(t *testing.T) {
+	f := newFakeRenderer(t)
+	m := NewManager(&Discoverer{Addr: f.ssdp.LocalAddr().String(), Window: 300 * time.Millisecond})
+
+	dev, err := m.Device(context.Background(), "uuid:fake-tv")
+	if err != nil {
+		t.Fatalf("Device: %v", err)
+	}
+	if dev.Name != "Living Room TV" {
+		t.Fatalf("Name = %q", dev.Name)
+	}
+	if _, err := m.Device(context.Background(), "uuid:missing"); err != ErrDeviceNotFound {
+		t.Fatalf("missing device err = %v, want ErrDeviceNotFound", err)
+	}
+}
+
+func TestControllerRelaysTransportActions(t *testing.T) {
+	f := newFakeRenderer(t)
+	c := NewController(f.discover(t), nil)
+	ctx := context.Background()
+
+	media := Media{URL: "http://192.0.2.1:6969/sessions/abc/rendition.mp4?token=x&start=0", Title: "Movie <1>", MimeType: "video/mp4"}
+	if err := c.Load(ctx, media); err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if err := c.Pause(ctx); err != nil {
+		t.Fatalf("Pause: %v", err)
+	}
+	if err := c.Seek(ctx, 3725.7); err != nil {
+		t.Fatalf("Seek: %v", err)
+	}
+	if err := c.SetVolume(ctx, 140); err != nil {
+		t.Fatalf("SetVolume: %v", err)
+	}
+	if err := c.Stop(ctx); err != nil {
+		t.Fatalf("Stop: %v", err)
+	}
+
+	calls := f.calls()
+	var names []string
+	for _, call := range calls {
+		names = append(names, call.Action)
+	}
+	if got, want := strings.Join(names, ","), "SetAVTransportURI,Play,Pause,Seek,SetVolume,Stop"; got != want {
+		t.Fatalf("actions = %s, want %s", got, want)
+	}
+
+	set := calls[0]
+	if set.Args["CurrentURI"] != media.URL {
+		t.Errorf("CurrentURI = %q", set.Args["CurrentURI"])
+	}
+	if meta := set.Args["CurrentURIMetaData"]; !strings.Contains(meta, "Movie &lt;1&gt;") || !strings.Contains(meta, `protocolInfo="http-get:*:video/mp4:*"`) {
+		t.Errorf("CurrentURIMetaData = %q", meta)
+	}
+	if calls[1].Args["Speed"] != "1" {
+		t.Errorf("Play Speed = %q", calls[1].Args["Speed"])
+	}
+	if seek := calls[3]; seek.Args["Unit"] != "REL_TIME" || seek.Args["Target"] != "01:02:05" {
+		t.Errorf("Seek args = %v", seek.Args)
+	}
+	if vol := calls[4]; vol.Service != RenderingControlService || vol.Args["DesiredVolume"] != "100" || vol.Args["Channel"] != "Master" {
+		t.Errorf("SetVolume call = %+v", vol)
+	}
+	for _, call := range calls {
+		if call.Args["InstanceID"] != "0" {
+			t.Errorf("%s InstanceID = %q", call.Action, call.Args["InstanceID"])
+		}
+	}
+}
+
+func TestControllerStatus(t *testing.T) {
+	f := newFakeRenderer(t)
+	c := NewController(f.discover(t), nil)
+
+	info, err := c.Status(context.Background())
+	if err != nil {
+		t.Fatalf("Status: %v", err)
+	}
+	if info.State != "PLAYING" || info.Position != 42.5 || info.Duration != 3723 {
+		t.Fatalf("Status = %+v", info)
+	}
+}
+
+func TestControllerSurfacesUPnPErrors(t *testing.T) {
+	f := newFakeRenderer(t)
+	c := NewController(f.discover(t), nil)
+	f.fail["Pause"] = 701
+
+	err := c.Pause(context.Background())
+	soapErr, ok := err.(*SOAPError)
+	if !ok {
+		t.Fatalf("Pause err = %v (%T), want *SOAPError", err, err)
+	}
+	if soapErr.Code != 701 || soapErr.Description != "Transition not available" {
+		t.Fatalf("SOAPError = %+v", soapErr)
+	}
+}
+
+func TestSetVolumeWithoutRenderingControl(t *testing.T) {
+	c := NewController(&Device{avTransportURL: "http://127.0.0.1:1/ctl"}, nil)
+	if err := c.SetVolume(context.Background(), 10); err != ErrVolumeUnsupported {
+		t.Fatalf("err = %v, want ErrVolumeUnsupported", err)
+	}
+}
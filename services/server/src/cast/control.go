@@ -0,0 +1,248 @@
+package cast
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const maxSOAPResponseSize = 1 << 20
+
+// SOAPError is a UPnP fault returned by a renderer.
+type SOAPError struct {
+	Action      string
+	Code        int
+	Description string
+}
+
+func (e *SOAPError) Error() string {
+	if e.Description != "" {
+		return fmt.Sprintf("%s failed: UPnP error %d (%s)", e.Action, e.Code, e.Description)
+	}
+	return fmt.Sprintf("%s failed: UPnP error %d", e.Action, e.Code)
+}
+
+var ErrVolumeUnsupported = errors.New("renderer does not expose RenderingControl")
+
+// Media describes what is handed to the renderer.
+type Media struct {
+	URL      string
+	Title    string
+	MimeType string
+}
+
+// TransportInfo is the renderer's playback state.
+type TransportInfo struct {
+	State    string  `json:"state"`
+	Position float64 `json:"position"`
+	Duration float64 `json:"duration"`
+}
+
+// Controller drives one renderer's AVTransport and RenderingControl services.
+type Controller struct {
+	dev    *Device
+	client *http.Client
+}
+
+func NewController(dev *Device, client *http.Client) *Controller {
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+	return &Controller{dev: dev, client: client}
+}
+
+func (c *Controller) Device() *Device { return c.dev }
+
+// Load sets the transport URI and starts playback.
+func (c *Controller) Load(ctx context.Context, media Media) error {
+	if media.MimeType == "" {
+		media.MimeType = "video/mp4"
+	}
+	_, err := c.avTransport(ctx, "SetAVTransportURI",
+		"CurrentURI", media.URL,
+		"CurrentURIMetaData", didlMetadata(media),
+	)
+	if err != nil {
+		return err
+	}
+	return c.Play(ctx)
+}
+
+func (c *Controller) Play(ctx context.Context) error {
+	_, err := c.avTransport(ctx, "Play", "Speed", "1")
+	return err
+}
+
+func (c *Controller) Pause(ctx context.Context) error {
+	_, err := c.avTransport(ctx, "Pause")
+	return err
+}
+
+func (c *Controller) Stop(ctx context.Context) error {
+	_, err := c.avTransport(ctx, "Stop")
+	return err
+}
+
+// Seek moves playback to an absolute position in seconds.
+func (c *Controller) Seek(ctx context.Context, seconds float64) error {
+	if seconds < 0 {
+		seconds = 0
+	}
+	_, err := c.avTransport(ctx, "Seek", "Unit", "REL_TIME", "Target", formatTime(seconds))
+	return err
+}
+
+// SetVolume sets the master volume, 0-100.
+func (c *Controller) SetVolume(ctx context.Context, volume int) error {
+	if c.dev.renderingControlURL == "" {
+		return ErrVolumeUnsupported
+	}
+	if volume < 0 {
+		volume = 0
+	}
+	if volume > 100 {
+		volume = 100
+	}
+	_, err := c.call(ctx, c.dev.renderingControlURL, RenderingControlService, "SetVolume",
+		"InstanceID", "0",
+		"Channel", "Master",
+		"DesiredVolume", strconv.Itoa(volume),
+	)
+	return err
+}
+
+func (c *Controller) Status(ctx context.Context) (TransportInfo, error) {
+	var info TransportInfo
+	body, err := c.avTransport(ctx, "GetTransportInfo")
+	if err != nil {
+		return info, err
+	}
+	var ti struct {
+		State string `xml:"Body>GetTransportInfoResponse>CurrentTransportState"`
+	}
+	if err := xml.Unmarshal(body, &ti); err != nil {
+		return info, err
+	}
+	info.State = ti.State
+
+	body, err = c.avTransport(ctx, "GetPositionInfo")
+	if err != nil {
+		return info, err
+	}
+	var pi struct {
+		RelTime       string `xml:"Body>GetPositionInfoResponse>RelTime"`
+		TrackDuration string `xml:"Body>GetPositionInfoResponse>TrackDuration"`
+	}
+	if err := xml.Unmarshal(body, &pi); err != nil {
+		return info, err
+	}
+	info.Position = parseTime(pi.RelTime)
+	info.Duration = parseTime(pi.TrackDuration)
+	return info, nil
+}
+
+func (c *Controller) avTransport(ctx context.Context, action string, args ...string) ([]byte, error) {
+	return c.call(ctx, c.dev.avTransportURL, AVTransportService, action, append([]string{"InstanceID", "0"}, args...)...)
+}
+
+// call performs a SOAP action. args are name/value pairs in the order the
+// service definition lists them; some renderers reject reordered arguments.
+func (c *Controller) call(ctx context.Context, controlURL, service, action string, args ...string) ([]byte, error) {
+	var body bytes.Buffer
+	body.WriteString(`<?xml version="1.0" encoding="utf-8"?>`)
+	body.WriteString(`<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/"><s:Body>`)
+	fmt.Fprintf(&body, `<u:%s xmlns:u="%s">`, action, service)
+	for i := 0; i+1 < len(args); i += 2 {
+		fmt.Fprintf(&body, "<%s>", args[i])
+		_ = xml.EscapeText(&body, []byte(args[i+1]))
+		fmt.Fprintf(&body, "</%s>", args[i])
+	}
+	fmt.Fprintf(&body, `</u:%s></s:Body></s:Envelope>`, action)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, controlURL, &body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", `text/xml; charset="utf-8"`)
+	req.Header.Set("SOAPAction", fmt.Sprintf(`"%s#%s"`, service, action))
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", action, err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxSOAPResponseSize))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", action, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		var fault struct {
+			Code        int    `xml:"Body>Fault>detail>UPnPError>errorCode"`
+			Description string `xml:"Body>Fault>detail>UPnPError>errorDescription"`
+		}
+		if xml.Unmarshal(data, &fault) == nil && fault.Code != 0 {
+			return nil, &SOAPError{Action: action, Code: fault.Code, Description: fault.Description}
+		}
+		return nil, fmt.Errorf("%s: renderer returned status %d", action, resp.StatusCode)
+	}
+	return data, nil
+}
+
+// didlMetadata builds the DIDL-Lite item most renderers need before they
+// accept a URI.
+func didlMetadata(media Media) string {
+	var b bytes.Buffer
+	esc := func(s string) string {
+		var e bytes.Buffer
+		_ = xml.EscapeText(&e, []byte(s))
+		return e.String()
+	}
+	title := media.Title
+	if title == "" {
+		title = "Raffi"
+	}
+	b.WriteString(`<DIDL-Lite xmlns="urn:schemas-upnp-org:metadata-1-0/DIDL-Lite/" xmlns:dc="http://purl.org/dc/elements/1.1/" xmlns:upnp="urn:schemas-upnp-org:metadata-1-0/upnp/">`)
+	b.WriteString(`<item id="0" parentID="-1" restricted="1">`)
+	fmt.Fprintf(&b, `<dc:title>%s</dc:title>`, esc(title))
+	b.WriteString(`<upnp:class>object.item.videoItem</upnp:class>`)
+	fmt.Fprintf(&b, `<res protocolInfo="http-get:*:%s:*">%s</res>`, esc(media.MimeType), esc(media.URL))
+	b.WriteString(`</item></DIDL-Lite>`)
+	return b.String()
+}
+
+func formatTime(seconds float64) string {
+	total := int(seconds)
+	return fmt.Sprintf("%02d:%02d:%02d", total/3600, (total/60)%60, total%60)
+}
+
+// parseTime reads H+:MM:SS[.F+] durations; NOT_IMPLEMENTED and other
+// placeholders parse as zero.
+func parseTime(s string) float64 {
+	parts := strings.Split(strings.TrimSpace(s), ":")
+	if len(parts) != 3 {
+		return 0
+	}
+	var total float64
+	for i, p := range parts {
+		v, err := strconv.ParseFloat(p, 64)
+		if err != nil {
+			return 0
+		}
+		switch i {
+		case 0:
+			total += v * 3600
+		case 1:
+			total += v * 60
+		default:
+			total += v
+		}
+	}
+	return total
+}
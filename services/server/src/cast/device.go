@@ -0,0 +1,159 @@
+package cast
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	AVTransportService      = "urn:schemas-upnp-org:service:AVTransport:1"
+	RenderingControlService = "urn:schemas-upnp-org:service:RenderingControl:1"
+	MediaRendererDevice     = "urn:schemas-upnp-org:device:MediaRenderer:1"
+
+	maxDescriptionSize = 1 << 20
+)
+
+// Device is a UPnP MediaRenderer that exposes an AVTransport service.
+type Device struct {
+	ID             string    `json:"id"`
+	Name           string    `json:"name"`
+	Manufacturer   string    `json:"manufacturer,omitempty"`
+	Model          string    `json:"model,omitempty"`
+	Location       string    `json:"location"`
+	SupportsVolume bool      `json:"supportsVolume"`
+	LastSeen       time.Time `json:"lastSeen"`
+
+	avTransportURL      string
+	renderingControlURL string
+}
+
+// Host returns the host:port the renderer's description was served from.
+func (d *Device) Host() string {
+	u, err := url.Parse(d.Location)
+	if err != nil {
+		return ""
+	}
+	return u.Host
+}
+
+type deviceDescription struct {
+	URLBase string     `xml:"URLBase"`
+	Device  descDevice `xml:"device"`
+}
+
+type descDevice struct {
+	DeviceType   string        `xml:"deviceType"`
+	FriendlyName string        `xml:"friendlyName"`
+	Manufacturer string        `xml:"manufacturer"`
+	ModelName    string        `xml:"modelName"`
+	UDN          string        `xml:"UDN"`
+	Services     []descService `xml:"serviceList>service"`
+	Devices      []descDevice  `xml:"deviceList>device"`
+}
+
+type descService struct {
+	ServiceType string `xml:"serviceType"`
+	ControlURL  string `xml:"controlURL"`
+}
+
+// FetchDevice downloads and parses a device description. Renderers are often
+// embedded devices inside a root device, so the whole tree is searched for an
+// AVTransport service.
+func FetchDevice(ctx context.Context, client *http.Client, location string) (*Device, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, location, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("device description %s: status %d", location, resp.StatusCode)
+	}
+
+	var desc deviceDescription
+	if err := xml.NewDecoder(io.LimitReader(resp.Body, maxDescriptionSize)).Decode(&desc); err != nil {
+		return nil, fmt.Errorf("device description %s: %w", location, err)
+	}
+
+	base := location
+	if strings.TrimSpace(desc.URLBase) != "" {
+		base = strings.TrimSpace(desc.URLBase)
+	}
+	baseURL, err := url.Parse(base)
+	if err != nil {
+		return nil, fmt.Errorf("device description %s: bad base URL: %w", location, err)
+	}
+
+	dd, avt := findService(desc.Device, AVTransportService)
+	if dd == nil {
+		return nil, fmt.Errorf("device %s has no AVTransport service", location)
+	}
+
+	dev := &Device{
+		ID:           strings.TrimSpace(dd.UDN),
+		Name:         strings.TrimSpace(dd.FriendlyName),
+		Manufacturer: strings.TrimSpace(dd.Manufacturer),
+		Model:        strings.TrimSpace(dd.ModelName),
+		Location:     location,
+		LastSeen:     time.Now(),
+	}
+	if dev.ID == "" {
+		dev.ID = location
+	}
+	if dev.Name == "" {
+		dev.Name = dev.Host()
+	}
+	dev.avTransportURL = resolveURL(baseURL, avt.ControlURL)
+	for _, svc := range dd.Services {
+		if serviceMatches(svc.ServiceType, RenderingControlService) {
+			dev.renderingControlURL = resolveURL(baseURL, svc.ControlURL)
+			dev.SupportsVolume = true
+			break
+		}
+	}
+	return dev, nil
+}
+
+func findService(d descDevice, serviceType string) (*descDevice, *descService) {
+	for i := range d.Services {
+		if serviceMatches(d.Services[i].ServiceType, serviceType) {
+			return &d, &d.Services[i]
+		}
+	}
+	for _, child := range d.Devices {
+		if dd, svc := findService(child, serviceType); dd != nil {
+			return dd, svc
+		}
+	}
+	return nil, nil
+}
+
+// serviceMatches compares service types ignoring the version suffix so
+// AVTransport:2 renderers are accepted as well.
+func serviceMatches(have, want string) bool {
+	trim := func(s string) string {
+		s = strings.TrimSpace(s)
+		if i := strings.LastIndex(s, ":"); i > 0 {
+			return s[:i]
+		}
+		return s
+	}
+	return strings.EqualFold(trim(have), trim(want))
+}
+
+func resolveURL(base *url.URL, ref string) string {
+	u, err := url.Parse(strings.TrimSpace(ref))
+	if err != nil {
+		return ""
+	}
+	return base.ResolveReference(u).String()
+}
@@ -0,0 +1,257 @@
+package cast
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	ssdpMulticastAddr = "239.255.255.250:1900"
+	defaultScanWindow = 3 * time.Second
+	// Cached scan results are reused for this long unless a refresh is asked for.
+	deviceCacheTTL = time.Minute
+)
+
+var ErrDeviceNotFound = errors.New("cast device not found")
+
+// Discoverer finds renderers with SSDP M-SEARCH.
+type Discoverer struct {
+	// Addr is where M-SEARCH requests are sent. Defaults to the SSDP
+	// multicast group.
+	Addr string
+	// Window is how long to collect responses.
+	Window time.Duration
+	Client *http.Client
+}
+
+// Discover searches for AVTransport renderers and returns the ones whose
+// description could be fetched.
+func (d *Discoverer) Discover(ctx context.Context) ([]*Device, error) {
+	addr := d.Addr
+	if addr == "" {
+		addr = ssdpMulticastAddr
+	}
+	window := d.Window
+	if window <= 0 {
+		window = defaultScanWindow
+	}
+	client := d.Client
+	if client == nil {
+		client = &http.Client{Timeout: 5 * time.Second}
+	}
+
+	dst, err := net.ResolveUDPAddr("udp4", addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		return nil, fmt.Errorf("ssdp listen: %w", err)
+	}
+	defer conn.Close()
+
+	mx := int(window / time.Second)
+	if mx < 1 {
+		mx = 1
+	}
+	search := []byte(fmt.Sprintf("M-SEARCH * HTTP/1.1\r\n"+
+		"HOST: %s\r\n"+
+		"MAN: \"ssdp:discover\"\r\n"+
+		"MX: %d\r\n"+
+		"ST: %s\r\n"+
+		"USER-AGENT: Raffi/1.0 UPnP/1.1\r\n\r\n", ssdpMulticastAddr, mx, AVTransportService))
+	// SSDP is UDP; send a couple of times in case one is dropped.
+	for i := 0; i < 2; i++ {
+		if _, err := conn.WriteToUDP(search, dst); err != nil {
+			return nil, fmt.Errorf("ssdp search: %w", err)
+		}
+	}
+
+	deadline := time.Now().Add(window)
+	if dl, ok := ctx.Deadline(); ok && dl.Before(deadline) {
+		deadline = dl
+	}
+	_ = conn.SetReadDeadline(deadline)
+
+	locations := make(map[string]struct{})
+	buf := make([]byte, 8192)
+	for {
+		n, _, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			break
+		}
+		if loc := parseSearchResponse(buf[:n]); loc != "" {
+			locations[loc] = struct{}{}
+		}
+	}
+
+	var (
+		mu      sync.Mutex
+		wg      sync.WaitGroup
+		devices = make(map[string]*Device)
+	)
+	for loc := range locations {
+		wg.Add(1)
+		go func(loc string) {
+			defer wg.Done()
+			dev, err := FetchDevice(ctx, client, loc)
+			if err != nil {
+				log.Printf("cast: skipping %s: %v", loc, err)
+				return
+			}
+			mu.Lock()
+			devices[dev.ID] = dev
+			mu.Unlock()
+		}(loc)
+	}
+	wg.Wait()
+
+	out := make([]*Device, 0, len(devices))
+	for _, dev := range devices {
+		out = append(out, dev)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out, nil
+}
+
+// parseSearchResponse returns the LOCATION of an M-SEARCH response for an
+// AVTransport or MediaRenderer search target.
+func parseSearchResponse(data []byte) string {
+	resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(data)), nil)
+	if err != nil {
+		return ""
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return ""
+	}
+	st := resp.Header.Get("ST")
+	if st != "" && !serviceMatches(st, AVTransportService) && !serviceMatches(st, MediaRendererDevice) {
+		return ""
+	}
+	loc := strings.TrimSpace(resp.Header.Get("LOCATION"))
+	if !strings.HasPrefix(loc, "http://") && !strings.HasPrefix(loc, "https://") {
+		return ""
+	}
+	return loc
+}
+
+// Manager caches discovered renderers between scans.
+type Manager struct {
+	discoverer *Discoverer
+
+	mu       sync.Mutex
+	devices  map[string]*Device
+	scanned  time.Time
+	scanning chan struct{}
+}
+
+func NewManager(d *Discoverer) *Manager {
+	if d == nil {
+		d = &Discoverer{}
+	}
+	return &Manager{discoverer: d, devices: make(map[string]*Device)}
+}
+
+// Devices returns known renderers, scanning when the cache is stale or
+// refresh is set. Concurrent callers share one scan.
+func (m *Manager) Devices(ctx context.Context, refresh bool) ([]*Device, error) {
+	m.mu.Lock()
+	if !refresh && !m.scanned.IsZero() && time.Since(m.scanned) < deviceCacheTTL {
+		out := m.listLocked()
+		m.mu.Unlock()
+		return out, nil
+	}
+	if wait := m.scanning; wait != nil {
+		m.mu.Unlock()
+		select {
+		case <-wait:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		return m.listLocked(), nil
+	}
+	done := make(chan struct{})
+	m.scanning = done
+	m.mu.Unlock()
+
+	found, err := m.discoverer.Discover(ctx)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.scanning = nil
+	close(done)
+	if err != nil {
+		return nil, err
+	}
+	for _, dev := range found {
+		m.devices[dev.ID] = dev
+	}
+	// Drop renderers that have not answered for a while.
+	for id, dev := range m.devices {
+		if time.Since(dev.LastSeen) > 10*deviceCacheTTL {
+			delete(m.devices, id)
+		}
+	}
+	m.scanned = time.Now()
+	return m.listLocked(), nil
+}
+
+// Device looks a renderer up by ID, rescanning once if it is unknown.
+func (m *Manager) Device(ctx context.Context, id string) (*Device, error) {
+	m.mu.Lock()
+	dev, ok := m.devices[id]
+	m.mu.Unlock()
+	if ok {
+		return dev, nil
+	}
+	if _, err := m.Devices(ctx, true); err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if dev, ok := m.devices[id]; ok {
+		return dev, nil
+	}
+	return nil, ErrDeviceNotFound
+}
+
+func (m *Manager) listLocked() []*Device {
+	out := make([]*Device, 0, len(m.devices))
+	for _, dev := range m.devices {
+		out = append(out, dev)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+// LocalAddrFor returns the local IP this host would use to reach a renderer,
+// which is the address the renderer has to fetch media from.
+func LocalAddrFor(host string) (net.IP, error) {
+	h, port, err := net.SplitHostPort(host)
+	if err != nil {
+		h, port = host, "80"
+	}
+	conn, err := net.Dial("udp", net.JoinHostPort(h, port))
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	addr, ok := conn.LocalAddr().(*net.UDPAddr)
+	if !ok {
+		return nil, fmt.Errorf("unexpected local address %v", conn.LocalAddr())
+	}
+	return addr.IP, nil
+}
@@ -0,0 +1,281 @@
+package lan
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	ServiceType = "_raffi._tcp"
+	mdnsTTL     = 120
+)
+
+var mdnsGroup = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353}
+
+// Advertiser answers DNS-SD queries for the Raffi service over multicast DNS
+// so LAN clients can discover the server without typing an address.
+type Advertiser struct {
+	conn     *net.UDPConn
+	instance dnsmessage.Name
+	service  dnsmessage.Name
+	host     dnsmessage.Name
+	port     uint16
+	txt      []string
+
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+// Advertise starts answering queries for instance._raffi._tcp.local. and
+// sends an initial round of unsolicited announcements.
+func Advertise(instance string, port int, txt map[string]string) (*Advertiser, error) {
+	if port <= 0 || port > 65535 {
+		return nil, fmt.Errorf("invalid port %d", port)
+	}
+	conn, err := net.ListenMulticastUDP("udp4", nil, mdnsGroup)
+	if err != nil {
+		return nil, fmt.Errorf("mdns listen: %w", err)
+	}
+
+	hostname, _ := os.Hostname()
+	hostLabel := sanitizeLabel(strings.Split(hostname, ".")[0])
+	if hostLabel == "" {
+		hostLabel = "raffi"
+	}
+	instance = sanitizeInstance(instance)
+	if instance == "" {
+		instance = "Raffi on " + hostLabel
+	}
+
+	a := &Advertiser{
+		conn:     conn,
+		instance: mustName(escapeInstance(instance) + "." + ServiceType + ".local."),
+		service:  mustName(ServiceType + ".local."),
+		host:     mustName(hostLabel + ".local."),
+		port:     uint16(port),
+		done:     make(chan struct{}),
+	}
+	for k, v := range txt {
+		a.txt = append(a.txt, k+"="+v)
+	}
+	if len(a.txt) == 0 {
+		a.txt = []string{""}
+	}
+
+	go a.serve()
+	go a.announce()
+	return a, nil
+}
+
+func (a *Advertiser) Close() {
+	a.closeOnce.Do(func() {
+		close(a.done)
+		if msg, err := a.response(0, nil); err == nil {
+			_, _ = a.conn.WriteToUDP(msg, mdnsGroup)
+		}
+		_ = a.conn.Close()
+	})
+}
+
+func (a *Advertiser) announce() {
+	for i := 0; i < 3; i++ {
+		if msg, err := a.response(mdnsTTL, nil); err == nil {
+			if _, err := a.conn.WriteToUDP(msg, mdnsGroup); err != nil {
+				log.Printf("mdns announce failed: %v", err)
+			}
+		}
+		select {
+		case <-a.done:
+			return
+		case <-time.After(time.Duration(1<<i) * time.Second):
+		}
+	}
+}
+
+func (a *Advertiser) serve() {
+	buf := make([]byte, 9000)
+	for {
+		n, from, err := a.conn.ReadFromUDP(buf)
+		if err != nil {
+			select {
+			case <-a.done:
+				return
+			default:
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+
+		var p dnsmessage.Parser
+		hdr, err := p.Start(buf[:n])
+		if err != nil || hdr.Response {
+			continue
+		}
+		questions, err := p.AllQuestions()
+		if err != nil {
+			continue
+		}
+		var matched []dnsmessage.Question
+		unicast := false
+		for _, q := range questions {
+			if a.answers(q) {
+				matched = append(matched, q)
+				// The top bit of the class requests a unicast response.
+				if q.Class&(1<<15) != 0 {
+					unicast = true
+				}
+			}
+		}
+		if len(matched) == 0 {
+			continue
+		}
+		msg, err := a.response(mdnsTTL, matched)
+		if err != nil {
+			continue
+		}
+		dst := mdnsGroup
+		if unicast || from.Port != mdnsGroup.Port {
+			dst = from
+		}
+		_, _ = a.conn.WriteToUDP(msg, dst)
+	}
+}
+
+func (a *Advertiser) answers(q dnsmessage.Question) bool {
+	name := strings.ToLower(q.Name.String())
+	switch q.Type {
+	case dnsmessage.TypePTR:
+		return name == strings.ToLower(a.service.String()) || name == "_services._dns-sd._udp.local."
+	case dnsmessage.TypeSRV, dnsmessage.TypeTXT:
+		return name == strings.ToLower(a.instance.String())
+	case dnsmessage.TypeA, dnsmessage.TypeAAAA:
+		return name == strings.ToLower(a.host.String())
+	case dnsmessage.TypeALL:
+		return name == strings.ToLower(a.instance.String()) || name == strings.ToLower(a.service.String())
+	}
+	return false
+}
+
+// response builds an authoritative answer carrying the full service record
+// set. Sending everything keeps clients from needing follow-up queries.
+func (a *Advertiser) response(ttl uint32, questions []dnsmessage.Question) ([]byte, error) {
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{Response: true, Authoritative: true})
+	b.EnableCompression()
+	if err := b.StartAnswers(); err != nil {
+		return nil, err
+	}
+
+	// Cache-flush bit for the records this host owns exclusively.
+	flush := dnsmessage.Class(1<<15) | dnsmessage.ClassINET
+	hdr := func(name dnsmessage.Name, class dnsmessage.Class) dnsmessage.ResourceHeader {
+		return dnsmessage.ResourceHeader{Name: name, Class: class, TTL: ttl}
+	}
+
+	enumerating := false
+	for _, q := range questions {
+		if strings.EqualFold(q.Name.String(), "_services._dns-sd._udp.local.") {
+			enumerating = true
+		}
+	}
+	if enumerating {
+		if err := b.PTRResource(hdr(mustName("_services._dns-sd._udp.local."), dnsmessage.ClassINET), dnsmessage.PTRResource{PTR: a.service}); err != nil {
+			return nil, err
+		}
+	}
+	if err := b.PTRResource(hdr(a.service, dnsmessage.ClassINET), dnsmessage.PTRResource{PTR: a.instance}); err != nil {
+		return nil, err
+	}
+	if err := b.SRVResource(hdr(a.instance, flush), dnsmessage.SRVResource{Target: a.host, Port: a.port}); err != nil {
+		return nil, err
+	}
+	if err := b.TXTResource(hdr(a.instance, flush), dnsmessage.TXTResource{TXT: a.txt}); err != nil {
+		return nil, err
+	}
+	for _, ip := range LocalAddrs() {
+		if v4 := ip.To4(); v4 != nil {
+			var addr [4]byte
+			copy(addr[:], v4)
+			if err := b.AResource(hdr(a.host, flush), dnsmessage.AResource{A: addr}); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		var addr [16]byte
+		copy(addr[:], ip.To16())
+		if err := b.AAAAResource(hdr(a.host, flush), dnsmessage.AAAAResource{AAAA: addr}); err != nil {
+			return nil, err
+		}
+	}
+	return b.Finish()
+}
+
+// LocalAddrs returns the unicast addresses of all up, non-loopback interfaces.
+func LocalAddrs() []net.IP {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil
+	}
+	var out []net.IP
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			ipNet, ok := addr.(*net.IPNet)
+			if !ok || ipNet.IP.IsLoopback() || ipNet.IP.IsMulticast() {
+				continue
+			}
+			if ipNet.IP.To4() == nil && !ipNet.IP.IsLinkLocalUnicast() && !ipNet.IP.IsPrivate() {
+				// Skip global IPv6 addresses; they are not useful for LAN discovery.
+				continue
+			}
+			out = append(out, ipNet.IP)
+		}
+	}
+	return out
+}
+
+func mustName(s string) dnsmessage.Name {
+	n, err := dnsmessage.NewName(s)
+	if err != nil {
+		return dnsmessage.MustNewName("raffi.local.")
+	}
+	return n
+}
+
+func sanitizeLabel(s string) string {
+	var b strings.Builder
+	for _, r := range strings.ToLower(s) {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') || r == '-' {
+			b.WriteRune(r)
+		}
+	}
+	return strings.Trim(b.String(), "-")
+}
+
+func sanitizeInstance(s string) string {
+	s = strings.TrimSpace(s)
+	if len(s) > 63 {
+		s = s[:63]
+	}
+	return s
+}
+
+// escapeInstance keeps the instance name a single DNS label.
+func escapeInstance(s string) string {
+	return strings.ReplaceAll(s, ".", "-")
+}
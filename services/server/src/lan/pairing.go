@@ -0,0 +1,283 @@
+package lan
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	pairingCodeTTL      = 5 * time.Minute
+	pairingCodeDigits   = 6
+	maxClaimFailures    = 10
+	claimFailureWindow  = time.Minute
+	ScopePlayback       = "playback"
+	devicesFileName     = "lan-devices.json"
+	deviceTokenByteSize = 32
+)
+
+var (
+	ErrInvalidCode   = errors.New("invalid or expired pairing code")
+	ErrRateLimited   = errors.New("too many failed pairing attempts, try again later")
+	ErrUnknownDevice = errors.New("device not found")
+)
+
+type Device struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	Scopes    []string  `json:"scopes"`
+	PairedAt  time.Time `json:"pairedAt"`
+	LastSeen  time.Time `json:"lastSeen"`
+	tokenHash string
+}
+
+type PairingCode struct {
+	Code      string    `json:"code"`
+	ExpiresAt time.Time `json:"expiresAt"`
+	Scopes    []string  `json:"scopes"`
+}
+
+// Pairing issues short-lived pairing codes and the device tokens they are
+// exchanged for. Paired devices are persisted so they survive restarts;
+// only a hash of each token is stored.
+type Pairing struct {
+	mu       sync.Mutex
+	codes    map[string]PairingCode
+	devices  map[string]*Device
+	byToken  map[string]*Device
+	failures []time.Time
+	path     string
+}
+
+func NewPairing(stateDir string) *Pairing {
+	p := &Pairing{
+		codes:   make(map[string]PairingCode),
+		devices: make(map[string]*Device),
+		byToken: make(map[string]*Device),
+	}
+	if stateDir != "" {
+		p.path = filepath.Join(stateDir, devicesFileName)
+		if err := p.load(); err != nil && !errors.Is(err, os.ErrNotExist) {
+			log.Printf("lan: failed to load paired devices: %v", err)
+		}
+	}
+	return p
+}
+
+// NewCode creates a pairing code valid for a few minutes.
+func (p *Pairing) NewCode(scopes []string) (PairingCode, error) {
+	if len(scopes) == 0 {
+		scopes = []string{ScopePlayback}
+	}
+	max := big.NewInt(1)
+	for i := 0; i < pairingCodeDigits; i++ {
+		max.Mul(max, big.NewInt(10))
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.pruneLocked()
+
+	for attempt := 0; attempt < 10; attempt++ {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return PairingCode{}, err
+		}
+		code := fmt.Sprintf("%0*d", pairingCodeDigits, n)
+		if _, exists := p.codes[code]; exists {
+			continue
+		}
+		pc := PairingCode{Code: code, ExpiresAt: time.Now().Add(pairingCodeTTL), Scopes: scopes}
+		p.codes[code] = pc
+		return pc, nil
+	}
+	return PairingCode{}, errors.New("failed to allocate pairing code")
+}
+
+// Claim exchanges a pairing code for a device token. The token is only
+// returned once.
+func (p *Pairing) Claim(code, name string) (*Device, string, error) {
+	code = strings.TrimSpace(code)
+	name = strings.TrimSpace(name)
+	if name == "" {
+		name = "Unnamed device"
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.pruneLocked()
+
+	if len(p.failures) >= maxClaimFailures {
+		return nil, "", ErrRateLimited
+	}
+	pc, ok := p.codes[code]
+	if !ok {
+		p.failures = append(p.failures, time.Now())
+		return nil, "", ErrInvalidCode
+	}
+	delete(p.codes, code)
+
+	token, err := randomHex(deviceTokenByteSize)
+	if err != nil {
+		return nil, "", err
+	}
+	id, err := randomHex(8)
+	if err != nil {
+		return nil, "", err
+	}
+	dev := &Device{
+		ID:        id,
+		Name:      name,
+		Scopes:    pc.Scopes,
+		PairedAt:  time.Now(),
+		tokenHash: hashToken(token),
+	}
+	p.devices[id] = dev
+	p.byToken[dev.tokenHash] = dev
+	p.saveLocked()
+
+	copyDev := *dev
+	return &copyDev, token, nil
+}
+
+// Authenticate returns the device a token belongs to.
+func (p *Pairing) Authenticate(token string) (*Device, bool) {
+	if token == "" {
+		return nil, false
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	dev, ok := p.byToken[hashToken(token)]
+	if !ok {
+		return nil, false
+	}
+	dev.LastSeen = time.Now()
+	copyDev := *dev
+	return &copyDev, true
+}
+
+func (p *Pairing) Devices() []Device {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	out := make([]Device, 0, len(p.devices))
+	for _, d := range p.devices {
+		out = append(out, *d)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].PairedAt.Before(out[j].PairedAt) })
+	return out
+}
+
+func (p *Pairing) Revoke(id string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	dev, ok := p.devices[id]
+	if !ok {
+		return ErrUnknownDevice
+	}
+	delete(p.devices, id)
+	delete(p.byToken, dev.tokenHash)
+	p.saveLocked()
+	return nil
+}
+
+func (d *Device) HasScope(scope string) bool {
+	for _, s := range d.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *Pairing) pruneLocked() {
+	now := time.Now()
+	for code, pc := range p.codes {
+		if now.After(pc.ExpiresAt) {
+			delete(p.codes, code)
+		}
+	}
+	kept := p.failures[:0]
+	for _, t := range p.failures {
+		if now.Sub(t) < claimFailureWindow {
+			kept = append(kept, t)
+		}
+	}
+	p.failures = kept
+}
+
+type persistedDevice struct {
+	Device
+	TokenHash string `json:"tokenHash"`
+}
+
+func (p *Pairing) load() error {
+	data, err := os.ReadFile(p.path)
+	if err != nil {
+		return err
+	}
+	var stored []persistedDevice
+	if err := json.Unmarshal(data, &stored); err != nil {
+		return err
+	}
+	for _, sd := range stored {
+		if sd.ID == "" || sd.TokenHash == "" {
+			continue
+		}
+		dev := sd.Device
+		dev.tokenHash = sd.TokenHash
+		p.devices[dev.ID] = &dev
+		p.byToken[dev.tokenHash] = &dev
+	}
+	return nil
+}
+
+func (p *Pairing) saveLocked() {
+	if p.path == "" {
+		return
+	}
+	stored := make([]persistedDevice, 0, len(p.devices))
+	for _, d := range p.devices {
+		stored = append(stored, persistedDevice{Device: *d, TokenHash: d.tokenHash})
+	}
+	data, err := json.MarshalIndent(stored, "", "  ")
+	if err != nil {
+		log.Printf("lan: failed to encode paired devices: %v", err)
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(p.path), 0o700); err != nil {
+		log.Printf("lan: failed to create state dir: %v", err)
+		return
+	}
+	tmp := p.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		log.Printf("lan: failed to write paired devices: %v", err)
+		return
+	}
+	if err := os.Rename(tmp, p.path); err != nil {
+		log.Printf("lan: failed to save paired devices: %v", err)
+	}
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
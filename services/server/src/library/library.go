@@ -0,0 +1,551 @@
+package library
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"raffi-server/src/session"
+	"raffi-server/src/source"
+	"raffi-server/src/stream/hls"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	indexFileName  = "library.json"
+	probeTimeout   = 45 * time.Second
+	probeWorkers   = 2
+	DefaultPollGap = 2 * time.Minute
+)
+
+var ErrScanInProgress = errors.New("library scan already in progress")
+
+// ProbeFunc matches hls.NewProbeDuration.
+type ProbeFunc func(ctx context.Context, source string) (*hls.Metadata, string, error)
+
+// Item is one media file in the library.
+type Item struct {
+	ID   string `json:"id"`
+	Path string `json:"path"`
+	Root string `json:"root"`
+	ParsedName
+	Size       int64                `json:"size"`
+	ModTime    time.Time            `json:"modTime"`
+	AddedAt    time.Time            `json:"addedAt"`
+	Duration   float64              `json:"durationSeconds,omitempty"`
+	VideoCodec string               `json:"videoCodec,omitempty"`
+	Streams    []session.StreamInfo `json:"streams,omitempty"`
+	Chapters   []session.Chapter    `json:"chapters,omitempty"`
+	Media      *session.MediaInfo   `json:"media,omitempty"`
+	ProbedAt   time.Time            `json:"probedAt,omitempty"`
+	ProbeError string               `json:"probeError,omitempty"`
+}
+
+type ScanResult struct {
+	Added      int   `json:"added"`
+	Updated    int   `json:"updated"`
+	Removed    int   `json:"removed"`
+	Total      int   `json:"total"`
+	DurationMs int64 `json:"durationMs"`
+}
+
+type Status struct {
+	Roots    []string    `json:"roots"`
+	Items    int         `json:"items"`
+	Scanning bool        `json:"scanning"`
+	LastScan time.Time   `json:"lastScan,omitempty"`
+	Last     *ScanResult `json:"lastResult,omitempty"`
+}
+
+// Library indexes media files under a set of root folders. The index is kept
+// on disk so restarts do not re-probe unchanged files.
+type Library struct {
+	probe     ProbeFunc
+	indexPath string
+
+	scanMu sync.Mutex
+
+	mu       sync.RWMutex
+	roots    []string
+	items    map[string]*Item
+	scanning bool
+	lastScan time.Time
+	last     *ScanResult
+}
+
+type persistedIndex struct {
+	Roots []string `json:"roots"`
+	Items []*Item  `json:"items"`
+}
+
+// New loads the persisted index from stateDir. Roots passed here take
+// precedence over persisted ones when non-empty.
+func New(stateDir string, roots []string, probe ProbeFunc) *Library {
+	l := &Library{
+		probe: probe,
+		items: make(map[string]*Item),
+	}
+	if stateDir != "" {
+		l.indexPath = filepath.Join(stateDir, indexFileName)
+		if err := l.load(); err != nil && !errors.Is(err, os.ErrNotExist) {
+			log.Printf("library: failed to load index: %v", err)
+		}
+	}
+	if len(roots) > 0 {
+		l.roots = cleanRoots(roots)
+	}
+	return l
+}
+
+func ItemID(path string) string {
+	sum := sha1.Sum([]byte(filepath.Clean(path)))
+	return hex.EncodeToString(sum[:8])
+}
+
+func (l *Library) Roots() []string {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return append([]string(nil), l.roots...)
+}
+
+// SetRoots replaces the library roots. Items outside the new roots are
+// dropped on the next scan.
+func (l *Library) SetRoots(roots []string) {
+	l.mu.Lock()
+	l.roots = cleanRoots(roots)
+	l.mu.Unlock()
+	l.save()
+}
+
+func (l *Library) Get(id string) (Item, bool) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	it, ok := l.items[id]
+	if !ok {
+		return Item{}, false
+	}
+	return *it, true
+}
+
+func (l *Library) Status() Status {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return Status{
+		Roots:    append([]string(nil), l.roots...),
+		Items:    len(l.items),
+		Scanning: l.scanning,
+		LastScan: l.lastScan,
+		Last:     l.last,
+	}
+}
+
+type fileEntry struct {
+	path string
+	root string
+	size int64
+	mod  time.Time
+}
+
+// Scan walks the roots, probes new or changed files and drops files that
+// disappeared. Unchanged files (same size and modification time) are kept
+// without probing, which makes repeated scans cheap enough to poll.
+func (l *Library) Scan(ctx context.Context) (ScanResult, error) {
+	if !l.scanMu.TryLock() {
+		return ScanResult{}, ErrScanInProgress
+	}
+	defer l.scanMu.Unlock()
+
+	started := time.Now()
+	l.mu.Lock()
+	l.scanning = true
+	roots := append([]string(nil), l.roots...)
+	l.mu.Unlock()
+	defer func() {
+		l.mu.Lock()
+		l.scanning = false
+		l.mu.Unlock()
+	}()
+
+	seen := make(map[string]fileEntry)
+	for _, root := range roots {
+		err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				if path == root {
+					return err
+				}
+				return nil
+			}
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			name := d.Name()
+			if d.IsDir() {
+				if path != root && strings.HasPrefix(name, ".") {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if strings.HasPrefix(name, ".") || !d.Type().IsRegular() || !source.IsMediaFile(name) {
+				return nil
+			}
+			info, err := d.Info()
+			if err != nil {
+				return nil
+			}
+			seen[ItemID(path)] = fileEntry{path: path, root: root, size: info.Size(), mod: info.ModTime()}
+			return nil
+		})
+		if err != nil {
+			if ctx.Err() != nil {
+				return ScanResult{}, ctx.Err()
+			}
+			log.Printf("library: cannot scan %s: %v", root, err)
+		}
+	}
+
+	var result ScanResult
+	var pending []fileEntry
+	l.mu.Lock()
+	for id := range l.items {
+		if _, ok := seen[id]; !ok {
+			delete(l.items, id)
+			result.Removed++
+		}
+	}
+	for id, fe := range seen {
+		it, ok := l.items[id]
+		// Items indexed before media info was recorded are probed again.
+		if ok && it.Size == fe.size && it.ModTime.Equal(fe.mod) && it.Root == fe.root && (it.Media != nil || it.ProbeError != "") {
+			continue
+		}
+		if ok {
+			result.Updated++
+		} else {
+			result.Added++
+		}
+		pending = append(pending, fe)
+	}
+	l.mu.Unlock()
+
+	l.probeAll(ctx, pending)
+
+	l.mu.Lock()
+	result.Total = len(l.items)
+	result.DurationMs = time.Since(started).Milliseconds()
+	l.lastScan = time.Now()
+	l.last = &result
+	l.mu.Unlock()
+	l.save()
+
+	if result.Added+result.Updated+result.Removed > 0 {
+		log.Printf("library: scan done (+%d ~%d -%d, %d items)", result.Added, result.Updated, result.Removed, result.Total)
+	}
+	return result, ctx.Err()
+}
+
+func (l *Library) probeAll(ctx context.Context, entries []fileEntry) {
+	jobs := make(chan fileEntry)
+	var wg sync.WaitGroup
+	for i := 0; i < probeWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for fe := range jobs {
+				it := l.buildItem(ctx, fe)
+				l.mu.Lock()
+				if prev, ok := l.items[it.ID]; ok {
+					it.AddedAt = prev.AddedAt
+				}
+				l.items[it.ID] = it
+				l.mu.Unlock()
+			}
+		}()
+	}
+	for _, fe := range entries {
+		if ctx.Err() != nil {
+			break
+		}
+		jobs <- fe
+	}
+	close(jobs)
+	wg.Wait()
+}
+
+func (l *Library) buildItem(ctx context.Context, fe fileEntry) *Item {
+	it := &Item{
+		ID:         ItemID(fe.path),
+		Path:       fe.path,
+		Root:       fe.root,
+		ParsedName: ParseName(fe.path),
+		Size:       fe.size,
+		ModTime:    fe.mod,
+		AddedAt:    time.Now(),
+	}
+	if l.probe == nil {
+		return it
+	}
+
+	pctx, cancel := context.WithTimeout(ctx, probeTimeout)
+	defer cancel()
+	meta, videoCodec, err := l.probe(pctx, fe.path)
+	it.ProbedAt = time.Now()
+	if err != nil {
+		it.ProbeError = err.Error()
+		return it
+	}
+	it.Duration = meta.Format.DurationSeconds
+	it.Media = meta.MediaInfo()
+	for _, st := range meta.Streams {
+		if st.CodecType == "video" && it.VideoCodec == "" {
+			it.VideoCodec = st.CodecName
+		}
+	}
+	if it.VideoCodec == "" {
+		it.VideoCodec = videoCodec
+	}
+
+	audioCount, subCount := 0, 0
+	for _, st := range meta.Streams {
+		switch st.CodecType {
+		case "audio":
+			it.Streams = append(it.Streams, session.StreamInfo{
+				Index:    audioCount,
+				Type:     "audio",
+				Codec:    st.CodecName,
+				Language: st.Tags.Language,
+				Title:    st.Tags.Title,
+				Channels: st.Channels,
+			})
+			audioCount++
+		case "subtitle":
+			it.Streams = append(it.Streams, session.StreamInfo{
+				Index:    subCount,
+				Type:     "subtitle",
+				Codec:    st.CodecName,
+				Language: st.Tags.Language,
+				Title:    st.Tags.Title,
+			})
+			subCount++
+		}
+	}
+	for _, c := range meta.Chapters {
+		it.Chapters = append(it.Chapters, session.Chapter{
+			StartTime: c.StartTime,
+			EndTime:   c.EndTime,
+			Title:     c.Tags.Title,
+		})
+	}
+	return it
+}
+
+// Watch rescans the roots every interval until ctx is cancelled. Scans only
+// stat files, so polling stays cheap; new and modified files are probed.
+func (l *Library) Watch(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		interval = DefaultPollGap
+	}
+	if _, err := l.Scan(ctx); err != nil && !errors.Is(err, ErrScanInProgress) && ctx.Err() == nil {
+		log.Printf("library: scan failed: %v", err)
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := l.Scan(ctx); err != nil && !errors.Is(err, ErrScanInProgress) && ctx.Err() == nil {
+				log.Printf("library: scan failed: %v", err)
+			}
+		}
+	}
+}
+
+// Query filters and sorts library items.
+type Query struct {
+	Search string
+	Kind   string
+	// Sort is one of title, added, year, duration, size, modified.
+	Sort   string
+	Desc   bool
+	Offset int
+	Limit  int
+}
+
+// Query returns a page of matching items and the total match count.
+func (l *Library) Query(q Query) ([]Item, int) {
+	terms := strings.Fields(strings.ToLower(q.Search))
+
+	l.mu.RLock()
+	out := make([]Item, 0, len(l.items))
+	for _, it := range l.items {
+		if q.Kind != "" && it.Kind != q.Kind {
+			continue
+		}
+		if len(terms) > 0 {
+			hay := strings.ToLower(it.Title + " " + filepath.Base(it.Path))
+			match := true
+			for _, t := range terms {
+				if !strings.Contains(hay, t) {
+					match = false
+					break
+				}
+			}
+			if !match {
+				continue
+			}
+		}
+		out = append(out, *it)
+	}
+	l.mu.RUnlock()
+
+	less := sortFunc(q.Sort)
+	sort.SliceStable(out, func(i, j int) bool {
+		if q.Desc {
+			return less(out[j], out[i])
+		}
+		return less(out[i], out[j])
+	})
+
+	total := len(out)
+	if q.Offset > total {
+		q.Offset = total
+	}
+	out = out[q.Offset:]
+	if q.Limit > 0 && q.Limit < len(out) {
+		out = out[:q.Limit]
+	}
+	return out, total
+}
+
+func sortFunc(key string) func(a, b Item) bool {
+	byTitle := func(a, b Item) bool {
+		at, bt := strings.ToLower(a.Title), strings.ToLower(b.Title)
+		if at != bt {
+			return at < bt
+		}
+		if a.Season != b.Season {
+			return a.Season < b.Season
+		}
+		if a.Episode != b.Episode {
+			return a.Episode < b.Episode
+		}
+		return a.Path < b.Path
+	}
+	switch key {
+	case "added":
+		return func(a, b Item) bool {
+			if !a.AddedAt.Equal(b.AddedAt) {
+				return a.AddedAt.Before(b.AddedAt)
+			}
+			return byTitle(a, b)
+		}
+	case "modified":
+		return func(a, b Item) bool {
+			if !a.ModTime.Equal(b.ModTime) {
+				return a.ModTime.Before(b.ModTime)
+			}
+			return byTitle(a, b)
+		}
+	case "year":
+		return func(a, b Item) bool {
+			if a.Year != b.Year {
+				return a.Year < b.Year
+			}
+			return byTitle(a, b)
+		}
+	case "duration":
+		return func(a, b Item) bool {
+			if a.Duration != b.Duration {
+				return a.Duration < b.Duration
+			}
+			return byTitle(a, b)
+		}
+	case "size":
+		return func(a, b Item) bool {
+			if a.Size != b.Size {
+				return a.Size < b.Size
+			}
+			return byTitle(a, b)
+		}
+	default:
+		return byTitle
+	}
+}
+
+func (l *Library) load() error {
+	data, err := os.ReadFile(l.indexPath)
+	if err != nil {
+		return err
+	}
+	var idx persistedIndex
+	if err := json.Unmarshal(data, &idx); err != nil {
+		return err
+	}
+	l.roots = cleanRoots(idx.Roots)
+	for _, it := range idx.Items {
+		if it != nil && it.ID != "" {
+			l.items[it.ID] = it
+		}
+	}
+	return nil
+}
+
+func (l *Library) save() {
+	if l.indexPath == "" {
+		return
+	}
+	l.mu.RLock()
+	idx := persistedIndex{Roots: append([]string(nil), l.roots...)}
+	for _, it := range l.items {
+		idx.Items = append(idx.Items, it)
+	}
+	data, err := json.Marshal(idx)
+	l.mu.RUnlock()
+	if err != nil {
+		log.Printf("library: failed to encode index: %v", err)
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(l.indexPath), 0o755); err != nil {
+		log.Printf("library: failed to create state dir: %v", err)
+		return
+	}
+	tmp := l.indexPath + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		log.Printf("library: failed to write index: %v", err)
+		return
+	}
+	if err := os.Rename(tmp, l.indexPath); err != nil {
+		log.Printf("library: failed to save index: %v", err)
+	}
+}
+
+func cleanRoots(roots []string) []string {
+	seen := make(map[string]struct{})
+	var out []string
+	for _, r := range roots {
+		r = strings.TrimSpace(r)
+		if r == "" {
+			continue
+		}
+		abs, err := filepath.Abs(r)
+		if err != nil {
+			continue
+		}
+		abs = filepath.Clean(abs)
+		if _, dup := seen[abs]; dup {
+			continue
+		}
+		seen[abs] = struct{}{}
+		out = append(out, abs)
+	}
+	return out
+}
@@ -0,0 +1,214 @@
+package library
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"raffi-server/src/stream/hls"
+)
+
+const probeJSON = `{
+	"format": {"duration": "1320.5", "format_name": "matroska,webm"},
+	"streams": [
+		{"index": 0, "codec_type": "video", "codec_name": "h264", "width": 1920, "height": 1080},
+		{"index": 1, "codec_type": "audio", "codec_name": "aac", "channels": 2, "tags": {"language": "eng"}},
+		{"index": 2, "codec_type": "audio", "codec_name": "ac3", "channels": 6, "tags": {"language": "jpn"}},
+		{"index": 3, "codec_type": "subtitle", "codec_name": "subrip", "tags": {"language": "eng", "title": "Full"}}
+	],
+	"chapters": [{"start_time": "0.0", "end_time": "90.0", "tags": {"title": "Intro"}}]
+}`
+
+// fakeProbe records the files it was asked to probe and fails for names
+// containing "broken".
+type fakeProbe struct {
+	mu     sync.Mutex
+	probed []string
+}
+
+func (f *fakeProbe) probe(_ context.Context, source string) (*hls.Metadata, string, error) {
+	f.mu.Lock()
+	f.probed = append(f.probed, source)
+	f.mu.Unlock()
+	if strings.Contains(source, "broken") {
+		return nil, "", errors.New("invalid data found when processing input")
+	}
+	var meta hls.Metadata
+	if err := json.Unmarshal([]byte(probeJSON), &meta); err != nil {
+		return nil, "", err
+	}
+	meta.Format.DurationSeconds = 1320.5
+	return &meta, "", nil
+}
+
+func (f *fakeProbe) take() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	out := f.probed
+	f.probed = nil
+	return out
+}
+
+func writeFile(t *testing.T, path string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte("media"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestScanIndexesMediaFiles(t *testing.T) {
+	root := t.TempDir()
+	writeFile(t, filepath.Join(root, "Movies", "Alien.1979.1080p.mkv"))
+	writeFile(t, filepath.Join(root, "TV", "Show", "Season 1", "01 - Pilot.mp4"))
+	writeFile(t, filepath.Join(root, "TV", "broken.S01E01.mkv"))
+	writeFile(t, filepath.Join(root, "Movies", "Alien.nfo"))
+	writeFile(t, filepath.Join(root, "Movies", ".hidden.mkv"))
+	writeFile(t, filepath.Join(root, ".trash", "Old.mkv"))
+
+	fp := &fakeProbe{}
+	l := New("", []string{root}, fp.probe)
+	res, err := l.Scan(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Added != 3 || res.Total != 3 {
+		t.Fatalf("scan result = %+v, want 3 added", res)
+	}
+
+	movie, ok := l.Get(ItemID(filepath.Join(root, "Movies", "Alien.1979.1080p.mkv")))
+	if !ok {
+		t.Fatal("movie not indexed")
+	}
+	if movie.Title != "Alien" || movie.Year != 1979 || movie.Kind != KindMovie {
+		t.Errorf("movie name = %+v", movie.ParsedName)
+	}
+	if movie.Duration != 1320.5 || movie.VideoCodec != "h264" || movie.Media == nil {
+		t.Errorf("movie probe data: duration %v, codec %q, media %v", movie.Duration, movie.VideoCodec, movie.Media)
+	}
+	var audio, subs int
+	for _, st := range movie.Streams {
+		switch st.Type {
+		case "audio":
+			if st.Index != audio {
+				t.Errorf("audio stream %+v has index %d, want %d", st, st.Index, audio)
+			}
+			audio++
+		case "subtitle":
+			subs++
+		}
+	}
+	if audio != 2 || subs != 1 {
+		t.Errorf("streams = %+v, want 2 audio and 1 subtitle", movie.Streams)
+	}
+	if len(movie.Chapters) != 1 || movie.Chapters[0].Title != "Intro" {
+		t.Errorf("chapters = %+v", movie.Chapters)
+	}
+
+	episode, _ := l.Get(ItemID(filepath.Join(root, "TV", "Show", "Season 1", "01 - Pilot.mp4")))
+	if episode.Title != "Show" || episode.Season != 1 || episode.Episode != 1 {
+		t.Errorf("episode name = %+v", episode.ParsedName)
+	}
+	broken, _ := l.Get(ItemID(filepath.Join(root, "TV", "broken.S01E01.mkv")))
+	if broken.ProbeError == "" {
+		t.Error("probe failure was not recorded")
+	}
+}
+
+func TestRescanProbesOnlyChanges(t *testing.T) {
+	root := t.TempDir()
+	keep := filepath.Join(root, "Keep.mkv")
+	change := filepath.Join(root, "Change.mkv")
+	remove := filepath.Join(root, "Remove.mkv")
+	broken := filepath.Join(root, "broken.mkv")
+	for _, f := range []string{keep, change, remove, broken} {
+		writeFile(t, f)
+	}
+
+	state := t.TempDir()
+	fp := &fakeProbe{}
+	l := New(state, []string{root}, fp.probe)
+	if _, err := l.Scan(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	fp.take()
+
+	later := time.Now().Add(time.Hour)
+	if err := os.Chtimes(change, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(remove); err != nil {
+		t.Fatal(err)
+	}
+	added := filepath.Join(root, "New.mkv")
+	writeFile(t, added)
+
+	// A restarted library loads the index and only probes what changed;
+	// files that failed to probe are not retried until they change.
+	l = New(state, nil, fp.probe)
+	res, err := l.Scan(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Added != 1 || res.Updated != 1 || res.Removed != 1 || res.Total != 4 {
+		t.Errorf("rescan result = %+v, want 1 added, 1 updated, 1 removed, 4 total", res)
+	}
+	probed := fp.take()
+	if len(probed) != 2 {
+		t.Fatalf("probed %v, want only the new and the changed file", probed)
+	}
+	for _, p := range probed {
+		if p != added && p != change {
+			t.Errorf("unchanged file %s was probed again", p)
+		}
+	}
+	if _, ok := l.Get(ItemID(remove)); ok {
+		t.Error("removed file is still indexed")
+	}
+}
+
+func TestQuery(t *testing.T) {
+	root := t.TempDir()
+	for _, name := range []string{
+		"Show.S01E02.mkv", "Show.S01E01.mkv", "Show.S02E01.mkv",
+		"Alien.1979.mkv", "Aliens.1986.mkv",
+	} {
+		writeFile(t, filepath.Join(root, name))
+	}
+	l := New("", []string{root}, nil)
+	if _, err := l.Scan(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	names := func(items []Item) string {
+		var out []string
+		for _, it := range items {
+			out = append(out, filepath.Base(it.Path))
+		}
+		return strings.Join(out, " ")
+	}
+
+	items, total := l.Query(Query{Kind: KindEpisode})
+	if total != 3 || names(items) != "Show.S01E01.mkv Show.S01E02.mkv Show.S02E01.mkv" {
+		t.Errorf("episodes = %d %s", total, names(items))
+	}
+	items, total = l.Query(Query{Search: "alien", Sort: "year", Desc: true})
+	if total != 2 || names(items) != "Aliens.1986.mkv Alien.1979.mkv" {
+		t.Errorf("search = %d %s", total, names(items))
+	}
+	items, total = l.Query(Query{Offset: 1, Limit: 2})
+	if total != 5 || len(items) != 2 || names(items) != "Aliens.1986.mkv Show.S01E01.mkv" {
+		t.Errorf("page = %d %s", total, names(items))
+	}
+	if items, total = l.Query(Query{Offset: 10}); total != 5 || len(items) != 0 {
+		t.Errorf("offset past the end = %d items of %d", len(items), total)
+	}
+}
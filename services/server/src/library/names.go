@@ -0,0 +1,125 @@
+package library
+
+import (
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	KindMovie   = "movie"
+	KindEpisode = "episode"
+)
+
+// ParsedName is what can be recovered from a release-style file name.
+type ParsedName struct {
+	Title   string `json:"title"`
+	Year    int    `json:"year,omitempty"`
+	Season  int    `json:"season,omitempty"`
+	Episode int    `json:"episode,omitempty"`
+	Kind    string `json:"kind"`
+}
+
+// Episode markers are delimited by anything but letters and digits rather than
+// \b, which does not split on the underscores in names like show_s01e02.
+var (
+	// S01E02, s1e2, S01.E02, S01E02E03 (first episode wins)
+	reSeasonEpisode = regexp.MustCompile(`(?i)(?:^|[^a-z0-9])s(\d{1,2})[ ._-]?e(\d{1,3})`)
+	// 1x02
+	reCrossEpisode = regexp.MustCompile(`(?i)(?:^|[^a-z0-9])(\d{1,2})x(\d{2,3})(?:$|[^a-z0-9])`)
+	// "Season 1" directory names
+	reSeasonDir = regexp.MustCompile(`(?i)^(?:season|series|staffel|saison)[ ._-]*(\d{1,2})$`)
+	// "Episode 5" / "Ep 5" / "E05" inside a season directory
+	reEpisodeOnly   = regexp.MustCompile(`(?i)\b(?:episode|ep|e)[ ._-]*(\d{1,3})\b`)
+	reLeadingNumber = regexp.MustCompile(`^\s*(\d{1,3})\b`)
+	reYear          = regexp.MustCompile(`\b(?:19|20)\d{2}\b`)
+	// Release tags that end the human-readable part of a name.
+	reReleaseTag = regexp.MustCompile(`(?i)[\[(. _-](?:2160p|1080p|1080i|720p|576p|480p|4k|uhd|hdr10?\+?|dv|bluray|blu-ray|bdrip|brrip|web-?dl|webrip|web|hdtv|dvdrip|remux|x264|x265|h\.?264|h\.?265|hevc|avc|aac\d?(?:\.\d)?|ac3|dts(?:-hd)?|ddp?\d?(?:\.\d)?|atmos|proper|repack|extended|unrated|remastered|multi|internal)(?:[\]). _-]|$)`)
+	reBrackets   = regexp.MustCompile(`\[[^\]]*\]`)
+	reSpaces     = regexp.MustCompile(`\s+`)
+)
+
+// ParseName extracts a title, year and season/episode numbers from a media
+// path. Parent directories are used when the file name alone does not carry
+// the show name, e.g. "Show/Season 2/05 - Title.mkv".
+func ParseName(path string) ParsedName {
+	base := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	dir := filepath.Dir(path)
+	parent := filepath.Base(dir)
+	grandparent := filepath.Base(filepath.Dir(dir))
+
+	p := ParsedName{Kind: KindMovie}
+
+	if m := reSeasonEpisode.FindStringSubmatchIndex(base); m != nil {
+		p.Kind = KindEpisode
+		p.Season = atoi(base[m[2]:m[3]])
+		p.Episode = atoi(base[m[4]:m[5]])
+		p.Title = cleanTitle(base[:m[0]])
+	} else if m := reCrossEpisode.FindStringSubmatchIndex(base); m != nil {
+		p.Kind = KindEpisode
+		p.Season = atoi(base[m[2]:m[3]])
+		p.Episode = atoi(base[m[4]:m[5]])
+		p.Title = cleanTitle(base[:m[0]])
+	} else if sm := reSeasonDir.FindStringSubmatch(parent); sm != nil {
+		p.Kind = KindEpisode
+		p.Season = atoi(sm[1])
+		if em := reEpisodeOnly.FindStringSubmatch(base); em != nil {
+			p.Episode = atoi(em[1])
+		} else if em := reLeadingNumber.FindStringSubmatch(base); em != nil {
+			p.Episode = atoi(em[1])
+		}
+		p.Title = cleanTitle(grandparent)
+	}
+
+	if p.Kind == KindEpisode {
+		if p.Title == "" {
+			// "Show/Season 1/S01E01.mkv" or "Show/S01E01.mkv"
+			if reSeasonDir.MatchString(parent) {
+				p.Title = cleanTitle(grandparent)
+			} else {
+				p.Title = cleanTitle(parent)
+			}
+		}
+		if y, rest := extractYear(p.Title); y != 0 && rest != "" {
+			p.Year, p.Title = y, rest
+		}
+		return p
+	}
+
+	p.Year, p.Title = extractYear(cleanTitle(base))
+	if p.Title == "" {
+		p.Title = cleanTitle(parent)
+	}
+	return p
+}
+
+// extractYear splits a trailing release year off a cleaned title. A title
+// that is only a year ("1917") is kept as the title.
+func extractYear(title string) (int, string) {
+	locs := reYear.FindAllStringIndex(title, -1)
+	if len(locs) == 0 {
+		return 0, title
+	}
+	start, end := locs[len(locs)-1][0], locs[len(locs)-1][1]
+	head := strings.TrimSpace(title[:start])
+	if head == "" {
+		return 0, title
+	}
+	return atoi(title[start:end]), strings.TrimRight(head, " -([")
+}
+
+func cleanTitle(s string) string {
+	if loc := reReleaseTag.FindStringIndex(s); loc != nil {
+		s = s[:loc[0]]
+	}
+	s = reBrackets.ReplaceAllString(s, " ")
+	s = strings.NewReplacer(".", " ", "_", " ").Replace(s)
+	s = reSpaces.ReplaceAllString(s, " ")
+	return strings.Trim(s, " -()[]")
+}
+
+func atoi(s string) int {
+	n, _ := strconv.Atoi(s)
+	return n
+}
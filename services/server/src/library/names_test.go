@@ -0,0 +1,57 @@
+package library
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestParseName(t *testing.T) {
+	tests := []struct {
+		path string
+		want ParsedName
+	}{
+		{"/media/Movies/The.Matrix.1999.1080p.BluRay.x264.mkv", ParsedName{Title: "The Matrix", Year: 1999, Kind: KindMovie}},
+		{"/media/Movies/Blade Runner 2049 (2017) [2160p].mkv", ParsedName{Title: "Blade Runner 2049", Year: 2017, Kind: KindMovie}},
+		{"/media/Movies/1917.mkv", ParsedName{Title: "1917", Kind: KindMovie}},
+		{"/media/Movies/Heat/movie.mkv", ParsedName{Title: "movie", Kind: KindMovie}},
+		{"/media/TV/Breaking.Bad.S01E02.720p.WEB-DL.mkv", ParsedName{Title: "Breaking Bad", Season: 1, Episode: 2, Kind: KindEpisode}},
+		{"/media/TV/the_office_s3e7_hdtv.avi", ParsedName{Title: "the office", Season: 3, Episode: 7, Kind: KindEpisode}},
+		{"/media/TV/Show.S02.E10.mkv", ParsedName{Title: "Show", Season: 2, Episode: 10, Kind: KindEpisode}},
+		{"/media/TV/Show S01E01E02.mkv", ParsedName{Title: "Show", Season: 1, Episode: 1, Kind: KindEpisode}},
+		{"/media/TV/Doctor.Who.2005.S10E01.mkv", ParsedName{Title: "Doctor Who", Year: 2005, Season: 10, Episode: 1, Kind: KindEpisode}},
+		{"/media/TV/Firefly 1x03 Bushwhacked.mkv", ParsedName{Title: "Firefly", Season: 1, Episode: 3, Kind: KindEpisode}},
+		{"/media/TV/firefly_1x04_hdtv.mkv", ParsedName{Title: "firefly", Season: 1, Episode: 4, Kind: KindEpisode}},
+		{"/media/TV/Twin Peaks/Season 2/05 - Cooper's Dreams.mkv", ParsedName{Title: "Twin Peaks", Season: 2, Episode: 5, Kind: KindEpisode}},
+		{"/media/TV/Dark/Staffel 1/Episode 4.mkv", ParsedName{Title: "Dark", Season: 1, Episode: 4, Kind: KindEpisode}},
+		{"/media/TV/Lost/Season 01/S01E05.mkv", ParsedName{Title: "Lost", Season: 1, Episode: 5, Kind: KindEpisode}},
+		{"/media/TV/Fargo/S03E04.mkv", ParsedName{Title: "Fargo", Season: 3, Episode: 4, Kind: KindEpisode}},
+		{"/media/TV/[Group] Anime Title - S01E12 [1080p].mkv", ParsedName{Title: "Anime Title", Season: 1, Episode: 12, Kind: KindEpisode}},
+	}
+	for _, tt := range tests {
+		t.Run(filepath.Base(tt.path), func(t *testing.T) {
+			if got := ParseName(filepath.FromSlash(tt.path)); got != tt.want {
+				t.Errorf("ParseName(%q) = %+v, want %+v", tt.path, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExtractYear(t *testing.T) {
+	tests := []struct {
+		title string
+		year  int
+		rest  string
+	}{
+		{"Alien 1979", 1979, "Alien"},
+		{"2001 A Space Odyssey 1968", 1968, "2001 A Space Odyssey"},
+		{"1917", 0, "1917"},
+		{"Amelie", 0, "Amelie"},
+		{"Dune (2021", 2021, "Dune"},
+	}
+	for _, tt := range tests {
+		year, rest := extractYear(tt.title)
+		if year != tt.year || rest != tt.rest {
+			t.Errorf("extractYear(%q) = %d, %q, want %d, %q", tt.title, year, rest, tt.year, tt.rest)
+		}
+	}
+}
@@ -0,0 +1,327 @@
+package party
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	writeWait      = 10 * time.Second
+	pongWait       = 60 * time.Second
+	pingPeriod     = (pongWait * 9) / 10
+	syncPeriod     = 10 * time.Second
+	maxMessageSize = 4096
+	sendBuffer     = 32
+	offsetSamples  = 8
+)
+
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+	// Origins are checked by the server's auth middleware before the upgrade.
+	CheckOrigin: func(*http.Request) bool { return true },
+}
+
+// inbound is any message a client sends. Host actions are play, pause, seek
+// and audio; every member may send sync, ping and drift.
+type inbound struct {
+	Type       string   `json:"type"`
+	Position   *float64 `json:"position,omitempty"`
+	AudioTrack *int     `json:"audioTrack,omitempty"`
+	ClientTime int64    `json:"clientTime,omitempty"`
+	ServerTime int64    `json:"serverTime,omitempty"`
+}
+
+type event struct {
+	Type      string       `json:"type"`
+	Action    string       `json:"action,omitempty"`
+	MemberID  string       `json:"memberId,omitempty"`
+	Name      string       `json:"name,omitempty"`
+	Role      string       `json:"role,omitempty"`
+	SessionID string       `json:"sessionId,omitempty"`
+	Code      string       `json:"code,omitempty"`
+	State     *State       `json:"state,omitempty"`
+	Members   []MemberInfo `json:"members,omitempty"`
+	Drift     *float64     `json:"drift,omitempty"`
+	// LocalTime is State.ServerTime translated to the receiver's clock using
+	// its measured offset, so followers can extrapolate the position with
+	// their own clock.
+	LocalTime  int64  `json:"localTime,omitempty"`
+	ServerTime int64  `json:"serverTime,omitempty"`
+	ClientTime int64  `json:"clientTime,omitempty"`
+	OffsetMs   *int64 `json:"offsetMs,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+type offsetSample struct {
+	offset int64
+	rtt    int64
+}
+
+type member struct {
+	id       string
+	name     string
+	role     string
+	joinedAt time.Time
+	send     chan []byte
+
+	mu      sync.Mutex
+	closed  bool
+	samples []offsetSample
+	offset  int64
+	rtt     int64
+	drift   float64
+}
+
+func (m *member) info() MemberInfo {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return MemberInfo{
+		ID:       m.id,
+		Name:     m.name,
+		Role:     m.role,
+		OffsetMs: m.offset,
+		RTTMs:    m.rtt,
+		Drift:    m.drift,
+		JoinedAt: m.joinedAt.UnixMilli(),
+	}
+}
+
+// toServerTime maps a timestamp from the member's clock to the server clock.
+func (m *member) toServerTime(clientTime int64) int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return clientTime - m.offset
+}
+
+func (m *member) setDrift(d float64) {
+	m.mu.Lock()
+	m.drift = d
+	m.mu.Unlock()
+}
+
+// recordSync updates the clock offset from a sync round trip. The sample with
+// the lowest round-trip time among the recent ones is the least skewed by
+// queueing, so that one wins.
+func (m *member) recordSync(sentAt, clientTime int64) int64 {
+	now := nowMillis()
+	rtt := now - sentAt
+	if rtt < 0 || rtt > 30_000 {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		return m.offset
+	}
+	sample := offsetSample{offset: clientTime - (sentAt + rtt/2), rtt: rtt}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.samples = append(m.samples, sample)
+	if len(m.samples) > offsetSamples {
+		m.samples = m.samples[len(m.samples)-offsetSamples:]
+	}
+	best := m.samples[0]
+	for _, s := range m.samples[1:] {
+		if s.rtt < best.rtt {
+			best = s
+		}
+	}
+	m.offset = best.offset
+	m.rtt = best.rtt
+	return m.offset
+}
+
+func (m *member) sendState(action string, st State) {
+	m.mu.Lock()
+	offset := m.offset
+	m.mu.Unlock()
+	m.sendEvent(event{Type: "state", Action: action, State: &st, LocalTime: st.ServerTime + offset})
+}
+
+// sendEvent queues a message without blocking. A member whose buffer is full
+// is too slow to keep in sync and gets disconnected.
+func (m *member) sendEvent(ev event) {
+	data, err := json.Marshal(ev)
+	if err != nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return
+	}
+	select {
+	case m.send <- data:
+	default:
+		log.Printf("party: dropping slow member %s", m.id)
+		m.closed = true
+		close(m.send)
+	}
+}
+
+func (m *member) closeSend() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.closed {
+		m.closed = true
+		close(m.send)
+	}
+}
+
+// Serve upgrades the request to a WebSocket and runs the connection as a room
+// member until either side closes it.
+func (r *Room) Serve(w http.ResponseWriter, req *http.Request, role, name string) error {
+	if role != RoleHost {
+		role = RoleFollower
+	}
+	name = strings.TrimSpace(name)
+	if name == "" {
+		name = role
+	}
+	if len(name) > 64 {
+		name = name[:64]
+	}
+
+	conn, err := upgrader.Upgrade(w, req, nil)
+	if err != nil {
+		// Upgrade has already written an HTTP error response.
+		return err
+	}
+
+	id, err := newMemberID()
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	mem := &member{
+		id:       id,
+		name:     name,
+		role:     role,
+		joinedAt: time.Now(),
+		send:     make(chan []byte, sendBuffer),
+	}
+
+	state, members, err := r.join(mem)
+	if err != nil {
+		_ = conn.WriteJSON(event{Type: "error", Error: err.Error()})
+		conn.Close()
+		return err
+	}
+	mem.sendEvent(event{
+		Type:       "welcome",
+		MemberID:   mem.id,
+		Role:       mem.role,
+		SessionID:  r.sessionID,
+		Code:       r.code,
+		State:      &state,
+		Members:    members,
+		ServerTime: nowMillis(),
+	})
+
+	go mem.writeLoop(conn)
+	mem.readLoop(conn, r)
+	r.leave(mem)
+	mem.closeSend()
+	return nil
+}
+
+func (m *member) readLoop(conn *websocket.Conn, r *Room) {
+	defer conn.Close()
+	conn.SetReadLimit(maxMessageSize)
+	_ = conn.SetReadDeadline(time.Now().Add(pongWait))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(pongWait))
+	})
+
+	for {
+		var msg inbound
+		if err := conn.ReadJSON(&msg); err != nil {
+			var syntaxErr *json.SyntaxError
+			var typeErr *json.UnmarshalTypeError
+			if errors.As(err, &syntaxErr) || errors.As(err, &typeErr) {
+				m.sendEvent(event{Type: "error", Error: "invalid message"})
+				continue
+			}
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseNormalClosure, websocket.CloseNoStatusReceived) {
+				log.Printf("party: member %s read error: %v", m.id, err)
+			}
+			return
+		}
+		_ = conn.SetReadDeadline(time.Now().Add(pongWait))
+
+		switch msg.Type {
+		case "sync":
+			offset := m.recordSync(msg.ServerTime, msg.ClientTime)
+			m.sendEvent(event{Type: "offset", OffsetMs: &offset})
+		case "ping":
+			m.sendEvent(event{Type: "pong", ClientTime: msg.ClientTime, ServerTime: nowMillis()})
+		case "drift":
+			r.reportDrift(m, msg)
+		case "play", "pause", "seek", "audio":
+			if err := r.apply(m, msg); err != nil {
+				m.sendEvent(event{Type: "error", Action: msg.Type, Error: err.Error()})
+			}
+		default:
+			m.sendEvent(event{Type: "error", Error: ErrUnknownAction.Error()})
+		}
+	}
+}
+
+// writeLoop owns all writes to the connection: queued events, keepalive
+// pings and periodic clock sync probes.
+func (m *member) writeLoop(conn *websocket.Conn) {
+	ping := time.NewTicker(pingPeriod)
+	syncTick := time.NewTicker(syncPeriod)
+	defer func() {
+		ping.Stop()
+		syncTick.Stop()
+		conn.Close()
+	}()
+
+	writeSync := func() error {
+		_ = conn.SetWriteDeadline(time.Now().Add(writeWait))
+		return conn.WriteJSON(event{Type: "sync", ServerTime: nowMillis()})
+	}
+	if err := writeSync(); err != nil {
+		return
+	}
+
+	for {
+		select {
+		case data, ok := <-m.send:
+			_ = conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if !ok {
+				_ = conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+				return
+			}
+			if err := conn.WriteMessage(websocket.TextMessage, data); err != nil {
+				return
+			}
+		case <-syncTick.C:
+			if err := writeSync(); err != nil {
+				return
+			}
+		case <-ping.C:
+			_ = conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func newMemberID() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,98 @@
+package party
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// drain returns the events queued for a member without a connection.
+func drain(m *member) []event {
+	var out []event
+	for {
+		select {
+		case data := <-m.send:
+			var ev event
+			_ = json.Unmarshal(data, &ev)
+			out = append(out, ev)
+		default:
+			return out
+		}
+	}
+}
+
+func dialRoom(t *testing.T, srv *httptest.Server, role string) *websocket.Conn {
+	t.Helper()
+	u := "ws" + strings.TrimPrefix(srv.URL, "http") + "/?role=" + role
+	conn, _, err := websocket.DefaultDialer.Dial(u, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// next reads events until one of type typ arrives, skipping others such as
+// clock sync probes and member list updates.
+func next(t *testing.T, conn *websocket.Conn, typ string) event {
+	t.Helper()
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		var ev event
+		if err := conn.ReadJSON(&ev); err != nil {
+			t.Fatalf("waiting for %s: %v", typ, err)
+		}
+		if ev.Type == typ {
+			return ev
+		}
+	}
+}
+
+func TestServeSyncsHostAndFollower(t *testing.T) {
+	room, _ := NewManager().Open("sess")
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = room.Serve(w, r, r.URL.Query().Get("role"), "")
+	}))
+	defer srv.Close()
+
+	host := dialRoom(t, srv, RoleHost)
+	if ev := next(t, host, "welcome"); ev.Role != RoleHost || ev.Code != room.Code() || ev.SessionID != "sess" {
+		t.Errorf("host welcome = %+v", ev)
+	}
+	follower := dialRoom(t, srv, RoleFollower)
+	welcome := next(t, follower, "welcome")
+	if welcome.Role != RoleFollower || len(welcome.Members) != 2 {
+		t.Errorf("follower welcome = %+v", welcome)
+	}
+
+	// Answering a clock probe yields the follower's offset.
+	_ = follower.WriteJSON(inbound{Type: "sync", ServerTime: welcome.ServerTime, ClientTime: welcome.ServerTime + 250})
+	if ev := next(t, follower, "offset"); ev.OffsetMs == nil || *ev.OffsetMs > 250 || *ev.OffsetMs < 200 {
+		t.Errorf("offset = %+v, want about 250ms", ev.OffsetMs)
+	}
+
+	_ = follower.WriteJSON(inbound{Type: "play"})
+	if ev := next(t, follower, "error"); ev.Error != ErrNotHost.Error() {
+		t.Errorf("follower play error = %q", ev.Error)
+	}
+
+	pos := 30.0
+	_ = host.WriteJSON(inbound{Type: "play", Position: &pos})
+	ev := next(t, follower, "state")
+	if ev.Action != "play" || ev.State == nil || !ev.State.Playing || ev.State.Position != pos {
+		t.Errorf("follower state = %+v", ev)
+	}
+	if ev.LocalTime-ev.State.ServerTime < 200 {
+		t.Errorf("localTime %d not shifted by the follower offset from %d", ev.LocalTime, ev.State.ServerTime)
+	}
+
+	_ = host.WriteJSON(inbound{Type: "ping", ClientTime: 7})
+	if ev := next(t, host, "pong"); ev.ClientTime != 7 || ev.ServerTime == 0 {
+		t.Errorf("pong = %+v", ev)
+	}
+}
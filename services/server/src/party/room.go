@@ -0,0 +1,381 @@
+package party
+
+import (
+	"crypto/rand"
+	"errors"
+	"math/big"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	shareCodeLength   = 6
+	shareCodeAlphabet = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+	// Rooms nobody is connected to are dropped after this long.
+	emptyRoomTTL = 10 * time.Minute
+	// Followers further than this from the host position get a corrective
+	// state update.
+	driftCorrectionThreshold = 1.0
+)
+
+const (
+	RoleHost     = "host"
+	RoleFollower = "follower"
+)
+
+var (
+	ErrRoomNotFound  = errors.New("watch party not found")
+	ErrInvalidCode   = errors.New("invalid share code")
+	ErrRoomClosed    = errors.New("watch party closed")
+	ErrNotHost       = errors.New("only the host can control playback")
+	ErrUnknownAction = errors.New("unknown action")
+)
+
+// State is the host's playback state. Position is the media time in seconds
+// at ServerTime (unix milliseconds on the server clock); while playing it
+// advances in real time from there.
+type State struct {
+	Playing    bool    `json:"playing"`
+	Position   float64 `json:"position"`
+	AudioTrack *int    `json:"audioTrack,omitempty"`
+	ServerTime int64   `json:"serverTime"`
+}
+
+// PositionAt extrapolates the playback position to server time t.
+func (s State) PositionAt(t int64) float64 {
+	if !s.Playing || t <= s.ServerTime {
+		return s.Position
+	}
+	return s.Position + float64(t-s.ServerTime)/1000
+}
+
+type MemberInfo struct {
+	ID       string  `json:"id"`
+	Name     string  `json:"name"`
+	Role     string  `json:"role"`
+	OffsetMs int64   `json:"offsetMs"`
+	RTTMs    int64   `json:"rttMs"`
+	Drift    float64 `json:"drift"`
+	JoinedAt int64   `json:"joinedAt"`
+}
+
+type RoomInfo struct {
+	SessionID string       `json:"sessionId"`
+	Code      string       `json:"code"`
+	State     State        `json:"state"`
+	Members   []MemberInfo `json:"members"`
+	CreatedAt int64        `json:"createdAt"`
+}
+
+// Manager owns the watch-party rooms, one per playback session.
+type Manager struct {
+	mu     sync.Mutex
+	rooms  map[string]*Room
+	byCode map[string]*Room
+}
+
+func NewManager() *Manager {
+	return &Manager{
+		rooms:  make(map[string]*Room),
+		byCode: make(map[string]*Room),
+	}
+}
+
+// Open returns the room for a session, creating it if needed.
+func (m *Manager) Open(sessionID string) (*Room, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if room, ok := m.rooms[sessionID]; ok {
+		return room, nil
+	}
+
+	var code string
+	for attempt := 0; ; attempt++ {
+		if attempt >= 10 {
+			return nil, errors.New("failed to allocate share code")
+		}
+		c, err := newShareCode()
+		if err != nil {
+			return nil, err
+		}
+		if _, taken := m.byCode[c]; !taken {
+			code = c
+			break
+		}
+	}
+
+	now := time.Now()
+	room := &Room{
+		sessionID: sessionID,
+		code:      code,
+		members:   make(map[string]*member),
+		createdAt: now,
+		idleSince: now,
+		state:     State{ServerTime: nowMillis()},
+	}
+	m.rooms[sessionID] = room
+	m.byCode[code] = room
+	return room, nil
+}
+
+func (m *Manager) Get(sessionID string) (*Room, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	room, ok := m.rooms[sessionID]
+	return room, ok
+}
+
+// Lookup resolves a share code to its room. Codes are case-insensitive.
+func (m *Manager) Lookup(code string) (*Room, error) {
+	code = strings.ToUpper(strings.TrimSpace(code))
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	room, ok := m.byCode[code]
+	if !ok {
+		return nil, ErrInvalidCode
+	}
+	return room, nil
+}
+
+// Close ends the party for a session and disconnects everyone in it.
+func (m *Manager) Close(sessionID string) {
+	m.mu.Lock()
+	room, ok := m.rooms[sessionID]
+	if ok {
+		delete(m.rooms, sessionID)
+		delete(m.byCode, room.code)
+	}
+	m.mu.Unlock()
+	if ok {
+		room.close()
+	}
+}
+
+// Prune drops rooms that have had no connections for a while.
+func (m *Manager) Prune() {
+	m.mu.Lock()
+	var idle []*Room
+	for id, room := range m.rooms {
+		if room.idleFor() > emptyRoomTTL {
+			delete(m.rooms, id)
+			delete(m.byCode, room.code)
+			idle = append(idle, room)
+		}
+	}
+	m.mu.Unlock()
+	for _, room := range idle {
+		room.close()
+	}
+}
+
+// Room tracks the members of one watch party and the host's playback state.
+type Room struct {
+	sessionID string
+	code      string
+	createdAt time.Time
+
+	mu        sync.Mutex
+	state     State
+	members   map[string]*member
+	host      *member
+	idleSince time.Time
+	closed    bool
+}
+
+func (r *Room) SessionID() string { return r.sessionID }
+func (r *Room) Code() string      { return r.code }
+
+func (r *Room) Info() RoomInfo {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return RoomInfo{
+		SessionID: r.sessionID,
+		Code:      r.code,
+		State:     r.state,
+		Members:   r.membersLocked(),
+		CreatedAt: r.createdAt.UnixMilli(),
+	}
+}
+
+func (r *Room) membersLocked() []MemberInfo {
+	out := make([]MemberInfo, 0, len(r.members))
+	for _, mem := range r.members {
+		out = append(out, mem.info())
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].JoinedAt < out[j].JoinedAt })
+	return out
+}
+
+func (r *Room) idleFor() time.Duration {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.members) > 0 {
+		return 0
+	}
+	return time.Since(r.idleSince)
+}
+
+// join adds a member. A new host replaces the previous host connection.
+func (r *Room) join(mem *member) (State, []MemberInfo, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return State{}, nil, ErrRoomClosed
+	}
+	if mem.role == RoleHost && r.host != nil {
+		r.host.sendEvent(event{Type: "replaced"})
+		r.host.closeSend()
+		delete(r.members, r.host.id)
+	}
+	if mem.role == RoleHost {
+		r.host = mem
+	}
+	r.members[mem.id] = mem
+	// The new member gets the list in its welcome message.
+	r.broadcastMembersLocked(mem)
+	return r.state, r.membersLocked(), nil
+}
+
+func (r *Room) leave(mem *member) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.members[mem.id] != mem {
+		return
+	}
+	delete(r.members, mem.id)
+	if r.host == mem {
+		r.host = nil
+		// Without a host nobody drives playback; hold followers in place.
+		if r.state.Playing {
+			now := nowMillis()
+			r.state = State{Playing: false, Position: r.state.PositionAt(now), AudioTrack: r.state.AudioTrack, ServerTime: now}
+			r.broadcastStateLocked("host-left")
+		}
+	}
+	if len(r.members) == 0 {
+		r.idleSince = time.Now()
+	}
+	r.broadcastMembersLocked(nil)
+}
+
+func (r *Room) close() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return
+	}
+	r.closed = true
+	for _, mem := range r.members {
+		mem.sendEvent(event{Type: "closed"})
+		mem.closeSend()
+	}
+	r.members = map[string]*member{}
+	r.host = nil
+}
+
+// apply updates the shared state from a host action. clientTime is the host's
+// clock when the action happened; it is mapped onto the server clock so the
+// host's network latency is not added to everyone's position.
+func (r *Room) apply(from *member, msg inbound) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.host != from {
+		return ErrNotHost
+	}
+
+	at := nowMillis()
+	if msg.ClientTime > 0 {
+		if t := from.toServerTime(msg.ClientTime); t <= at && at-t < 10_000 {
+			at = t
+		}
+	}
+	next := r.state
+	next.Position = r.state.PositionAt(at)
+	next.ServerTime = at
+	if msg.Position != nil && *msg.Position >= 0 {
+		next.Position = *msg.Position
+	}
+
+	switch msg.Type {
+	case "play":
+		next.Playing = true
+	case "pause":
+		next.Playing = false
+	case "seek":
+		if msg.Position == nil {
+			return errors.New("seek requires a position")
+		}
+	case "audio":
+		if msg.AudioTrack == nil {
+			return errors.New("audio requires an audioTrack")
+		}
+		track := *msg.AudioTrack
+		next.AudioTrack = &track
+	default:
+		return ErrUnknownAction
+	}
+
+	r.state = next
+	r.broadcastStateLocked(msg.Type)
+	return nil
+}
+
+// reportDrift records how far a follower is from the expected position,
+// forwards it to the host and re-sends the state to followers that are too
+// far off.
+func (r *Room) reportDrift(from *member, msg inbound) {
+	if msg.Position == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	at := nowMillis()
+	if msg.ClientTime > 0 {
+		at = from.toServerTime(msg.ClientTime)
+	}
+	drift := *msg.Position - r.state.PositionAt(at)
+	from.setDrift(drift)
+
+	if r.host != nil && r.host != from {
+		r.host.sendEvent(event{Type: "drift", MemberID: from.id, Name: from.name, Drift: &drift})
+	}
+	if from.role == RoleFollower && (drift > driftCorrectionThreshold || drift < -driftCorrectionThreshold) {
+		from.sendState("correct", r.state)
+	}
+}
+
+func (r *Room) broadcastStateLocked(action string) {
+	for _, mem := range r.members {
+		mem.sendState(action, r.state)
+	}
+}
+
+func (r *Room) broadcastMembersLocked(except *member) {
+	members := r.membersLocked()
+	for _, mem := range r.members {
+		if mem == except {
+			continue
+		}
+		mem.sendEvent(event{Type: "members", Members: members})
+	}
+}
+
+func newShareCode() (string, error) {
+	max := big.NewInt(int64(len(shareCodeAlphabet)))
+	b := make([]byte, shareCodeLength)
+	for i := range b {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		b[i] = shareCodeAlphabet[n.Int64()]
+	}
+	return string(b), nil
+}
+
+func nowMillis() int64 {
+	return time.Now().UnixMilli()
+}
@@ -0,0 +1,160 @@
+package party
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestManagerOpenLookupClose(t *testing.T) {
+	m := NewManager()
+	room, err := m.Open("sess")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := m.Open("sess"); again != room {
+		t.Error("Open created a second room for the same session")
+	}
+	if len(room.Code()) != shareCodeLength {
+		t.Errorf("share code %q has length %d", room.Code(), len(room.Code()))
+	}
+	for _, c := range room.Code() {
+		if !strings.ContainsRune(shareCodeAlphabet, c) {
+			t.Errorf("share code %q uses %q", room.Code(), c)
+		}
+	}
+	if found, err := m.Lookup(" " + strings.ToLower(room.Code()) + " "); err != nil || found != room {
+		t.Errorf("Lookup(lower-case code) = %v, %v", found, err)
+	}
+
+	m.Close("sess")
+	if _, ok := m.Get("sess"); ok {
+		t.Error("room still open after Close")
+	}
+	if _, err := m.Lookup(room.Code()); err != ErrInvalidCode {
+		t.Errorf("Lookup after Close = %v, want %v", err, ErrInvalidCode)
+	}
+	if _, _, err := room.join(newTestMember("late", RoleFollower)); err != ErrRoomClosed {
+		t.Errorf("join closed room = %v, want %v", err, ErrRoomClosed)
+	}
+}
+
+func newTestMember(id, role string) *member {
+	return &member{id: id, name: id, role: role, send: make(chan []byte, sendBuffer)}
+}
+
+func TestApplyOnlyFromHost(t *testing.T) {
+	room, _ := NewManager().Open("sess")
+	host := newTestMember("host", RoleHost)
+	follower := newTestMember("follower", RoleFollower)
+	room.join(host)
+	room.join(follower)
+
+	pos := 42.0
+	if err := room.apply(follower, inbound{Type: "play", Position: &pos}); err != ErrNotHost {
+		t.Errorf("follower play = %v, want %v", err, ErrNotHost)
+	}
+	if err := room.apply(host, inbound{Type: "seek"}); err == nil {
+		t.Error("seek without a position was accepted")
+	}
+	if err := room.apply(host, inbound{Type: "play", Position: &pos}); err != nil {
+		t.Fatal(err)
+	}
+	st := room.Info().State
+	if !st.Playing || st.Position != pos {
+		t.Errorf("state after play = %+v", st)
+	}
+
+	// The host leaving pauses everyone at the extrapolated position.
+	room.leave(host)
+	st = room.Info().State
+	if st.Playing || st.Position < pos {
+		t.Errorf("state after host left = %+v", st)
+	}
+}
+
+func TestNewHostReplacesPrevious(t *testing.T) {
+	room, _ := NewManager().Open("sess")
+	first := newTestMember("first", RoleHost)
+	second := newTestMember("second", RoleHost)
+	room.join(first)
+	room.join(second)
+	if room.host != second {
+		t.Error("second host did not take over")
+	}
+	if _, ok := room.members[first.id]; ok {
+		t.Error("replaced host is still a member")
+	}
+	if !first.closed {
+		t.Error("replaced host connection was not closed")
+	}
+}
+
+func TestPositionAt(t *testing.T) {
+	paused := State{Position: 10, ServerTime: 1000}
+	if got := paused.PositionAt(5000); got != 10 {
+		t.Errorf("paused PositionAt = %v, want 10", got)
+	}
+	playing := State{Playing: true, Position: 10, ServerTime: 1000}
+	if got := playing.PositionAt(3500); got != 12.5 {
+		t.Errorf("playing PositionAt = %v, want 12.5", got)
+	}
+	if got := playing.PositionAt(500); got != 10 {
+		t.Errorf("PositionAt before ServerTime = %v, want 10", got)
+	}
+}
+
+func TestRecordSyncKeepsLowestRTTSample(t *testing.T) {
+	m := newTestMember("m", RoleFollower)
+	now := nowMillis()
+
+	// A slow round trip with a skewed offset, then a fast one.
+	m.recordSync(now-400, now+5000)
+	fast := m.recordSync(now-20, now+1000)
+	if fast < 950 || fast > 1050 {
+		t.Errorf("offset from fast sample = %d, want about 1000", fast)
+	}
+	// A later slow sample does not displace the fast one.
+	if got := m.recordSync(now-600, now+9000); got != fast {
+		t.Errorf("offset after slow sample = %d, want %d", got, fast)
+	}
+	// Implausible round trips are ignored.
+	if got := m.recordSync(now+60_000, now); got != fast {
+		t.Errorf("offset after bogus sample = %d, want %d", got, fast)
+	}
+	if got := m.toServerTime(now + fast); got != now {
+		t.Errorf("toServerTime = %d, want %d", got, now)
+	}
+}
+
+func TestReportDriftCorrectsFollower(t *testing.T) {
+	room, _ := NewManager().Open("sess")
+	host := newTestMember("host", RoleHost)
+	follower := newTestMember("follower", RoleFollower)
+	room.join(host)
+	room.join(follower)
+	drain(host)
+	drain(follower)
+
+	pos := 100.0
+	room.apply(host, inbound{Type: "pause", Position: &pos})
+	drain(host)
+	drain(follower)
+
+	off := 103.0
+	room.reportDrift(follower, inbound{Type: "drift", Position: &off})
+	if got := follower.info().Drift; got != 3 {
+		t.Errorf("recorded drift = %v, want 3", got)
+	}
+	if ev := drain(host); len(ev) != 1 || ev[0].Type != "drift" {
+		t.Errorf("host events = %+v, want one drift report", ev)
+	}
+	if ev := drain(follower); len(ev) != 1 || ev[0].Action != "correct" {
+		t.Errorf("follower events = %+v, want one correction", ev)
+	}
+
+	near := 100.5
+	room.reportDrift(follower, inbound{Type: "drift", Position: &near})
+	if ev := drain(follower); len(ev) != 0 {
+		t.Errorf("follower within threshold got %+v", ev)
+	}
+}
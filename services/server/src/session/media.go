@@ -0,0 +1,66 @@
+package session
+
+// HDR formats reported in VideoInfo.HDR.
+const (
+	HDRNone        = ""
+	HDR10          = "hdr10"
+	HDRHLG         = "hlg"
+	HDRDolbyVision = "dolby_vision"
+)
+
+// MediaInfo describes the probed source: container, overall bitrate and the
+// primary video stream plus every audio and subtitle stream.
+type MediaInfo struct {
+	Container string         `json:"container,omitempty"`
+	BitRate   int64          `json:"bitRate,omitempty"`
+	SizeBytes int64          `json:"sizeBytes,omitempty"`
+	Video     *VideoInfo     `json:"video,omitempty"`
+	Audio     []AudioInfo    `json:"audio,omitempty"`
+	Subtitles []SubtitleInfo `json:"subtitles,omitempty"`
+}
+
+type VideoInfo struct {
+	Codec          string  `json:"codec"`
+	Profile        string  `json:"profile,omitempty"`
+	Width          int     `json:"width,omitempty"`
+	Height         int     `json:"height,omitempty"`
+	FPS            float64 `json:"fps,omitempty"`
+	BitDepth       int     `json:"bitDepth,omitempty"`
+	BitRate        int64   `json:"bitRate,omitempty"`
+	PixelFormat    string  `json:"pixelFormat,omitempty"`
+	ColorTransfer  string  `json:"colorTransfer,omitempty"`
+	ColorPrimaries string  `json:"colorPrimaries,omitempty"`
+	ColorSpace     string  `json:"colorSpace,omitempty"`
+	// HDR is one of hdr10, hlg or dolby_vision; empty for SDR.
+	HDR                string `json:"hdr,omitempty"`
+	DolbyVisionProfile int    `json:"dolbyVisionProfile,omitempty"`
+}
+
+// AudioInfo.Index is relative to the audio streams, matching StreamInfo.
+type AudioInfo struct {
+	Index         int    `json:"index"`
+	Codec         string `json:"codec"`
+	Profile       string `json:"profile,omitempty"`
+	Channels      int    `json:"channels,omitempty"`
+	ChannelLayout string `json:"channelLayout,omitempty"`
+	SampleRate    int    `json:"sampleRate,omitempty"`
+	BitRate       int64  `json:"bitRate,omitempty"`
+	Language      string `json:"language,omitempty"`
+	Title         string `json:"title,omitempty"`
+	Default       bool   `json:"default,omitempty"`
+	Forced        bool   `json:"forced,omitempty"`
+	Commentary    bool   `json:"commentary,omitempty"`
+}
+
+// SubtitleInfo.Index is relative to the subtitle streams. Text is false for
+// bitmap formats (PGS, VobSub, DVB) that cannot be converted to WebVTT.
+type SubtitleInfo struct {
+	Index           int    `json:"index"`
+	Codec           string `json:"codec"`
+	Language        string `json:"language,omitempty"`
+	Title           string `json:"title,omitempty"`
+	Text            bool   `json:"text"`
+	Default         bool   `json:"default,omitempty"`
+	Forced          bool   `json:"forced,omitempty"`
+	HearingImpaired bool   `json:"hearingImpaired,omitempty"`
+}
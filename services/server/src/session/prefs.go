@@ -0,0 +1,261 @@
+package session
+
+import (
+	"sort"
+	"strings"
+)
+
+// Subtitle modes for TrackPreferences.SubtitleMode.
+const (
+	SubtitlesOff    = "off"
+	SubtitlesForced = "forced"
+	SubtitlesAlways = "always"
+)
+
+// Channel preferences for TrackPreferences.Channels.
+const (
+	ChannelsAny      = ""
+	ChannelsSurround = "surround"
+	ChannelsStereo   = "stereo"
+)
+
+// TrackPreferences drives the default audio and subtitle selection. Clients
+// send it with a new session; anything they leave out comes from the server
+// defaults (see DefaultTrackPreferences).
+type TrackPreferences struct {
+	// AudioLanguages is ordered by preference. ISO 639-1 and 639-2 codes are
+	// both accepted ("en", "eng").
+	AudioLanguages []string `json:"audioLanguages,omitempty"`
+	// PreferOriginal puts the original language ahead of AudioLanguages.
+	// OriginalLanguage comes from the client's catalog metadata; when it is
+	// unknown the first audio stream is taken as the original.
+	PreferOriginal   bool   `json:"preferOriginal,omitempty"`
+	OriginalLanguage string `json:"originalLanguage,omitempty"`
+	// AvoidCommentary skips commentary tracks unless nothing else matches.
+	AvoidCommentary bool   `json:"avoidCommentary"`
+	Channels        string `json:"channels,omitempty"`
+	// HonorDefault prefers the stream flagged default among equal matches.
+	HonorDefault bool `json:"honorDefault"`
+
+	SubtitleLanguages []string `json:"subtitleLanguages,omitempty"`
+	// SubtitleMode is off, forced (only forced tracks, in the audio language)
+	// or always.
+	SubtitleMode string `json:"subtitleMode,omitempty"`
+}
+
+// DefaultTrackPreferences matches the historical behaviour: English audio
+// when there is one, no subtitles.
+func DefaultTrackPreferences() TrackPreferences {
+	return TrackPreferences{
+		AudioLanguages:  []string{"eng"},
+		AvoidCommentary: true,
+		HonorDefault:    true,
+		SubtitleMode:    SubtitlesOff,
+	}
+}
+
+// TrackSelection is the outcome of applying preferences to a stream list.
+// Indexes are relative to the audio and subtitle streams respectively.
+type TrackSelection struct {
+	AudioIndex    int
+	SubtitleIndex int // -1 when no subtitle should be shown
+}
+
+// SelectTracks picks the default audio and subtitle streams for prefs.
+func SelectTracks(media *MediaInfo, prefs TrackPreferences) TrackSelection {
+	sel := TrackSelection{SubtitleIndex: -1}
+	if media == nil {
+		return sel
+	}
+	sel.AudioIndex = selectAudio(media.Audio, prefs)
+
+	audioLang := ""
+	for _, a := range media.Audio {
+		if a.Index == sel.AudioIndex {
+			audioLang = a.Language
+			break
+		}
+	}
+	sel.SubtitleIndex = selectSubtitle(media.Subtitles, prefs, audioLang)
+	return sel
+}
+
+func selectAudio(audio []AudioInfo, prefs TrackPreferences) int {
+	ranked := RankAudio(audio, prefs)
+	if len(ranked) == 0 {
+		return 0
+	}
+	return ranked[0]
+}
+
+// RankAudio orders the audio streams from most to least preferred and returns
+// their indexes. Commentary tracks go last when AvoidCommentary is set.
+func RankAudio(audio []AudioInfo, prefs TrackPreferences) []int {
+	if len(audio) == 0 {
+		return nil
+	}
+
+	langs := prefs.AudioLanguages
+	if prefs.PreferOriginal {
+		original := prefs.OriginalLanguage
+		if original == "" {
+			original = audio[0].Language
+		}
+		if original != "" {
+			langs = append([]string{original}, langs...)
+		}
+	}
+
+	sorted := append([]AudioInfo(nil), audio...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		a, b := sorted[i], sorted[j]
+		if prefs.AvoidCommentary && isCommentary(a) != isCommentary(b) {
+			return !isCommentary(a)
+		}
+		return betterAudio(a, b, langs, prefs)
+	})
+	ranked := make([]int, len(sorted))
+	for i, a := range sorted {
+		ranked[i] = a.Index
+	}
+	return ranked
+}
+
+// betterAudio reports whether a should be preferred over b. Language rank
+// dominates, then the channel preference, then the default flag; otherwise
+// the earlier stream wins.
+func betterAudio(a, b AudioInfo, langs []string, prefs TrackPreferences) bool {
+	if ra, rb := languageRank(a.Language, langs), languageRank(b.Language, langs); ra != rb {
+		return ra < rb
+	}
+	if ca, cb := channelScore(a.Channels, prefs.Channels), channelScore(b.Channels, prefs.Channels); ca != cb {
+		return ca > cb
+	}
+	if prefs.HonorDefault && a.Default != b.Default {
+		return a.Default
+	}
+	return false
+}
+
+func channelScore(channels int, want string) int {
+	switch want {
+	case ChannelsSurround:
+		if channels > 2 {
+			return 1
+		}
+	case ChannelsStereo:
+		if channels > 0 && channels <= 2 {
+			return 1
+		}
+	}
+	return 0
+}
+
+func isCommentary(a AudioInfo) bool {
+	return a.Commentary || strings.Contains(strings.ToLower(a.Title), "commentary")
+}
+
+func selectSubtitle(subs []SubtitleInfo, prefs TrackPreferences, audioLang string) int {
+	switch prefs.SubtitleMode {
+	case SubtitlesForced:
+		// Forced tracks translate foreign dialogue, so they have to match the
+		// audio being played.
+		best := -1
+		for i, s := range subs {
+			if !s.Forced || !SameLanguage(s.Language, audioLang) {
+				continue
+			}
+			if best < 0 || (s.Text && !subs[best].Text) {
+				best = i
+			}
+		}
+		if best < 0 {
+			return -1
+		}
+		return subs[best].Index
+	case SubtitlesAlways:
+		langs := prefs.SubtitleLanguages
+		if len(langs) == 0 {
+			langs = prefs.AudioLanguages
+		}
+		best := -1
+		for i, s := range subs {
+			if s.Forced {
+				continue
+			}
+			if best < 0 || betterSubtitle(s, subs[best], langs, prefs) {
+				best = i
+			}
+		}
+		if best < 0 {
+			return -1
+		}
+		// Subtitles in a language nobody asked for are worse than none.
+		if len(langs) > 0 && languageRank(subs[best].Language, langs) == len(langs) {
+			return -1
+		}
+		return subs[best].Index
+	}
+	return -1
+}
+
+// betterSubtitle ranks by language, then prefers text tracks (they can be
+// converted to WebVTT), then the default flag.
+func betterSubtitle(a, b SubtitleInfo, langs []string, prefs TrackPreferences) bool {
+	if ra, rb := languageRank(a.Language, langs), languageRank(b.Language, langs); ra != rb {
+		return ra < rb
+	}
+	if a.Text != b.Text {
+		return a.Text
+	}
+	if a.HearingImpaired != b.HearingImpaired {
+		return !a.HearingImpaired
+	}
+	if prefs.HonorDefault && a.Default != b.Default {
+		return a.Default
+	}
+	return false
+}
+
+// languageRank is the position of lang in langs, or len(langs) if absent.
+func languageRank(lang string, langs []string) int {
+	for i, l := range langs {
+		if SameLanguage(lang, l) {
+			return i
+		}
+	}
+	return len(langs)
+}
+
+// SameLanguage compares language codes across ISO 639-1, 639-2/T and 639-2/B.
+// Unknown ("und") never matches.
+func SameLanguage(a, b string) bool {
+	a, b = normalizeLanguage(a), normalizeLanguage(b)
+	return a != "" && a == b
+}
+
+func normalizeLanguage(code string) string {
+	code = strings.ToLower(strings.TrimSpace(code))
+	if i := strings.IndexAny(code, "-_"); i > 0 {
+		code = code[:i] // en-US -> en
+	}
+	if code == "" || code == "und" {
+		return ""
+	}
+	if canonical, ok := languageAliases[code]; ok {
+		return canonical
+	}
+	return code
+}
+
+// languageAliases folds ISO 639-1 and 639-2/B codes into 639-2/T. Containers
+// use either 639-2 form.
+var languageAliases = map[string]string{
+	"en": "eng", "ja": "jpn", "de": "deu", "ger": "deu", "fr": "fra", "fre": "fra",
+	"es": "spa", "it": "ita", "pt": "por", "ru": "rus", "zh": "zho", "chi": "zho",
+	"ko": "kor", "nl": "nld", "dut": "nld", "sv": "swe", "no": "nor", "nb": "nob",
+	"da": "dan", "fi": "fin", "pl": "pol", "cs": "ces", "cze": "ces", "hu": "hun",
+	"tr": "tur", "el": "ell", "gre": "ell", "he": "heb", "ar": "ara", "hi": "hin",
+	"th": "tha", "vi": "vie", "id": "ind", "uk": "ukr", "ro": "ron", "rum": "ron",
+	"fa": "fas", "per": "fas", "ms": "msa", "may": "msa",
+}
@@ -0,0 +1,167 @@
+package session
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRankAudio(t *testing.T) {
+	tests := []struct {
+		name  string
+		audio []AudioInfo
+		prefs TrackPreferences
+		want  []int
+	}{
+		{
+			name:  "language order",
+			audio: []AudioInfo{{Index: 0, Language: "ger"}, {Index: 1, Language: "fre"}, {Index: 2, Language: "eng"}},
+			prefs: TrackPreferences{AudioLanguages: []string{"en", "fr"}},
+			want:  []int{2, 1, 0},
+		},
+		{
+			name:  "original language from metadata",
+			audio: []AudioInfo{{Index: 0, Language: "eng"}, {Index: 1, Language: "jpn"}},
+			prefs: TrackPreferences{AudioLanguages: []string{"eng"}, PreferOriginal: true, OriginalLanguage: "ja"},
+			want:  []int{1, 0},
+		},
+		{
+			name:  "original language defaults to the first stream",
+			audio: []AudioInfo{{Index: 0, Language: "kor"}, {Index: 1, Language: "eng"}},
+			prefs: TrackPreferences{AudioLanguages: []string{"eng"}, PreferOriginal: true},
+			want:  []int{0, 1},
+		},
+		{
+			name: "commentary avoided",
+			audio: []AudioInfo{
+				{Index: 0, Language: "eng", Title: "Director's Commentary"},
+				{Index: 1, Language: "eng", Commentary: true},
+				{Index: 2, Language: "spa"},
+			},
+			prefs: TrackPreferences{AudioLanguages: []string{"eng"}, AvoidCommentary: true},
+			want:  []int{2, 0, 1},
+		},
+		{
+			name:  "commentary allowed",
+			audio: []AudioInfo{{Index: 0, Language: "eng", Commentary: true}, {Index: 1, Language: "spa"}},
+			prefs: TrackPreferences{AudioLanguages: []string{"eng"}},
+			want:  []int{0, 1},
+		},
+		{
+			name:  "surround preferred within a language",
+			audio: []AudioInfo{{Index: 0, Language: "eng", Channels: 2}, {Index: 1, Language: "eng", Channels: 6}, {Index: 2, Language: "fra", Channels: 8}},
+			prefs: TrackPreferences{AudioLanguages: []string{"eng"}, Channels: ChannelsSurround},
+			want:  []int{1, 0, 2},
+		},
+		{
+			name:  "stereo preferred within a language",
+			audio: []AudioInfo{{Index: 0, Language: "eng", Channels: 6}, {Index: 1, Language: "eng", Channels: 2}},
+			prefs: TrackPreferences{AudioLanguages: []string{"eng"}, Channels: ChannelsStereo},
+			want:  []int{1, 0},
+		},
+		{
+			name:  "default flag breaks ties",
+			audio: []AudioInfo{{Index: 0, Language: "eng"}, {Index: 1, Language: "eng", Default: true}},
+			prefs: TrackPreferences{AudioLanguages: []string{"eng"}, HonorDefault: true},
+			want:  []int{1, 0},
+		},
+		{
+			name:  "unknown language never matches",
+			audio: []AudioInfo{{Index: 0, Language: "und"}, {Index: 1, Language: "en-US"}},
+			prefs: TrackPreferences{AudioLanguages: []string{"und", "eng"}},
+			want:  []int{1, 0},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := RankAudio(tt.audio, tt.prefs); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("RankAudio = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSelectTracks(t *testing.T) {
+	media := &MediaInfo{
+		Audio: []AudioInfo{
+			{Index: 0, Language: "jpn", Channels: 6},
+			{Index: 1, Language: "eng", Channels: 2},
+		},
+		Subtitles: []SubtitleInfo{
+			{Index: 0, Language: "eng", Text: true},
+			{Index: 1, Language: "eng", Forced: true, Codec: "hdmv_pgs_subtitle"},
+			{Index: 2, Language: "eng", Forced: true, Text: true},
+			{Index: 3, Language: "jpn", Forced: true, Text: true},
+			{Index: 4, Language: "ger", Text: true, HearingImpaired: true},
+			{Index: 5, Language: "deu", Text: true},
+		},
+	}
+	tests := []struct {
+		name  string
+		media *MediaInfo
+		prefs TrackPreferences
+		want  TrackSelection
+	}{
+		{"defaults", media, DefaultTrackPreferences(), TrackSelection{AudioIndex: 1, SubtitleIndex: -1}},
+		{
+			"forced subtitles follow the audio language",
+			media,
+			TrackPreferences{AudioLanguages: []string{"en"}, SubtitleMode: SubtitlesForced},
+			TrackSelection{AudioIndex: 1, SubtitleIndex: 2},
+		},
+		{
+			"forced subtitles for original audio",
+			media,
+			TrackPreferences{AudioLanguages: []string{"eng"}, PreferOriginal: true, SubtitleMode: SubtitlesForced},
+			TrackSelection{AudioIndex: 0, SubtitleIndex: 3},
+		},
+		{
+			"always skips forced tracks and prefers text without SDH",
+			media,
+			TrackPreferences{AudioLanguages: []string{"jpn"}, SubtitleLanguages: []string{"de"}, SubtitleMode: SubtitlesAlways},
+			TrackSelection{AudioIndex: 0, SubtitleIndex: 5},
+		},
+		{
+			"always falls back to audio languages",
+			media,
+			TrackPreferences{AudioLanguages: []string{"eng"}, SubtitleMode: SubtitlesAlways},
+			TrackSelection{AudioIndex: 1, SubtitleIndex: 0},
+		},
+		{
+			"no subtitles in unwanted languages",
+			media,
+			TrackPreferences{AudioLanguages: []string{"eng"}, SubtitleLanguages: []string{"spa"}, SubtitleMode: SubtitlesAlways},
+			TrackSelection{AudioIndex: 1, SubtitleIndex: -1},
+		},
+		{"no media", nil, DefaultTrackPreferences(), TrackSelection{SubtitleIndex: -1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := SelectTracks(tt.media, tt.prefs); got != tt.want {
+				t.Errorf("SelectTracks = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSameLanguage(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want bool
+	}{
+		{"en", "eng", true},
+		{"ger", "de", true},
+		{"ger", "deu", true},
+		{"fre", "fra", true},
+		{"chi", "zh", true},
+		{"pt-BR", "por", true},
+		{"ENG", "en", true},
+		{"eng", "fra", false},
+		{"und", "und", false},
+		{"", "", false},
+	}
+	for _, tt := range tests {
+		if got := SameLanguage(tt.a, tt.b); got != tt.want {
+			t.Errorf("SameLanguage(%q, %q) = %v, want %v", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
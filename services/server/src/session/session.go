@@ -1,8 +1,10 @@
 package session
 
 import (
+	"encoding/json"
 	"errors"
 	"math/rand"
+	"net/url"
 	"os"
 	"path/filepath"
 	"sync"
@@ -26,8 +28,54 @@ type Session struct {
 	Chapters         []Chapter    `json:"chapters,omitempty"`
 	AvailableStreams []StreamInfo `json:"availableStreams,omitempty"`
 	AudioIndex       int          `json:"audioIndex"`
-	IsTorrent        bool         `json:"isTorrent,omitempty"`
-	TorrentInfoHash  string       `json:"torrentInfoHash,omitempty"`
+	// SubtitleIndex is the subtitle stream to show by default, if any.
+	SubtitleIndex *int              `json:"subtitleIndex,omitempty"`
+	Preferences   *TrackPreferences `json:"preferences,omitempty"`
+	// AudioProfile names the audio processing used for playback and clips.
+	AudioProfile string `json:"audioProfile,omitempty"`
+	// SegmentFormat is the container of HLS segments ("ts" or "cmaf").
+	SegmentFormat string `json:"segmentFormat,omitempty"`
+	// EncodingProfile names the video encoding settings.
+	EncodingProfile string `json:"encodingProfile,omitempty"`
+	// LowLatency starts each slice with short segments.
+	LowLatency      bool       `json:"lowLatency,omitempty"`
+	IsTorrent       bool       `json:"isTorrent,omitempty"`
+	TorrentInfoHash string     `json:"torrentInfoHash,omitempty"`
+	Media           *MediaInfo `json:"media,omitempty"`
+	// SkipSegments marks intros and credits once they are known.
+	SkipSegments []SkipSegment `json:"skipSegments,omitempty"`
+	// SkipDetection lets torrent sessions be analysed for intros and
+	// credits, which downloads parts of neighbouring episodes.
+	SkipDetection bool `json:"skipDetection,omitempty"`
+	// QualityCap is set once the server lowered the video quality because
+	// the client could not download it fast enough.
+	QualityCap *QualityCap `json:"qualityCap,omitempty"`
+	// DeviceID is the paired LAN device that created the session; empty for
+	// the owner.
+	DeviceID string `json:"deviceId,omitempty"`
+}
+
+// MarshalJSON redacts a token query parameter of Source; clients include
+// paired LAN devices.
+func (s Session) MarshalJSON() ([]byte, error) {
+	type plain Session
+	p := plain(s)
+	p.Source = redactToken(p.Source)
+	return json.Marshal(p)
+}
+
+func redactToken(source string) string {
+	u, err := url.Parse(source)
+	if err != nil || u.RawQuery == "" {
+		return source
+	}
+	q := u.Query()
+	if !q.Has("token") {
+		return source
+	}
+	q.Set("token", "redacted")
+	u.RawQuery = q.Encode()
+	return u.String()
 }
 
 type StreamInfo struct {
@@ -36,6 +84,17 @@ type StreamInfo struct {
 	Codec    string `json:"codec"`
 	Language string `json:"language"`
 	Title    string `json:"title"`
+	Channels int    `json:"channels,omitempty"` // audio only
+}
+
+// QualityCap is the size and bit rate limit video is encoded with after the
+// client's measured throughput fell below the bit rate being served.
+type QualityCap struct {
+	MaxHeight  int   `json:"maxHeight,omitempty"`
+	MaxBitRate int64 `json:"maxBitRate"`
+	// Throughput is the client's download rate in bits per second.
+	Throughput int64     `json:"throughput"`
+	ReducedAt  time.Time `json:"reducedAt"`
 }
 
 type Chapter struct {
@@ -44,9 +103,28 @@ type Chapter struct {
 	Title     string  `json:"title"`
 }
 
+// Skip segment types.
+const (
+	SkipIntro   = "intro"
+	SkipCredits = "credits"
+)
+
+// SkipSegment is a stretch of the video a player can offer to skip. Source
+// says how it was found: "chapter", "fingerprint" or "blackframe".
+type SkipSegment struct {
+	Type      string  `json:"type"`
+	StartTime float64 `json:"startTime"`
+	EndTime   float64 `json:"endTime"`
+	Source    string  `json:"source"`
+}
+
 type Store interface {
 	Create(source string, kind SessionKind, startTime float64) (*Session, error)
 	Get(id string) (*Session, error)
+	// Update runs fn on session id with the store locked.
+	Update(id string, fn func(*Session)) error
+	// Snapshot returns a copy of session id taken with the store locked.
+	Snapshot(id string) (Session, error)
 	Delete(id string) error
 }
 
@@ -105,6 +183,27 @@ func (s *memoryStore) Get(id string) (*Session, error) {
 	return sess, nil
 }
 
+func (s *memoryStore) Update(id string, fn func(*Session)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sess, ok := s.sessions[id]
+	if !ok {
+		return errors.New("not found")
+	}
+	fn(sess)
+	return nil
+}
+
+func (s *memoryStore) Snapshot(id string) (Session, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	sess, ok := s.sessions[id]
+	if !ok {
+		return Session{}, errors.New("not found")
+	}
+	return *sess, nil
+}
+
 func (s *memoryStore) Delete(id string) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -0,0 +1,32 @@
+package session
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestMarshalRedactsSourceToken(t *testing.T) {
+	tests := []struct {
+		source string
+		want   string
+	}{
+		{"http://127.0.0.1:6969/torrents/abc/files/0?token=secret", "http://127.0.0.1:6969/torrents/abc/files/0?token=redacted"},
+		{"https://cdn.example.com/movie.mkv?e=123", "https://cdn.example.com/movie.mkv?e=123"},
+		{"/home/user/Videos/movie.mkv", "/home/user/Videos/movie.mkv"},
+	}
+	for _, tt := range tests {
+		b, err := json.Marshal(Session{ID: "s", Source: tt.source})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var out struct {
+			Source string `json:"source"`
+		}
+		if err := json.Unmarshal(b, &out); err != nil {
+			t.Fatal(err)
+		}
+		if out.Source != tt.want {
+			t.Errorf("source %q marshalled as %q, want %q", tt.source, out.Source, tt.want)
+		}
+	}
+}
@@ -0,0 +1,296 @@
+package source
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+)
+
+type Kind string
+
+const (
+	KindHTTP    Kind = "http"
+	KindLocal   Kind = "local"
+	KindTorrent Kind = "torrent"
+)
+
+// Rules reported in a Violation.
+const (
+	RuleEmpty          = "empty-source"
+	RuleProtocol       = "forbidden-protocol"
+	RuleScheme         = "unsupported-scheme"
+	RuleRelativePath   = "relative-path"
+	RuleOutsideRoots   = "outside-allowed-roots"
+	RuleNotRegularFile = "not-a-regular-file"
+	RuleMediaExtension = "unsupported-extension"
+	RuleInternalPath   = "internal-path"
+)
+
+// Protocol whitelists passed to ffmpeg/ffprobe per source kind. Nested
+// protocols (concat, subfile, data, pipe, ...) are never allowed.
+const (
+	httpProtocols    = "http,https,tcp,tls"
+	localProtocols   = "file"
+	torrentProtocols = "http,tcp"
+)
+
+// Prefixes ffmpeg would interpret as a protocol or special input.
+var forbiddenPrefixes = []string{
+	"file:", "concat:", "concatf:", "subfile:", "pipe:", "data:", "fd:",
+	"cache:", "async:", "crypto:", "hls+", "gopher:", "ftp:", "tcp:", "udp:",
+	"unix:", "rtmp", "rtsp:", "srt:", "smb:", "sftp:", "lavfi:", "tee:",
+	"ipfs:", "ipns:", "md5:", "zmq:",
+}
+
+var mediaExtensions = map[string]struct{}{
+	".mkv": {}, ".mp4": {}, ".m4v": {}, ".mov": {}, ".avi": {}, ".webm": {},
+	".ts": {}, ".m2ts": {}, ".mts": {}, ".wmv": {}, ".flv": {}, ".mpg": {},
+	".mpeg": {}, ".ogv": {}, ".3gp": {}, ".vob": {}, ".divx": {},
+	".mp3": {}, ".m4a": {}, ".flac": {}, ".ogg": {}, ".opus": {}, ".wav": {},
+}
+
+// Violation is returned when a source is rejected. Rule is one of the Rule*
+// constants so clients can react to specific failures.
+type Violation struct {
+	Rule   string `json:"rule"`
+	Detail string `json:"detail"`
+}
+
+func (v *Violation) Error() string {
+	return fmt.Sprintf("source rejected (%s): %s", v.Rule, v.Detail)
+}
+
+func violation(rule, format string, args ...any) error {
+	return &Violation{Rule: rule, Detail: fmt.Sprintf(format, args...)}
+}
+
+type Source struct {
+	Raw  string
+	Kind Kind
+	// Path is the cleaned absolute path for local sources.
+	Path string
+	// URL is the parsed URL for http and torrent sources.
+	URL *url.URL
+}
+
+// Input returns the string that should be handed to ffmpeg.
+func (s *Source) Input() string {
+	if s.Kind == KindLocal {
+		return s.Path
+	}
+	return s.Raw
+}
+
+type Policy struct {
+	mu    sync.RWMutex
+	roots []string
+	// serverHosts are host:port values that address this server; URLs on
+	// them are only accepted for the internal torrent endpoint.
+	serverHosts map[string]struct{}
+}
+
+func NewPolicy(roots []string, serverAddr string) *Policy {
+	p := &Policy{serverHosts: make(map[string]struct{})}
+	p.SetRoots(roots)
+	p.AddServerAddr(serverAddr)
+	return p
+}
+
+// DefaultRoots are the directories local playback is allowed from when no
+// roots are configured: the home directory and common removable media mounts.
+func DefaultRoots() []string {
+	var roots []string
+	if home, err := os.UserHomeDir(); err == nil && home != "" {
+		roots = append(roots, home)
+	}
+	switch runtime.GOOS {
+	case "darwin":
+		roots = append(roots, "/Volumes")
+	case "linux":
+		roots = append(roots, "/media", "/mnt", "/run/media")
+	}
+	return roots
+}
+
+func (p *Policy) SetRoots(roots []string) {
+	cleaned := make([]string, 0, len(roots))
+	for _, r := range roots {
+		r = strings.TrimSpace(r)
+		if r == "" {
+			continue
+		}
+		abs, err := filepath.Abs(r)
+		if err != nil {
+			continue
+		}
+		if resolved, err := filepath.EvalSymlinks(abs); err == nil {
+			abs = resolved
+		}
+		cleaned = append(cleaned, filepath.Clean(abs))
+	}
+	p.mu.Lock()
+	p.roots = cleaned
+	p.mu.Unlock()
+}
+
+// AddRoots extends the allowed roots, e.g. with configured library folders.
+func (p *Policy) AddRoots(roots ...string) {
+	p.mu.RLock()
+	current := append([]string(nil), p.roots...)
+	p.mu.RUnlock()
+	p.SetRoots(append(current, roots...))
+}
+
+func (p *Policy) Roots() []string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return append([]string(nil), p.roots...)
+}
+
+func (p *Policy) AddServerAddr(addr string) {
+	host, port, err := net.SplitHostPort(strings.TrimSpace(addr))
+	if err != nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.serverHosts[net.JoinHostPort(host, port)] = struct{}{}
+	if ip := net.ParseIP(host); ip != nil && (ip.IsLoopback() || ip.IsUnspecified()) {
+		for _, h := range []string{"127.0.0.1", "localhost", "::1"} {
+			p.serverHosts[net.JoinHostPort(h, port)] = struct{}{}
+		}
+	}
+}
+
+func (p *Policy) isServerHost(hostport string) bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	_, ok := p.serverHosts[strings.ToLower(hostport)]
+	return ok
+}
+
+// Classify parses raw and checks it against the policy.
+func (p *Policy) Classify(raw string) (*Source, error) {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return nil, violation(RuleEmpty, "source is empty")
+	}
+
+	if isLocalPath(raw) {
+		return p.classifyLocal(raw)
+	}
+
+	lower := strings.ToLower(raw)
+	for _, prefix := range forbiddenPrefixes {
+		if strings.HasPrefix(lower, prefix) {
+			return nil, violation(RuleProtocol, "protocol %q is not allowed", strings.TrimSuffix(prefix, ":"))
+		}
+	}
+
+	u, err := url.Parse(raw)
+	if err != nil || u.Scheme == "" {
+		if strings.Contains(raw, ":") {
+			return nil, violation(RuleProtocol, "unrecognized protocol in %q", raw)
+		}
+		return nil, violation(RuleRelativePath, "relative paths are not allowed")
+	}
+
+	switch strings.ToLower(u.Scheme) {
+	case "http", "https":
+	default:
+		return nil, violation(RuleScheme, "scheme %q is not allowed", u.Scheme)
+	}
+	if u.Host == "" {
+		return nil, violation(RuleScheme, "URL has no host")
+	}
+
+	if p.isServerHost(u.Host) {
+		if !strings.HasPrefix(u.Path, "/torrents/") {
+			return nil, violation(RuleInternalPath, "only the torrent endpoint may be used as a source on this server")
+		}
+		return &Source{Raw: raw, Kind: KindTorrent, URL: u}, nil
+	}
+	return &Source{Raw: raw, Kind: KindHTTP, URL: u}, nil
+}
+
+func (p *Policy) classifyLocal(raw string) (*Source, error) {
+	if !filepath.IsAbs(raw) {
+		return nil, violation(RuleRelativePath, "relative paths are not allowed")
+	}
+	clean := filepath.Clean(raw)
+	resolved, err := filepath.EvalSymlinks(clean)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, violation(RuleNotRegularFile, "file does not exist")
+		}
+		return nil, violation(RuleNotRegularFile, "cannot resolve path: %v", err)
+	}
+
+	if !p.withinRoots(resolved) {
+		return nil, violation(RuleOutsideRoots, "%s is outside the allowed media roots", resolved)
+	}
+
+	info, err := os.Stat(resolved)
+	if err != nil {
+		return nil, violation(RuleNotRegularFile, "cannot stat file: %v", err)
+	}
+	if !info.Mode().IsRegular() {
+		return nil, violation(RuleNotRegularFile, "%s is not a regular file", resolved)
+	}
+	if !IsMediaFile(resolved) {
+		return nil, violation(RuleMediaExtension, "extension %q is not a supported media type", filepath.Ext(resolved))
+	}
+
+	return &Source{Raw: raw, Kind: KindLocal, Path: resolved}, nil
+}
+
+func (p *Policy) withinRoots(path string) bool {
+	for _, root := range p.Roots() {
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			continue
+		}
+		if rel == "." || (rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))) {
+			return true
+		}
+	}
+	return false
+}
+
+func IsMediaFile(path string) bool {
+	_, ok := mediaExtensions[strings.ToLower(filepath.Ext(path))]
+	return ok
+}
+
+// isLocalPath reports whether raw is a filesystem path rather than a URL.
+// Windows drive paths (C:\...) would otherwise parse as a URL scheme.
+func isLocalPath(raw string) bool {
+	if strings.HasPrefix(raw, "/") || strings.HasPrefix(raw, `\\`) {
+		return true
+	}
+	if len(raw) >= 3 && raw[1] == ':' && (raw[2] == '\\' || raw[2] == '/') {
+		c := raw[0] | 0x20
+		return c >= 'a' && c <= 'z'
+	}
+	return false
+}
+
+// ProtocolWhitelist returns the -protocol_whitelist value for an ffmpeg or
+// ffprobe input.
+func ProtocolWhitelist(input string) string {
+	lower := strings.ToLower(strings.TrimSpace(input))
+	switch {
+	case strings.HasPrefix(lower, "http://") && strings.Contains(lower, "/torrents/"):
+		return torrentProtocols
+	case strings.HasPrefix(lower, "http://"), strings.HasPrefix(lower, "https://"):
+		return httpProtocols
+	default:
+		return localProtocols
+	}
+}
@@ -0,0 +1,132 @@
+package source
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func rule(err error) string {
+	var v *Violation
+	if errors.As(err, &v) {
+		return v.Rule
+	}
+	return ""
+}
+
+func TestClassifyForbiddenPrefixes(t *testing.T) {
+	p := NewPolicy(nil, "127.0.0.1:6969")
+	tests := []struct {
+		raw  string
+		rule string
+	}{
+		{"concat:/a.mkv|/b.mkv", RuleProtocol},
+		{"subfile,,start,0,end,100,,:/etc/passwd", RuleProtocol},
+		{"file:/etc/passwd", RuleProtocol},
+		{"FILE:/etc/passwd", RuleProtocol},
+		{"crypto:http://example.com/a.ts", RuleProtocol},
+		{"hls+http://example.com/a.m3u8", RuleProtocol},
+		{"pipe:0", RuleProtocol},
+		{"data:video/mp4;base64,AAAA", RuleProtocol},
+		{"lavfi:testsrc", RuleProtocol},
+		{"rtmp://example.com/live", RuleProtocol},
+		{"ftp://example.com/movie.mkv", RuleProtocol},
+		{"gopher://example.com/1", RuleProtocol},
+		{"smb://nas/share/movie.mkv", RuleProtocol},
+		{"mms://example.com/movie", RuleScheme},
+		{"movie.mkv", RuleRelativePath},
+		{"http://127.0.0.1:6969/sessions", RuleInternalPath},
+		{"", RuleEmpty},
+	}
+	for _, tt := range tests {
+		_, err := p.Classify(tt.raw)
+		if got := rule(err); got != tt.rule {
+			t.Errorf("Classify(%q) rule = %q (%v), want %q", tt.raw, got, err, tt.rule)
+		}
+	}
+}
+
+func TestClassifyURLs(t *testing.T) {
+	p := NewPolicy(nil, "127.0.0.1:6969")
+	tests := []struct {
+		raw       string
+		kind      Kind
+		whitelist string
+	}{
+		{"https://cdn.example.com/movie.mkv", KindHTTP, httpProtocols},
+		{"http://127.0.0.1:6969/torrents/abc/files/0", KindTorrent, torrentProtocols},
+		{"http://localhost:6969/torrents/abc/files/0", KindTorrent, torrentProtocols},
+	}
+	for _, tt := range tests {
+		src, err := p.Classify(tt.raw)
+		if err != nil {
+			t.Fatalf("Classify(%q): %v", tt.raw, err)
+		}
+		if src.Kind != tt.kind {
+			t.Errorf("Classify(%q) kind = %q, want %q", tt.raw, src.Kind, tt.kind)
+		}
+		if got := ProtocolWhitelist(src.Input()); got != tt.whitelist {
+			t.Errorf("ProtocolWhitelist(%q) = %q, want %q", tt.raw, got, tt.whitelist)
+		}
+	}
+}
+
+func TestClassifyLocalSymlinks(t *testing.T) {
+	root := t.TempDir()
+	outside := t.TempDir()
+	inside := filepath.Join(root, "movie.mkv")
+	secret := filepath.Join(outside, "secret.mkv")
+	for _, f := range []string{inside, secret} {
+		if err := os.WriteFile(f, []byte("x"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// A link inside the root that points outside of it, and a link outside
+	// of the root that points into it.
+	escape := filepath.Join(root, "escape.mkv")
+	if err := os.Symlink(secret, escape); err != nil {
+		t.Skipf("symlinks unavailable: %v", err)
+	}
+	entry := filepath.Join(outside, "entry.mkv")
+	if err := os.Symlink(inside, entry); err != nil {
+		t.Fatal(err)
+	}
+	dirLink := filepath.Join(root, "other")
+	if err := os.Symlink(outside, dirLink); err != nil {
+		t.Fatal(err)
+	}
+
+	p := NewPolicy([]string{root}, "")
+	resolvedInside, _ := filepath.EvalSymlinks(inside)
+
+	src, err := p.Classify(inside)
+	if err != nil {
+		t.Fatalf("file in root rejected: %v", err)
+	}
+	if src.Kind != KindLocal || src.Path != resolvedInside {
+		t.Errorf("file in root = %+v", src)
+	}
+	if _, err := p.Classify(escape); rule(err) != RuleOutsideRoots {
+		t.Errorf("symlink escaping the root: %v, want %s", err, RuleOutsideRoots)
+	}
+	if _, err := p.Classify(filepath.Join(dirLink, "secret.mkv")); rule(err) != RuleOutsideRoots {
+		t.Errorf("file under a linked directory: %v, want %s", err, RuleOutsideRoots)
+	}
+	if _, err := p.Classify(filepath.Join(root, "..", filepath.Base(outside), "secret.mkv")); rule(err) != RuleOutsideRoots {
+		t.Errorf("dot-dot path: %v, want %s", err, RuleOutsideRoots)
+	}
+	src, err = p.Classify(entry)
+	if err != nil {
+		t.Fatalf("symlink into the root rejected: %v", err)
+	}
+	if src.Path != resolvedInside {
+		t.Errorf("symlink into the root resolved to %q, want %q", src.Path, resolvedInside)
+	}
+	if _, err := p.Classify(filepath.Join(root, "missing.mkv")); rule(err) != RuleNotRegularFile {
+		t.Errorf("missing file: %v, want %s", err, RuleNotRegularFile)
+	}
+	if _, err := p.Classify(root); rule(err) != RuleNotRegularFile {
+		t.Errorf("directory: %v, want %s", err, RuleNotRegularFile)
+	}
+}
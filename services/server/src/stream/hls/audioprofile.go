@@ -0,0 +1,168 @@
+package hls
+
+import (
+	"fmt"
+	"strings"
+)
+
+// AudioProfile names how audio is processed for playback. A session's profile
+// applies to every audio stream the transcoder writes and to clip exports.
+type AudioProfile string
+
+const (
+	// AudioProfileAuto is the default and matches the behaviour from before
+	// profiles existed: playback copies AAC and converts anything else with
+	// the voice profile; clips are plain AAC stereo (see ClipEncoderArgs).
+	AudioProfileAuto AudioProfile = "auto"
+	// AudioProfilePassthrough copies AAC and otherwise re-encodes to AAC with
+	// the source channel layout and no filtering.
+	AudioProfilePassthrough AudioProfile = "passthrough"
+	// AudioProfileStereo is a plain stereo downmix.
+	AudioProfileStereo AudioProfile = "stereo"
+	// AudioProfileNight compresses the dynamic range so explosions and
+	// whispers end up closer in level.
+	AudioProfileNight AudioProfile = "night"
+	// AudioProfileDialogue favours the centre channel and speech frequencies.
+	AudioProfileDialogue AudioProfile = "dialogue"
+	// AudioProfileSurround keeps 5.1 as AAC; sources with fewer channels get
+	// the stereo profile.
+	AudioProfileSurround AudioProfile = "surround"
+	// AudioProfileLoudness downmixes to stereo and normalizes loudness, so
+	// every source plays at the same level.
+	AudioProfileLoudness AudioProfile = "loudness"
+	// AudioProfileVoice downmixes surround to stereo with the centre channel
+	// in front and normalizes loudness.
+	AudioProfileVoice AudioProfile = "voice"
+)
+
+// AudioProfiles lists the valid profiles.
+var AudioProfiles = []AudioProfile{
+	AudioProfileAuto,
+	AudioProfilePassthrough,
+	AudioProfileStereo,
+	AudioProfileNight,
+	AudioProfileDialogue,
+	AudioProfileSurround,
+	AudioProfileLoudness,
+	AudioProfileVoice,
+}
+
+// ParseAudioProfile validates a profile name. The empty string is the default.
+func ParseAudioProfile(name string) (AudioProfile, error) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if name == "" {
+		return AudioProfileAuto, nil
+	}
+	for _, p := range AudioProfiles {
+		if string(p) == name {
+			return p, nil
+		}
+	}
+	names := make([]string, len(AudioProfiles))
+	for i, p := range AudioProfiles {
+		names[i] = string(p)
+	}
+	return "", fmt.Errorf("unknown audio profile %q (want one of %s)", name, strings.Join(names, ", "))
+}
+
+const (
+	// dialogueDownmix keeps the centre channel at full level and mixes the
+	// rest in quietly. It needs a source with a centre channel.
+	dialogueDownmix = "pan=stereo|FL=FC+0.30*FL+0.30*BL|FR=FC+0.30*FR+0.30*BR"
+	loudnessFilter  = "loudnorm=I=-16:TP=-1.5:LRA=11"
+	nightFilter     = "acompressor=threshold=-30dB:ratio=6:attack=5:release=300:makeup=12dB,alimiter=limit=-1dB"
+	speechFilter    = "highpass=f=80,equalizer=f=2500:t=q:w=1.5:g=4"
+
+	stereoBitRate   = "160k"
+	surroundBitRate = "384k"
+)
+
+// EncoderArgs returns the ffmpeg audio codec and filter arguments for one
+// output stream. codec and channels describe the source stream; channels is
+// 0 when unknown.
+func (p AudioProfile) EncoderArgs(codec string, channels int) []string {
+	switch p {
+	case AudioProfilePassthrough:
+		if codec == "aac" {
+			return []string{"-c:a", "copy"}
+		}
+		bitRate := stereoBitRate
+		if channels > 2 {
+			bitRate = surroundBitRate
+		}
+		return aacArgs(0, bitRate, "aresample=async=1")
+	case AudioProfileStereo:
+		return aacArgs(2, stereoBitRate, "aresample=async=1")
+	case AudioProfileNight:
+		return aacArgs(2, stereoBitRate, "aresample=async=1,"+nightFilter)
+	case AudioProfileDialogue:
+		chain := "aresample=async=1," + speechFilter + "," + loudnessFilter
+		if channels > 2 {
+			chain = "aresample=async=1," + dialogueDownmix + "," + speechFilter + "," + loudnessFilter
+		}
+		return aacArgs(2, stereoBitRate, chain)
+	case AudioProfileSurround:
+		if channels < 6 {
+			return AudioProfileStereo.EncoderArgs(codec, channels)
+		}
+		if codec == "aac" && channels == 6 {
+			return []string{"-c:a", "copy"}
+		}
+		return aacArgs(6, surroundBitRate, "aresample=async=1")
+	case AudioProfileLoudness:
+		return aacArgs(2, stereoBitRate, "aresample=async=1,"+loudnessFilter)
+	case AudioProfileVoice:
+		chain := "aresample=async=1," + loudnessFilter
+		if channels > 2 {
+			chain = "aresample=async=1," + dialogueDownmix + "," + loudnessFilter
+		}
+		return aacArgs(2, stereoBitRate, chain)
+	}
+
+	if codec == "aac" {
+		return []string{"-c:a", "copy"}
+	}
+	return AudioProfileVoice.EncoderArgs(codec, channels)
+}
+
+// ClipEncoderArgs is EncoderArgs for clip exports. With auto every source is
+// re-encoded to plain AAC stereo; other profiles apply as in playback.
+func (p AudioProfile) ClipEncoderArgs(codec string, channels int) []string {
+	if p == AudioProfileAuto || p == "" {
+		return []string{"-c:a", "aac", "-ac", "2", "-ar", "48000", "-b:a", stereoBitRate}
+	}
+	return p.EncoderArgs(codec, channels)
+}
+
+// OutputChannels is the channel count EncoderArgs produces for a source with
+// the given codec and channels, or 0 when it keeps an unknown layout.
+func (p AudioProfile) OutputChannels(codec string, channels int) int {
+	switch p {
+	case AudioProfilePassthrough:
+		return channels
+	case AudioProfileSurround:
+		if channels >= 6 {
+			return 6
+		}
+		return 2
+	case AudioProfileStereo, AudioProfileNight, AudioProfileDialogue, AudioProfileLoudness, AudioProfileVoice:
+		return 2
+	}
+	if codec == "aac" {
+		return channels
+	}
+	return 2
+}
+
+// aacArgs encodes AAC at 48 kHz. channels 0 keeps the source layout.
+func aacArgs(channels int, bitRate, filters string) []string {
+	args := []string{"-c:a", "aac"}
+	if channels > 0 {
+		args = append(args, "-ac", fmt.Sprint(channels))
+	}
+	return append(args,
+		"-ar", "48000",
+		"-b:a", bitRate,
+		"-af", filters,
+	)
+}
@@ -0,0 +1,78 @@
+package hls
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestAudioProfileArgs(t *testing.T) {
+	const (
+		resample = "aresample=async=1"
+		downmix  = "aresample=async=1," + dialogueDownmix
+	)
+	stereo := func(filters string) []string {
+		return []string{"-c:a", "aac", "-ac", "2", "-ar", "48000", "-b:a", stereoBitRate, "-af", filters}
+	}
+	copyAudio := []string{"-c:a", "copy"}
+
+	tests := []struct {
+		profile  AudioProfile
+		codec    string
+		channels int
+		want     []string
+		clip     []string // nil when clips get the same arguments
+		outputCh int
+	}{
+		{AudioProfileAuto, "aac", 2, copyAudio, plainClip, 2},
+		{AudioProfileAuto, "aac", 6, copyAudio, plainClip, 6},
+		{AudioProfileAuto, "ac3", 2, stereo(resample + "," + loudnessFilter), plainClip, 2},
+		{AudioProfileAuto, "ac3", 6, stereo(downmix + "," + loudnessFilter), plainClip, 2},
+		{AudioProfileVoice, "aac", 2, stereo(resample + "," + loudnessFilter), nil, 2},
+		{AudioProfileVoice, "dts", 6, stereo(downmix + "," + loudnessFilter), nil, 2},
+		{AudioProfilePassthrough, "aac", 6, copyAudio, nil, 6},
+		{AudioProfilePassthrough, "dts", 6, []string{"-c:a", "aac", "-ar", "48000", "-b:a", surroundBitRate, "-af", resample}, nil, 6},
+		{AudioProfileStereo, "aac", 6, stereo(resample), nil, 2},
+		{AudioProfileNight, "ac3", 6, stereo(resample + "," + nightFilter), nil, 2},
+		{AudioProfileDialogue, "aac", 2, stereo(resample + "," + speechFilter + "," + loudnessFilter), nil, 2},
+		{AudioProfileDialogue, "ac3", 6, stereo(downmix + "," + speechFilter + "," + loudnessFilter), nil, 2},
+		{AudioProfileSurround, "aac", 6, copyAudio, nil, 6},
+		{AudioProfileSurround, "eac3", 8, []string{"-c:a", "aac", "-ac", "6", "-ar", "48000", "-b:a", surroundBitRate, "-af", resample}, nil, 6},
+		{AudioProfileSurround, "ac3", 2, stereo(resample), nil, 2},
+		{AudioProfileLoudness, "aac", 6, stereo(resample + "," + loudnessFilter), nil, 2},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s/%s/%dch", tt.profile, tt.codec, tt.channels), func(t *testing.T) {
+			if got := tt.profile.EncoderArgs(tt.codec, tt.channels); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("EncoderArgs = %q, want %q", got, tt.want)
+			}
+			clip := tt.clip
+			if clip == nil {
+				clip = tt.want
+			}
+			if got := tt.profile.ClipEncoderArgs(tt.codec, tt.channels); !reflect.DeepEqual(got, clip) {
+				t.Errorf("ClipEncoderArgs = %q, want %q", got, clip)
+			}
+			if got := tt.profile.OutputChannels(tt.codec, tt.channels); got != tt.outputCh {
+				t.Errorf("OutputChannels = %d, want %d", got, tt.outputCh)
+			}
+		})
+	}
+}
+
+// plainClip is what clips got before audio profiles existed.
+var plainClip = []string{"-c:a", "aac", "-ac", "2", "-ar", "48000", "-b:a", "160k"}
+
+func TestParseAudioProfile(t *testing.T) {
+	for _, name := range []string{"", " AUTO "} {
+		if p, err := ParseAudioProfile(name); err != nil || p != AudioProfileAuto {
+			t.Errorf("ParseAudioProfile(%q) = %q, %v", name, p, err)
+		}
+	}
+	if p, err := ParseAudioProfile("voice"); err != nil || p != AudioProfileVoice {
+		t.Errorf("ParseAudioProfile(voice) = %q, %v", p, err)
+	}
+	if _, err := ParseAudioProfile("cinema"); err == nil {
+		t.Error("unknown profile accepted")
+	}
+}
@@ -0,0 +1,253 @@
+package hls
+
+import (
+	"log"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"raffi-server/src/session"
+)
+
+// A client that downloads segments slower than it plays them will stall. The
+// server times the delivery of each video segment (RecordSegmentDelivery) and
+// compares the throughput over the last few segments with the bit rate of the
+// video it served. When the client falls behind, encoding restarts with a
+// lower size and bit rate cap after the segments already written, so the
+// player's playlist carries on. Caps only go down for the life of a session.
+
+const (
+	bandwidthWindow     = 6
+	bandwidthMinSamples = 4
+	// Smaller responses fit in socket buffers and say little about the link.
+	bandwidthMinSampleBytes = 64 << 10
+	// bandwidthHeadroom is the share of the throughput a reduced cap uses.
+	bandwidthHeadroom = 0.75
+	minCappedBitRate  = 400_000
+)
+
+// qualityRungs are the sizes a reduced cap steps down through, largest first,
+// with the bit rate each needs.
+var qualityRungs = []struct {
+	height  int
+	bitRate int64
+}{
+	{1080, 6_000_000},
+	{720, 3_000_000},
+	{480, 1_500_000},
+	{360, 800_000},
+}
+
+// deliverySample is one video segment sent to the client.
+type deliverySample struct {
+	bytes   int64
+	media   float64
+	elapsed time.Duration
+}
+
+// bandwidthEstimate holds the last bandwidthWindow deliveries of a session.
+type bandwidthEstimate struct {
+	samples []deliverySample
+}
+
+func (e *bandwidthEstimate) add(s deliverySample) {
+	e.samples = append(e.samples, s)
+	if len(e.samples) > bandwidthWindow {
+		e.samples = e.samples[len(e.samples)-bandwidthWindow:]
+	}
+}
+
+// rates returns the client's throughput and the bit rate of the media it
+// downloaded, both in bits per second. ok is false until there are
+// bandwidthMinSamples samples.
+func (e *bandwidthEstimate) rates() (throughput, bitRate int64, ok bool) {
+	if len(e.samples) < bandwidthMinSamples {
+		return 0, 0, false
+	}
+	var bytes int64
+	var media float64
+	var elapsed time.Duration
+	for _, s := range e.samples {
+		bytes += s.bytes
+		media += s.media
+		elapsed += s.elapsed
+	}
+	if media <= 0 || elapsed <= 0 {
+		return 0, 0, false
+	}
+	bits := float64(bytes * 8)
+	return int64(bits / elapsed.Seconds()), int64(bits / media), true
+}
+
+// reducedProfile caps p for a client with the given throughput. height is
+// the source's video height (0 if unknown). ok is false if p is already
+// capped at least as low.
+func reducedProfile(p EncodingProfile, height int, throughput int64) (EncodingProfile, bool) {
+	target := max(int64(float64(throughput)*bandwidthHeadroom), minCappedBitRate)
+	if p.MaxBitRate > 0 && target >= p.MaxBitRate {
+		return p, false
+	}
+
+	current := height
+	if p.MaxHeight > 0 && (current == 0 || p.MaxHeight < current) {
+		current = p.MaxHeight
+	}
+	rung := qualityRungs[len(qualityRungs)-1]
+	for _, r := range qualityRungs {
+		if r.bitRate <= target {
+			rung = r
+			break
+		}
+	}
+	if current == 0 || rung.height < current {
+		p.MaxHeight = rung.height
+	}
+	p.MaxBitRate = target
+	return p, true
+}
+
+// RecordSegmentDelivery records that size bytes of video segment asset (as
+// passed to MarkSegmentServed) took elapsed to send to the client of session
+// id, and lowers the session's video quality if the client cannot keep up.
+func (c *Controller) RecordSegmentDelivery(id, asset string, size int64, elapsed time.Duration) {
+	if size < bandwidthMinSampleBytes || elapsed <= 0 {
+		return
+	}
+	sess := c.lockSession(id)
+	if sess == nil {
+		return
+	}
+	defer sess.mu.Unlock()
+
+	media, ok := segmentDurationLocked(sess, asset)
+	if !ok {
+		return
+	}
+	sess.bandwidth.add(deliverySample{bytes: size, media: media, elapsed: elapsed})
+	throughput, bitRate, ok := sess.bandwidth.rates()
+	if !ok || throughput >= bitRate {
+		return
+	}
+	c.reduceQualityLocked(sess, throughput, bitRate)
+}
+
+// QualityCap returns the cap session id's video is encoded with because of
+// the client's bandwidth, or nil at full quality.
+func (c *Controller) QualityCap(id string) *session.QualityCap {
+	sess := c.lockSession(id)
+	if sess == nil {
+		return nil
+	}
+	defer sess.mu.Unlock()
+	if sess.QualityCap == nil {
+		return nil
+	}
+	qc := *sess.QualityCap
+	return &qc
+}
+
+func (c *Controller) reduceQualityLocked(sess *Session, throughput, bitRate int64) {
+	profile, ok := reducedProfile(sess.Profile, sess.VideoHeight, throughput)
+	if !ok {
+		return
+	}
+	log.Printf("Session %s: client downloads %d kb/s of %d kb/s video, capping at %dp and %d kb/s",
+		sess.ID, throughput/1000, bitRate/1000, profile.MaxHeight, profile.MaxBitRate/1000)
+
+	copied := sess.Codec == "h264"
+	sess.Profile = profile
+	sess.Codec = "libx264"
+	sess.QualityCap = &session.QualityCap{
+		MaxHeight:  profile.MaxHeight,
+		MaxBitRate: profile.MaxBitRate,
+		Throughput: throughput,
+		ReducedAt:  time.Now(),
+	}
+	sess.bandwidth = bandwidthEstimate{}
+
+	if sess.Cmd == nil || sess.SliceIndex >= len(sess.Slices) {
+		// Whatever is encoded next uses the new profile.
+		return
+	}
+	slice := sess.Slices[sess.SliceIndex]
+	manifestPath := filepath.Join(sess.sliceDir(slice.Index), "child.m3u8")
+
+	if slice.VOD {
+		next := slice.StartSeq
+		if mediaSeq, count, err := readPlaylistState(manifestPath); err == nil && count > 0 {
+			next = mediaSeq + count
+		}
+		if next >= vodSegmentCount(sess.DurationHint) {
+			return
+		}
+		if _, err := c.newSliceLocked(sess, SliceInfo{
+			StartTime: float64(next) * DefaultSegmentDuration.Seconds(),
+			VOD:       true,
+			StartSeq:  next,
+		}); err != nil {
+			log.Printf("Failed to restart session %s at reduced quality: %v", sess.ID, err)
+		}
+		return
+	}
+
+	// Transcoded segments no longer end on source keyframes.
+	if copied {
+		sess.Slices[slice.Index].Keyframe = false
+	}
+	stopCmdLocked(sess)
+	_, timeline, err := readPlaylistTimeline(manifestPath, slice.StartTime)
+	if err != nil || len(timeline) == 0 {
+		if err := c.ensureCmdLocked(sess, slice.StartTime, sess.sliceDir(slice.Index), false, len(sess.AvailableStreams) > 0); err != nil {
+			log.Printf("Failed to restart session %s at reduced quality: %v", sess.ID, err)
+		}
+		return
+	}
+	// The appended segments have another size and bit rate, and another
+	// codec after a stream copy, so players reset their decoders there.
+	playlists := []string{"child.m3u8"}
+	for _, idx := range sess.AudioRenditions {
+		playlists = append(playlists, AudioPlaylistName(idx))
+	}
+	for _, name := range playlists {
+		if err := appendDiscontinuity(filepath.Join(sess.sliceDir(slice.Index), name)); err != nil {
+			log.Printf("Session %s: failed to mark discontinuity in %s: %v", sess.ID, name, err)
+		}
+	}
+	c.continueSliceLocked(sess, slice.Index, timeline[len(timeline)-1].End)
+}
+
+// segmentDurationLocked returns the length in seconds of video segment
+// asset, named as for MarkSegmentServed.
+func segmentDurationLocked(sess *Session, asset string) (float64, bool) {
+	if strings.HasPrefix(asset, VODSegmentPrefix) {
+		seq, ok := parseSegmentSequence(asset)
+		if !ok {
+			return 0, false
+		}
+		segDur := DefaultSegmentDuration.Seconds()
+		if sess.DurationHint > 0 {
+			segDur = min(segDur, sess.DurationHint-float64(seq)*segDur)
+		}
+		return segDur, segDur > 0
+	}
+
+	index := sess.PlaylistSlice
+	if i, ok := assetSlice(asset); ok {
+		index = i
+	}
+	if index >= len(sess.Slices) {
+		return 0, false
+	}
+	_, timeline, err := readPlaylistTimeline(filepath.Join(sess.sliceDir(index), "child.m3u8"), sess.Slices[index].StartTime)
+	if err != nil {
+		return 0, false
+	}
+	name := path.Base(asset)
+	for _, seg := range timeline {
+		if seg.Filename == name {
+			return seg.End - seg.Start, true
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,52 @@
+package hls
+
+import (
+	"context"
+	"log"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+// Helper commands are canceled together on shutdown; commandsRunning counts
+// those whose caller is not done with them yet.
+var (
+	commandsCtx, cancelCommands = context.WithCancel(context.Background())
+	commandsRunning             sync.WaitGroup
+)
+
+// CommandContext is exec.CommandContext for helper ffmpeg and ffprobe runs
+// outside the controller: the process gets its own group, so canceling ctx
+// kills anything it spawned too, and on Linux it dies with the server.
+// StopCommands kills it as well, so ctx must be canceled once the caller is
+// done with the command.
+func CommandContext(ctx context.Context, name string, args ...string) *exec.Cmd {
+	cmdCtx, cancel := context.WithCancel(ctx)
+	stop := context.AfterFunc(commandsCtx, cancel)
+	commandsRunning.Add(1)
+	context.AfterFunc(ctx, func() {
+		stop()
+		cancel()
+		commandsRunning.Done()
+	})
+
+	cmd := exec.CommandContext(cmdCtx, name, args...)
+	configureProcess(cmd)
+	return cmd
+}
+
+// StopCommands kills the processes started with CommandContext, and any
+// started later, and waits up to timeout for their callers to finish.
+func StopCommands(timeout time.Duration) {
+	cancelCommands()
+	done := make(chan struct{})
+	go func() {
+		commandsRunning.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		log.Printf("Timed out waiting for helper ffmpeg processes to exit")
+	}
+}
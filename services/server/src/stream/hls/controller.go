@@ -2,6 +2,7 @@ package hls
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
 	"os"
@@ -19,156 +20,291 @@ const (
 	sliceReuseSafetyMargin = 5.0
 )
 
+// Controller owns the HLS transcoding sessions.
+//
+// Locking: mu guards only the sessions map and the probe cache pointer and is
+// never held across I/O. Everything else about a session is guarded by its own
+// Session.mu, so a slow probe or ffmpeg start for one session does not block
+// requests for another. Lock order is mu before Session.mu; never take mu while
+// holding a session lock.
 type Controller struct {
 	mu         sync.Mutex
 	sessions   map[string]*Session
-	probeCache map[string]probeCacheEntry
+	probeCache *ProbeCache
+	probes     probeGroup
+	options    map[string]SessionOptions
 	ffprobeFn  func(ctx context.Context, source string) (*Metadata, string, error)
 	startCmd   TranscoderFunc
-}
 
-type probeCacheEntry struct {
-	meta  *Metadata
-	codec string
+	keyframes      *keyframeIndex
+	keyframeScanFn KeyframeScanFunc
+
+	// running counts ffmpeg processes not yet waited for.
+	running sync.WaitGroup
 }
 
+var errSessionStopped = errors.New("session was stopped")
+
 func NewController(ffmpegPath, ffprobePath string) *Controller {
 	return &Controller{
 		sessions:   make(map[string]*Session),
-		probeCache: make(map[string]probeCacheEntry),
+		probeCache: NewProbeCache("", DefaultProbeCacheSize),
+		options:    make(map[string]SessionOptions),
 		ffprobeFn:  NewProbeDuration(ffprobePath),
 		startCmd:   NewTranscoder(ffmpegPath),
+
+		keyframes:      newKeyframeIndex(),
+		keyframeScanFn: NewKeyframeScan(ffprobePath),
 	}
 }
 
-func (c *Controller) getOrProbeLocked(ctx context.Context, source string) (*Metadata, string, error) {
-	if cached, ok := c.probeCache[source]; ok {
-		return cached.meta, cached.codec, nil
+// UseProbeCache replaces the in-memory probe cache, e.g. with a persistent one.
+func (c *Controller) UseProbeCache(cache *ProbeCache) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.probeCache = cache
+}
+
+func (c *Controller) ProbeCache() *ProbeCache {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.probeCache
+}
+
+// SessionOptions are per-session settings that apply when the transcoding
+// session is created.
+type SessionOptions struct {
+	Preferences session.TrackPreferences
+	// AudioRenditions is the number of audio streams to publish as separate
+	// HLS renditions; 0 muxes the selected stream into the video playlist.
+	AudioRenditions int
+	AudioProfile    AudioProfile
+	SegmentFormat   SegmentFormat
+	// LowLatency starts slices with short segments (see lowlatency.go).
+	LowLatency bool
+	// Profile encodes the video. Sources above its size or bit rate limits
+	// are transcoded even when they could be stream-copied.
+	Profile EncodingProfile
+	// DisplayHDR is set for clients that can show HDR video. Other clients
+	// get HDR sources transcoded and tone-mapped even when they could be
+	// stream-copied.
+	DisplayHDR bool
+}
+
+// Configure sets the options for the session id. Call it before the first
+// playlist request.
+func (c *Controller) Configure(id string, opts SessionOptions) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.options[id] = opts
+}
+
+func (c *Controller) sessionOptions(id string) SessionOptions {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if opts, ok := c.options[id]; ok {
+		return opts
 	}
+	return SessionOptions{Preferences: session.DefaultTrackPreferences(), AudioProfile: AudioProfileAuto, SegmentFormat: SegmentFormatTS, Profile: DefaultEncodingProfile}
+}
 
-	meta, codec, err := c.ffprobeFn(ctx, source)
-	if err != nil {
-		return nil, "", err
+// probe returns cached metadata for source or runs ffprobe. Concurrent probes
+// of the same content share one ffprobe process. No controller lock is held.
+func (c *Controller) probe(ctx context.Context, source string) (*Metadata, string, error) {
+	cache := c.ProbeCache()
+	if meta, codec, ok := cache.Get(source); ok {
+		return meta, codec, nil
 	}
 
-	c.probeCache[source] = probeCacheEntry{meta: meta, codec: codec}
-	return meta, codec, nil
+	return c.probes.do(ctx, ProbeCacheKey(source), func(probeCtx context.Context) (*Metadata, string, error) {
+		meta, codec, err := c.ffprobeFn(probeCtx, source)
+		if err != nil {
+			return nil, "", err
+		}
+		cache.Put(source, meta, codec)
+		return meta, codec, nil
+	})
 }
 
-func isTorrentSource(source string) bool {
-	// Raffi torrent sessions use a local HTTP source like:
-	// http://127.0.0.1:6969/torrents/{infoHash}
-	return strings.Contains(source, "/torrents/")
+// lockSession returns the session for id with its lock held, or nil.
+func (c *Controller) lockSession(id string) *Session {
+	c.mu.Lock()
+	sess := c.sessions[id]
+	c.mu.Unlock()
+	if sess == nil {
+		return nil
+	}
+	sess.mu.Lock()
+	if sess.stopped {
+		sess.mu.Unlock()
+		return nil
+	}
+	return sess
 }
 
-func (c *Controller) EnsureSession(ctx context.Context, id, source string, startTime float64) (float64, string, error) {
+// lockOrCreateSession returns the session for id with its lock held, probing
+// the source and registering a new session first if there is none. The probe
+// runs without any lock; if another request registers the session meanwhile,
+// that one wins. created reports whether this call registered it.
+func (c *Controller) lockOrCreateSession(ctx context.Context, id, source string, startTime float64, torrentProbeTimeout time.Duration) (sess *Session, created bool, err error) {
+	if sess := c.lockSession(id); sess != nil {
+		return sess, false, nil
+	}
+
+	baseDir := session.TempDirForSession(id)
+	if err := os.MkdirAll(baseDir, 0o755); err != nil {
+		return nil, false, err
+	}
+	if err := writeOwnerFile(baseDir); err != nil {
+		return nil, false, err
+	}
+
+	probeCtx := ctx
+	if isTorrentSource(source) {
+		ctxProbe, cancel := context.WithTimeout(ctx, torrentProbeTimeout)
+		defer cancel()
+		probeCtx = ctxProbe
+	}
+	meta, codec, err := c.probe(probeCtx, source)
+	if err != nil {
+		return nil, false, fmt.Errorf("probe failed: %w", err)
+	}
+	startTime, keyframe := c.keyframeBefore(probeCtx, source, startTime)
+
+	fresh := newSession(id, source, baseDir, startTime, meta, codec, c.sessionOptions(id))
+	fresh.Slices[0].Keyframe = keyframe
+
 	c.mu.Lock()
-	sess := c.sessions[id]
+	sess = c.sessions[id]
 	if sess == nil {
-		baseDir := session.TempDirForSession(id)
-		if err := os.MkdirAll(baseDir, 0o755); err != nil {
-			c.mu.Unlock()
-			return 0, "", err
-		}
+		sess = fresh
+		c.sessions[id] = sess
+		created = true
+	}
+	c.mu.Unlock()
 
-		probeCtx := ctx
-		if isTorrentSource(source) {
-			ctxProbe, cancel := context.WithTimeout(ctx, 10*time.Second)
-			defer cancel()
-			probeCtx = ctxProbe
-		}
+	sess.mu.Lock()
+	if sess.stopped {
+		sess.mu.Unlock()
+		return nil, false, errSessionStopped
+	}
+	return sess, created, nil
+}
 
-		meta, codec, err := c.getOrProbeLocked(probeCtx, source)
-		if err != nil {
-			c.mu.Unlock()
-			return 0, "", fmt.Errorf("probe failed: %w", err)
+func newSession(id, source, baseDir string, startTime float64, meta *Metadata, codec string, opts SessionOptions) *Session {
+	var streams []session.StreamInfo
+	audioCount := 0
+
+	for _, st := range meta.Streams {
+		if st.CodecType == "audio" {
+			streams = append(streams, session.StreamInfo{
+				Index:    audioCount, // This is the index relative to audio streams for ffmpeg map
+				Type:     "audio",
+				Codec:    st.CodecName,
+				Language: st.Tags.Language,
+				Title:    st.Tags.Title,
+				Channels: st.Channels,
+			})
+			audioCount++
 		}
-		duration := meta.Format.DurationSeconds
-
-		var streams []session.StreamInfo
-		audioIndex := 0
-		audioCount := 0
-		foundEng := false
-
-		for _, st := range meta.Streams {
-			if st.CodecType == "audio" {
-				streams = append(streams, session.StreamInfo{
-					Index:    audioCount, // This is the index relative to audio streams for ffmpeg map
-					Type:     "audio",
-					Codec:    st.CodecName,
-					Language: st.Tags.Language,
-					Title:    st.Tags.Title,
-				})
-
-				if st.Tags.Language == "eng" && !foundEng {
-					audioIndex = audioCount
-					foundEng = true
-				}
-				audioCount++
-			}
+	}
+	media := meta.MediaInfo()
+	ranked := session.RankAudio(media.Audio, opts.Preferences)
+	audioIndex := 0
+	if len(ranked) > 0 {
+		audioIndex = ranked[0]
+	}
+	var renditions []int
+	if opts.AudioRenditions > 0 {
+		renditions = ranked[:min(opts.AudioRenditions, len(ranked))]
+	}
+	videoHeight := 0
+	if media.Video != nil {
+		videoHeight = media.Video.Height
+	}
+	if codec == "h264" && media.Video != nil {
+		bitRate := media.Video.BitRate
+		if bitRate == 0 {
+			bitRate = media.BitRate
 		}
-
-		// Find codec for selected audio index
-		audioCodec := "aac" // Default
-		currentAudioIdx := 0
-		for _, st := range meta.Streams {
-			if st.CodecType == "audio" {
-				if currentAudioIdx == audioIndex {
-					audioCodec = st.CodecName
-					break
-				}
-				currentAudioIdx++
-			}
+		if !opts.Profile.allowsCopy(media.Video.Width, media.Video.Height, bitRate) {
+			codec = "libx264"
 		}
-
-		sess = &Session{
-			ID:               id,
-			Source:           source,
-			WorkDir:          baseDir,
-			DurationHint:     duration,
-			Codec:            codec,
-			AudioIndex:       audioIndex,
-			AudioCodec:       audioCodec,
-			AvailableStreams: streams,
-			LastServedSeq:    -1,
-			SliceIndex:       0,
-			Slices: []SliceInfo{
-				{Index: 0, StartTime: startTime},
-			},
+		if media.Video.HDR != session.HDRNone && !opts.DisplayHDR {
+			codec = "libx264"
 		}
-		c.sessions[id] = sess
+	}
+
+	return &Session{
+		ID:               id,
+		Source:           source,
+		WorkDir:          baseDir,
+		LastAccess:       time.Now(),
+		DurationHint:     meta.Format.DurationSeconds,
+		Codec:            codec,
+		AudioIndex:       audioIndex,
+		AudioProfile:     opts.AudioProfile,
+		SegmentFormat:    opts.SegmentFormat,
+		LowLatency:       opts.LowLatency,
+		Profile:          opts.Profile,
+		AvailableStreams: streams,
+		AudioRenditions:  renditions,
+		BitRate:          media.BitRate,
+		VideoHeight:      videoHeight,
+		ToneMap:          ToneMapFor(media.Video),
+		LastServedSeq:    -1,
+		SliceIndex:       0,
+		Slices: []SliceInfo{
+			{Index: 0, StartTime: startTime},
+		},
+	}
+}
+
+func isTorrentSource(source string) bool {
+	// Raffi torrent sessions use a local HTTP source like:
+	// http://127.0.0.1:6969/torrents/{infoHash}
+	return strings.Contains(source, "/torrents/")
+}
+
+func (c *Controller) EnsureSession(ctx context.Context, id, source string, startTime float64) (float64, string, error) {
+	sess, _, err := c.lockOrCreateSession(ctx, id, source, startTime, 10*time.Second)
+	if err != nil {
+		return 0, "", err
 	}
 
 	sess.LastAccess = time.Now()
 
-	if (sess.Cmd != nil && sess.Cmd.Process != nil) || sess.Finished {
-		sliceDir := filepath.Join(sess.WorkDir, fmt.Sprintf("slice_%03d", sess.SliceIndex))
+	if (sess.Cmd != nil && sess.Cmd.Process != nil) || sess.Finished || sess.AtCoverage {
+		sliceDir := filepath.Join(sess.WorkDir, fmt.Sprintf("slice_%03d", sess.PlaylistSlice))
 		manifestPath := filepath.Join(sliceDir, "child.m3u8")
-		c.mu.Unlock()
-		return sess.DurationHint, manifestPath, nil
+		duration := sess.DurationHint
+		sess.mu.Unlock()
+		return duration, manifestPath, nil
 	}
 
+	sess.SliceIndex = sess.PlaylistSlice
 	sliceDir := filepath.Join(sess.WorkDir, fmt.Sprintf("slice_%03d", sess.SliceIndex))
 	if err := os.MkdirAll(sliceDir, 0o755); err != nil {
-		c.mu.Unlock()
+		sess.mu.Unlock()
 		return 0, "", err
 	}
 
-	if err := c.ensureCmdLocked(id, source, sess, sess.Slices[sess.SliceIndex].StartTime, sliceDir, false, len(sess.AvailableStreams) > 0); err != nil {
-		c.mu.Unlock()
+	if err := c.ensureCmdLocked(sess, sess.Slices[sess.SliceIndex].StartTime, sliceDir, false, len(sess.AvailableStreams) > 0); err != nil {
+		sess.mu.Unlock()
 		return 0, "", err
 	}
 
 	duration := sess.DurationHint
 	manifestPath := filepath.Join(sliceDir, "child.m3u8")
-	abortFn := c.transcoderAbortFn(id)
-	c.mu.Unlock()
+	abortFn := transcoderAbortFn(sess)
+	ready := startupBuffer(sess)
+	sess.mu.Unlock()
 
 	manifestTimeout := 10 * time.Second
 	if isTorrentSource(source) {
 		manifestTimeout = 60 * time.Second
 	}
-	if err := waitForManifestReady(manifestPath, manifestTimeout, abortFn); err != nil {
+	if err := waitForManifestReady(manifestPath, ready, manifestTimeout, abortFn); err != nil {
 		return 0, "", err
 	}
 
@@ -176,113 +312,59 @@ func (c *Controller) EnsureSession(ctx context.Context, id, source string, start
 }
 
 func (c *Controller) Seek(ctx context.Context, id, source string, target float64, seekID string, forceSlice bool) (float64, float64, string, error) {
-	c.mu.Lock()
-	sess := c.sessions[id]
-	if sess == nil {
-		log.Printf("Seek: session %s is nil, creating new...", id)
-		// ... (rest of the new creation logic)
-		// Create session if not exists, starting at target
-		baseDir := session.TempDirForSession(id)
-		if err := os.MkdirAll(baseDir, 0o755); err != nil {
-			c.mu.Unlock()
-			return 0, 0, "", err
-		}
-
-		probeCtx := ctx
-		if isTorrentSource(source) {
-			ctxProbe, cancel := context.WithTimeout(ctx, 2*time.Minute)
-			defer cancel()
-			probeCtx = ctxProbe
-		}
-		meta, codec, err := c.getOrProbeLocked(probeCtx, source)
-		if err != nil {
-			c.mu.Unlock()
-			return 0, 0, "", fmt.Errorf("probe failed: %w", err)
-		}
-		duration := meta.Format.DurationSeconds
-
-		audioIndex := 0
-		audioCount := 0
-		foundEng := false
-		for _, st := range meta.Streams {
-			if st.CodecType == "audio" {
-				if st.Tags.Language == "eng" && !foundEng {
-					audioIndex = audioCount
-					foundEng = true
-				}
-				audioCount++
-			}
-		}
-
-		// Find codec for selected audio index
-		audioCodec := "aac" // Default
-		currentAudioIdx := 0
-		for _, st := range meta.Streams {
-			if st.CodecType == "audio" {
-				if currentAudioIdx == audioIndex {
-					audioCodec = st.CodecName
-					break
-				}
-				currentAudioIdx++
-			}
-		}
-
-		sess = &Session{
-			WorkDir:       baseDir,
-			DurationHint:  duration,
-			Codec:         codec,
-			AudioIndex:    audioIndex,
-			AudioCodec:    audioCodec,
-			LastServedSeq: -1,
-			SliceIndex:    0,
-			Slices: []SliceInfo{
-				{Index: 0, StartTime: target},
-			},
-			LastSeekID: seekID,
-		}
-		c.sessions[id] = sess
+	sess, created, err := c.lockOrCreateSession(ctx, id, source, target, 2*time.Minute)
+	if err != nil {
+		return 0, 0, "", err
+	}
+	if created {
+		start := sess.Slices[sess.SliceIndex].StartTime
+		log.Printf("Seek: session %s did not exist, created at %.2f for target %.2f", id, start, target)
+		sess.LastSeekID = seekID
 
 		// Initialize the first slice
 		sliceDir := filepath.Join(sess.WorkDir, fmt.Sprintf("slice_%03d", sess.SliceIndex))
 		if err := os.MkdirAll(sliceDir, 0o755); err != nil {
-			c.mu.Unlock()
+			sess.mu.Unlock()
 			return 0, 0, "", err
 		}
 
-		if err := c.ensureCmdLocked(id, source, sess, target, sliceDir, false, len(sess.AvailableStreams) > 0); err != nil {
-			c.mu.Unlock()
+		if err := c.ensureCmdLocked(sess, start, sliceDir, false, len(sess.AvailableStreams) > 0); err != nil {
+			sess.mu.Unlock()
 			return 0, 0, "", err
 		}
 
+		duration := sess.DurationHint
 		manifestPath := filepath.Join(sliceDir, "child.m3u8")
-		abortFn := c.transcoderAbortFn(id)
-		c.mu.Unlock()
+		abortFn := transcoderAbortFn(sess)
+		ready := startupBuffer(sess)
+		sess.mu.Unlock()
 
 		manifestTimeout := 10 * time.Second
 		if isTorrentSource(source) {
 			manifestTimeout = 60 * time.Second
 		}
-		if err := waitForManifestReady(manifestPath, manifestTimeout, abortFn); err != nil {
+		if err := waitForManifestReady(manifestPath, ready, manifestTimeout, abortFn); err != nil {
 			return 0, 0, "", err
 		}
 
-		return duration, target, manifestPath, nil
+		return duration, start, manifestPath, nil
 	}
 
 	if seekID != "" && sess.LastSeekID == seekID {
-		sliceDir := filepath.Join(sess.WorkDir, fmt.Sprintf("slice_%03d", sess.SliceIndex))
+		sliceDir := filepath.Join(sess.WorkDir, fmt.Sprintf("slice_%03d", sess.PlaylistSlice))
 		manifestPath := filepath.Join(sliceDir, "child.m3u8")
 
 		startTime := 0.0
 		for _, s := range sess.Slices {
-			if s.Index == sess.SliceIndex {
+			if s.Index == sess.PlaylistSlice {
 				startTime = s.StartTime
 				break
 			}
 		}
 
-		c.mu.Unlock()
-		return sess.DurationHint, startTime, manifestPath, nil
+		duration := sess.DurationHint
+		sess.mu.Unlock()
+		return duration, startTime, manifestPath, nil
 	}
 
 	if target < 0 {
@@ -295,12 +377,18 @@ func (c *Controller) Seek(ctx context.Context, id, source string, target float64
 	if !forceSlice {
 		// Check if we can reuse an existing slice
 		for _, slice := range sess.Slices {
+			if slice.VOD {
+				continue
+			}
 			sliceDir := filepath.Join(sess.WorkDir, fmt.Sprintf("slice_%03d", slice.Index))
 			manifestPath := filepath.Join(sliceDir, "child.m3u8")
 			_, timeline, err := readPlaylistTimeline(manifestPath, slice.StartTime)
 			if err != nil || len(timeline) == 0 {
 				continue
 			}
+			if slice.Keyframe {
+				c.learnSegmentKeyframes(source, timeline)
+			}
 
 			lastSegment := timeline[len(timeline)-1]
 			endTime := lastSegment.End
@@ -323,67 +411,82 @@ func (c *Controller) Seek(ctx context.Context, id, source string, target float64
 			}
 
 			log.Printf("Seek: reusing cached segment in slice %d (start=%.2f) for target %.2f", slice.Index, slice.StartTime, target)
-			sess.SliceIndex = slice.Index
+			sess.PlaylistSlice = slice.Index
 			sess.LastSeekID = seekID
 			sess.CurrentlyAt = target
 
-			if sess.Cmd == nil && !sess.Finished && endTime < sess.DurationHint {
-				resumeTime := endTime
-				if err := c.ensureCmdLocked(id, source, sess, resumeTime, sliceDir, true, len(sess.AvailableStreams) > 0); err != nil {
-					log.Printf("Failed to resume slice %d: %v", slice.Index, err)
-				}
+			// ffmpeg keeps going if it writes a slice this playlist runs
+			// into; otherwise encoding continues after this slice.
+			idle := sess.Cmd == nil && !sess.Finished && !sess.AtCoverage
+			if idle || !chainContains(chainLocked(sess, slice.Index), sess.SliceIndex) {
+				c.continueSliceLocked(sess, slice.Index, endTime)
 			}
 
-			c.mu.Unlock()
-			return sess.DurationHint, slice.StartTime, manifestPath, nil
+			duration := sess.DurationHint
+			sess.mu.Unlock()
+			return duration, slice.StartTime, manifestPath, nil
 		}
 	}
 
-	sess.LastAccess = time.Now()
-	sess.Finished = false
-	sess.LastSeekID = seekID
-
-	sess.SliceIndex++
-	sess.Slices = append(sess.Slices, SliceInfo{
-		Index:     sess.SliceIndex,
-		StartTime: target,
-	})
-	sliceDir := filepath.Join(sess.WorkDir, fmt.Sprintf("slice_%03d", sess.SliceIndex))
-	if err := os.MkdirAll(sliceDir, 0o755); err != nil {
-		c.mu.Unlock()
-		return 0, 0, "", err
+	// Finding the keyframe may scan the source, so it runs unlocked.
+	sess.mu.Unlock()
+	start, keyframe := c.keyframeBefore(ctx, source, target)
+	if c.lockSession(id) != sess {
+		return 0, 0, "", errSessionStopped
 	}
 
-	if err := c.ensureCmdLocked(id, source, sess, target, sliceDir, false, len(sess.AvailableStreams) > 0); err != nil {
-		c.mu.Unlock()
+	sess.LastSeekID = seekID
+	sliceDir, err := c.newSliceLocked(sess, SliceInfo{StartTime: start, Keyframe: keyframe})
+	if err != nil {
+		sess.mu.Unlock()
 		return 0, 0, "", err
 	}
 
 	duration := sess.DurationHint
 	manifestPath := filepath.Join(sliceDir, "child.m3u8")
-	abortFn := c.transcoderAbortFn(id)
-	c.mu.Unlock()
+	abortFn := transcoderAbortFn(sess)
+	ready := startupBuffer(sess)
+	sess.mu.Unlock()
 
-	if err := waitForManifestReady(manifestPath, 10*time.Second, abortFn); err != nil {
+	if err := waitForManifestReady(manifestPath, ready, 10*time.Second, abortFn); err != nil {
 		return 0, 0, "", err
 	}
 
-	return duration, target, manifestPath, nil
+	return duration, start, manifestPath, nil
+}
+
+// newSliceLocked appends slice to the session, makes it current and starts
+// ffmpeg at its start time. It returns the slice directory.
+func (c *Controller) newSliceLocked(sess *Session, slice SliceInfo) (string, error) {
+	sess.LastAccess = time.Now()
+	sess.Finished = false
+
+	slice.Index = len(sess.Slices)
+	sess.SliceIndex = slice.Index
+	if !slice.VOD {
+		sess.PlaylistSlice = slice.Index
+	}
+	sess.Slices = append(sess.Slices, slice)
+	sliceDir := filepath.Join(sess.WorkDir, fmt.Sprintf("slice_%03d", slice.Index))
+	if err := os.MkdirAll(sliceDir, 0o755); err != nil {
+		return "", err
+	}
+
+	if err := c.ensureCmdLocked(sess, slice.StartTime, sliceDir, false, len(sess.AvailableStreams) > 0); err != nil {
+		return "", err
+	}
+	return sliceDir, nil
 }
 
 // transcoderAbortFn returns a callback suitable for waitForManifestReady that
 // reports true once the ffmpeg process for the given session has exited.
-// It snapshots the live state under the controller lock so concurrent
+// It snapshots the live state under the session lock so concurrent
 // cleanupProcess calls are observed immediately.
-func (c *Controller) transcoderAbortFn(id string) func() bool {
+func transcoderAbortFn(sess *Session) func() bool {
 	return func() bool {
-		c.mu.Lock()
-		defer c.mu.Unlock()
-		sess := c.sessions[id]
-		if sess == nil {
-			return true
-		}
-		return sess.Cmd == nil
+		sess.mu.Lock()
+		defer sess.mu.Unlock()
+		return sess.stopped || sess.Cmd == nil
 	}
 }
 
@@ -392,27 +495,24 @@ func (c *Controller) IsDuplicateSeek(id, seekID string) bool {
 		return false
 	}
 
-	c.mu.Lock()
-	defer c.mu.Unlock()
-
-	sess := c.sessions[id]
+	sess := c.lockSession(id)
 	if sess == nil {
 		return false
 	}
+	defer sess.mu.Unlock()
 
 	return sess.LastSeekID == seekID
 }
 
 func (c *Controller) GetSliceStart(id string) float64 {
-	c.mu.Lock()
-	defer c.mu.Unlock()
-	sess := c.sessions[id]
+	sess := c.lockSession(id)
 	if sess == nil {
 		return 0
 	}
+	defer sess.mu.Unlock()
 
 	for _, s := range sess.Slices {
-		if s.Index == sess.SliceIndex {
+		if s.Index == sess.PlaylistSlice {
 			return s.StartTime
 		}
 	}
@@ -420,13 +520,12 @@ func (c *Controller) GetSliceStart(id string) float64 {
 }
 
 func (c *Controller) CurrentSliceDir(id string) string {
-	c.mu.Lock()
-	defer c.mu.Unlock()
-	sess := c.sessions[id]
+	sess := c.lockSession(id)
 	if sess == nil {
 		return ""
 	}
-	return filepath.Join(sess.WorkDir, fmt.Sprintf("slice_%03d", sess.SliceIndex))
+	defer sess.mu.Unlock()
+	return filepath.Join(sess.WorkDir, fmt.Sprintf("slice_%03d", sess.PlaylistSlice))
 }
 
 func (c *Controller) GetAllSessionIDs() []string {
@@ -439,50 +538,45 @@ func (c *Controller) GetAllSessionIDs() []string {
 	return ids
 }
 
-func (c *Controller) SetAudioTrack(id string, index int) error {
-	c.mu.Lock()
-	defer c.mu.Unlock()
-	sess := c.sessions[id]
+// SetAudioTrack selects audio stream index for session id. If the stream is
+// already published as a rendition the player switches to it on its own and
+// nothing is restarted (inPlace is true). Otherwise ffmpeg is stopped and
+// restarts with the new stream on the next playlist request.
+func (c *Controller) SetAudioTrack(id string, index int) (inPlace bool, err error) {
+	sess := c.lockSession(id)
 	if sess == nil {
-		return fmt.Errorf("session not found")
+		return false, fmt.Errorf("session not found")
 	}
+	defer sess.mu.Unlock()
 
 	if sess.AudioIndex == index {
-		return nil
+		return true, nil
 	}
 
 	sess.AudioIndex = index
 
-	// Update AudioCodec
-	for _, st := range sess.AvailableStreams {
-		// AvailableStreams index is the relative audio index
-		if st.Index == index {
-			sess.AudioCodec = st.Codec
-			break
-		}
+	if sess.hasRendition(index) {
+		return true, nil
+	}
+	if len(sess.AudioRenditions) > 0 {
+		// Publish the requested stream in place of the least preferred one.
+		renditions := append([]int{index}, sess.AudioRenditions...)
+		sess.AudioRenditions = renditions[:len(sess.AudioRenditions)]
 	}
 
 	// Kill current command to force restart with new audio index on next request
-	if sess.Cmd != nil && sess.Cmd.Process != nil {
-		if sess.CmdCancel != nil {
-			sess.CmdCancel()
-		}
-		_ = sess.Cmd.Process.Kill()
-	}
-	sess.Cmd = nil
-	sess.CmdCancel = nil
-	sess.Paused = false
+	stopCmdLocked(sess)
+	sess.AtCoverage = false
 
-	return nil
+	return false, nil
 }
 
 func (c *Controller) DescribeSession(id string) (int, []session.StreamInfo, bool) {
-	c.mu.Lock()
-	defer c.mu.Unlock()
-	sess := c.sessions[id]
+	sess := c.lockSession(id)
 	if sess == nil {
 		return 0, nil, false
 	}
+	defer sess.mu.Unlock()
 	streams := make([]session.StreamInfo, len(sess.AvailableStreams))
 	copy(streams, sess.AvailableStreams)
 	return sess.AudioIndex, streams, true
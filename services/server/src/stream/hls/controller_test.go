@@ -0,0 +1,163 @@
+package hls
+
+import (
+	"context"
+	"errors"
+	"os/exec"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// These tests are meant to be run with -race: they exercise the controller
+// from many goroutines while a probe is blocked.
+
+func newTestController(t *testing.T, probe func(ctx context.Context, source string) (*Metadata, string, error)) *Controller {
+	t.Helper()
+	c := NewController("ffmpeg", "ffprobe")
+	c.ffprobeFn = probe
+	return c
+}
+
+func testMetadata() *Metadata {
+	meta := &Metadata{}
+	meta.Format.Duration = "120"
+	meta.Format.DurationSeconds = 120
+	return meta
+}
+
+func TestSlowProbeDoesNotBlockOtherSessions(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{}, 1)
+	var calls atomic.Int32
+	c := newTestController(t, func(ctx context.Context, source string) (*Metadata, string, error) {
+		calls.Add(1)
+		started <- struct{}{}
+		select {
+		case <-release:
+			return testMetadata(), "h264", nil
+		case <-ctx.Done():
+			return nil, "", ctx.Err()
+		}
+	})
+
+	// An established session that is playing while another one probes.
+	c.sessions["playing"] = &Session{ID: "playing", Source: "/media/a.mkv", WorkDir: t.TempDir(), LastServedSeq: -1}
+
+	const slowSource = "http://127.0.0.1:6969/torrents/0123456789abcdef0123456789abcdef01234567"
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := c.ProbeMetadata(context.Background(), "slow", slowSource); err != nil {
+				t.Errorf("ProbeMetadata: %v", err)
+			}
+		}()
+	}
+	<-started
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 50; i++ {
+			c.MarkSegmentServed("playing", "segment00001.ts")
+			c.NotifyClientAssetRequest("playing")
+			c.NotifyClientPlaylistRequest("playing")
+			_ = c.GetSliceStart("playing")
+			_ = c.CurrentSliceDir("playing")
+			_, _, _ = c.DescribeSession("playing")
+			_ = c.GetAllSessionIDs()
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("session calls blocked behind an unrelated probe")
+	}
+
+	close(release)
+	wg.Wait()
+	if n := calls.Load(); n != 1 {
+		t.Fatalf("ffprobe ran %d times for concurrent probes of one source, want 1", n)
+	}
+	if _, err := c.ProbeMetadata(context.Background(), "slow", slowSource); err != nil {
+		t.Fatal(err)
+	}
+	if n := calls.Load(); n != 1 {
+		t.Fatalf("cached probe ran ffprobe again (%d calls)", n)
+	}
+}
+
+func TestProbeSurvivesOneWaiterCancelling(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{}, 1)
+	c := newTestController(t, func(ctx context.Context, source string) (*Metadata, string, error) {
+		started <- struct{}{}
+		select {
+		case <-release:
+			return testMetadata(), "h264", nil
+		case <-ctx.Done():
+			return nil, "", ctx.Err()
+		}
+	})
+
+	const source = "https://example.com/movie.mkv"
+	impatient, cancel := context.WithCancel(context.Background())
+	errc := make(chan error, 2)
+	go func() {
+		_, err := c.ProbeMetadata(impatient, "a", source)
+		errc <- err
+	}()
+	<-started
+	go func() {
+		_, err := c.ProbeMetadata(context.Background(), "b", source)
+		errc <- err
+	}()
+
+	// Let the second caller join before the first gives up.
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	if err := <-errc; !errors.Is(err, context.Canceled) {
+		t.Fatalf("cancelled waiter got %v, want context.Canceled", err)
+	}
+	close(release)
+	if err := <-errc; err != nil {
+		t.Fatalf("remaining waiter got %v, want the probe result", err)
+	}
+}
+
+func TestConcurrentEnsureSessionCreatesOneSession(t *testing.T) {
+	var calls atomic.Int32
+	c := newTestController(t, func(ctx context.Context, source string) (*Metadata, string, error) {
+		calls.Add(1)
+		time.Sleep(20 * time.Millisecond)
+		return testMetadata(), "h264", nil
+	})
+	errStart := errors.New("no transcoder in tests")
+	c.startCmd = func(context.Context, TranscodeRequest) (*exec.Cmd, error) {
+		return nil, errStart
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, _, err := c.EnsureSession(context.Background(), "sess", "/media/b.mkv", 0)
+			if !errors.Is(err, errStart) {
+				t.Errorf("EnsureSession: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if ids := c.GetAllSessionIDs(); len(ids) != 1 {
+		t.Fatalf("got sessions %v, want exactly one", ids)
+	}
+	if n := calls.Load(); n != 1 {
+		t.Fatalf("ffprobe ran %d times, want 1", n)
+	}
+	_ = c.StopSession("sess")
+}
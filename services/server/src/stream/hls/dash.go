@@ -0,0 +1,166 @@
+package hls
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// The DASH manifest describes the same grid of VOD segments as vod.m3u8 (see
+// vod.go), written as CMAF so both protocols play the same files. Segment
+// requests go through VODSegment either way, so slices, throttling and
+// MarkSegmentServed are shared and nothing is transcoded twice.
+
+const DASHManifestName = "manifest.mpd"
+
+// ErrSegmentFormatInUse is returned for a DASH manifest of a session that
+// already serves MPEG-TS segments to HLS clients.
+var ErrSegmentFormatInUse = errors.New("session already serves MPEG-TS segments")
+
+// DASHManifest returns the static MPD of session id. A session that has not
+// written any segments yet switches to CMAF; one that has is left to its HLS
+// clients and ErrSegmentFormatInUse is returned.
+func (c *Controller) DASHManifest(ctx context.Context, id, source string, startTime float64, token string) (string, error) {
+	sess, _, err := c.lockOrCreateSession(ctx, id, source, startTime, 2*time.Minute)
+	if err != nil {
+		return "", err
+	}
+	if sess.SegmentFormat != SegmentFormatCMAF {
+		if sess.Cmd != nil || hasSegmentsLocked(sess) {
+			sess.mu.Unlock()
+			return "", ErrSegmentFormatInUse
+		}
+		log.Printf("Session %s: switching to CMAF segments for DASH", sess.ID)
+		sess.SegmentFormat = SegmentFormatCMAF
+	}
+	duration := sess.DurationHint
+	hasAudio := sess.HasAudio
+	renditions := append([]int(nil), sess.AudioRenditions...)
+	audioIndex := sess.AudioIndex
+	bandwidth := sess.BitRate
+	streams := sess.AvailableStreams
+	profile := sess.AudioProfile
+	sess.mu.Unlock()
+
+	if duration <= 0 {
+		return "", fmt.Errorf("duration of %s is unknown", source)
+	}
+	if bandwidth <= 0 {
+		bandwidth = defaultBandwidth
+	}
+
+	// VOD slices always encode video (see ensureCmdLocked).
+	codecs := "avc1.4D4029" // -profile:v main -level:v 4.1
+	width, height := 0, 0
+	if meta, _, err := c.probe(ctx, source); err == nil {
+		for _, st := range meta.Streams {
+			if st.CodecType != "video" || st.Disposition.AttachedPic == 1 {
+				continue
+			}
+			width, height = st.Width, st.Height
+			break
+		}
+	}
+	if hasAudio && len(renditions) == 0 {
+		codecs += ",mp4a.40.2"
+	}
+	withToken := func(uri string) string {
+		if token == "" {
+			return uri
+		}
+		return uri + "?token=" + url.QueryEscape(token)
+	}
+	template := func(init, media string) string {
+		return fmt.Sprintf(`<SegmentTemplate timescale="1000" duration="%d" startNumber="0" initialization=%s media=%s/>`,
+			DefaultSegmentDuration.Milliseconds(), xmlAttr(withToken(VODSegmentPrefix+init)), xmlAttr(withToken(VODSegmentPrefix+media)))
+	}
+
+	var b strings.Builder
+	b.WriteString(xml.Header)
+	fmt.Fprintf(&b, `<MPD xmlns="urn:mpeg:dash:schema:mpd:2011" profiles="urn:mpeg:dash:profile:isoff-live:2011" type="static" mediaPresentationDuration=%s minBufferTime="PT%dS">`+"\n",
+		xmlAttr(isoDuration(duration)), int(DefaultSegmentDuration.Seconds()))
+	b.WriteString(`<Period id="0" start="PT0S">` + "\n")
+
+	b.WriteString(`<AdaptationSet id="0" contentType="video" mimeType="video/mp4" segmentAlignment="true" startWithSAP="1">` + "\n")
+	b.WriteString(template(initSegmentName(-1), "segment$Number%05d$.m4s") + "\n")
+	size := ""
+	if width > 0 && height > 0 {
+		size = fmt.Sprintf(` width="%d" height="%d"`, width, height)
+	}
+	fmt.Fprintf(&b, `<Representation id="video" codecs=%s bandwidth="%d"%s/>`+"\n", xmlAttr(codecs), bandwidth, size)
+	b.WriteString("</AdaptationSet>\n")
+
+	// Same order as the master playlist: stream order, published ones only.
+	for _, st := range streams {
+		published := false
+		for _, idx := range renditions {
+			if idx == st.Index {
+				published = true
+				break
+			}
+		}
+		if !published {
+			continue
+		}
+
+		lang := ""
+		if l := strings.TrimSpace(st.Language); l != "" && l != "und" {
+			lang = " lang=" + xmlAttr(l)
+		}
+		fmt.Fprintf(&b, `<AdaptationSet id="%d" contentType="audio" mimeType="audio/mp4"%s segmentAlignment="true" startWithSAP="1">`+"\n", st.Index+1, lang)
+		fmt.Fprintf(&b, "<Label>%s</Label>\n", xmlText(renditionName(st.Title, st.Language, st.Index)))
+		role := "alternate"
+		if st.Index == audioIndex {
+			role = "main"
+		}
+		fmt.Fprintf(&b, `<Role schemeIdUri="urn:mpeg:dash:role:2011" value="%s"/>`+"\n", role)
+		b.WriteString(template(initSegmentName(st.Index), fmt.Sprintf("audio_%d_$Number%%05d$.m4s", st.Index)) + "\n")
+		fmt.Fprintf(&b, `<Representation id="audio_%d" codecs="mp4a.40.2" bandwidth="160000" audioSamplingRate="48000">`+"\n", st.Index)
+		if channels := profile.OutputChannels(st.Codec, st.Channels); channels > 0 {
+			fmt.Fprintf(&b, `<AudioChannelConfiguration schemeIdUri="urn:mpeg:dash:23003:3:audio_channel_configuration:2011" value="%d"/>`+"\n", channels)
+		}
+		b.WriteString("</Representation>\n")
+		b.WriteString("</AdaptationSet>\n")
+	}
+
+	b.WriteString("</Period>\n")
+	b.WriteString("</MPD>\n")
+	return b.String(), nil
+}
+
+// hasSegmentsLocked reports whether any slice of sess has written a playlist.
+func hasSegmentsLocked(sess *Session) bool {
+	for _, slice := range sess.Slices {
+		if _, err := os.Stat(filepath.Join(sess.sliceDir(slice.Index), "child.m3u8")); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// isoDuration formats seconds as an xs:duration.
+func isoDuration(seconds float64) string {
+	seconds = math.Round(seconds*1000) / 1000
+	h := int(seconds) / 3600
+	m := int(seconds) % 3600 / 60
+	s := seconds - float64(h*3600+m*60)
+	return fmt.Sprintf("PT%dH%dM%.3fS", h, m, s)
+}
+
+func xmlAttr(v string) string {
+	return `"` + xmlText(v) + `"`
+}
+
+func xmlText(v string) string {
+	var b strings.Builder
+	_ = xml.EscapeText(&b, []byte(v))
+	return b.String()
+}
@@ -0,0 +1,284 @@
+package hls
+
+import (
+	"context"
+	"errors"
+	"math"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// End-to-end tests of the controller against the fake ffmpeg and ffprobe in
+// faketools_test.go.
+
+func TestEnsureSessionWritesPlaylist(t *testing.T) {
+	c, rec := newFakeToolsController(t)
+
+	duration, manifest, err := c.EnsureSession(context.Background(), "sess", "/media/movie.mkv", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if duration != 120 {
+		t.Errorf("duration = %v, want 120", duration)
+	}
+	_, timeline, err := readPlaylistTimeline(manifest, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := bufferedAfter(timeline, -1); got < 2*DefaultSegmentDuration {
+		t.Errorf("playlist lists %v when EnsureSession returns, want at least %v", got, 2*DefaultSegmentDuration)
+	}
+
+	req := rec.last(t)
+	if req.Codec != "h264" || req.StartSeconds != 0 || req.StartSeq != 0 {
+		t.Errorf("ffmpeg started with codec %q at %v, sequence %d; want a copy from 0, sequence 0", req.Codec, req.StartSeconds, req.StartSeq)
+	}
+
+	// A second call finds ffmpeg running or done and starts nothing.
+	if _, again, err := c.EnsureSession(context.Background(), "sess", "/media/movie.mkv", 0); err != nil || again != manifest {
+		t.Fatalf("second EnsureSession = %q, %v; want %q", again, err, manifest)
+	}
+	if n := rec.count(); n != 1 {
+		t.Errorf("ffmpeg started %d times, want 1", n)
+	}
+}
+
+func TestSeekWithinCoverageReusesSlice(t *testing.T) {
+	c, rec := newFakeToolsController(t)
+	_, manifest, err := c.EnsureSession(context.Background(), "sess", "/media/movie.mkv", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, 5*time.Second, "a minute of segments", func() bool {
+		_, timeline, _ := readPlaylistTimeline(manifest, 0)
+		return bufferedAfter(timeline, -1) >= time.Minute
+	})
+
+	_, start, seekManifest, err := c.Seek(context.Background(), "sess", "/media/movie.mkv", 50, "seek-1", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if start != 0 || seekManifest != manifest {
+		t.Errorf("Seek = %v, %s; want %s from 0", start, seekManifest, manifest)
+	}
+	if n := rec.count(); n != 1 {
+		t.Errorf("ffmpeg started %d times, want 1", n)
+	}
+}
+
+func TestSeekBeyondCoverageStartsSliceAtKeyframe(t *testing.T) {
+	t.Setenv(fakeDurationEnv, "600")
+	t.Setenv(fakeSegmentDelayEnv, "100")
+	c, rec := newFakeToolsController(t)
+	if _, _, err := c.EnsureSession(context.Background(), "sess", "/media/movie.mkv", 0); err != nil {
+		t.Fatal(err)
+	}
+
+	_, start, manifest, err := c.Seek(context.Background(), "sess", "/media/movie.mkv", 301, "seek-1", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if start != 300 {
+		t.Errorf("slice starts at %v, want the keyframe at 300", start)
+	}
+	if got := filepath.Base(filepath.Dir(manifest)); got != "slice_001" {
+		t.Errorf("manifest in %s, want slice_001", got)
+	}
+	if _, err := os.Stat(manifest); err != nil {
+		t.Error(err)
+	}
+
+	req := rec.last(t)
+	if math.Abs(req.StartSeconds-300) > 0.001 || req.StartSeq != 1 {
+		t.Errorf("ffmpeg started at %v, sequence %d; want 300, sequence 1", req.StartSeconds, req.StartSeq)
+	}
+	if n := rec.count(); n != 2 {
+		t.Errorf("ffmpeg started %d times, want 2", n)
+	}
+}
+
+func TestSetAudioTrackRestartsTranscode(t *testing.T) {
+	t.Setenv(fakeDurationEnv, "600")
+	t.Setenv(fakeSegmentDelayEnv, "100")
+	c, rec := newFakeToolsController(t)
+	if _, _, err := c.EnsureSession(context.Background(), "sess", "/media/movie.mkv", 0); err != nil {
+		t.Fatal(err)
+	}
+	if req := rec.last(t); req.Audio.Index != 0 {
+		t.Fatalf("ffmpeg started with audio %d, want 0", req.Audio.Index)
+	}
+
+	inPlace, err := c.SetAudioTrack("sess", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inPlace {
+		t.Fatal("SetAudioTrack switched in place without renditions")
+	}
+	inSession(t, c, "sess", func(sess *Session) {
+		if sess.Cmd != nil {
+			t.Error("ffmpeg still running after the audio track changed")
+		}
+	})
+
+	if _, _, err := c.EnsureSession(context.Background(), "sess", "/media/movie.mkv", 0); err != nil {
+		t.Fatal(err)
+	}
+	if n := rec.count(); n != 2 {
+		t.Fatalf("ffmpeg started %d times, want 2", n)
+	}
+	if req := rec.last(t); req.Audio.Index != 1 || req.Audio.Codec != "ac3" {
+		t.Errorf("ffmpeg restarted with audio %d (%s), want 1 (ac3)", req.Audio.Index, req.Audio.Codec)
+	}
+}
+
+func TestThrottlePausesAheadOfPlayback(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("throttling suspends ffmpeg with signals")
+	}
+	t.Setenv(fakeDurationEnv, "600")
+	c, _ := newFakeToolsController(t)
+	_, manifest, err := c.EnsureSession(context.Background(), "sess", "/media/movie.mkv", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	segments := func() int {
+		_, timeline, _ := readPlaylistTimeline(manifest, 0)
+		return len(timeline)
+	}
+	paused := func() bool {
+		p := false
+		inSession(t, c, "sess", func(sess *Session) { p = sess.Paused && sess.PausedByCap })
+		return p
+	}
+
+	eventually(t, 5*time.Second, "the buffer cap to pause ffmpeg", paused)
+	held := segments()
+	if held*int(DefaultSegmentDuration/time.Second) < int(MaxBufferAhead/time.Second) {
+		t.Errorf("paused with %d segments, under the %v cap", held, MaxBufferAhead)
+	}
+	time.Sleep(500 * time.Millisecond)
+	if n := segments(); n != held {
+		t.Fatalf("paused ffmpeg went from %d to %d segments", held, n)
+	}
+
+	// Playback catching up drains the buffer and resumes ffmpeg.
+	_, timeline, err := readPlaylistTimeline(manifest, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.MarkSegmentServed("sess", timeline[len(timeline)-1].Filename)
+	eventually(t, 5*time.Second, "ffmpeg to resume", func() bool { return segments() > held })
+}
+
+func TestVODSegmentOfCopiedSourceEncodesOnGrid(t *testing.T) {
+	t.Setenv(fakeDurationEnv, "600")
+	t.Setenv(fakeSegmentDelayEnv, "100")
+	c, rec := newFakeToolsController(t)
+	if _, err := c.VODPlaylist(context.Background(), "sess", "/media/movie.mkv", 0, VODPlaylistName); err != nil {
+		t.Fatal(err)
+	}
+	inSession(t, c, "sess", func(sess *Session) {
+		if sess.Codec != "h264" {
+			t.Fatalf("session codec = %q, want a stream-copied h264 source", sess.Codec)
+		}
+	})
+
+	if _, err := c.VODSegment(context.Background(), "sess", "/media/movie.mkv", 0, "segment00021.ts"); err != nil {
+		t.Fatal(err)
+	}
+	req := rec.last(t)
+	if req.Codec == "h264" {
+		t.Fatal("VOD slice copies video, whose segments would follow the source's keyframes")
+	}
+	if !req.VOD || req.StartSeconds != 126 || req.StartSeq != 21 {
+		t.Errorf("ffmpeg started at %v, sequence %d, VOD %v; want 126, sequence 21, VOD", req.StartSeconds, req.StartSeq, req.VOD)
+	}
+	if argAfter(transcodeArgs(req), "-force_key_frames") == "" {
+		t.Error("VOD slice does not force keyframes on segment boundaries")
+	}
+}
+
+func TestDASHManifestLeavesTSSessionAlone(t *testing.T) {
+	t.Setenv(fakeDurationEnv, "600")
+	t.Setenv(fakeSegmentDelayEnv, "100")
+	c, rec := newFakeToolsController(t)
+	if _, _, err := c.EnsureSession(context.Background(), "sess", "/media/movie.mkv", 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := c.DASHManifest(context.Background(), "sess", "/media/movie.mkv", 0, ""); !errors.Is(err, ErrSegmentFormatInUse) {
+		t.Fatalf("DASHManifest error = %v, want ErrSegmentFormatInUse", err)
+	}
+	inSession(t, c, "sess", func(sess *Session) {
+		if sess.SegmentFormat == SegmentFormatCMAF || sess.Cmd == nil {
+			t.Errorf("HLS transcode interrupted: format %q, running %v", sess.SegmentFormat, sess.Cmd != nil)
+		}
+	})
+	if n := rec.count(); n != 1 {
+		t.Errorf("ffmpeg started %d times, want 1", n)
+	}
+
+	// A session nothing has played yet switches to CMAF.
+	mpd, err := c.DASHManifest(context.Background(), "fresh", "/media/movie.mkv", 0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Its segments are encoded on the grid, not copied.
+	if !strings.Contains(mpd, `codecs="avc1.4D4029"`) {
+		t.Errorf("manifest does not advertise the encoded video:\n%s", mpd)
+	}
+	inSession(t, c, "fresh", func(sess *Session) {
+		if sess.SegmentFormat != SegmentFormatCMAF {
+			t.Errorf("fresh session format = %q, want CMAF", sess.SegmentFormat)
+		}
+	})
+}
+
+func TestSlowClientContinuesPlaylistAfterDiscontinuity(t *testing.T) {
+	t.Setenv(fakeDurationEnv, "600")
+	t.Setenv(fakeSegmentDelayEnv, "50")
+	c, rec := newFakeToolsController(t)
+	_, manifest, err := c.EnsureSession(context.Background(), "sess", "/media/movie.mkv", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var timeline []PlaylistSegment
+	eventually(t, 5*time.Second, "four segments", func() bool {
+		_, timeline, _ = readPlaylistTimeline(manifest, 0)
+		return len(timeline) >= 4
+	})
+
+	// 1 MB per 6s segment is 1.3 Mb/s; at 10s each the client gets 0.8 Mb/s.
+	for _, seg := range timeline[:4] {
+		c.RecordSegmentDelivery("sess", seg.Filename, 1_000_000, 10*time.Second)
+	}
+	if c.QualityCap("sess") == nil {
+		t.Fatal("quality not reduced for a client slower than the video")
+	}
+	req := rec.last(t)
+	if req.Codec == "h264" || !req.Append {
+		t.Fatalf("ffmpeg restarted with codec %q, append %v; want an encode appending to the playlist", req.Codec, req.Append)
+	}
+
+	eventually(t, 5*time.Second, "segments after the restart", func() bool {
+		_, after, _ := readPlaylistTimeline(manifest, 0)
+		for _, seg := range after {
+			if seg.Discontinuity {
+				return true
+			}
+		}
+		return false
+	})
+	playlist, err := c.MediaPlaylist("sess", "child.m3u8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(playlist, "#EXT-X-DISCONTINUITY"); n != 1 {
+		t.Errorf("playlist has %d discontinuities, want 1 where encoding switched:\n%s", n, playlist)
+	}
+}
@@ -0,0 +1,183 @@
+package hls
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// EncodingProfile holds the video encoder settings a session transcodes with.
+// Zero fields take the value of DefaultEncodingProfile.
+type EncodingProfile struct {
+	Name   string `json:"name"`
+	CRF    int    `json:"crf,omitempty"`
+	Preset string `json:"preset,omitempty"`
+	// Tune is an x264 -tune value such as "film" or "animation".
+	Tune string `json:"tune,omitempty"`
+	// MaxWidth and MaxHeight scale larger video down, keeping its aspect
+	// ratio.
+	MaxWidth  int `json:"maxWidth,omitempty"`
+	MaxHeight int `json:"maxHeight,omitempty"`
+	// MaxBitRate caps the video bit rate in bits per second.
+	MaxBitRate int64 `json:"maxBitRate,omitempty"`
+	// AudioProfile is used by sessions that do not pick one themselves.
+	AudioProfile AudioProfile `json:"audioProfile,omitempty"`
+}
+
+const DefaultEncodingProfileName = "default"
+
+// DefaultEncodingProfile is how sessions were transcoded before profiles
+// existed.
+var DefaultEncodingProfile = EncodingProfile{
+	Name:   DefaultEncodingProfileName,
+	CRF:    23,
+	Preset: "veryfast",
+}
+
+var (
+	x264Presets = []string{"ultrafast", "superfast", "veryfast", "faster", "fast", "medium", "slow", "slower", "veryslow"}
+	x264Tunes   = []string{"film", "animation", "grain", "stillimage", "fastdecode", "zerolatency"}
+)
+
+// withDefaults fills zero fields from DefaultEncodingProfile.
+func (p EncodingProfile) withDefaults() EncodingProfile {
+	if p.CRF == 0 {
+		p.CRF = DefaultEncodingProfile.CRF
+	}
+	if p.Preset == "" {
+		p.Preset = DefaultEncodingProfile.Preset
+	}
+	return p
+}
+
+func (p EncodingProfile) validate() error {
+	if strings.TrimSpace(p.Name) == "" {
+		return fmt.Errorf("encoding profile without a name")
+	}
+	if p.CRF < 0 || p.CRF > 51 {
+		return fmt.Errorf("encoding profile %q: crf must be between 0 and 51", p.Name)
+	}
+	if p.Preset != "" && !slices.Contains(x264Presets, p.Preset) {
+		return fmt.Errorf("encoding profile %q: unknown preset %q", p.Name, p.Preset)
+	}
+	if p.Tune != "" && !slices.Contains(x264Tunes, p.Tune) {
+		return fmt.Errorf("encoding profile %q: unknown tune %q", p.Name, p.Tune)
+	}
+	if p.MaxWidth < 0 || p.MaxHeight < 0 || p.MaxBitRate < 0 {
+		return fmt.Errorf("encoding profile %q: limits must not be negative", p.Name)
+	}
+	if p.AudioProfile != "" {
+		if _, err := ParseAudioProfile(string(p.AudioProfile)); err != nil {
+			return fmt.Errorf("encoding profile %q: %w", p.Name, err)
+		}
+	}
+	return nil
+}
+
+// allowsCopy reports whether video of the given size and bit rate (0 when
+// unknown) fits the profile's limits, so it can be stream-copied.
+func (p EncodingProfile) allowsCopy(width, height int, bitRate int64) bool {
+	return (p.MaxWidth == 0 || width <= p.MaxWidth) &&
+		(p.MaxHeight == 0 || height <= p.MaxHeight) &&
+		(p.MaxBitRate == 0 || bitRate <= p.MaxBitRate)
+}
+
+// scaleFilter returns the -vf scale filter for the profile's size limits, or
+// "" without limits. Smaller video is left alone.
+func (p EncodingProfile) scaleFilter() string {
+	switch {
+	case p.MaxWidth > 0 && p.MaxHeight > 0:
+		return fmt.Sprintf("scale=w='min(iw,%d)':h='min(ih,%d)':force_original_aspect_ratio=decrease:force_divisible_by=2", p.MaxWidth, p.MaxHeight)
+	case p.MaxWidth > 0:
+		return fmt.Sprintf("scale=w='min(iw,%d)':h=-2", p.MaxWidth)
+	case p.MaxHeight > 0:
+		return fmt.Sprintf("scale=w=-2:h='min(ih,%d)'", p.MaxHeight)
+	}
+	return ""
+}
+
+// ProfileRegistry is a set of named encoding profiles. It always has
+// DefaultEncodingProfileName.
+type ProfileRegistry struct {
+	mu       sync.RWMutex
+	profiles map[string]EncodingProfile
+}
+
+func NewProfileRegistry() *ProfileRegistry {
+	return &ProfileRegistry{profiles: map[string]EncodingProfile{
+		DefaultEncodingProfileName: DefaultEncodingProfile,
+	}}
+}
+
+// Get returns profile name, or the default profile for "".
+func (r *ProfileRegistry) Get(name string) (EncodingProfile, error) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if name == "" {
+		name = DefaultEncodingProfileName
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	p, ok := r.profiles[name]
+	if !ok {
+		return EncodingProfile{}, fmt.Errorf("unknown encoding profile %q (want one of %s)", name, strings.Join(r.namesLocked(), ", "))
+	}
+	return p, nil
+}
+
+// Names lists the profiles in alphabetical order.
+func (r *ProfileRegistry) Names() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.namesLocked()
+}
+
+func (r *ProfileRegistry) namesLocked() []string {
+	names := make([]string, 0, len(r.profiles))
+	for name := range r.profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Register adds or replaces profile p.
+func (r *ProfileRegistry) Register(p EncodingProfile) error {
+	p.Name = strings.ToLower(strings.TrimSpace(p.Name))
+	if err := p.validate(); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.profiles[p.Name] = p.withDefaults()
+	return nil
+}
+
+// Load registers the profiles of a JSON file holding an array of
+// EncodingProfile. A profile named "default" replaces the default. Nothing is
+// registered if any profile is invalid.
+func (r *ProfileRegistry) Load(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var profiles []EncodingProfile
+	if err := json.Unmarshal(data, &profiles); err != nil {
+		return fmt.Errorf("parse %s: %w", path, err)
+	}
+	for i := range profiles {
+		profiles[i].Name = strings.ToLower(strings.TrimSpace(profiles[i].Name))
+		if err := profiles[i].validate(); err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	for _, p := range profiles {
+		if err := r.Register(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
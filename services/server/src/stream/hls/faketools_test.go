@@ -0,0 +1,311 @@
+package hls
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// The test binary doubles as a fake ffmpeg and ffprobe, so controller tests
+// run the real process handling without media. Started with fakeToolsEnv set,
+// it acts on its arguments instead of running tests: ffprobe invocations
+// print canned metadata or packets, anything else is taken for ffmpeg and
+// writes HLS playlists and empty segments at a steady pace.
+const (
+	fakeToolsEnv = "HLS_FAKE_MEDIA_TOOLS"
+	// fakeDurationEnv is the length of the fake title in seconds.
+	fakeDurationEnv = "HLS_FAKE_DURATION"
+	// fakeSegmentDelayEnv is how long fake ffmpeg takes per segment, in
+	// milliseconds.
+	fakeSegmentDelayEnv = "HLS_FAKE_SEGMENT_DELAY"
+	// Fake video has a keyframe every fakeKeyframeInterval seconds.
+	fakeKeyframeInterval = 2
+)
+
+func TestMain(m *testing.M) {
+	if os.Getenv(fakeToolsEnv) == "1" {
+		os.Exit(runFakeTool(os.Args[1:]))
+	}
+	os.Exit(m.Run())
+}
+
+func runFakeTool(args []string) int {
+	var err error
+	switch {
+	case slices.Contains(args, "-show_streams"):
+		err = fakeProbe()
+	case slices.Contains(args, "-show_entries"):
+		err = fakeKeyframeScan(args)
+	default:
+		err = fakeFFmpeg(args)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "fake tool:", err)
+		return 1
+	}
+	return 0
+}
+
+func fakeDuration() float64 {
+	if v, err := strconv.ParseFloat(os.Getenv(fakeDurationEnv), 64); err == nil && v > 0 {
+		return v
+	}
+	return 120
+}
+
+// fakeProbe prints an H.264 title with English AAC stereo and French AC-3
+// 5.1 audio.
+func fakeProbe() error {
+	_, err := fmt.Printf(`{
+  "format": {"duration": "%.3f", "format_name": "matroska,webm", "bit_rate": "4000000", "size": "60000000"},
+  "streams": [
+    {"index": 0, "codec_name": "h264", "codec_type": "video", "profile": "High", "level": 41, "width": 1920, "height": 1080, "pix_fmt": "yuv420p", "avg_frame_rate": "24000/1001"},
+    {"index": 1, "codec_name": "aac", "codec_type": "audio", "channels": 2, "tags": {"language": "eng"}},
+    {"index": 2, "codec_name": "ac3", "codec_type": "audio", "channels": 6, "tags": {"language": "fra"}}
+  ]
+}
+`, fakeDuration())
+	return err
+}
+
+// fakeKeyframeScan prints a packet per second from the keyframe before the
+// -read_intervals start, then the format start time.
+func fakeKeyframeScan(args []string) error {
+	interval := argAfter(args, "-read_intervals")
+	fromStr, durStr, ok := strings.Cut(interval, "%+")
+	from, err1 := strconv.ParseFloat(fromStr, 64)
+	dur, err2 := strconv.ParseFloat(durStr, 64)
+	if !ok || err1 != nil || err2 != nil {
+		return fmt.Errorf("bad -read_intervals %q", interval)
+	}
+	end := math.Min(from+dur, fakeDuration())
+	for t := math.Floor(from/fakeKeyframeInterval) * fakeKeyframeInterval; t < end; t++ {
+		flags := "__"
+		if math.Mod(t, fakeKeyframeInterval) == 0 {
+			flags = "K_"
+		}
+		fmt.Printf("%.6f,%.6f,%s\n", t, t, flags)
+	}
+	fmt.Println("0.000000")
+	return nil
+}
+
+// fakeOutput is one HLS output of a fake ffmpeg run.
+type fakeOutput struct {
+	playlist, segmentPattern, initName string
+	segmentDur                         float64
+	startSeq                           int
+	appendList                         bool
+	lines                              []string
+}
+
+// fakeFFmpeg writes the HLS outputs transcodeArgs describes: options of an
+// output precede its -hls_segment_filename, which the playlist path follows.
+func fakeFFmpeg(args []string) error {
+	start := 0.0
+	if v := argAfter(args, "-ss"); v != "" {
+		start, _ = strconv.ParseFloat(v, 64)
+	}
+
+	var outputs []*fakeOutput
+	cur := &fakeOutput{segmentDur: 6}
+	for i := 0; i+1 < len(args); i++ {
+		switch args[i] {
+		case "-hls_time":
+			cur.segmentDur, _ = strconv.ParseFloat(args[i+1], 64)
+		case "-start_number":
+			cur.startSeq, _ = strconv.Atoi(args[i+1])
+		case "-hls_fmp4_init_filename":
+			cur.initName = args[i+1]
+		case "-hls_flags":
+			cur.appendList = strings.Contains(args[i+1], "append_list")
+		case "-hls_segment_filename":
+			if i+2 >= len(args) {
+				return fmt.Errorf("no playlist after -hls_segment_filename")
+			}
+			cur.segmentPattern, cur.playlist = args[i+1], args[i+2]
+			outputs = append(outputs, cur)
+			cur = &fakeOutput{segmentDur: 6}
+			i += 2
+		}
+	}
+	if len(outputs) == 0 {
+		return fmt.Errorf("no HLS outputs in %q", args)
+	}
+
+	delay := 20 * time.Millisecond
+	if ms, err := strconv.Atoi(os.Getenv(fakeSegmentDelayEnv)); err == nil {
+		delay = time.Duration(ms) * time.Millisecond
+	}
+	for _, out := range outputs {
+		if err := out.begin(); err != nil {
+			return err
+		}
+	}
+	duration := fakeDuration()
+	for n, t := 0, start; t < duration-1e-6; n++ {
+		time.Sleep(delay)
+		segDur := math.Min(outputs[0].segmentDur, duration-t)
+		for _, out := range outputs {
+			if err := out.addSegment(out.startSeq+n, segDur); err != nil {
+				return err
+			}
+		}
+		t += segDur
+	}
+	for _, out := range outputs {
+		out.lines = append(out.lines, "#EXT-X-ENDLIST")
+		if err := out.write(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (o *fakeOutput) begin() error {
+	if o.initName != "" {
+		if err := os.WriteFile(filepath.Join(filepath.Dir(o.playlist), o.initName), nil, 0o644); err != nil {
+			return err
+		}
+	}
+	if o.appendList {
+		if data, err := os.ReadFile(o.playlist); err == nil {
+			for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+				if line != "#EXT-X-ENDLIST" {
+					o.lines = append(o.lines, line)
+				}
+			}
+			return nil
+		}
+	}
+	version := 6
+	if o.initName != "" {
+		version = 7
+	}
+	o.lines = []string{
+		"#EXTM3U",
+		fmt.Sprintf("#EXT-X-VERSION:%d", version),
+		fmt.Sprintf("#EXT-X-TARGETDURATION:%d", int(math.Ceil(o.segmentDur))),
+		fmt.Sprintf("#EXT-X-MEDIA-SEQUENCE:%d", o.startSeq),
+		"#EXT-X-PLAYLIST-TYPE:EVENT",
+		"#EXT-X-INDEPENDENT-SEGMENTS",
+	}
+	if o.initName != "" {
+		o.lines = append(o.lines, fmt.Sprintf("#EXT-X-MAP:URI=%q", o.initName))
+	}
+	return nil
+}
+
+// addSegment writes segment seq under a temporary name first, as ffmpeg
+// does with temp_file, then lists it.
+func (o *fakeOutput) addSegment(seq int, dur float64) error {
+	name := fmt.Sprintf(filepath.Base(o.segmentPattern), seq)
+	path := filepath.Join(filepath.Dir(o.segmentPattern), name)
+	if err := os.WriteFile(path+".tmp", []byte(name), 0o644); err != nil {
+		return err
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return err
+	}
+	o.lines = append(o.lines, fmt.Sprintf("#EXTINF:%.6f,", dur), name)
+	return o.write()
+}
+
+func (o *fakeOutput) write() error {
+	tmp := o.playlist + ".tmp"
+	if err := os.WriteFile(tmp, []byte(strings.Join(o.lines, "\n")+"\n"), 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, o.playlist)
+}
+
+func argAfter(args []string, flag string) string {
+	for i := 0; i+1 < len(args); i++ {
+		if args[i] == flag {
+			return args[i+1]
+		}
+	}
+	return ""
+}
+
+// transcodeLog records the requests a controller started ffmpeg with.
+type transcodeLog struct {
+	mu   sync.Mutex
+	reqs []TranscodeRequest
+}
+
+func (l *transcodeLog) count() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.reqs)
+}
+
+func (l *transcodeLog) last(t *testing.T) TranscodeRequest {
+	t.Helper()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.reqs) == 0 {
+		t.Fatal("ffmpeg was never started")
+	}
+	return l.reqs[len(l.reqs)-1]
+}
+
+// newFakeToolsController returns a controller running the fake tools, with
+// session directories under a test temp dir.
+func newFakeToolsController(t *testing.T) (*Controller, *transcodeLog) {
+	t.Helper()
+	exe, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv(fakeToolsEnv, "1")
+	t.Setenv("TMPDIR", t.TempDir())
+
+	c := NewController(exe, exe)
+	rec := &transcodeLog{}
+	start := c.startCmd
+	c.startCmd = func(ctx context.Context, req TranscodeRequest) (*exec.Cmd, error) {
+		rec.mu.Lock()
+		rec.reqs = append(rec.reqs, req)
+		rec.mu.Unlock()
+		return start(ctx, req)
+	}
+	t.Cleanup(func() {
+		for _, id := range c.GetAllSessionIDs() {
+			_ = c.StopSession(id)
+		}
+	})
+	return c, rec
+}
+
+// inSession runs fn with the lock of session id held.
+func inSession(t *testing.T, c *Controller, id string, fn func(sess *Session)) {
+	t.Helper()
+	sess := c.lockSession(id)
+	if sess == nil {
+		t.Fatalf("session %s not found", id)
+	}
+	defer sess.mu.Unlock()
+	fn(sess)
+}
+
+// eventually polls cond for up to timeout.
+func eventually(t *testing.T, timeout time.Duration, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
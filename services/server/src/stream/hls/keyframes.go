@@ -0,0 +1,261 @@
+package hls
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	sourcepolicy "raffi-server/src/source"
+)
+
+const (
+	// A scan covers keyframeScanBack seconds before the target and a little
+	// after it; longer GOPs trigger one wider scan.
+	keyframeScanBack  = 20.0
+	keyframeScanAhead = 5.0
+	keyframeScanWide  = 90.0
+	keyframeScanLimit = 20 * time.Second
+	// A keyframe learned from segment boundaries is used without scanning if
+	// it is at most this far before the target; the playlist's EXT-X-START
+	// offset covers the difference.
+	maxKeyframeSnap = 8.0
+	// -ss lands on the last keyframe at or before the given time, so it is
+	// nudged past the keyframe to survive rounding.
+	keyframeSeekNudge = 0.0005
+	maxKeyframeLists  = 64
+)
+
+// KeyframeScanFunc lists the video keyframe times of source between from and
+// from+duration. scannedFrom and scannedTo bound the range in which every
+// keyframe was reported. Times are relative to the start of the input, the
+// way -ss counts.
+type KeyframeScanFunc func(ctx context.Context, source string, from, duration float64) (keyframes []float64, scannedFrom, scannedTo float64, err error)
+
+// keyframeIndex remembers video keyframe times per source (by ProbeCacheKey).
+// It is filled by targeted ffprobe packet scans around seek targets and by the
+// segment boundaries of stream-copied slices, which always fall on keyframes.
+type keyframeIndex struct {
+	mu    sync.Mutex
+	lists map[string]*keyframeList
+}
+
+type keyframeList struct {
+	times    []float64 // sorted, unique
+	covered  []timeRange
+	lastUsed time.Time
+}
+
+type timeRange struct{ from, to float64 }
+
+func newKeyframeIndex() *keyframeIndex {
+	return &keyframeIndex{lists: make(map[string]*keyframeList)}
+}
+
+// lookup returns the keyframe at or before t if the index can answer without
+// a scan.
+func (k *keyframeIndex) lookup(key string, t float64) (float64, bool) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	l, ok := k.lists[key]
+	if !ok {
+		return 0, false
+	}
+	l.lastUsed = time.Now()
+
+	i := sort.SearchFloat64s(l.times, t+keyframeSeekNudge)
+	if i == 0 {
+		return 0, false
+	}
+	kf := l.times[i-1]
+	for _, r := range l.covered {
+		// Inside a scanned range the nearest known keyframe is the real one.
+		if t >= r.from && t <= r.to && kf >= r.from {
+			return kf, true
+		}
+	}
+	return kf, t-kf <= maxKeyframeSnap
+}
+
+// add records keyframes; covered, if non-empty, is a range in which times
+// lists every keyframe.
+func (k *keyframeIndex) add(key string, times []float64, covered timeRange) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	l, ok := k.lists[key]
+	if !ok {
+		l = &keyframeList{}
+		k.lists[key] = l
+		k.evictLocked()
+	}
+	l.lastUsed = time.Now()
+
+	l.times = append(l.times, times...)
+	sort.Float64s(l.times)
+	uniq := l.times[:0]
+	for _, t := range l.times {
+		// Boundaries derived from playlists carry rounding noise.
+		if len(uniq) > 0 && t-uniq[len(uniq)-1] < 2*keyframeSeekNudge {
+			continue
+		}
+		uniq = append(uniq, t)
+	}
+	l.times = uniq
+
+	if covered.to > covered.from {
+		l.covered = append(l.covered, covered)
+		sort.Slice(l.covered, func(i, j int) bool { return l.covered[i].from < l.covered[j].from })
+		merged := l.covered[:1]
+		for _, r := range l.covered[1:] {
+			last := &merged[len(merged)-1]
+			if r.from <= last.to {
+				last.to = max(last.to, r.to)
+				continue
+			}
+			merged = append(merged, r)
+		}
+		l.covered = merged
+	}
+}
+
+func (k *keyframeIndex) evictLocked() {
+	for len(k.lists) > maxKeyframeLists {
+		oldestKey := ""
+		var oldest time.Time
+		for key, l := range k.lists {
+			if oldestKey == "" || l.lastUsed.Before(oldest) {
+				oldestKey, oldest = key, l.lastUsed
+			}
+		}
+		delete(k.lists, oldestKey)
+	}
+}
+
+// keyframeBefore returns the latest video keyframe at or before target for
+// sessions whose video is stream-copied, so that a slice starts exactly where
+// it claims to. Transcoded video is cut precisely anyway and keeps target.
+// snapped reports whether the result is known to be a keyframe; on failures
+// target is returned as is.
+func (c *Controller) keyframeBefore(ctx context.Context, source string, target float64) (start float64, snapped bool) {
+	if target <= 0 {
+		return 0, true
+	}
+	_, codec, err := c.probe(ctx, source)
+	if err != nil || codec != "h264" {
+		return target, false
+	}
+
+	key := ProbeCacheKey(source)
+	if kf, ok := c.keyframes.lookup(key, target); ok {
+		return kf, true
+	}
+
+	for _, back := range []float64{keyframeScanBack, keyframeScanWide} {
+		scanCtx, cancel := context.WithTimeout(ctx, keyframeScanLimit)
+		from := max(0, target-back)
+		times, scannedFrom, scannedTo, err := c.keyframeScanFn(scanCtx, source, from, target-from+keyframeScanAhead)
+		cancel()
+		if err != nil {
+			log.Printf("keyframe scan of %s near %.2f failed: %v", source, target, err)
+			return target, false
+		}
+		c.keyframes.add(key, times, timeRange{scannedFrom, scannedTo})
+		if kf, ok := c.keyframes.lookup(key, target); ok {
+			return kf, true
+		}
+	}
+	return target, false
+}
+
+// inputSeek is the -ss value for a slice starting at start. Stream copy
+// begins at the last keyframe at or before -ss, so the keyframe start is
+// nudged forward to survive rounding of the printed value.
+func inputSeek(codec string, start float64) float64 {
+	if codec == "h264" && start > 0 {
+		return start + keyframeSeekNudge
+	}
+	return start
+}
+
+// learnSegmentKeyframes adds the segment boundaries of a stream-copied slice
+// to the keyframe index. The slice must have started on a keyframe.
+func (c *Controller) learnSegmentKeyframes(source string, timeline []PlaylistSegment) {
+	if len(timeline) == 0 {
+		return
+	}
+	times := make([]float64, 0, len(timeline))
+	for _, seg := range timeline {
+		times = append(times, seg.Start)
+	}
+	c.keyframes.add(ProbeCacheKey(source), times, timeRange{})
+}
+
+// NewKeyframeScan scans packets with ffprobe -read_intervals, which seeks to
+// the keyframe before the interval start and reads on from there.
+func NewKeyframeScan(ffprobePath string) KeyframeScanFunc {
+	return func(ctx context.Context, source string, from, duration float64) ([]float64, float64, float64, error) {
+		startTime := 0.0
+		cmd := exec.CommandContext(ctx, ffprobePath, keyframeScanArgs(source, from, duration)...)
+		out, err := cmd.Output()
+		if err != nil {
+			return nil, 0, 0, wrapProbeError(ffprobePath, err)
+		}
+
+		var keyframes []float64
+		var packets []float64
+		scanner := bufio.NewScanner(bytes.NewReader(out))
+		for scanner.Scan() {
+			fields := strings.Split(strings.TrimSpace(scanner.Text()), ",")
+			switch len(fields) {
+			case 1:
+				// The format section comes last: start_time.
+				if v, err := strconv.ParseFloat(fields[0], 64); err == nil {
+					startTime = v
+				}
+			case 3:
+				t, err := strconv.ParseFloat(fields[0], 64)
+				if err != nil {
+					if t, err = strconv.ParseFloat(fields[1], 64); err != nil {
+						continue
+					}
+				}
+				packets = append(packets, t)
+				if strings.HasPrefix(fields[2], "K") {
+					keyframes = append(keyframes, t)
+				}
+			}
+		}
+		if len(packets) == 0 {
+			return nil, 0, 0, fmt.Errorf("no video packets between %.1fs and %.1fs", from, from+duration)
+		}
+
+		// Reading starts at a keyframe, so everything from the first packet
+		// on was seen. Packets arrive in decode order; use the extremes.
+		sort.Float64s(packets)
+		for i := range keyframes {
+			keyframes[i] -= startTime
+		}
+		return keyframes, packets[0] - startTime, packets[len(packets)-1] - startTime, nil
+	}
+}
+
+// keyframeScanArgs builds the ffprobe command line listing the video packets
+// of source from from to from+duration seconds.
+func keyframeScanArgs(source string, from, duration float64) []string {
+	return []string{
+		"-v", "error",
+		"-select_streams", "v:0",
+		"-show_entries", "format=start_time:packet=pts_time,dts_time,flags",
+		"-read_intervals", fmt.Sprintf("%.3f%%+%.3f", from, duration),
+		"-of", "csv=p=0",
+		"-protocol_whitelist", sourcepolicy.ProtocolWhitelist(source),
+		source,
+	}
+}
@@ -11,27 +11,49 @@ import (
 
 func (c *Controller) StopSession(id string) error {
 	c.mu.Lock()
-	defer c.mu.Unlock()
 	sess := c.sessions[id]
+	delete(c.sessions, id)
+	delete(c.options, id)
+	c.mu.Unlock()
 	if sess == nil {
 		return nil
 	}
 
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	sess.stopped = true
+
 	if sess.Cmd != nil && sess.Cmd.Process != nil {
 		if sess.CmdCancel != nil {
 			sess.CmdCancel()
 		}
-		_ = sess.Cmd.Process.Kill()
+		_ = killProcess(sess.Cmd)
 	}
 
 	if sess.WorkDir != "" {
 		_ = os.RemoveAll(sess.WorkDir)
 	}
-
-	delete(c.sessions, id)
 	return nil
 }
 
+// Shutdown stops all sessions and waits up to timeout for their ffmpeg
+// processes to exit.
+func (c *Controller) Shutdown(timeout time.Duration) {
+	for _, id := range c.GetAllSessionIDs() {
+		_ = c.StopSession(id)
+	}
+	done := make(chan struct{})
+	go func() {
+		c.running.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		log.Printf("Timed out waiting for ffmpeg processes to exit")
+	}
+}
+
 func (c *Controller) CleanupOrphanedSessions() {
 	// Get list of all temp directories
 	raffiTempDir := filepath.Join(os.TempDir(), "raffi")
@@ -78,7 +100,6 @@ func (c *Controller) CleanupOrphanedSessions() {
 }
 
 func (c *Controller) ensureCmdLocked(
-	id, source string,
 	sess *Session,
 	seek float64,
 	outDir string,
@@ -94,7 +115,38 @@ func (c *Controller) ensureCmdLocked(
 	ctxCmd, cancel := context.WithCancel(context.Background())
 	sess.CmdCancel = cancel
 
-	cmd, err := c.startCmd(ctxCmd, source, outDir, seek, sess.SliceIndex, DefaultSegmentDuration, MaxBufferAhead, sess.Codec, sess.AudioIndex, sess.AudioCodec, append, hasAudio)
+	vod := sess.SliceIndex < len(sess.Slices) && sess.Slices[sess.SliceIndex].VOD
+	codec := sess.Codec
+	if vod && codec == "h264" {
+		// Copied video is cut at the source's keyframes, which do not fall
+		// on the grid VOD playlists advertise.
+		codec = "libx264"
+	}
+
+	req := TranscodeRequest{
+		Source:          sess.Source,
+		OutDir:          outDir,
+		StartSeconds:    inputSeek(codec, seek),
+		StartSeq:        sess.SliceIndex,
+		SegmentDuration: DefaultSegmentDuration,
+		BufferAhead:     MaxBufferAhead,
+		Codec:           codec,
+		Profile:         sess.Profile,
+		ToneMap:         sess.ToneMap,
+		Audio:           sess.audioTrack(sess.AudioIndex),
+		AudioProfile:    sess.AudioProfile,
+		HasAudio:        hasAudio,
+		Renditions:      sess.audioRenditions(),
+		Append:          append,
+		Format:          sess.SegmentFormat,
+		// Resumed slices are past startup and keep regular segments.
+		LowLatency: sess.LowLatency && !append,
+	}
+	if vod {
+		req.StartSeq, req.VOD = sess.Slices[sess.SliceIndex].StartSeq, true
+	}
+
+	cmd, err := c.startCmd(ctxCmd, req)
 	if err != nil {
 		cancel()
 		return err
@@ -107,25 +159,24 @@ func (c *Controller) ensureCmdLocked(
 	sess.PausedByCap = false
 	sess.LastServedSeq = -1
 	sess.Finished = false
+	sess.AtCoverage = false
 
-	go func(sessionID string, command *exec.Cmd, cmdCtx context.Context) {
+	c.running.Add(1)
+	go func(command *exec.Cmd) {
+		defer c.running.Done()
 		err := command.Wait()
 		cancel()
-		c.cleanupProcess(sessionID, command, err)
-	}(id, cmd, ctxCmd)
+		cleanupProcess(sess, command, err)
+	}(cmd)
 
-	go c.monitorBuffer(id, ctxCmd)
+	go c.monitorBuffer(sess, ctxCmd)
 
 	return nil
 }
 
-func (c *Controller) cleanupProcess(id string, cmd *exec.Cmd, err error) {
-	c.mu.Lock()
-	defer c.mu.Unlock()
-	sess := c.sessions[id]
-	if sess == nil {
-		return
-	}
+func cleanupProcess(sess *Session, cmd *exec.Cmd, err error) {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
 
 	// if the session has moved on to a new command, don't touch it
 	if sess.Cmd != cmd {
@@ -135,7 +186,7 @@ func (c *Controller) cleanupProcess(id string, cmd *exec.Cmd, err error) {
 	if err == nil {
 		sess.Finished = true
 	} else {
-		log.Printf("ffmpeg exited with error for session %s: %v", id, err)
+		log.Printf("ffmpeg exited with error for session %s: %v", sess.ID, err)
 	}
 	sess.Cmd = nil
 	sess.CmdCancel = nil
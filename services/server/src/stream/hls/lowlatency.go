@@ -0,0 +1,39 @@
+package hls
+
+import (
+	"fmt"
+	"time"
+)
+
+// Low-latency sessions start each slice with a few short segments, so the
+// first frame only waits for seconds of media instead of two full segments.
+// Transcoded video gets keyframes forced at the short boundaries and then on
+// the regular grid. Stream-copied video can only be cut at the source's
+// keyframes, so its segments follow the source's GOP length throughout, and
+// audio-only renditions keep the short duration. Playlists carry the real
+// durations, which the manifest wait and the throttle go by.
+
+const (
+	lowLatencySegmentDuration = 2 * time.Second
+	lowLatencySegments        = 3
+	// readySlack absorbs EXTINF rounding when comparing buffered media.
+	readySlack = 250 * time.Millisecond
+)
+
+// startupBuffer is how much media a new slice's playlist lists before
+// playback starts.
+func startupBuffer(sess *Session) time.Duration {
+	if sess.LowLatency {
+		return 2 * lowLatencySegmentDuration
+	}
+	return 2 * DefaultSegmentDuration
+}
+
+// lowLatencyKeyframes is the -force_key_frames expression for
+// lowLatencySegments short segments followed by segmentDur ones.
+func lowLatencyKeyframes(segmentDur time.Duration) string {
+	short := lowLatencySegmentDuration.Seconds()
+	warmup := short * lowLatencySegments
+	return fmt.Sprintf("expr:if(lt(t,%.3f),gte(t,n_forced*%.3f),gte(t,%.3f+(n_forced-%d)*%.3f))",
+		warmup, short, warmup, lowLatencySegments, segmentDur.Seconds())
+}
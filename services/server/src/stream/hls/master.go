@@ -0,0 +1,120 @@
+package hls
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	audioGroupID     = "audio"
+	defaultBandwidth = 8_000_000
+)
+
+// MasterPlaylist returns the multivariant playlist for session id: the video
+// variant (child.m3u8) and one EXT-X-MEDIA entry per audio rendition. When the
+// session muxes its audio there is a single variant and no audio group.
+// rawQuery is appended to every URI so seek parameters reach the media
+// playlists. With vod the variants are the VOD playlists instead. The session
+// is created (probed) if needed but ffmpeg is not started; that happens on the
+// first media playlist or segment request.
+func (c *Controller) MasterPlaylist(ctx context.Context, id, source string, startTime float64, rawQuery string, vod bool) (string, error) {
+	sess, _, err := c.lockOrCreateSession(ctx, id, source, startTime, 2*time.Minute)
+	if err != nil {
+		return "", err
+	}
+	renditions := append([]int(nil), sess.AudioRenditions...)
+	audioIndex := sess.AudioIndex
+	bandwidth := sess.BitRate
+	streams := sess.AvailableStreams
+	profile := sess.AudioProfile
+	sess.mu.Unlock()
+
+	if bandwidth <= 0 {
+		bandwidth = defaultBandwidth
+	}
+	withQuery := func(uri string) string {
+		if rawQuery == "" {
+			return uri
+		}
+		return uri + "?" + rawQuery
+	}
+	videoPlaylist, audioPlaylist := "child.m3u8", AudioPlaylistName
+	if vod {
+		videoPlaylist, audioPlaylist = VODPlaylistName, VODAudioPlaylistName
+	}
+
+	var b strings.Builder
+	b.WriteString("#EXTM3U\n")
+	b.WriteString("#EXT-X-VERSION:6\n")
+	b.WriteString("#EXT-X-INDEPENDENT-SEGMENTS\n")
+
+	if len(renditions) == 0 {
+		fmt.Fprintf(&b, "#EXT-X-STREAM-INF:BANDWIDTH=%d\n", bandwidth)
+		b.WriteString(withQuery(videoPlaylist) + "\n")
+		return b.String(), nil
+	}
+
+	// Playlist order follows stream order so the player's track list matches
+	// the session's availableStreams.
+	for _, st := range streams {
+		published := false
+		for _, idx := range renditions {
+			if idx == st.Index {
+				published = true
+				break
+			}
+		}
+		if !published {
+			continue
+		}
+
+		attrs := []string{
+			"TYPE=AUDIO",
+			"GROUP-ID=" + quoteAttr(audioGroupID),
+			"NAME=" + quoteAttr(renditionName(st.Title, st.Language, st.Index)),
+		}
+		if lang := strings.TrimSpace(st.Language); lang != "" && lang != "und" {
+			attrs = append(attrs, "LANGUAGE="+quoteAttr(lang))
+		}
+		if st.Index == audioIndex {
+			attrs = append(attrs, "DEFAULT=YES", "AUTOSELECT=YES")
+		} else {
+			attrs = append(attrs, "DEFAULT=NO", "AUTOSELECT=YES")
+		}
+		if channels := profile.OutputChannels(st.Codec, st.Channels); channels > 0 {
+			attrs = append(attrs, fmt.Sprintf(`CHANNELS="%d"`, channels))
+		}
+		attrs = append(attrs, "URI="+quoteAttr(withQuery(audioPlaylist(st.Index))))
+		b.WriteString("#EXT-X-MEDIA:" + strings.Join(attrs, ",") + "\n")
+	}
+
+	fmt.Fprintf(&b, "#EXT-X-STREAM-INF:BANDWIDTH=%d,AUDIO=%s\n", bandwidth, quoteAttr(audioGroupID))
+	b.WriteString(withQuery(videoPlaylist) + "\n")
+	return b.String(), nil
+}
+
+// IsAudioPlaylist reports whether asset names a rendition playlist.
+func IsAudioPlaylist(asset string) bool {
+	var idx int
+	n, err := fmt.Sscanf(asset, "audio_%d.m3u8", &idx)
+	return err == nil && n == 1 && asset == AudioPlaylistName(idx)
+}
+
+func renditionName(title, language string, index int) string {
+	name := strings.TrimSpace(title)
+	if name == "" {
+		name = strings.TrimSpace(language)
+	}
+	if name == "" || name == "und" {
+		name = fmt.Sprintf("Audio %d", index+1)
+	}
+	return name
+}
+
+// quoteAttr quotes an attribute value. Quoted strings in playlists cannot
+// contain double quotes or line breaks and have no escape syntax.
+func quoteAttr(v string) string {
+	return `"` + strings.NewReplacer(`"`, "'", "\n", " ", "\r", " ").Replace(v) + `"`
+}
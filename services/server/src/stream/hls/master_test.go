@@ -0,0 +1,107 @@
+package hls
+
+import (
+	"context"
+	"testing"
+
+	"raffi-server/src/session"
+)
+
+func TestMasterPlaylist(t *testing.T) {
+	tests := []struct {
+		name       string
+		renditions int
+		profile    AudioProfile
+		rawQuery   string
+		vod        bool
+		want       string
+	}{
+		{
+			name: "muxed audio",
+			want: "#EXTM3U\n" +
+				"#EXT-X-VERSION:6\n" +
+				"#EXT-X-INDEPENDENT-SEGMENTS\n" +
+				"#EXT-X-STREAM-INF:BANDWIDTH=4000000\n" +
+				"child.m3u8\n",
+		},
+		{
+			name:       "audio renditions",
+			renditions: 2,
+			rawQuery:   "start=30",
+			want: "#EXTM3U\n" +
+				"#EXT-X-VERSION:6\n" +
+				"#EXT-X-INDEPENDENT-SEGMENTS\n" +
+				`#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID="audio",NAME="eng",LANGUAGE="eng",DEFAULT=YES,AUTOSELECT=YES,CHANNELS="2",URI="audio_0.m3u8?start=30"` + "\n" +
+				`#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID="audio",NAME="fra",LANGUAGE="fra",DEFAULT=NO,AUTOSELECT=YES,CHANNELS="2",URI="audio_1.m3u8?start=30"` + "\n" +
+				`#EXT-X-STREAM-INF:BANDWIDTH=4000000,AUDIO="audio"` + "\n" +
+				"child.m3u8?start=30\n",
+		},
+		{
+			name:       "passthrough keeps surround",
+			renditions: 2,
+			profile:    AudioProfilePassthrough,
+			want: "#EXTM3U\n" +
+				"#EXT-X-VERSION:6\n" +
+				"#EXT-X-INDEPENDENT-SEGMENTS\n" +
+				`#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID="audio",NAME="eng",LANGUAGE="eng",DEFAULT=YES,AUTOSELECT=YES,CHANNELS="2",URI="audio_0.m3u8"` + "\n" +
+				`#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID="audio",NAME="fra",LANGUAGE="fra",DEFAULT=NO,AUTOSELECT=YES,CHANNELS="6",URI="audio_1.m3u8"` + "\n" +
+				`#EXT-X-STREAM-INF:BANDWIDTH=4000000,AUDIO="audio"` + "\n" +
+				"child.m3u8\n",
+		},
+		{
+			name:       "vod with one rendition",
+			renditions: 1,
+			vod:        true,
+			want: "#EXTM3U\n" +
+				"#EXT-X-VERSION:6\n" +
+				"#EXT-X-INDEPENDENT-SEGMENTS\n" +
+				`#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID="audio",NAME="eng",LANGUAGE="eng",DEFAULT=YES,AUTOSELECT=YES,CHANNELS="2",URI="` + VODAudioPlaylistName(0) + `"` + "\n" +
+				`#EXT-X-STREAM-INF:BANDWIDTH=4000000,AUDIO="audio"` + "\n" +
+				VODPlaylistName + "\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, _ := newFakeToolsController(t)
+			profile := tt.profile
+			if profile == "" {
+				profile = AudioProfileAuto
+			}
+			c.Configure("sess", SessionOptions{
+				Preferences:     session.DefaultTrackPreferences(),
+				AudioRenditions: tt.renditions,
+				AudioProfile:    profile,
+				SegmentFormat:   SegmentFormatTS,
+				Profile:         DefaultEncodingProfile,
+			})
+			got, err := c.MasterPlaylist(context.Background(), "sess", "/media/movie.mkv", 0, tt.rawQuery, tt.vod)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("master playlist:\n%s\nwant:\n%s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRenditionNameAndQuoting(t *testing.T) {
+	tests := []struct {
+		title, language string
+		index           int
+		want            string
+	}{
+		{"Director's Cut", "eng", 0, "Director's Cut"},
+		{"", "jpn", 1, "jpn"},
+		{"", "und", 2, "Audio 3"},
+		{"  ", "", 0, "Audio 1"},
+	}
+	for _, tt := range tests {
+		if got := renditionName(tt.title, tt.language, tt.index); got != tt.want {
+			t.Errorf("renditionName(%q, %q, %d) = %q, want %q", tt.title, tt.language, tt.index, got, tt.want)
+		}
+	}
+	if got := quoteAttr("The \"Best\"\nMix"); got != `"The 'Best' Mix"` {
+		t.Errorf("quoteAttr = %s", got)
+	}
+}
@@ -0,0 +1,152 @@
+package hls
+
+import (
+	"strconv"
+	"strings"
+
+	"raffi-server/src/session"
+)
+
+// Subtitle codecs ffmpeg can convert to WebVTT. Everything else is bitmap
+// based and has to be burned in.
+var textSubtitleCodecs = map[string]bool{
+	"subrip": true, "srt": true, "ass": true, "ssa": true, "webvtt": true,
+	"mov_text": true, "text": true, "microdvd": true, "subviewer": true,
+}
+
+// MediaInfo summarizes the probe result for the session API.
+func (m *Metadata) MediaInfo() *session.MediaInfo {
+	if m == nil {
+		return nil
+	}
+	info := &session.MediaInfo{
+		Container: m.Format.FormatName,
+		BitRate:   parseInt64(m.Format.BitRate),
+		SizeBytes: parseInt64(m.Format.Size),
+	}
+
+	audioCount, subCount := 0, 0
+	for _, st := range m.Streams {
+		switch st.CodecType {
+		case "video":
+			// Cover art is exposed as a video stream; skip it.
+			if info.Video != nil || st.Disposition.AttachedPic == 1 {
+				continue
+			}
+			v := &session.VideoInfo{
+				Codec:          st.CodecName,
+				Profile:        st.Profile,
+				Width:          st.Width,
+				Height:         st.Height,
+				FPS:            parseFrameRate(st.AvgFrameRate),
+				BitDepth:       bitDepth(st.BitsPerRawSample, st.PixFmt),
+				BitRate:        streamBitRate(st.BitRate, st.Tags.BPS),
+				PixelFormat:    st.PixFmt,
+				ColorTransfer:  st.ColorTransfer,
+				ColorPrimaries: st.ColorPrimaries,
+				ColorSpace:     st.ColorSpace,
+			}
+			if v.FPS == 0 {
+				v.FPS = parseFrameRate(st.RFrameRate)
+			}
+			for _, sd := range st.SideDataList {
+				if strings.EqualFold(sd.SideDataType, "DOVI configuration record") {
+					v.HDR = session.HDRDolbyVision
+					v.DolbyVisionProfile = sd.DVProfile
+				}
+			}
+			if v.HDR == "" {
+				switch {
+				case st.CodecTag == "dvh1" || st.CodecTag == "dvhe" || st.CodecTag == "dav1":
+					v.HDR = session.HDRDolbyVision
+				case st.ColorTransfer == "smpte2084":
+					v.HDR = session.HDR10
+				case st.ColorTransfer == "arib-std-b67":
+					v.HDR = session.HDRHLG
+				}
+			}
+			info.Video = v
+		case "audio":
+			info.Audio = append(info.Audio, session.AudioInfo{
+				Index:         audioCount,
+				Codec:         st.CodecName,
+				Profile:       st.Profile,
+				Channels:      st.Channels,
+				ChannelLayout: st.ChannelLayout,
+				SampleRate:    int(parseInt64(st.SampleRate)),
+				BitRate:       streamBitRate(st.BitRate, st.Tags.BPS),
+				Language:      st.Tags.Language,
+				Title:         st.Tags.Title,
+				Default:       st.Disposition.Default == 1,
+				Forced:        st.Disposition.Forced == 1,
+				Commentary:    st.Disposition.Comment == 1,
+			})
+			audioCount++
+		case "subtitle":
+			info.Subtitles = append(info.Subtitles, session.SubtitleInfo{
+				Index:           subCount,
+				Codec:           st.CodecName,
+				Language:        st.Tags.Language,
+				Title:           st.Tags.Title,
+				Text:            textSubtitleCodecs[st.CodecName],
+				Default:         st.Disposition.Default == 1,
+				Forced:          st.Disposition.Forced == 1 || strings.Contains(strings.ToLower(st.Tags.Title), "forced"),
+				HearingImpaired: st.Disposition.HearingImpaired == 1 || strings.Contains(strings.ToLower(st.Tags.Title), "sdh"),
+			})
+			subCount++
+		}
+	}
+	return info
+}
+
+// parseFrameRate reads ffprobe rationals such as "24000/1001".
+func parseFrameRate(s string) float64 {
+	num, den, ok := strings.Cut(s, "/")
+	if !ok {
+		f, _ := strconv.ParseFloat(s, 64)
+		return f
+	}
+	n, err1 := strconv.ParseFloat(num, 64)
+	d, err2 := strconv.ParseFloat(den, 64)
+	if err1 != nil || err2 != nil || d == 0 {
+		return 0
+	}
+	return float64(int(n/d*1000+0.5)) / 1000
+}
+
+// bitDepth prefers bits_per_raw_sample and falls back to the pixel format
+// name (yuv420p10le -> 10).
+func bitDepth(raw, pixFmt string) int {
+	if n, err := strconv.Atoi(raw); err == nil && n > 0 {
+		return n
+	}
+	if pixFmt == "" {
+		return 0
+	}
+	name := strings.TrimSuffix(strings.TrimSuffix(pixFmt, "le"), "be")
+	end := len(name)
+	start := end
+	for start > 0 && name[start-1] >= '0' && name[start-1] <= '9' {
+		start--
+	}
+	if start < end && start > 0 && name[start-1] == 'p' {
+		if n, err := strconv.Atoi(name[start:end]); err == nil && n > 8 {
+			return n
+		}
+	}
+	return 8
+}
+
+// streamBitRate uses the stream bit_rate, or the BPS tag Matroska muxers write
+// when the container has no per-stream rate.
+func streamBitRate(bitRate, bps string) int64 {
+	if n := parseInt64(bitRate); n > 0 {
+		return n
+	}
+	return parseInt64(bps)
+}
+
+func parseInt64(s string) int64 {
+	n, _ := strconv.ParseInt(strings.TrimSpace(s), 10, 64)
+	return n
+}
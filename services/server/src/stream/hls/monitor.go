@@ -17,7 +17,7 @@ const (
 	playlistDemandNudgeMinGap = 2 * time.Second
 )
 
-func (c *Controller) monitorBuffer(id string, ctx context.Context) {
+func (c *Controller) monitorBuffer(sess *Session, ctx context.Context) {
 	ticker := time.NewTicker(250 * time.Millisecond)
 	defer ticker.Stop()
 
@@ -26,27 +26,30 @@ func (c *Controller) monitorBuffer(id string, ctx context.Context) {
 		case <-ctx.Done():
 			return
 		case <-ticker.C:
-			c.mu.Lock()
-			sess := c.sessions[id]
-			if sess == nil || sess.Cmd == nil {
-				c.mu.Unlock()
+			sess.mu.Lock()
+			if sess.stopped || sess.Cmd == nil {
+				sess.mu.Unlock()
 				return
 			}
 			c.adjustThrottleLocked(sess)
-			c.mu.Unlock()
+			sess.mu.Unlock()
 		}
 	}
 }
 
 func (c *Controller) adjustThrottleLocked(sess *Session) {
+	if stopAtCoverageLocked(sess) {
+		return
+	}
+
 	isHTTPSource := false
 	if sess != nil {
 		src := sess.Source
 		isHTTPSource = strings.HasPrefix(src, "http://") || strings.HasPrefix(src, "https://")
 	}
 
-	mediaSeq, segCount, err := readPlaylistState(filepath.Join(sess.WorkDir, fmt.Sprintf("slice_%03d", sess.SliceIndex), "child.m3u8"))
-	if err != nil || segCount == 0 {
+	_, timeline, err := readPlaylistTimeline(filepath.Join(sess.WorkDir, fmt.Sprintf("slice_%03d", sess.SliceIndex), "child.m3u8"), 0)
+	if err != nil || len(timeline) == 0 {
 		if !sess.DemandResumeUntil.IsZero() && time.Now().Before(sess.DemandResumeUntil) {
 			if sess.Paused && sess.PausedByCap {
 				sess.PausedByCap = false
@@ -56,9 +59,8 @@ func (c *Controller) adjustThrottleLocked(sess *Session) {
 		return
 	}
 
-	highest := mediaSeq + segCount - 1
-	aheadSegments := max(highest-sess.LastServedSeq, 0)
-	aheadDuration := time.Duration(aheadSegments) * DefaultSegmentDuration
+	// Segments differ in length (see lowlatency.go), so add up what is left.
+	aheadDuration := bufferedAfter(timeline, sess.LastServedSeq)
 
 	if !sess.DemandResumeUntil.IsZero() && time.Now().Before(sess.DemandResumeUntil) {
 		if aheadDuration < MaxBufferAhead {
@@ -147,33 +149,41 @@ func (c *Controller) adjustThrottleLocked(sess *Session) {
 	}
 }
 
-func (c *Controller) MarkSegmentServed(id, filename string) {
-	seq, ok := parseSegmentSequence(filename)
+// MarkSegmentServed records that video segment asset was served: a segment
+// name of the playlist's slice, slice_NNN/name, or a VOD segment under
+// VODSegmentPrefix.
+func (c *Controller) MarkSegmentServed(id, asset string) {
+	seq, ok := parseSegmentSequence(asset)
 	if !ok {
 		return
 	}
 
-	c.mu.Lock()
-	sess := c.sessions[id]
+	sess := c.lockSession(id)
 	if sess == nil {
-		c.mu.Unlock()
 		return
 	}
-	if seq > sess.LastServedSeq {
-		sess.LastServedSeq = seq
+	// Sequence numbers are only comparable within the slice ffmpeg writes;
+	// VOD segments share one numbering.
+	slice, ok := assetSlice(asset)
+	if !ok {
+		slice = sess.PlaylistSlice
+	}
+	if strings.HasPrefix(asset, VODSegmentPrefix) || slice == sess.SliceIndex {
+		if seq > sess.LastServedSeq {
+			sess.LastServedSeq = seq
+		}
 	}
+	c.resumeAfterCoverageLocked(sess, asset, seq)
 	c.adjustThrottleLocked(sess)
-	c.mu.Unlock()
+	sess.mu.Unlock()
 }
 
 func (c *Controller) NotifyClientAssetRequest(id string) {
-	c.mu.Lock()
-	defer c.mu.Unlock()
-
-	sess := c.sessions[id]
+	sess := c.lockSession(id)
 	if sess == nil {
 		return
 	}
+	defer sess.mu.Unlock()
 
 	sess.DemandResumeUntil = time.Now().Add(clientDemandResumeGrace)
 
@@ -189,13 +199,11 @@ func (c *Controller) NotifyClientAssetRequest(id string) {
 }
 
 func (c *Controller) NotifyClientPlaylistRequest(id string) {
-	c.mu.Lock()
-	defer c.mu.Unlock()
-
-	sess := c.sessions[id]
+	sess := c.lockSession(id)
 	if sess == nil {
 		return
 	}
+	defer sess.mu.Unlock()
 
 	now := time.Now()
 	if !sess.LastPlaylistNudge.IsZero() && now.Sub(sess.LastPlaylistNudge) < playlistDemandNudgeMinGap {
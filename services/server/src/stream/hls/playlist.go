@@ -16,6 +16,9 @@ type PlaylistSegment struct {
 	Filename string
 	Start    float64
 	End      float64
+	// Discontinuity is set when an EXT-X-DISCONTINUITY tag precedes the
+	// segment.
+	Discontinuity bool
 }
 
 func readPlaylistState(path string) (int, int, error) {
@@ -61,6 +64,7 @@ func readPlaylistTimelineFromReader(r io.Reader, sliceStart float64) (int, []Pla
 	nextSeq := 0
 	cursor := sliceStart
 	pendingDur := 0.0
+	discontinuity := false
 	segments := make([]PlaylistSegment, 0, 8)
 
 	for scanner.Scan() {
@@ -91,6 +95,11 @@ func readPlaylistTimelineFromReader(r io.Reader, sliceStart float64) (int, []Pla
 			continue
 		}
 
+		if line == "#EXT-X-DISCONTINUITY" {
+			discontinuity = true
+			continue
+		}
+
 		if strings.HasPrefix(line, "#") {
 			continue
 		}
@@ -100,15 +109,17 @@ func readPlaylistTimelineFromReader(r io.Reader, sliceStart float64) (int, []Pla
 			dur = DefaultSegmentDuration.Seconds()
 		}
 		seg := PlaylistSegment{
-			Sequence: nextSeq,
-			Filename: line,
-			Start:    cursor,
-			End:      cursor + dur,
+			Sequence:      nextSeq,
+			Filename:      line,
+			Start:         cursor,
+			End:           cursor + dur,
+			Discontinuity: discontinuity,
 		}
 		segments = append(segments, seg)
 		cursor = seg.End
 		nextSeq++
 		pendingDur = 0
+		discontinuity = false
 	}
 
 	if err := scanner.Err(); err != nil {
@@ -118,7 +129,35 @@ func readPlaylistTimelineFromReader(r io.Reader, sliceStart float64) (int, []Pla
 	return mediaSeq, segments, nil
 }
 
-func waitForManifestReady(manifestPath string, timeout time.Duration, shouldAbort func() bool) error {
+// appendDiscontinuity marks the next segment appended to the playlist at
+// path as discontinuous.
+func appendDiscontinuity(path string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		return err
+	}
+	_, err = f.WriteString("#EXT-X-DISCONTINUITY\n")
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// bufferedAfter is the duration of the segments in timeline after sequence
+// seq.
+func bufferedAfter(timeline []PlaylistSegment, seq int) time.Duration {
+	var total float64
+	for _, seg := range timeline {
+		if seg.Sequence > seq {
+			total += seg.End - seg.Start
+		}
+	}
+	return time.Duration(total * float64(time.Second))
+}
+
+// waitForManifestReady waits for manifestPath to list ready worth of segments
+// so playback starts smoothly.
+func waitForManifestReady(manifestPath string, ready, timeout time.Duration, shouldAbort func() bool) error {
 	deadline := time.Now().Add(timeout)
 
 	for {
@@ -134,13 +173,14 @@ func waitForManifestReady(manifestPath string, timeout time.Duration, shouldAbor
 		time.Sleep(100 * time.Millisecond)
 	}
 
-	// best-effort: wait for at least 2 segments to ensure smooth start
+	// best-effort: segment durations vary, so wait for enough media rather
+	// than a fixed number of segments
 	for {
 		if shouldAbort != nil && shouldAbort() {
 			return fmt.Errorf("transcoder exited before manifest had segments: %s", manifestPath)
 		}
-		_, segCount, err := readPlaylistState(manifestPath)
-		if err == nil && segCount >= 2 {
+		_, timeline, err := readPlaylistTimeline(manifestPath, 0)
+		if err == nil && bufferedAfter(timeline, -1) >= ready-readySlack {
 			return nil
 		}
 		if time.Now().After(deadline) {
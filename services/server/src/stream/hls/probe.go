@@ -12,22 +12,53 @@ import (
 	"strings"
 	"sync"
 	"syscall"
+
+	sourcepolicy "raffi-server/src/source"
 )
 
 type Metadata struct {
 	Format struct {
 		Duration        string  `json:"duration"`
 		DurationSeconds float64 `json:"-"`
+		FormatName      string  `json:"format_name"`
+		BitRate         string  `json:"bit_rate"`
+		Size            string  `json:"size"`
 	} `json:"format"`
 	Streams []struct {
-		Index     int    `json:"index"`
-		CodecName string `json:"codec_name"`
-		CodecType string `json:"codec_type"`
-		PixFmt    string `json:"pix_fmt"`
-		Profile   string `json:"profile"`
-		Tags      struct {
+		Index            int    `json:"index"`
+		CodecName        string `json:"codec_name"`
+		CodecType        string `json:"codec_type"`
+		CodecTag         string `json:"codec_tag_string"`
+		PixFmt           string `json:"pix_fmt"`
+		Profile          string `json:"profile"`
+		Level            int    `json:"level"`
+		Width            int    `json:"width"`
+		Height           int    `json:"height"`
+		AvgFrameRate     string `json:"avg_frame_rate"`
+		RFrameRate       string `json:"r_frame_rate"`
+		BitsPerRawSample string `json:"bits_per_raw_sample"`
+		ColorTransfer    string `json:"color_transfer"`
+		ColorPrimaries   string `json:"color_primaries"`
+		ColorSpace       string `json:"color_space"`
+		Channels         int    `json:"channels"`
+		ChannelLayout    string `json:"channel_layout"`
+		SampleRate       string `json:"sample_rate"`
+		BitRate          string `json:"bit_rate"`
+		Disposition      struct {
+			Default         int `json:"default"`
+			Forced          int `json:"forced"`
+			Comment         int `json:"comment"`
+			HearingImpaired int `json:"hearing_impaired"`
+			AttachedPic     int `json:"attached_pic"`
+		} `json:"disposition"`
+		SideDataList []struct {
+			SideDataType string `json:"side_data_type"`
+			DVProfile    int    `json:"dv_profile"`
+		} `json:"side_data_list"`
+		Tags struct {
 			Language string `json:"language"`
 			Title    string `json:"title"`
+			BPS      string `json:"BPS"`
 		} `json:"tags"`
 	} `json:"streams"`
 	Chapters []struct {
@@ -62,15 +93,6 @@ func NewProbeDuration(ffprobePath string) func(ctx context.Context, source strin
 	var fallbackPath string
 
 	return func(ctx context.Context, source string) (*Metadata, string, error) {
-		probeSource := source
-		if strings.Contains(source, "/torrents/") {
-			if strings.Contains(source, "?") {
-				probeSource = source + "&metadata=1"
-			} else {
-				probeSource = source + "?metadata=1"
-			}
-		}
-
 		attemptPaths := []string{ffprobePath}
 		if runtime.GOOS == "linux" {
 			fallbackOnce.Do(func() {
@@ -86,16 +108,7 @@ func NewProbeDuration(ffprobePath string) func(ctx context.Context, source strin
 
 		var lastErr error
 		for _, p := range attemptPaths {
-			cmd := exec.CommandContext(ctx, p,
-				"-v", "quiet",
-				"-analyzeduration", "1000000",
-				"-probesize", "1000000",
-				"-print_format", "json",
-				"-show_format",
-				"-show_streams",
-				"-show_chapters",
-				probeSource,
-			)
+			cmd := exec.CommandContext(ctx, p, probeArgs(source)...)
 			out, err := cmd.Output()
 			if err == nil {
 				// Success — if we used fallback, remember it for future calls
@@ -138,11 +151,31 @@ func NewProbeDuration(ffprobePath string) func(ctx context.Context, source strin
 	}
 }
 
-func (c *Controller) ProbeMetadata(ctx context.Context, id, source string) (*Metadata, error) {
-	c.mu.Lock()
-	defer c.mu.Unlock()
+// probeArgs builds the ffprobe command line for source. Torrent sources are
+// asked for the file's metadata region first.
+func probeArgs(source string) []string {
+	if strings.Contains(source, "/torrents/") {
+		if strings.Contains(source, "?") {
+			source += "&metadata=1"
+		} else {
+			source += "?metadata=1"
+		}
+	}
+	return []string{
+		"-v", "quiet",
+		"-analyzeduration", "1000000",
+		"-probesize", "1000000",
+		"-print_format", "json",
+		"-show_format",
+		"-show_streams",
+		"-show_chapters",
+		"-protocol_whitelist", sourcepolicy.ProtocolWhitelist(source),
+		source,
+	}
+}
 
-	meta, _, err := c.getOrProbeLocked(ctx, source)
+func (c *Controller) ProbeMetadata(ctx context.Context, id, source string) (*Metadata, error) {
+	meta, _, err := c.probe(ctx, source)
 	return meta, err
 }
 
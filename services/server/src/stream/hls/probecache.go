@@ -0,0 +1,442 @@
+package hls
+
+import (
+	"container/list"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultProbeCacheSize = 512
+	probeCacheSaveDelay   = 2 * time.Second
+	probeCacheVersion     = 3
+	// Debrid link sizes remembered before the table is cleared.
+	maxDebridSizes = 1024
+)
+
+// TTLs per key kind. File and torrent keys identify the content itself, so
+// they can live long; plain URLs may start serving something else.
+var probeCacheTTL = map[string]time.Duration{
+	"file":    30 * 24 * time.Hour,
+	"torrent": 30 * 24 * time.Hour,
+	"debrid":  24 * time.Hour,
+	"url":     6 * time.Hour,
+}
+
+// Query parameters that carry credentials or expiry and change between
+// otherwise identical links.
+var volatileQueryParams = map[string]struct{}{
+	"token": {}, "access_token": {}, "auth": {}, "key": {}, "apikey": {}, "api_key": {},
+	"expires": {}, "expiry": {}, "exp": {}, "e": {}, "st": {}, "sig": {}, "signature": {},
+	"policy": {}, "key-pair-id": {}, "hash": {}, "ts": {}, "metadata": {},
+}
+
+// Hosts of debrid CDNs whose download links are reissued with new path
+// tokens; the file name and size are the only stable parts.
+var debridHosts = []string{
+	"real-debrid.com", "debrid.it", "alldebrid.com", "debrid-link.com", "debrid-link.fr",
+	"premiumize.me", "energycdn.com", "torbox.app", "tb-cdn.st", "offcloud.com",
+}
+
+// Hosts that hand out signed links whose volatile query parameters change
+// for the same file. Other hosts keep their query intact, where parameters
+// like key or hash may select the content.
+var signedURLHosts = []string{
+	"amazonaws.com", "cloudfront.net", "googleusercontent.com", "googlevideo.com",
+	"akamaized.net", "b-cdn.net", "r2.cloudflarestorage.com",
+}
+
+// debridSizes remembers the size of each debrid link so ProbeCacheKey asks
+// the CDN once per link.
+var debridSizes = struct {
+	sync.Mutex
+	m map[string]int64
+}{m: make(map[string]int64)}
+
+// remoteFileSize returns the Content-Length of a HEAD request. It is a
+// variable so tests do not need a CDN.
+var remoteFileSize = func(rawURL string) (int64, bool) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, rawURL, nil)
+	if err != nil {
+		return 0, false
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, false
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.ContentLength <= 0 {
+		return 0, false
+	}
+	return resp.ContentLength, true
+}
+
+func debridFileSize(rawURL string) (int64, bool) {
+	debridSizes.Lock()
+	size, ok := debridSizes.m[rawURL]
+	debridSizes.Unlock()
+	if ok {
+		return size, size > 0
+	}
+	size, ok = remoteFileSize(rawURL)
+	if !ok {
+		size = 0
+	}
+	debridSizes.Lock()
+	if len(debridSizes.m) >= maxDebridSizes {
+		clear(debridSizes.m)
+	}
+	debridSizes.m[rawURL] = size
+	debridSizes.Unlock()
+	return size, ok
+}
+
+type probeCacheEntry struct {
+	Key      string    `json:"key"`
+	Source   string    `json:"source"`
+	Meta     *Metadata `json:"meta"`
+	Codec    string    `json:"codec"`
+	StoredAt time.Time `json:"storedAt"`
+
+	elem *list.Element
+}
+
+// ProbeCache is a bounded LRU of ffprobe results with per-kind TTLs. Keys are
+// derived from content identity rather than the raw source string; see
+// ProbeCacheKey. When given a path the cache is persisted across restarts.
+type ProbeCache struct {
+	mu        sync.Mutex
+	entries   map[string]*probeCacheEntry
+	lru       *list.List
+	max       int
+	path      string
+	saveTimer *time.Timer
+}
+
+type persistedProbeCache struct {
+	Version int                `json:"version"`
+	Entries []*probeCacheEntry `json:"entries"`
+}
+
+func NewProbeCache(path string, max int) *ProbeCache {
+	if max <= 0 {
+		max = DefaultProbeCacheSize
+	}
+	c := &ProbeCache{
+		entries: make(map[string]*probeCacheEntry),
+		lru:     list.New(),
+		max:     max,
+		path:    path,
+	}
+	if path != "" {
+		if err := c.load(); err != nil && !errors.Is(err, os.ErrNotExist) {
+			log.Printf("probe cache: failed to load %s: %v", path, err)
+		}
+	}
+	return c
+}
+
+func (c *ProbeCache) Get(source string) (*Metadata, string, bool) {
+	key := ProbeCacheKey(source)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if !ok {
+		return nil, "", false
+	}
+	if expired(e) {
+		c.removeLocked(e)
+		return nil, "", false
+	}
+	c.lru.MoveToFront(e.elem)
+	return e.Meta, e.Codec, true
+}
+
+func (c *ProbeCache) Put(source string, meta *Metadata, codec string) {
+	if meta == nil {
+		return
+	}
+	key := ProbeCacheKey(source)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[key]; ok {
+		c.removeLocked(e)
+	}
+	e := &probeCacheEntry{Key: key, Source: redactSource(source), Meta: meta, Codec: codec, StoredAt: time.Now()}
+	e.elem = c.lru.PushFront(e)
+	c.entries[key] = e
+	for c.lru.Len() > c.max {
+		c.removeLocked(c.lru.Back().Value.(*probeCacheEntry))
+	}
+	c.scheduleSaveLocked()
+}
+
+// Invalidate drops the entry for source and reports the key it used.
+func (c *ProbeCache) Invalidate(source string) (string, bool) {
+	key := ProbeCacheKey(source)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if ok {
+		c.removeLocked(e)
+		c.scheduleSaveLocked()
+	}
+	return key, ok
+}
+
+func (c *ProbeCache) Clear() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := len(c.entries)
+	c.entries = make(map[string]*probeCacheEntry)
+	c.lru.Init()
+	c.scheduleSaveLocked()
+	return n
+}
+
+func (c *ProbeCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.entries)
+}
+
+func (c *ProbeCache) removeLocked(e *probeCacheEntry) {
+	c.lru.Remove(e.elem)
+	delete(c.entries, e.Key)
+}
+
+func expired(e *probeCacheEntry) bool {
+	kind, _, _ := strings.Cut(e.Key, ":")
+	ttl, ok := probeCacheTTL[kind]
+	if !ok {
+		ttl = probeCacheTTL["url"]
+	}
+	return time.Since(e.StoredAt) > ttl
+}
+
+// scheduleSaveLocked coalesces writes; probes tend to arrive in bursts.
+func (c *ProbeCache) scheduleSaveLocked() {
+	if c.path == "" || c.saveTimer != nil {
+		return
+	}
+	c.saveTimer = time.AfterFunc(probeCacheSaveDelay, func() {
+		c.mu.Lock()
+		c.saveTimer = nil
+		c.mu.Unlock()
+		if err := c.Save(); err != nil {
+			log.Printf("probe cache: save failed: %v", err)
+		}
+	})
+}
+
+// Save writes the unexpired entries to disk.
+func (c *ProbeCache) Save() error {
+	if c.path == "" {
+		return nil
+	}
+	c.mu.Lock()
+	snapshot := persistedProbeCache{Version: probeCacheVersion}
+	for el := c.lru.Back(); el != nil; el = el.Prev() {
+		e := el.Value.(*probeCacheEntry)
+		if !expired(e) {
+			snapshot.Entries = append(snapshot.Entries, e)
+		}
+	}
+	data, err := json.Marshal(snapshot)
+	c.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(c.path), 0o755); err != nil {
+		return err
+	}
+	tmp := c.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, c.path)
+}
+
+func (c *ProbeCache) load() error {
+	data, err := os.ReadFile(c.path)
+	if err != nil {
+		return err
+	}
+	var snapshot persistedProbeCache
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return err
+	}
+	if snapshot.Version != probeCacheVersion {
+		return nil
+	}
+	// Entries are stored oldest first so pushing to the front restores the
+	// LRU order.
+	for _, e := range snapshot.Entries {
+		if e == nil || e.Key == "" || e.Meta == nil || expired(e) {
+			continue
+		}
+		e.Meta.Format.DurationSeconds, _ = strconv.ParseFloat(e.Meta.Format.Duration, 64)
+		if old, ok := c.entries[e.Key]; ok {
+			c.removeLocked(old)
+		}
+		e.elem = c.lru.PushFront(e)
+		c.entries[e.Key] = e
+	}
+	for c.lru.Len() > c.max {
+		c.removeLocked(c.lru.Back().Value.(*probeCacheEntry))
+	}
+	return nil
+}
+
+// ProbeCacheKey maps a probe source to a stable identity:
+//
+//	file:{path}:{size}:{mtime}      local files, so edits invalidate the entry
+//	torrent:{infohash}:{fileIdx}    this server's torrent streams and addon
+//	                                resolver links that embed an infohash
+//	debrid:{host}:{name}:{size}     debrid CDN links with rotating tokens
+//	url:{normalized url}            everything else; volatile params are removed
+//	                                for hosts that sign their links
+func ProbeCacheKey(source string) string {
+	source = strings.TrimSpace(source)
+	if filepath.IsAbs(source) {
+		clean := filepath.Clean(source)
+		if info, err := os.Stat(clean); err == nil {
+			return fmt.Sprintf("file:%s:%d:%d", clean, info.Size(), info.ModTime().UnixNano())
+		}
+		return "file:" + clean
+	}
+
+	u, err := url.Parse(source)
+	if err != nil || u.Host == "" {
+		return "url:" + source
+	}
+	host := strings.ToLower(u.Hostname())
+
+	if isTorrentSource(source) {
+		if hash, idx, ok := torrentIdentity(u); ok {
+			return "torrent:" + hash + ":" + idx
+		}
+	}
+	if hash, idx, ok := resolverIdentity(u.Path); ok {
+		return "torrent:" + hash + ":" + idx
+	}
+	for _, d := range debridHosts {
+		if host == d || strings.HasSuffix(host, "."+d) {
+			name := path.Base(u.Path)
+			if name == "" || name == "/" || name == "." {
+				break
+			}
+			// Two files of the same name on one CDN are told apart by size;
+			// without it the link itself is the key.
+			if size, ok := debridFileSize(source); ok {
+				return fmt.Sprintf("debrid:%s:%s:%d", d, strings.ToLower(name), size)
+			}
+			break
+		}
+	}
+
+	signed := hostIn(host, signedURLHosts) || hostIn(host, debridHosts)
+	q := u.Query()
+	for k := range q {
+		lower := strings.ToLower(k)
+		if _, ok := volatileQueryParams[lower]; (ok && signed) || strings.HasPrefix(lower, "x-amz-") {
+			q.Del(k)
+		}
+	}
+	u.RawQuery = q.Encode()
+	u.Fragment = ""
+	u.Host = strings.ToLower(u.Host)
+	u.Scheme = strings.ToLower(u.Scheme)
+	return "url:" + u.String()
+}
+
+func hostIn(host string, domains []string) bool {
+	for _, d := range domains {
+		if host == d || strings.HasSuffix(host, "."+d) {
+			return true
+		}
+	}
+	return false
+}
+
+// torrentIdentity reads /torrents/{infohash}?file={idx} stream URLs and
+// /torrents/{infohash}/files/{idx} file URLs.
+func torrentIdentity(u *url.URL) (string, string, bool) {
+	rest := strings.TrimPrefix(u.Path, "/torrents/")
+	hash, sub, _ := strings.Cut(rest, "/")
+	if !isInfoHash(hash) {
+		return "", "", false
+	}
+	idx := u.Query().Get("file")
+	if fileIdx, ok := strings.CutPrefix(sub, "files/"); ok {
+		idx = fileIdx
+	}
+	if idx == "" {
+		idx = "auto"
+	}
+	return strings.ToLower(hash), idx, true
+}
+
+// resolverIdentity recognizes addon resolver links such as
+// /resolve/{service}/{apikey}/{infohash}/{cached}/{fileIdx}/{name}: the
+// infohash and file index identify the content whatever the link resolves to.
+func resolverIdentity(p string) (string, string, bool) {
+	parts := strings.Split(strings.Trim(p, "/"), "/")
+	for i, part := range parts {
+		if !isInfoHash(part) {
+			continue
+		}
+		idx := "auto"
+		for _, next := range parts[i+1:] {
+			if _, err := strconv.Atoi(next); err == nil {
+				idx = next
+				break
+			}
+		}
+		return strings.ToLower(part), idx, true
+	}
+	return "", "", false
+}
+
+func isInfoHash(s string) bool {
+	if len(s) != 40 {
+		return false
+	}
+	for _, r := range s {
+		if !(r >= '0' && r <= '9') && !(r >= 'a' && r <= 'f') && !(r >= 'A' && r <= 'F') {
+			return false
+		}
+	}
+	return true
+}
+
+// redactSource keeps persisted sources free of credentials.
+func redactSource(source string) string {
+	u, err := url.Parse(source)
+	if err != nil || u.Host == "" {
+		return source
+	}
+	q := u.Query()
+	for k := range q {
+		if _, ok := volatileQueryParams[strings.ToLower(k)]; ok {
+			q.Set(k, "redacted")
+		}
+	}
+	u.RawQuery = q.Encode()
+	u.User = nil
+	return u.String()
+}
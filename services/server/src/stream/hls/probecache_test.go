@@ -0,0 +1,93 @@
+package hls
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// fakeRemoteSizes serves debrid link sizes from a map for the test.
+func fakeRemoteSizes(t *testing.T, sizes map[string]int64) {
+	t.Helper()
+	prev := remoteFileSize
+	remoteFileSize = func(rawURL string) (int64, bool) {
+		size, ok := sizes[rawURL]
+		return size, ok
+	}
+	clear(debridSizes.m)
+	t.Cleanup(func() {
+		remoteFileSize = prev
+		clear(debridSizes.m)
+	})
+}
+
+func TestProbeCacheKey(t *testing.T) {
+	dir := t.TempDir()
+	local := filepath.Join(dir, "Movie.mkv")
+	if err := os.WriteFile(local, []byte("0123456789"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(local)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const hash = "0123456789abcdef0123456789abcdef01234567"
+	fakeRemoteSizes(t, map[string]int64{
+		"https://abc.download.real-debrid.com/d/TOKEN1/Movie.mkv":     1000,
+		"https://xyz.download.real-debrid.com/d/TOKEN2/Movie.mkv":     1000,
+		"https://abc.download.real-debrid.com/d/TOKEN3/Movie.mkv":     2000,
+		"https://store-1.tb-cdn.st/dl/Show.S01E01.mkv?token=abc&e=99": 500,
+	})
+
+	tests := []struct {
+		name   string
+		source string
+		want   string
+	}{
+		{"local file", local, fmt.Sprintf("file:%s:%d:%d", local, info.Size(), info.ModTime().UnixNano())},
+		{"missing local file", filepath.Join(dir, "gone.mkv"), "file:" + filepath.Join(dir, "gone.mkv")},
+		{"torrent stream", "http://127.0.0.1:6969/torrents/" + hash + "?file=3&token=secret", "torrent:" + hash + ":3"},
+		{"torrent file", "http://127.0.0.1:6969/torrents/" + hash + "/files/2", "torrent:" + hash + ":2"},
+		{"torrent upper-case hash", "http://127.0.0.1:6969/torrents/0123456789ABCDEF0123456789ABCDEF01234567", "torrent:" + hash + ":auto"},
+		{"resolver link", "https://addon.example.com/resolve/realdebrid/APIKEY/" + hash + "/null/4/Movie.mkv", "torrent:" + hash + ":4"},
+		{"debrid link", "https://abc.download.real-debrid.com/d/TOKEN1/Movie.mkv", "debrid:real-debrid.com:movie.mkv:1000"},
+		{"debrid link reissued", "https://xyz.download.real-debrid.com/d/TOKEN2/Movie.mkv", "debrid:real-debrid.com:movie.mkv:1000"},
+		{"debrid same name other file", "https://abc.download.real-debrid.com/d/TOKEN3/Movie.mkv", "debrid:real-debrid.com:movie.mkv:2000"},
+		{"debrid query ignored", "https://store-1.tb-cdn.st/dl/Show.S01E01.mkv?token=abc&e=99", "debrid:tb-cdn.st:show.s01e01.mkv:500"},
+		{"debrid size unknown", "https://abc.download.real-debrid.com/d/TOKEN4/Movie.mkv?token=x", "url:https://abc.download.real-debrid.com/d/TOKEN4/Movie.mkv"},
+		{"plain url", "HTTPS://Media.Example.com/movie.mkv#t=10", "url:https://media.example.com/movie.mkv"},
+		{"plain url keeps generic params", "https://media.example.com/get?key=42&hash=ab&e=1", "url:https://media.example.com/get?e=1&hash=ab&key=42"},
+		{"plain url drops s3 signature", "https://minio.example.com/b/movie.mkv?X-Amz-Signature=s&X-Amz-Date=d", "url:https://minio.example.com/b/movie.mkv"},
+		{"signed cdn url", "https://d1.cloudfront.net/movie.mkv?Expires=1&Signature=s&Key-Pair-Id=k&v=2", "url:https://d1.cloudfront.net/movie.mkv?v=2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ProbeCacheKey(tt.source); got != tt.want {
+				t.Errorf("ProbeCacheKey(%q) = %q, want %q", tt.source, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestProbeCacheKeyAsksDebridSizeOnce(t *testing.T) {
+	calls := 0
+	prev := remoteFileSize
+	remoteFileSize = func(string) (int64, bool) {
+		calls++
+		return 0, false
+	}
+	clear(debridSizes.m)
+	t.Cleanup(func() {
+		remoteFileSize = prev
+		clear(debridSizes.m)
+	})
+
+	link := "https://abc.download.real-debrid.com/d/TOKEN/Movie.mkv"
+	for i := 0; i < 3; i++ {
+		ProbeCacheKey(link)
+	}
+	if calls != 1 {
+		t.Errorf("size requested %d times, want once", calls)
+	}
+}
@@ -0,0 +1,69 @@
+package hls
+
+import (
+	"context"
+	"sync"
+)
+
+// probeGroup deduplicates concurrent probes of the same source. Callers that
+// share a probe each wait on their own context; the probe itself is cancelled
+// only once every caller has given up, so one impatient request cannot fail
+// the others.
+type probeGroup struct {
+	mu    sync.Mutex
+	calls map[string]*probeCall
+}
+
+type probeCall struct {
+	done    chan struct{}
+	cancel  context.CancelFunc
+	waiters int
+
+	meta  *Metadata
+	codec string
+	err   error
+}
+
+func (g *probeGroup) do(ctx context.Context, key string, fn func(context.Context) (*Metadata, string, error)) (*Metadata, string, error) {
+	g.mu.Lock()
+	if g.calls == nil {
+		g.calls = make(map[string]*probeCall)
+	}
+	call, ok := g.calls[key]
+	if !ok {
+		probeCtx, cancel := context.WithCancel(context.Background())
+		call = &probeCall{done: make(chan struct{}), cancel: cancel}
+		g.calls[key] = call
+		go func() {
+			meta, codec, err := fn(probeCtx)
+			g.mu.Lock()
+			call.meta, call.codec, call.err = meta, codec, err
+			if g.calls[key] == call {
+				delete(g.calls, key)
+			}
+			g.mu.Unlock()
+			cancel()
+			close(call.done)
+		}()
+	}
+	call.waiters++
+	g.mu.Unlock()
+
+	select {
+	case <-call.done:
+		return call.meta, call.codec, call.err
+	case <-ctx.Done():
+		g.mu.Lock()
+		call.waiters--
+		if call.waiters == 0 {
+			// Nobody is left to use the result; drop the call so the next
+			// request starts a fresh probe instead of joining a cancelled one.
+			if g.calls[key] == call {
+				delete(g.calls, key)
+			}
+			call.cancel()
+		}
+		g.mu.Unlock()
+		return nil, "", ctx.Err()
+	}
+}
@@ -0,0 +1,43 @@
+//go:build linux
+// +build linux
+
+package hls
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// setParentDeathSignal has the kernel kill the process when the server dies,
+// even by SIGKILL. Strictly this follows the thread that started it, which the
+// Go runtime keeps alive for goroutines that do not lock threads.
+func setParentDeathSignal(attr *syscall.SysProcAttr) {
+	attr.Pdeathsig = syscall.SIGKILL
+}
+
+// listProcesses reads the processes from /proc.
+func listProcesses() ([]processInfo, error) {
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return nil, err
+	}
+	var procs []processInfo
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+		cmdline, err := os.ReadFile(filepath.Join("/proc", entry.Name(), "cmdline"))
+		if err != nil || len(cmdline) == 0 {
+			continue
+		}
+		procs = append(procs, processInfo{
+			pid:  pid,
+			args: strings.Split(strings.TrimRight(string(cmdline), "\x00"), "\x00"),
+		})
+	}
+	return procs, nil
+}
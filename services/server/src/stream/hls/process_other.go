@@ -0,0 +1,36 @@
+//go:build !windows && !linux
+// +build !windows,!linux
+
+package hls
+
+import (
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// setParentDeathSignal does nothing: only Linux has a parent-death signal.
+func setParentDeathSignal(attr *syscall.SysProcAttr) {}
+
+// listProcesses lists the processes with ps. Arguments are split on spaces,
+// which is enough to find paths without any.
+func listProcesses() ([]processInfo, error) {
+	out, err := exec.Command("ps", "-axww", "-o", "pid=,args=").Output()
+	if err != nil {
+		return nil, err
+	}
+	var procs []processInfo
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		pid, err := strconv.Atoi(fields[0])
+		if err != nil {
+			continue
+		}
+		procs = append(procs, processInfo{pid: pid, args: fields[1:]})
+	}
+	return procs, nil
+}
@@ -0,0 +1,45 @@
+//go:build !windows
+// +build !windows
+
+package hls
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// configureProcess starts cmd in its own process group, so signals to the
+// server's group do not reach it and killProcess takes anything it spawned
+// along. On Linux it also dies with the server.
+func configureProcess(cmd *exec.Cmd) {
+	attr := &syscall.SysProcAttr{Setpgid: true}
+	setParentDeathSignal(attr)
+	cmd.SysProcAttr = attr
+	cmd.Cancel = func() error { return killProcess(cmd) }
+}
+
+// killProcess kills cmd's process group. A throttled ffmpeg is stopped, so
+// it is continued first for the kill to be delivered at once.
+func killProcess(cmd *exec.Cmd) error {
+	if cmd == nil || cmd.Process == nil {
+		return nil
+	}
+	pid := cmd.Process.Pid
+	if pgid, err := syscall.Getpgid(pid); err == nil && pgid == pid {
+		_ = syscall.Kill(-pgid, syscall.SIGCONT)
+		return syscall.Kill(-pgid, syscall.SIGKILL)
+	}
+	_ = cmd.Process.Signal(syscall.SIGCONT)
+	if err := cmd.Process.Kill(); err != nil && !errors.Is(err, os.ErrProcessDone) {
+		return err
+	}
+	return nil
+}
+
+// killPID continues and kills process pid.
+func killPID(pid int) error {
+	_ = syscall.Kill(pid, syscall.SIGCONT)
+	return syscall.Kill(pid, syscall.SIGKILL)
+}
@@ -0,0 +1,69 @@
+//go:build windows
+// +build windows
+
+package hls
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"os/exec"
+
+	"golang.org/x/sys/windows"
+)
+
+// configureProcess leaves cmd as it is: Windows has no process groups to
+// signal and no parent-death signal.
+func configureProcess(cmd *exec.Cmd) {}
+
+// killProcess kills cmd. Suspended processes can be terminated as they are.
+func killProcess(cmd *exec.Cmd) error {
+	if cmd == nil || cmd.Process == nil {
+		return nil
+	}
+	if err := cmd.Process.Kill(); err != nil && !errors.Is(err, os.ErrProcessDone) {
+		return err
+	}
+	return nil
+}
+
+func killPID(pid int) error {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return err
+	}
+	return p.Kill()
+}
+
+// processQuery prints the pid and command line of every process as a JSON
+// array. The Win32 API only exposes command lines of other processes through
+// their memory, so WMI is asked instead.
+const processQuery = `ConvertTo-Json -Compress -InputObject @(Get-CimInstance Win32_Process | Select-Object ProcessId,CommandLine)`
+
+// listProcesses lists the processes with PowerShell. Processes whose command
+// line cannot be read, such as those of other users, are left out.
+func listProcesses() ([]processInfo, error) {
+	out, err := exec.Command("powershell", "-NoProfile", "-NonInteractive", "-Command", processQuery).Output()
+	if err != nil {
+		return nil, err
+	}
+	var rows []struct {
+		ProcessId   int
+		CommandLine *string
+	}
+	if err := json.Unmarshal(out, &rows); err != nil {
+		return nil, err
+	}
+	var procs []processInfo
+	for _, row := range rows {
+		if row.CommandLine == nil || *row.CommandLine == "" {
+			continue
+		}
+		args, err := windows.DecomposeCommandLine(*row.CommandLine)
+		if err != nil || len(args) == 0 {
+			continue
+		}
+		procs = append(procs, processInfo{pid: row.ProcessId, args: args})
+	}
+	return procs, nil
+}
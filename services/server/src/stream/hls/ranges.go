@@ -0,0 +1,352 @@
+package hls
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// Slices of a session often cover overlapping parts of the title: playback
+// that started at 0 runs into where an earlier seek started a second slice.
+// Instead of encoding those minutes again, ffmpeg stops once the slice it
+// writes reaches another slice's coverage, and the playlist continues into
+// that slice after an EXT-X-DISCONTINUITY. When playback nears the end of the
+// stitched range, encoding resumes from there.
+
+// Ranges join when one starts at most joinSlack seconds after the other ends.
+const joinSlack = 0.5
+
+// mapURIPattern matches the init segment a CMAF playlist declares.
+var mapURIPattern = regexp.MustCompile(`(?m)^#EXT-X-MAP:URI="([^"]+)"`)
+
+// segmentRange is the run of segments one slice has written.
+type segmentRange struct {
+	slice    int
+	segments []PlaylistSegment
+}
+
+func (r segmentRange) start() float64 { return r.segments[0].Start }
+func (r segmentRange) end() float64   { return r.segments[len(r.segments)-1].End }
+
+func (s *Session) sliceDir(index int) string {
+	return filepath.Join(s.WorkDir, fmt.Sprintf("slice_%03d", index))
+}
+
+// rangesLocked reads the video playlists of all non-VOD slices that have
+// segments.
+func rangesLocked(sess *Session) []segmentRange {
+	var ranges []segmentRange
+	for _, slice := range sess.Slices {
+		if slice.VOD {
+			continue
+		}
+		_, timeline, err := readPlaylistTimeline(filepath.Join(sess.sliceDir(slice.Index), "child.m3u8"), slice.StartTime)
+		if err != nil || len(timeline) == 0 {
+			continue
+		}
+		ranges = append(ranges, segmentRange{slice: slice.Index, segments: timeline})
+	}
+	return ranges
+}
+
+// nextRange returns the index in ranges of the range that continues cur: one
+// not in used that starts before cur ends and reaches further. Of several,
+// the one reaching furthest wins. It returns -1 if there is none.
+func nextRange(ranges []segmentRange, cur segmentRange, used map[int]bool) int {
+	best := -1
+	for i, r := range ranges {
+		if used[r.slice] || r.start() > cur.end()+joinSlack || r.end() <= cur.end()+joinSlack {
+			continue
+		}
+		if best < 0 || r.end() > ranges[best].end() {
+			best = i
+		}
+	}
+	return best
+}
+
+// chainLocked returns the ranges the playlist of slice head plays through:
+// head's own, then each range continuing the previous one.
+func chainLocked(sess *Session, head int) []segmentRange {
+	ranges := rangesLocked(sess)
+	var chain []segmentRange
+	for _, r := range ranges {
+		if r.slice == head {
+			chain = append(chain, r)
+		}
+	}
+	if len(chain) == 0 {
+		return nil
+	}
+	used := map[int]bool{head: true}
+	for {
+		i := nextRange(ranges, chain[len(chain)-1], used)
+		if i < 0 {
+			return chain
+		}
+		used[ranges[i].slice] = true
+		chain = append(chain, ranges[i])
+	}
+}
+
+func chainContains(chain []segmentRange, slice int) bool {
+	for _, r := range chain {
+		if r.slice == slice {
+			return true
+		}
+	}
+	return false
+}
+
+// MediaPlaylist returns media playlist asset (child.m3u8 or a rendition
+// playlist) of session id. A playlist whose slice runs into other slices
+// lists their segments too, as slice_NNN/segment URIs (see AssetPath).
+func (c *Controller) MediaPlaylist(id, asset string) (string, error) {
+	sess := c.lockSession(id)
+	if sess == nil {
+		return "", fmt.Errorf("session not found")
+	}
+	defer sess.mu.Unlock()
+
+	chain := chainLocked(sess, sess.PlaylistSlice)
+	if len(chain) < 2 {
+		content, err := os.ReadFile(filepath.Join(sess.sliceDir(sess.PlaylistSlice), asset))
+		return string(content), err
+	}
+	return stitchPlaylistLocked(sess, chain, asset)
+}
+
+// stitchPlaylistLocked joins playlist asset of every slice in chain. Segment
+// boundaries of two slices rarely line up, so each joint either replays or
+// skips part of a segment, whichever is shorter.
+func stitchPlaylistLocked(sess *Session, chain []segmentRange, asset string) (string, error) {
+	var b strings.Builder
+	mediaSeq := 0
+	ended := false
+	targetDur := math.Ceil(DefaultSegmentDuration.Seconds())
+	prevEnd := 0.0
+	version := 6
+
+	var body strings.Builder
+	for i, r := range chain {
+		content, err := os.ReadFile(filepath.Join(sess.sliceDir(r.slice), asset))
+		if err != nil {
+			if i == 0 {
+				return "", err
+			}
+			break
+		}
+		seq, timeline, err := readPlaylistTimelineFromReader(bytes.NewReader(content), r.start())
+		if err != nil {
+			return "", err
+		}
+		ended = bytes.Contains(content, []byte("#EXT-X-ENDLIST"))
+
+		prefix := ""
+		if i == 0 {
+			mediaSeq = seq
+		} else {
+			j := 0
+			for j < len(timeline) && timeline[j].End <= prevEnd+joinSlack {
+				j++
+			}
+			if j < len(timeline)-1 && prevEnd-timeline[j].Start > timeline[j].End-prevEnd {
+				j++
+			}
+			timeline = timeline[j:]
+			if len(timeline) == 0 {
+				continue
+			}
+			prefix = fmt.Sprintf("slice_%03d/", r.slice)
+			body.WriteString("#EXT-X-DISCONTINUITY\n")
+		}
+		if m := mapURIPattern.FindSubmatch(content); m != nil {
+			// Each slice has its own init segment.
+			fmt.Fprintf(&body, "#EXT-X-MAP:URI=%s\n", quoteAttr(prefix+string(m[1])))
+			version = 7
+		}
+		for k, seg := range timeline {
+			// The first segment of a later slice already follows one.
+			if seg.Discontinuity && (i == 0 || k > 0) {
+				body.WriteString("#EXT-X-DISCONTINUITY\n")
+			}
+			dur := seg.End - seg.Start
+			targetDur = max(targetDur, math.Ceil(dur))
+			fmt.Fprintf(&body, "#EXTINF:%.6f,\n", dur)
+			body.WriteString(prefix + seg.Filename + "\n")
+			prevEnd = seg.End
+		}
+	}
+
+	b.WriteString("#EXTM3U\n")
+	fmt.Fprintf(&b, "#EXT-X-VERSION:%d\n", version)
+	fmt.Fprintf(&b, "#EXT-X-TARGETDURATION:%d\n", int(targetDur))
+	fmt.Fprintf(&b, "#EXT-X-MEDIA-SEQUENCE:%d\n", mediaSeq)
+	b.WriteString("#EXT-X-PLAYLIST-TYPE:EVENT\n")
+	b.WriteString("#EXT-X-INDEPENDENT-SEGMENTS\n")
+	b.WriteString(body.String())
+	if ended {
+		b.WriteString("#EXT-X-ENDLIST\n")
+	}
+	return b.String(), nil
+}
+
+// AssetPath resolves asset of session id's playlist: plain names are in the
+// playlist's own slice, slice_NNN/name in slice NNN. It returns "" for paths
+// outside the session.
+func (c *Controller) AssetPath(id, asset string) string {
+	sess := c.lockSession(id)
+	if sess == nil {
+		return ""
+	}
+	defer sess.mu.Unlock()
+
+	p := filepath.Join(sess.sliceDir(sess.PlaylistSlice), asset)
+	if _, ok := assetSlice(asset); ok {
+		p = filepath.Join(sess.WorkDir, asset)
+	}
+	p = filepath.Clean(p)
+	if !strings.HasPrefix(p, filepath.Clean(sess.WorkDir)+string(filepath.Separator)) {
+		return ""
+	}
+	return p
+}
+
+// assetSlice parses the slice of a slice_NNN/name asset.
+func assetSlice(asset string) (int, bool) {
+	dir, _, ok := strings.Cut(asset, "/")
+	if !ok {
+		return 0, false
+	}
+	var index int
+	if _, err := fmt.Sscanf(dir, "slice_%03d", &index); err != nil || dir != fmt.Sprintf("slice_%03d", index) {
+		return 0, false
+	}
+	return index, true
+}
+
+// stopCmdLocked kills ffmpeg without marking the session finished.
+func stopCmdLocked(sess *Session) {
+	if sess.Cmd != nil && sess.Cmd.Process != nil {
+		if sess.CmdCancel != nil {
+			sess.CmdCancel()
+		}
+		_ = killProcess(sess.Cmd)
+	}
+	sess.Cmd = nil
+	sess.CmdCancel = nil
+	sess.Paused = false
+}
+
+// stopAtCoverageLocked stops ffmpeg once the slice it writes reaches media
+// another slice already has and reports whether it did.
+func stopAtCoverageLocked(sess *Session) bool {
+	if sess.Cmd == nil || len(sess.Slices) < 2 || sess.SliceIndex >= len(sess.Slices) {
+		return false
+	}
+	slice := sess.Slices[sess.SliceIndex]
+
+	covered := false
+	if slice.VOD {
+		mediaSeq, segCount, err := readPlaylistState(filepath.Join(sess.sliceDir(slice.Index), "child.m3u8"))
+		if err != nil || segCount == 0 {
+			return false
+		}
+		covered = vodSegmentPathLocked(sess, sess.segmentName(mediaSeq+segCount)) != ""
+	} else {
+		ranges := rangesLocked(sess)
+		for _, r := range ranges {
+			if r.slice == slice.Index {
+				covered = nextRange(ranges, r, map[int]bool{r.slice: true}) >= 0
+				break
+			}
+		}
+	}
+	if !covered {
+		return false
+	}
+
+	log.Printf("Session %s: slice %d reached media another slice has, stopping ffmpeg", sess.ID, slice.Index)
+	stopCmdLocked(sess)
+	sess.AtCoverage = true
+	return true
+}
+
+// continueSliceLocked makes slice index the one ffmpeg writes and resumes it
+// at end, unless that is the end of the title or another slice continues it.
+func (c *Controller) continueSliceLocked(sess *Session, index int, end float64) {
+	stopCmdLocked(sess)
+	sess.SliceIndex = index
+	sess.Finished = false
+	sess.AtCoverage = false
+
+	if sess.DurationHint > 0 && end >= sess.DurationHint-joinSlack {
+		sess.Finished = true
+		return
+	}
+	for _, r := range chainLocked(sess, index) {
+		if r.slice != index {
+			sess.AtCoverage = true
+			return
+		}
+	}
+	if err := c.ensureCmdLocked(sess, end, sess.sliceDir(index), true, len(sess.AvailableStreams) > 0); err != nil {
+		log.Printf("Failed to resume slice %d: %v", index, err)
+	}
+}
+
+// resumeAfterCoverageLocked restarts encoding where the covered media ends
+// once playback of segment asset gets within MaxBufferAhead of it.
+func (c *Controller) resumeAfterCoverageLocked(sess *Session, asset string, seq int) {
+	if sess.Cmd != nil || !sess.AtCoverage {
+		return
+	}
+	ahead := MaxBufferAhead.Seconds()
+	segDur := DefaultSegmentDuration.Seconds()
+
+	if strings.HasPrefix(asset, VODSegmentPrefix) {
+		next := seq + 1
+		count := vodSegmentCount(sess.DurationHint)
+		for next < count && vodSegmentPathLocked(sess, sess.segmentName(next)) != "" {
+			next++
+		}
+		if next >= count || float64(next-seq)*segDur > ahead {
+			return
+		}
+		if _, err := c.newSliceLocked(sess, SliceInfo{
+			StartTime: float64(next) * segDur,
+			VOD:       true,
+			StartSeq:  next,
+		}); err != nil {
+			log.Printf("Failed to resume after covered segments: %v", err)
+		}
+		return
+	}
+
+	served := sess.PlaylistSlice
+	if index, ok := assetSlice(asset); ok {
+		served = index
+	}
+	name := filepath.Base(asset)
+	chain := chainLocked(sess, sess.PlaylistSlice)
+	for _, r := range chain {
+		if r.slice != served {
+			continue
+		}
+		for _, seg := range r.segments {
+			if seg.Filename != name {
+				continue
+			}
+			last := chain[len(chain)-1]
+			if last.end()-seg.End <= ahead {
+				c.continueSliceLocked(sess, last.slice, last.end())
+			}
+			return
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package hls
+
+import (
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// ownerFileName is the file in a session directory holding the pid of the
+// server that transcodes into it.
+const ownerFileName = "owner.pid"
+
+// processInfo is a running process as listProcesses sees it.
+type processInfo struct {
+	pid  int
+	args []string
+}
+
+// writeOwnerFile records this server as the owner of session directory dir.
+func writeOwnerFile(dir string) error {
+	return os.WriteFile(filepath.Join(dir, ownerFileName), []byte(strconv.Itoa(os.Getpid())+"\n"), 0o644)
+}
+
+// ReapStaleTranscoders kills ffmpeg processes writing to session directories
+// under os.TempDir()/raffi that no running server owns, such as those a
+// crashed server left behind, throttled ones included. An ffmpeg is stale
+// when the server named in its session directory's owner file is not running
+// or the directory has no owner file; transcoders of other servers are left
+// alone. The parent pid is not consulted: an orphan may be adopted by a
+// subreaper rather than init. It returns how many it killed.
+func ReapStaleTranscoders() int {
+	procs, err := listProcesses()
+	if err != nil {
+		log.Printf("Failed to list processes for stale transcoders: %v", err)
+		return 0
+	}
+	running := make(map[int]bool, len(procs))
+	for _, p := range procs {
+		running[p.pid] = true
+	}
+
+	root := filepath.Join(os.TempDir(), "raffi") + string(filepath.Separator)
+	killed := 0
+	for _, p := range procs {
+		if p.pid == os.Getpid() {
+			continue
+		}
+		dir, ok := transcoderSessionDir(p, root)
+		if !ok {
+			continue
+		}
+		if owner, err := readOwnerFile(dir); err == nil && (owner == os.Getpid() || running[owner]) {
+			continue
+		}
+		if err := killPID(p.pid); err != nil {
+			log.Printf("Failed to kill stale ffmpeg (pid %d): %v", p.pid, err)
+			continue
+		}
+		log.Printf("Killed stale ffmpeg (pid %d) writing to %s", p.pid, dir)
+		killed++
+	}
+	return killed
+}
+
+// transcoderSessionDir returns the session directory under root that p, if it
+// is ffmpeg, writes to.
+func transcoderSessionDir(p processInfo, root string) (string, bool) {
+	if len(p.args) == 0 || !strings.HasPrefix(strings.ToLower(filepath.Base(p.args[0])), "ffmpeg") {
+		return "", false
+	}
+	for _, arg := range p.args[1:] {
+		rest, ok := strings.CutPrefix(arg, root)
+		if !ok {
+			continue
+		}
+		id, _, _ := strings.Cut(rest, string(filepath.Separator))
+		if id != "" && id != "." && id != ".." {
+			return filepath.Join(root, id), true
+		}
+	}
+	return "", false
+}
+
+func readOwnerFile(dir string) (int, error) {
+	data, err := os.ReadFile(filepath.Join(dir, ownerFileName))
+	if err != nil {
+		return 0, err
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil || pid <= 0 {
+		return 0, errors.New("invalid owner file")
+	}
+	return pid, nil
+}
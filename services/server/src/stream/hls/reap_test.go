@@ -0,0 +1,157 @@
+package hls
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestTranscoderSessionDir(t *testing.T) {
+	root := filepath.Join(os.TempDir(), "raffi") + string(filepath.Separator)
+	dir := filepath.Join(root, "abc")
+	tests := []struct {
+		name string
+		args []string
+		want string
+	}{
+		{"output path", []string{"/usr/bin/ffmpeg", "-i", "in.mkv", filepath.Join(dir, "slice_0", "index.m3u8")}, dir},
+		{"segment pattern", []string{"ffmpeg", "-hls_segment_filename", filepath.Join(dir, "seg_%05d.ts")}, dir},
+		{"versioned binary", []string{"/opt/ffmpeg-6.1", filepath.Join(dir, "index.m3u8")}, dir},
+		{"upper case", []string{"FFMPEG.EXE", filepath.Join(dir, "index.m3u8")}, dir},
+		{"not ffmpeg", []string{"/usr/bin/ffprobe", filepath.Join(dir, "index.m3u8")}, ""},
+		{"elsewhere", []string{"ffmpeg", "-i", "in.mkv", "/srv/out/index.m3u8"}, ""},
+		{"root itself", []string{"ffmpeg", root}, ""},
+		{"parent escape", []string{"ffmpeg", root + ".." + string(filepath.Separator) + "x"}, ""},
+		{"no args", nil, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := transcoderSessionDir(processInfo{pid: 42, args: tt.args}, root)
+			if got != tt.want || ok != (tt.want != "") {
+				t.Errorf("transcoderSessionDir = %q, %v; want %q", got, ok, tt.want)
+			}
+		})
+	}
+}
+
+// fakeFFmpegLink links the test binary as ffmpeg, so the reaper takes the
+// fake tools for transcoders.
+func fakeFFmpegLink(t *testing.T) string {
+	t.Helper()
+	exe, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	link := filepath.Join(t.TempDir(), "ffmpeg")
+	if err := os.Symlink(exe, link); err != nil {
+		t.Skipf("cannot link the test binary: %v", err)
+	}
+	return link
+}
+
+// strayFFmpeg is a fake ffmpeg no controller started. done is closed once
+// it exited, with its result in err.
+type strayFFmpeg struct {
+	done chan struct{}
+	err  error
+}
+
+// startStrayFFmpeg runs fake ffmpeg outside any controller, writing to
+// session directory id. owner is written to its owner file unless it is 0.
+func startStrayFFmpeg(t *testing.T, ffmpeg, id string, owner int) *strayFFmpeg {
+	t.Helper()
+	dir := filepath.Join(os.TempDir(), "raffi", id)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if owner != 0 {
+		if err := os.WriteFile(filepath.Join(dir, ownerFileName), []byte(strconv.Itoa(owner)+"\n"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cmd := exec.Command(ffmpeg,
+		"-hls_time", "6",
+		"-hls_segment_filename", filepath.Join(dir, "seg_%05d.ts"),
+		filepath.Join(dir, "index.m3u8"),
+	)
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	stray := &strayFFmpeg{done: make(chan struct{})}
+	go func() {
+		stray.err = cmd.Wait()
+		close(stray.done)
+	}()
+	t.Cleanup(func() {
+		_ = cmd.Process.Kill()
+		<-stray.done
+	})
+	return stray
+}
+
+// exitedPID returns the pid of a process that has exited.
+func exitedPID(t *testing.T) int {
+	t.Helper()
+	exe, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command(exe, "-show_streams")
+	if err := cmd.Run(); err != nil {
+		t.Fatal(err)
+	}
+	return cmd.Process.Pid
+}
+
+func TestReapStaleTranscoders(t *testing.T) {
+	c, _ := newFakeToolsController(t)
+	t.Setenv(fakeSegmentDelayEnv, "500")
+	ffmpeg := fakeFFmpegLink(t)
+	c.startCmd = NewTranscoder(ffmpeg)
+
+	// A transcoder of this server, started the usual way.
+	if _, _, err := c.EnsureSession(context.Background(), "mine", "/media/a.mkv", 0); err != nil {
+		t.Fatalf("EnsureSession: %v", err)
+	}
+	var mine int
+	inSession(t, c, "mine", func(sess *Session) { mine = sess.Cmd.Process.Pid })
+
+	deadOwner := startStrayFFmpeg(t, ffmpeg, "dead-owner", exitedPID(t))
+	noOwner := startStrayFFmpeg(t, ffmpeg, "no-owner", 0)
+	// Another server is still running.
+	otherServer := startStrayFFmpeg(t, ffmpeg, "other-server", os.Getppid())
+
+	if n := ReapStaleTranscoders(); n != 2 {
+		t.Errorf("ReapStaleTranscoders killed %d, want 2", n)
+	}
+	for name, stray := range map[string]*strayFFmpeg{"dead owner": deadOwner, "no owner": noOwner} {
+		select {
+		case <-stray.done:
+			if stray.err == nil {
+				t.Errorf("%s: ffmpeg exited cleanly, want killed", name)
+			}
+		case <-time.After(5 * time.Second):
+			t.Errorf("%s: ffmpeg was not killed", name)
+		}
+	}
+	select {
+	case <-otherServer.done:
+		t.Errorf("transcoder of another server exited: %v", otherServer.err)
+	case <-time.After(200 * time.Millisecond):
+	}
+	procs, err := listProcesses()
+	if err != nil {
+		t.Fatal(err)
+	}
+	running := false
+	for _, p := range procs {
+		running = running || p.pid == mine
+	}
+	if !running {
+		t.Error("the controller's ffmpeg was killed")
+	}
+}
@@ -0,0 +1,60 @@
+package hls
+
+import (
+	"fmt"
+	"strings"
+)
+
+// SegmentFormat is the container the transcoder writes segments in.
+type SegmentFormat string
+
+const (
+	// SegmentFormatTS writes MPEG-TS segments, the default.
+	SegmentFormatTS SegmentFormat = "ts"
+	// SegmentFormatCMAF writes fragmented MP4 segments with an init segment,
+	// which both HLS and DASH (manifest.mpd) can play.
+	SegmentFormatCMAF SegmentFormat = "cmaf"
+)
+
+// ParseSegmentFormat validates a format name. The empty string is the
+// default.
+func ParseSegmentFormat(name string) (SegmentFormat, error) {
+	switch SegmentFormat(strings.ToLower(strings.TrimSpace(name))) {
+	case "", SegmentFormatTS:
+		return SegmentFormatTS, nil
+	case SegmentFormatCMAF:
+		return SegmentFormatCMAF, nil
+	}
+	return "", fmt.Errorf("unknown segment format %q (want ts or cmaf)", name)
+}
+
+// ext is the file extension of media segments.
+func (f SegmentFormat) ext() string {
+	if f == SegmentFormatCMAF {
+		return ".m4s"
+	}
+	return ".ts"
+}
+
+// segmentName is the video segment with sequence number seq.
+func (s *Session) segmentName(seq int) string {
+	return fmt.Sprintf("segment%05d%s", seq, s.SegmentFormat.ext())
+}
+
+// initSegmentName is the CMAF init segment of the video, or of the audio
+// rendition for audio stream index if index >= 0.
+func initSegmentName(index int) string {
+	if index < 0 {
+		return "init.mp4"
+	}
+	return fmt.Sprintf("audio_%d_init.mp4", index)
+}
+
+func isInitSegment(name string) bool {
+	if name == initSegmentName(-1) {
+		return true
+	}
+	var idx int
+	n, err := fmt.Sscanf(name, "audio_%d_init.mp4", &idx)
+	return err == nil && n == 1 && name == initSegmentName(idx)
+}
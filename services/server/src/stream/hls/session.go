@@ -3,12 +3,17 @@ package hls
 import (
 	"context"
 	"os/exec"
+	"sync"
 	"time"
 
 	"raffi-server/src/session"
 )
 
+// Session is guarded by mu; see Controller for the lock order.
 type Session struct {
+	mu      sync.Mutex
+	stopped bool
+
 	ID               string
 	Source           string
 	WorkDir          string
@@ -19,10 +24,21 @@ type Session struct {
 	DurationHint     float64
 	Codec            string
 	AudioIndex       int
-	AudioCodec       string
+	AudioProfile     AudioProfile
+	SegmentFormat    SegmentFormat
+	LowLatency       bool
+	Profile          EncodingProfile
 	AvailableStreams []session.StreamInfo
-	HasAudio         bool
-	Finished         bool
+	// AudioRenditions lists the audio streams published as separate HLS
+	// renditions, most preferred first. Empty when audio is muxed.
+	AudioRenditions []int
+	BitRate         int64
+	// VideoHeight is the source's video height, 0 if unknown.
+	VideoHeight int
+	// ToneMap maps HDR video to SDR when it is transcoded.
+	ToneMap  ToneMap
+	HasAudio bool
+	Finished bool
 
 	LastServedSeq     int
 	Paused            bool
@@ -30,14 +46,61 @@ type Session struct {
 	DemandResumeUntil time.Time
 	LastPlaylistNudge time.Time
 
-	SliceIndex int
-	LastSeekID string
-	Slices     []SliceInfo
+	// SliceIndex is the slice ffmpeg writes; PlaylistSlice the one whose
+	// playlist the player follows. They differ once the playlist has been
+	// stitched into later slices (see ranges.go).
+	SliceIndex    int
+	PlaylistSlice int
+	LastSeekID    string
+	Slices        []SliceInfo
+	// AtCoverage is set when ffmpeg was stopped because other slices already
+	// have what would follow.
+	AtCoverage bool
+
+	// QualityCap is set once the client's bandwidth lowered Profile (see
+	// bandwidth.go).
+	QualityCap *session.QualityCap
+	bandwidth  bandwidthEstimate
+}
+
+// audioTrack describes audio stream index for the transcoder.
+func (s *Session) audioTrack(index int) AudioTrack {
+	for _, st := range s.AvailableStreams {
+		if st.Index == index {
+			return AudioTrack{Index: index, Codec: st.Codec, Channels: st.Channels}
+		}
+	}
+	return AudioTrack{Index: index, Codec: "aac"}
+}
+
+func (s *Session) audioRenditions() []AudioTrack {
+	renditions := make([]AudioTrack, 0, len(s.AudioRenditions))
+	for _, idx := range s.AudioRenditions {
+		renditions = append(renditions, s.audioTrack(idx))
+	}
+	return renditions
+}
+
+// hasRendition reports whether audio stream index is published as a rendition.
+func (s *Session) hasRendition(index int) bool {
+	for _, idx := range s.AudioRenditions {
+		if idx == index {
+			return true
+		}
+	}
+	return false
 }
 
 type SliceInfo struct {
 	Index     int
 	StartTime float64
+	// Keyframe is set when StartTime is a video keyframe of a stream-copied
+	// source; the slice's segment boundaries are then keyframes too.
+	Keyframe bool
+	// VOD slices feed the VOD playlist: their segments are numbered from
+	// StartSeq on the session-wide segment grid (see vod.go).
+	VOD      bool
+	StartSeq int
 }
 
 type Chapter struct {
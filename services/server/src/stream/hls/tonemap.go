@@ -0,0 +1,107 @@
+package hls
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"sync"
+	"time"
+
+	"raffi-server/src/session"
+)
+
+// Transcodes and clip exports encode 8-bit BT.709 H.264. HDR sources encoded
+// like SDR ones look washed out, so their video is tone-mapped on the way:
+// with OpenCL where ffmpeg has a working device, otherwise with zscale and
+// tonemap on the CPU. The server has no still-frame snapshot export; one added
+// later should apply the same filter.
+
+const (
+	transferPQ  = "smpte2084"
+	transferHLG = "arib-std-b67"
+)
+
+// ToneMap converts HDR video to SDR. The zero value leaves video alone.
+type ToneMap struct {
+	// Transfer is the source's transfer characteristic, "smpte2084" (PQ) or
+	// "arib-std-b67" (HLG).
+	Transfer string
+	// Hardware tone-maps with tonemap_opencl instead of zscale.
+	Hardware bool
+}
+
+// ToneMapFor returns how video v is tone-mapped when it is encoded; the zero
+// ToneMap for SDR or unknown video.
+func ToneMapFor(v *session.VideoInfo) ToneMap {
+	if v == nil {
+		return ToneMap{}
+	}
+	switch {
+	case v.ColorTransfer == transferPQ || v.ColorTransfer == transferHLG:
+		return ToneMap{Transfer: v.ColorTransfer}
+	case v.HDR == session.HDRHLG:
+		return ToneMap{Transfer: transferHLG}
+	case v.HDR != session.HDRNone:
+		// Dolby Vision without an HDR10 base layer (profile 5) is mapped as
+		// PQ too; its colors come out shifted.
+		return ToneMap{Transfer: transferPQ}
+	}
+	return ToneMap{}
+}
+
+// InputArgs are the options the filter needs before -i.
+func (t ToneMap) InputArgs() []string {
+	if t.Transfer == "" || !t.Hardware {
+		return nil
+	}
+	return []string{"-init_hw_device", "opencl=tm", "-filter_hw_device", "tm"}
+}
+
+// Filter returns the filter chain mapping the video to BT.709 SDR, or "".
+func (t ToneMap) Filter() string {
+	switch {
+	case t.Transfer == "":
+		return ""
+	case t.Hardware:
+		return "format=p010,hwupload,tonemap_opencl=tonemap=hable:desat=0:t=bt709:m=bt709:p=bt709:r=tv:format=nv12,hwdownload,format=nv12"
+	}
+	return fmt.Sprintf("zscale=tin=%s:pin=bt2020:min=bt2020nc:t=linear:npl=100,format=gbrpf32le,zscale=p=bt709,tonemap=tonemap=hable:desat=0,zscale=t=bt709:m=bt709:r=tv,format=yuv420p", t.Transfer)
+}
+
+// OutputArgs tag the encoded video as BT.709, so players do not take it for
+// HDR.
+func (t ToneMap) OutputArgs() []string {
+	if t.Transfer == "" {
+		return nil
+	}
+	return []string{"-color_primaries", "bt709", "-color_trc", "bt709", "-colorspace", "bt709"}
+}
+
+// hardwareToneMap caches HardwareToneMap per ffmpeg path.
+var hardwareToneMap sync.Map
+
+// HardwareToneMap reports whether ffmpegPath can tone-map with OpenCL. The
+// first call for a path tries it on a generated frame.
+func HardwareToneMap(ffmpegPath string) bool {
+	if ok, found := hardwareToneMap.Load(ffmpegPath); found {
+		return ok.(bool)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	err := exec.CommandContext(ctx, ffmpegPath, hardwareToneMapCheckArgs()...).Run()
+	hardwareToneMap.Store(ffmpegPath, err == nil)
+	return err == nil
+}
+
+// hardwareToneMapCheckArgs tone-maps one PQ-tagged frame with OpenCL.
+func hardwareToneMapCheckArgs() []string {
+	tm := ToneMap{Transfer: transferPQ, Hardware: true}
+	args := append([]string{"-v", "error"}, tm.InputArgs()...)
+	return append(args,
+		"-f", "lavfi",
+		"-i", "color=c=black:s=64x64:d=0.1",
+		"-vf", "setparams=color_primaries=bt2020:color_trc=smpte2084:colorspace=bt2020nc,"+tm.Filter(),
+		"-frames:v", "1",
+		"-f", "null", "-",
+	)
+}
@@ -10,168 +10,266 @@ import (
 	"strconv"
 	"strings"
 	"time"
+
+	sourcepolicy "raffi-server/src/source"
 )
 
-type TranscoderFunc func(
-	ctx context.Context,
-	source, outDir string,
-	startSeconds float64,
-	startSeq int,
-	segmentDur, bufferAhead time.Duration,
-	codec string,
-	audioIndex int,
-	audioCodec string,
-	appendMode bool,
-	hasAudio bool,
-) (*exec.Cmd, error)
-
-func DefaultTranscoder(
-	ctx context.Context,
-	source, outDir string,
-	startSeconds float64,
-	startSeq int,
-	segmentDur, bufferAhead time.Duration,
-	codec string,
-	audioIndex int,
-	audioCodec string,
-	appendMode bool,
-	hasAudio bool,
-) (*exec.Cmd, error) {
-	return NewTranscoder("ffmpeg")(
-		ctx,
-		source,
-		outDir,
-		startSeconds,
-		startSeq,
-		segmentDur,
-		bufferAhead,
-		codec,
-		audioIndex,
-		audioCodec,
-		appendMode,
-		hasAudio,
-	)
+// AudioTrack is an audio stream the transcoder writes, either muxed into the
+// video playlist or as a rendition with its own playlist next to a video-only
+// variant. Index is relative to the audio streams; Channels is 0 if unknown.
+type AudioTrack struct {
+	Index    int
+	Codec    string
+	Channels int
+}
+
+// AudioPlaylistName is the playlist of the rendition for audio stream index.
+func AudioPlaylistName(index int) string {
+	return fmt.Sprintf("audio_%d.m3u8", index)
+}
+
+// TranscodeRequest describes one ffmpeg run writing HLS segments numbered from
+// StartSeq to OutDir.
+type TranscodeRequest struct {
+	Source       string
+	OutDir       string
+	StartSeconds float64
+	StartSeq     int
+	// SegmentDuration is the target segment length; BufferAhead how far
+	// ahead of playback the throttle lets ffmpeg run.
+	SegmentDuration time.Duration
+	BufferAhead     time.Duration
+	// Codec is "h264" for video that is stream-copied; anything else is
+	// transcoded with Profile.
+	Codec   string
+	Profile EncodingProfile
+	// ToneMap applies to transcoded video (see tonemap.go).
+	ToneMap      ToneMap
+	Audio        AudioTrack
+	AudioProfile AudioProfile
+	// HasAudio is false for sources without audio streams.
+	HasAudio   bool
+	Renditions []AudioTrack
+	// Append continues the playlist already in OutDir.
+	Append bool
+	// In VOD mode the segments carry source timestamps and video keyframes
+	// are forced on SegmentDuration boundaries, so segments from different
+	// slices line up on one timeline.
+	VOD    bool
+	Format SegmentFormat
+	// LowLatency starts with short segments (see lowlatency.go); it has no
+	// effect in VOD mode.
+	LowLatency bool
+}
+
+// TranscoderFunc starts ffmpeg for req.
+type TranscoderFunc func(ctx context.Context, req TranscodeRequest) (*exec.Cmd, error)
+
+func DefaultTranscoder(ctx context.Context, req TranscodeRequest) (*exec.Cmd, error) {
+	return NewTranscoder("ffmpeg")(ctx, req)
 }
 
 func NewTranscoder(ffmpegPath string) TranscoderFunc {
-	return func(
-		ctx context.Context,
-		source, outDir string,
-		startSeconds float64,
-		startSeq int,
-		segmentDur, bufferAhead time.Duration,
-		codec string,
-		audioIndex int,
-		audioCodec string,
-		appendMode bool,
-		hasAudio bool,
-	) (*exec.Cmd, error) {
-		if !appendMode {
-			_ = os.RemoveAll(outDir)
-			if err := os.MkdirAll(outDir, 0o755); err != nil {
+	return func(ctx context.Context, req TranscodeRequest) (*exec.Cmd, error) {
+		if !req.Append {
+			_ = os.RemoveAll(req.OutDir)
+			if err := os.MkdirAll(req.OutDir, 0o755); err != nil {
 				return nil, err
 			}
 		}
 
-		videoCodec := "libx264"
-		videoArgs := []string{}
-
-		switch codec {
-		case "h264":
-			videoCodec = "copy"
-		default:
-			videoCodec = "libx264"
-			videoArgs = append(videoArgs,
-				"-preset", "veryfast",
-				"-crf", "23",
-				"-pix_fmt", "yuv420p",
-				"-profile:v", "main",
-				"-level:v", "4.1",
-			)
+		if req.ToneMap.Transfer != "" && req.Codec != "h264" {
+			req.ToneMap.Hardware = HardwareToneMap(ffmpegPath)
 		}
 
-		args := []string{
-			"-hwaccel", "auto",
-			"-fflags", "+genpts+nofillin",
-			"-probesize", "1000000",
-			"-analyzeduration", "1000000",
+		cmd := exec.CommandContext(ctx, ffmpegPath, transcodeArgs(req)...)
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		configureProcess(cmd)
+
+		if err := cmd.Start(); err != nil {
+			log.Printf("ffmpeg start failed: %v", err)
+			return nil, err
 		}
+		return cmd, nil
+	}
+}
+
+// transcodeArgs builds the ffmpeg command line for req.
+func transcodeArgs(req TranscodeRequest) []string {
+	videoCodec := "libx264"
+	videoArgs := []string{}
+	var inputArgs []string
 
-		if strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://") {
-			args = append(args,
-				"-reconnect", "1",
-				"-reconnect_at_eof", "1",
-				"-reconnect_streamed", "1",
-				"-reconnect_delay_max", "5",
+	switch req.Codec {
+	case "h264":
+		videoCodec = "copy"
+	default:
+		profile := req.Profile.withDefaults()
+		videoCodec = "libx264"
+		videoArgs = append(videoArgs,
+			"-preset", profile.Preset,
+			"-crf", strconv.Itoa(profile.CRF),
+		)
+		if profile.Tune != "" {
+			videoArgs = append(videoArgs, "-tune", profile.Tune)
+		}
+		if profile.MaxBitRate > 0 {
+			// Capped CRF: quality decides the rate up to the cap.
+			videoArgs = append(videoArgs,
+				"-maxrate", strconv.FormatInt(profile.MaxBitRate, 10),
+				"-bufsize", strconv.FormatInt(2*profile.MaxBitRate, 10),
 			)
 		}
-
-		if startSeconds > 0 {
-			args = append(args, "-ss", fmt.Sprintf("%f", startSeconds))
+		inputArgs = req.ToneMap.InputArgs()
+		var filters []string
+		if tm := req.ToneMap.Filter(); tm != "" {
+			filters = append(filters, tm)
 		}
+		if scale := profile.scaleFilter(); scale != "" {
+			filters = append(filters, scale)
+		}
+		if len(filters) > 0 {
+			videoArgs = append(videoArgs, "-vf", strings.Join(filters, ","))
+		}
+		videoArgs = append(videoArgs,
+			"-pix_fmt", "yuv420p",
+			"-profile:v", "main",
+			"-level:v", "4.1",
+		)
+		videoArgs = append(videoArgs, req.ToneMap.OutputArgs()...)
+		if req.VOD {
+			expr := fmt.Sprintf("expr:gte(t,n_forced*%.3f)", req.SegmentDuration.Seconds())
+			videoArgs = append(videoArgs, "-force_key_frames", expr)
+		} else if req.LowLatency {
+			// Scene cuts would end segments between the forced keyframes.
+			videoArgs = append(videoArgs, "-force_key_frames", lowLatencyKeyframes(req.SegmentDuration), "-sc_threshold", "0")
+		}
+	}
+
+	// Segments are cut at the first keyframe past hlsTime, so with a
+	// short hlsTime the forced keyframes decide their length.
+	hlsTime := req.SegmentDuration
+	if req.LowLatency && !req.VOD {
+		hlsTime = lowLatencySegmentDuration
+	}
 
+	tsOffset := 0.0
+	if req.VOD {
+		tsOffset = req.StartSeconds
+	}
+
+	args := []string{
+		"-hwaccel", "auto",
+		"-fflags", "+genpts+nofillin",
+		"-probesize", "1000000",
+		"-analyzeduration", "1000000",
+	}
+	args = append(args, inputArgs...)
+
+	if strings.HasPrefix(req.Source, "http://") || strings.HasPrefix(req.Source, "https://") {
 		args = append(args,
-			"-i", source,
-			"-map", "0:v:0",
+			"-reconnect", "1",
+			"-reconnect_at_eof", "1",
+			"-reconnect_streamed", "1",
+			"-reconnect_delay_max", "5",
 		)
+	}
 
-		if hasAudio {
-			args = append(args, "-map", fmt.Sprintf("0:a:%d", audioIndex))
-		} else {
-			args = append(args, "-an")
-		}
+	if req.StartSeconds > 0 {
+		args = append(args, "-ss", fmt.Sprintf("%f", req.StartSeconds))
+	}
 
-		args = append(args, "-c:v", videoCodec)
-		if videoCodec == "copy" {
-			args = append(args,
-				"-copytb", "1",
-				"-bsf:v", "h264_mp4toannexb",
-			)
-		}
-		args = append(args, videoArgs...)
-		hlsFlags := "independent_segments+temp_file"
-		if appendMode {
-			hlsFlags += "+append_list"
+	args = append(args,
+		"-protocol_whitelist", sourcepolicy.ProtocolWhitelist(req.Source),
+		"-i", req.Source,
+		"-map", "0:v:0",
+	)
+
+	// With separate renditions the video variant carries no audio.
+	muxAudio := req.HasAudio && len(req.Renditions) == 0
+	if muxAudio {
+		args = append(args, "-map", fmt.Sprintf("0:a:%d", req.Audio.Index))
+	} else {
+		args = append(args, "-an")
+	}
+
+	args = append(args, "-c:v", videoCodec)
+	if videoCodec == "copy" {
+		args = append(args, "-copytb", "1")
+		if req.Format != SegmentFormatCMAF {
+			args = append(args, "-bsf:v", "h264_mp4toannexb")
 		}
+	}
+	args = append(args, videoArgs...)
+	hlsFlags := "independent_segments+temp_file"
+	if req.Append {
+		hlsFlags += "+append_list"
+	}
 
-		// Audio transcoding logic (only if the source has audio)
-		if hasAudio {
-			if audioCodec == "aac" {
-				args = append(args, []string{"-c:a", "copy"}...)
-			} else {
-				args = append(args, []string{
-					"-c:a", "aac",
-					"-ac", "2",
-					"-ar", "48000",
-					"-b:a", "160k",
-					"-af", "aresample=async=1,pan=stereo|FL=FC+0.30*FL+0.30*BL|FR=FC+0.30*FR+0.30*BR,loudnorm=I=-16:TP=-1.5:LRA=11",
-				}...)
-			}
+	// Audio transcoding logic (only if the source has audio)
+	if muxAudio {
+		args = append(args, req.AudioProfile.EncoderArgs(req.Audio.Codec, req.Audio.Channels)...)
+	}
+
+	init := func(index int) string {
+		if req.Format != SegmentFormatCMAF {
+			return ""
 		}
+		return initSegmentName(index)
+	}
+	args = append(args, hlsOutputArgs(req.OutDir, "segment%05d"+req.Format.ext(), "child.m3u8", init(-1), hlsTime, hlsFlags, req.StartSeq, tsOffset)...)
+
+	// Each rendition is a further output of the same process, so all
+	// tracks share one demuxer and stay in sync.
+	for _, rendition := range req.Renditions {
+		args = append(args, "-map", fmt.Sprintf("0:a:%d", rendition.Index), "-vn")
+		args = append(args, req.AudioProfile.EncoderArgs(rendition.Codec, rendition.Channels)...)
+		args = append(args, hlsOutputArgs(
+			req.OutDir,
+			fmt.Sprintf("audio_%d_%%05d", rendition.Index)+req.Format.ext(),
+			AudioPlaylistName(rendition.Index),
+			init(rendition.Index),
+			hlsTime, hlsFlags, req.StartSeq, tsOffset,
+		)...)
+	}
+	return args
+}
 
+// hlsOutputArgs are the options of one HLS output. A positive tsOffset shifts
+// its timestamps, which would otherwise start at zero. With an initName the
+// segments are fragmented MP4.
+func hlsOutputArgs(outDir, segmentPattern, playlist, initName string, segmentDur time.Duration, hlsFlags string, startSeq int, tsOffset float64) []string {
+	var args []string
+	if tsOffset > 0 {
 		args = append(args,
-			"-avoid_negative_ts", "make_zero",
-			"-muxdelay", "0",
-			"-muxpreload", "0",
-			"-max_interleave_delta", "0",
-			"-f", "hls",
-			"-hls_time", fmt.Sprintf("%.2f", segmentDur.Seconds()),
-			"-hls_list_size", "0",
-			"-hls_playlist_type", "event",
-			"-hls_flags", hlsFlags,
-			"-start_number", strconv.Itoa(startSeq),
-			"-hls_segment_filename", filepath.Join(outDir, "segment%05d.ts"),
-			filepath.Join(outDir, "child.m3u8"),
+			"-output_ts_offset", fmt.Sprintf("%f", tsOffset),
+			"-avoid_negative_ts", "make_non_negative",
 		)
-
-		cmd := exec.CommandContext(ctx, ffmpegPath, args...)
-		cmd.Stdout = os.Stdout
-		cmd.Stderr = os.Stderr
-
-		if err := cmd.Start(); err != nil {
-			log.Printf("ffmpeg start failed: %v", err)
-			return nil, err
+	} else {
+		args = append(args, "-avoid_negative_ts", "make_zero")
+	}
+	if initName != "" {
+		args = append(args,
+			"-hls_segment_type", "fmp4",
+			"-hls_fmp4_init_filename", initName,
+		)
+		if tsOffset > 0 {
+			// Otherwise the fragments' decode times restart at zero.
+			args = append(args, "-hls_segment_options", "movflags=+frag_discont")
 		}
-		return cmd, nil
 	}
+	return append(args,
+		"-muxdelay", "0",
+		"-muxpreload", "0",
+		"-max_interleave_delta", "0",
+		"-f", "hls",
+		"-hls_time", fmt.Sprintf("%.2f", segmentDur.Seconds()),
+		"-hls_list_size", "0",
+		"-hls_playlist_type", "event",
+		"-hls_flags", hlsFlags,
+		"-start_number", strconv.Itoa(startSeq),
+		"-hls_segment_filename", filepath.Join(outDir, segmentPattern),
+		filepath.Join(outDir, playlist),
+	)
 }
@@ -0,0 +1,166 @@
+package hls
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// checkGolden compares args, one per line, with testdata/name.golden.
+func checkGolden(t *testing.T, name string, args []string) {
+	t.Helper()
+	got := strings.Join(args, "\n") + "\n"
+	path := filepath.Join("testdata", name+".golden")
+	if *update {
+		if err := os.MkdirAll("testdata", 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(got), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("%v (run go test -update to create it)", err)
+	}
+	if got != string(want) {
+		t.Errorf("arguments differ from %s (run go test -update if the change is intended)\n%s", path, lineDiff(string(want), got))
+	}
+}
+
+// lineDiff lists the lines only one side has, marked - for want and + for
+// got.
+func lineDiff(want, got string) string {
+	wantLines := strings.Split(want, "\n")
+	gotLines := strings.Split(got, "\n")
+	// Longest common subsequence keeps the output readable when arguments
+	// are inserted or removed.
+	lcs := make([][]int, len(wantLines)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(gotLines)+1)
+	}
+	for i := len(wantLines) - 1; i >= 0; i-- {
+		for j := len(gotLines) - 1; j >= 0; j-- {
+			if wantLines[i] == gotLines[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+	var b strings.Builder
+	i, j := 0, 0
+	for i < len(wantLines) || j < len(gotLines) {
+		switch {
+		case i < len(wantLines) && j < len(gotLines) && wantLines[i] == gotLines[j]:
+			b.WriteString("  " + wantLines[i] + "\n")
+			i++
+			j++
+		case j < len(gotLines) && (i == len(wantLines) || lcs[i][j+1] >= lcs[i+1][j]):
+			b.WriteString("+ " + gotLines[j] + "\n")
+			j++
+		default:
+			b.WriteString("- " + wantLines[i] + "\n")
+			i++
+		}
+	}
+	return b.String()
+}
+
+func TestTranscodeArgs(t *testing.T) {
+	base := TranscodeRequest{
+		Source:          "/media/movie.mkv",
+		OutDir:          "/work/slice_000",
+		SegmentDuration: DefaultSegmentDuration,
+		BufferAhead:     MaxBufferAhead,
+		Codec:           "libx264",
+		Profile:         DefaultEncodingProfile,
+		Audio:           AudioTrack{Index: 0, Codec: "ac3", Channels: 6},
+		AudioProfile:    AudioProfileAuto,
+		HasAudio:        true,
+		Format:          SegmentFormatTS,
+	}
+	renditions := []AudioTrack{{Index: 0, Codec: "aac", Channels: 2}, {Index: 1, Codec: "eac3", Channels: 6}}
+
+	tests := []struct {
+		name   string
+		modify func(req *TranscodeRequest)
+	}{
+		{"transcode_default", func(req *TranscodeRequest) {}},
+		{"transcode_copy_seek_http", func(req *TranscodeRequest) {
+			req.Source = "https://cdn.example.com/movie.mkv?token=abc"
+			req.Codec = "h264"
+			req.Audio = AudioTrack{Index: 1, Codec: "aac", Channels: 2}
+			req.StartSeconds = 120.0005
+			req.StartSeq = 2
+			req.OutDir = "/work/slice_002"
+		}},
+		{"transcode_append", func(req *TranscodeRequest) {
+			req.Append = true
+			req.StartSeconds = 300
+			req.LowLatency = true
+		}},
+		{"transcode_no_audio", func(req *TranscodeRequest) {
+			req.HasAudio = false
+		}},
+		{"transcode_vod_cmaf_renditions", func(req *TranscodeRequest) {
+			req.VOD = true
+			req.Format = SegmentFormatCMAF
+			req.StartSeconds = 600
+			req.StartSeq = 100
+			req.Renditions = renditions
+			req.AudioProfile = AudioProfileSurround
+		}},
+		{"transcode_copy_cmaf", func(req *TranscodeRequest) {
+			req.Codec = "h264"
+			req.Format = SegmentFormatCMAF
+		}},
+		{"transcode_low_latency", func(req *TranscodeRequest) {
+			req.LowLatency = true
+			req.Renditions = renditions
+		}},
+		{"transcode_profile_limits", func(req *TranscodeRequest) {
+			req.Profile = EncodingProfile{Name: "saver", CRF: 27, Preset: "faster", Tune: "film", MaxWidth: 1280, MaxHeight: 720, MaxBitRate: 3_000_000}
+			req.AudioProfile = AudioProfileNight
+		}},
+		{"transcode_tonemap_pq_scaled", func(req *TranscodeRequest) {
+			req.ToneMap = ToneMap{Transfer: "smpte2084"}
+			req.Profile.MaxHeight = 1080
+		}},
+		{"transcode_tonemap_hlg_hardware", func(req *TranscodeRequest) {
+			req.ToneMap = ToneMap{Transfer: "arib-std-b67", Hardware: true}
+		}},
+		{"transcode_copy_ignores_tonemap", func(req *TranscodeRequest) {
+			req.Codec = "h264"
+			req.ToneMap = ToneMap{Transfer: "arib-std-b67", Hardware: true}
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := base
+			tt.modify(&req)
+			checkGolden(t, tt.name, transcodeArgs(req))
+		})
+	}
+}
+
+func TestTranscodeArgsDefaultProfileMatchesZeroProfile(t *testing.T) {
+	req := TranscodeRequest{Source: "/media/movie.mkv", OutDir: "/work", SegmentDuration: 6 * time.Second, Codec: "libx264"}
+	zero := strings.Join(transcodeArgs(req), " ")
+	req.Profile = DefaultEncodingProfile
+	if def := strings.Join(transcodeArgs(req), " "); def != zero {
+		t.Fatalf("default profile args\n%s\ndiffer from zero profile args\n%s", def, zero)
+	}
+}
+
+func TestProbeArgs(t *testing.T) {
+	checkGolden(t, "probe_file", probeArgs("/media/movie.mkv"))
+	checkGolden(t, "probe_torrent", probeArgs("http://127.0.0.1:6969/torrents/0123456789abcdef0123456789abcdef01234567?file=2"))
+	checkGolden(t, "keyframe_scan", keyframeScanArgs("https://cdn.example.com/movie.mkv", 100, keyframeScanLimit.Seconds()))
+}
@@ -0,0 +1,195 @@
+package hls
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// The VOD playlist lists the whole title up front on a grid of
+// DefaultSegmentDuration segments: segment k covers k*d to (k+1)*d. Slices in
+// VOD mode number their segments on that grid and keep source timestamps, so
+// any slice can serve a segment and seeking is left to the player. A segment
+// nobody has encoded starts a new slice at its boundary. Stream-copied video
+// keeps the source's keyframes, which do not fall on the grid, so VOD slices
+// always encode video.
+
+const (
+	VODPlaylistName = "vod.m3u8"
+	// VODSegmentPrefix is the directory segment URIs in VOD playlists use.
+	VODSegmentPrefix = "vod/"
+	// A segment at most this many segments past what the running slice has
+	// written is waited for instead of starting a new slice.
+	vodWaitAhead = 3
+)
+
+// ErrUnknownSegment is returned for VOD assets the session does not have.
+var ErrUnknownSegment = errors.New("unknown segment")
+
+// VODAudioPlaylistName is the VOD playlist of the rendition for audio stream
+// index.
+func VODAudioPlaylistName(index int) string {
+	return fmt.Sprintf("vod_audio_%d.m3u8", index)
+}
+
+// IsVODPlaylist reports whether asset names a VOD playlist.
+func IsVODPlaylist(asset string) bool {
+	if asset == VODPlaylistName {
+		return true
+	}
+	var idx int
+	n, err := fmt.Sscanf(asset, "vod_audio_%d.m3u8", &idx)
+	return err == nil && n == 1 && asset == VODAudioPlaylistName(idx)
+}
+
+func vodSegmentCount(duration float64) int {
+	return int(math.Ceil(duration/DefaultSegmentDuration.Seconds() - 1e-6))
+}
+
+// VODPlaylist returns the VOD media playlist asset (VODPlaylistName or a
+// VODAudioPlaylistName) of session id. Playback starts at startTime. Nothing
+// is transcoded until a segment is requested.
+func (c *Controller) VODPlaylist(ctx context.Context, id, source string, startTime float64, asset string) (string, error) {
+	sess, _, err := c.lockOrCreateSession(ctx, id, source, startTime, 2*time.Minute)
+	if err != nil {
+		return "", err
+	}
+	duration := sess.DurationHint
+	format := sess.SegmentFormat
+	pattern := "segment%05d" + format.ext()
+	initName := initSegmentName(-1)
+	if asset != VODPlaylistName {
+		var idx int
+		if _, err := fmt.Sscanf(asset, "vod_audio_%d.m3u8", &idx); err != nil || !sess.hasRendition(idx) {
+			sess.mu.Unlock()
+			return "", ErrUnknownSegment
+		}
+		pattern = fmt.Sprintf("audio_%d_%%05d", idx) + format.ext()
+		initName = initSegmentName(idx)
+	}
+	sess.mu.Unlock()
+
+	if duration <= 0 {
+		return "", fmt.Errorf("duration of %s is unknown", source)
+	}
+
+	segDur := DefaultSegmentDuration.Seconds()
+	var b strings.Builder
+	b.WriteString("#EXTM3U\n")
+	if format == SegmentFormatCMAF {
+		b.WriteString("#EXT-X-VERSION:7\n")
+	} else {
+		b.WriteString("#EXT-X-VERSION:6\n")
+	}
+	fmt.Fprintf(&b, "#EXT-X-TARGETDURATION:%d\n", int(math.Ceil(segDur)))
+	b.WriteString("#EXT-X-MEDIA-SEQUENCE:0\n")
+	b.WriteString("#EXT-X-PLAYLIST-TYPE:VOD\n")
+	b.WriteString("#EXT-X-INDEPENDENT-SEGMENTS\n")
+	if startTime > 0 && startTime < duration {
+		fmt.Fprintf(&b, "#EXT-X-START:TIME-OFFSET=%.3f,PRECISE=YES\n", startTime)
+	}
+	if format == SegmentFormatCMAF {
+		fmt.Fprintf(&b, "#EXT-X-MAP:URI=%s\n", quoteAttr(VODSegmentPrefix+initName))
+	}
+	count := vodSegmentCount(duration)
+	for k := 0; k < count; k++ {
+		dur := min(segDur, duration-float64(k)*segDur)
+		fmt.Fprintf(&b, "#EXTINF:%.6f,\n", dur)
+		b.WriteString(VODSegmentPrefix + fmt.Sprintf(pattern, k) + "\n")
+	}
+	b.WriteString("#EXT-X-ENDLIST\n")
+	return b.String(), nil
+}
+
+// VODSegment returns the path that VOD segment name (e.g. "segment00042.ts",
+// or a CMAF init segment) of session id is or will be written to; the file may
+// not exist yet. If no slice has it or is about to write it, a new slice
+// starts at its boundary. Init segments come from any slice and otherwise
+// start one at startTime.
+func (c *Controller) VODSegment(ctx context.Context, id, source string, startTime float64, name string) (string, error) {
+	initSeg := isInitSegment(name)
+	seq, ok := parseSegmentSequence(name)
+	if !initSeg && (!ok || filepath.Base(name) != name) {
+		return "", ErrUnknownSegment
+	}
+
+	sess, _, err := c.lockOrCreateSession(ctx, id, source, startTime, 2*time.Minute)
+	if err != nil {
+		return "", err
+	}
+	sess.LastAccess = time.Now()
+	count := vodSegmentCount(sess.DurationHint)
+	switch {
+	case initSeg && sess.SegmentFormat == SegmentFormatCMAF && count > 0:
+		seq = min(int(startTime/DefaultSegmentDuration.Seconds()), count-1)
+	case initSeg, !strings.HasSuffix(name, sess.SegmentFormat.ext()), seq >= count:
+		sess.mu.Unlock()
+		return "", ErrUnknownSegment
+	}
+
+	if p := vodSegmentPathLocked(sess, name); p != "" {
+		sess.mu.Unlock()
+		return p, nil
+	}
+	if initSeg && sess.Cmd != nil && sess.SliceIndex < len(sess.Slices) && sess.Slices[sess.SliceIndex].VOD {
+		// Every slice writes the init segment first.
+		sliceDir := filepath.Join(sess.WorkDir, fmt.Sprintf("slice_%03d", sess.SliceIndex))
+		sess.mu.Unlock()
+		return filepath.Join(sliceDir, name), nil
+	}
+	defer sess.mu.Unlock()
+	if sliceDir, ok := vodProducingLocked(sess, seq); ok {
+		return filepath.Join(sliceDir, name), nil
+	}
+
+	// VOD slices encode video (see ensureCmdLocked), so they start on the
+	// grid rather than at a keyframe.
+	sliceDir, err := c.newSliceLocked(sess, SliceInfo{
+		StartTime: float64(seq) * DefaultSegmentDuration.Seconds(),
+		VOD:       true,
+		StartSeq:  seq,
+	})
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(sliceDir, name), nil
+}
+
+// vodSegmentPathLocked returns the path of an already written VOD segment.
+// ffmpeg writes segments under a temporary name, so an existing file is
+// complete.
+func vodSegmentPathLocked(sess *Session, name string) string {
+	for _, slice := range sess.Slices {
+		if !slice.VOD {
+			continue
+		}
+		p := filepath.Join(sess.WorkDir, fmt.Sprintf("slice_%03d", slice.Index), name)
+		if _, err := os.Stat(p); err == nil {
+			return p
+		}
+	}
+	return ""
+}
+
+// vodProducingLocked reports whether the running slice will write segment seq
+// soon, and returns its directory.
+func vodProducingLocked(sess *Session, seq int) (string, bool) {
+	if sess.Cmd == nil || sess.SliceIndex >= len(sess.Slices) {
+		return "", false
+	}
+	slice := sess.Slices[sess.SliceIndex]
+	if !slice.VOD || seq < slice.StartSeq {
+		return "", false
+	}
+	sliceDir := filepath.Join(sess.WorkDir, fmt.Sprintf("slice_%03d", slice.Index))
+	highest := slice.StartSeq - 1
+	if mediaSeq, segCount, err := readPlaylistState(filepath.Join(sliceDir, "child.m3u8")); err == nil {
+		highest = mediaSeq + segCount - 1
+	}
+	return sliceDir, seq <= highest+vodWaitAhead
+}
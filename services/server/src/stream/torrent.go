@@ -8,6 +8,7 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -22,8 +23,14 @@ type TorrentStreamer struct {
 	mu      sync.RWMutex
 	streams map[string]*TorrentStream
 	dataDir string
+	baseURL string
 }
 
+// DefaultBaseURL is where torrent streams are served when no base URL is
+// configured. ffmpeg reads them back from this server, so it must be
+// reachable locally.
+const DefaultBaseURL = "http://127.0.0.1:6969"
+
 type TorrentStream struct {
 	t        *torrent.Torrent
 	file     *torrent.File
@@ -349,9 +356,18 @@ func NewTorrentStreamer(dataDir string) *TorrentStreamer {
 		client:  c,
 		streams: make(map[string]*TorrentStream),
 		dataDir: dataDir,
+		baseURL: DefaultBaseURL,
 	}
 }
 
+// SetBaseURL changes the server origin baked into stream URLs returned by
+// AddTorrent, e.g. http://127.0.0.1:7000 when the listen port is overridden.
+func (s *TorrentStreamer) SetBaseURL(baseURL string) {
+	s.mu.Lock()
+	s.baseURL = strings.TrimSuffix(baseURL, "/")
+	s.mu.Unlock()
+}
+
 func (s *TorrentStreamer) AddTorrent(magnetOrInfoHash string, fileIdx *int) (string, string, error) {
 	var (
 		t   *torrent.Torrent
@@ -373,6 +389,7 @@ func (s *TorrentStreamer) AddTorrent(magnetOrInfoHash string, fileIdx *int) (str
 	stream := newTorrentStream(t, fileIdx)
 	s.mu.Lock()
 	s.streams[infoHash] = stream
+	baseURL := s.baseURL
 	s.mu.Unlock()
 
 	// Kick off metadata + file selection in the background.
@@ -382,11 +399,18 @@ func (s *TorrentStreamer) AddTorrent(magnetOrInfoHash string, fileIdx *int) (str
 		}
 	}()
 
-	return fmt.Sprintf("http://127.0.0.1:6969/torrents/%s", infoHash), infoHash, nil
+	streamURL := fmt.Sprintf("%s/torrents/%s", baseURL, infoHash)
+	if fileIdx != nil {
+		// The file index is informational here (the stream already knows it)
+		// but keeps per-file probe results apart.
+		streamURL += fmt.Sprintf("?file=%d", *fileIdx)
+	}
+	return streamURL, infoHash, nil
 }
 
 func (s *TorrentStreamer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	// Path: /torrents/{infohash}
+	// Path: /torrents/{infohash}, /torrents/{infohash}/status or
+	// /torrents/{infohash}/files/{idx}
 	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/torrents/"), "/")
 	if len(parts) == 0 || parts[0] == "" {
 		http.NotFound(w, r)
@@ -402,6 +426,11 @@ func (s *TorrentStreamer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if len(parts) == 3 && parts[1] == "files" {
+		s.serveFile(w, r, stream, parts[2])
+		return
+	}
+
 	if len(parts) >= 2 && parts[1] == "status" {
 		if r.Method != http.MethodGet {
 			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
@@ -435,6 +464,74 @@ func (s *TorrentStreamer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	http.ServeContent(w, r, name, time.Now(), tr)
 }
 
+// serveFile serves any file of the torrent by index. Unlike the stream URL it
+// does not change which file is downloaded: pieces are fetched only as they
+// are read. Analysis uses it to read other episodes of a season pack.
+func (s *TorrentStreamer) serveFile(w http.ResponseWriter, r *http.Request, stream *TorrentStream, rawIdx string) {
+	if err := stream.ensureReady(); err != nil {
+		http.Error(w, fmt.Sprintf("torrent not ready: %v", err), http.StatusGatewayTimeout)
+		return
+	}
+	idx, err := strconv.Atoi(rawIdx)
+	files := stream.t.Files()
+	if err != nil || idx < 0 || idx >= len(files) {
+		http.NotFound(w, r)
+		return
+	}
+	f := files[idx]
+
+	tr := f.NewReader()
+	defer tr.Close()
+	tr.SetReadahead(8 * 1024 * 1024)
+	http.ServeContent(w, r, filepath.Base(f.Path()), time.Now(), tr)
+}
+
+// TorrentFile is one file of a torrent.
+type TorrentFile struct {
+	Index  int
+	Path   string
+	Length int64
+	// Selected marks the file the stream plays.
+	Selected bool
+}
+
+// Files lists the files of infoHash once the stream has picked its file.
+func (s *TorrentStreamer) Files(infoHash string) ([]TorrentFile, bool) {
+	s.mu.RLock()
+	stream, ok := s.streams[infoHash]
+	s.mu.RUnlock()
+	if !ok || stream == nil {
+		return nil, false
+	}
+	select {
+	case <-stream.readyCh:
+	default:
+		return nil, false
+	}
+	if stream.readyErr != nil || stream.file == nil {
+		return nil, false
+	}
+
+	var out []TorrentFile
+	for i, f := range stream.t.Files() {
+		out = append(out, TorrentFile{
+			Index:    i,
+			Path:     f.Path(),
+			Length:   f.Length(),
+			Selected: f == stream.file,
+		})
+	}
+	return out, true
+}
+
+// FileURL is where serveFile serves file index of infoHash.
+func (s *TorrentStreamer) FileURL(infoHash string, index int) string {
+	s.mu.RLock()
+	baseURL := s.baseURL
+	s.mu.RUnlock()
+	return fmt.Sprintf("%s/torrents/%s/files/%d", baseURL, infoHash, index)
+}
+
 func (s *TorrentStreamer) RemoveTorrent(infoHash string) {
 	s.mu.Lock()
 	stream, ok := s.streams[infoHash]
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"path"
+	"raffi-server/src/session"
+	"raffi-server/src/stream/hls"
+	"strings"
+	"time"
+)
+
+// handleVODPlaylist serves vod.m3u8 and vod_audio_{n}.m3u8: the whole title
+// as one VOD playlist, so players seek natively instead of reloading with
+// seek parameters.
+func (s *Server) handleVODPlaylist(w http.ResponseWriter, r *http.Request, sess *session.Session, asset string) {
+	playlist, err := s.hlsController.VODPlaylist(r.Context(), sess.ID, s.mediaInput(sess), sess.StartTime, asset)
+	if errors.Is(err, hls.ErrUnknownSegment) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		log.Printf("failed to build VOD playlist for session %s: %v", sess.ID, err)
+		http.Error(w, "failed to prepare stream", http.StatusInternalServerError)
+		return
+	}
+
+	lines := strings.Split(playlist, "\n")
+	if token := r.URL.Query().Get("token"); token != "" {
+		lines = appendPlaylistToken(lines, token)
+	}
+
+	w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+	w.Header().Set("Cache-Control", "no-store, no-cache, must-revalidate, max-age=0")
+	_, _ = io.WriteString(w, strings.Join(lines, "\n"))
+}
+
+// handleDASHManifest serves manifest.mpd, the VOD segment grid as DASH. Its
+// segments are served by handleVODSegment like those of vod.m3u8.
+func (s *Server) handleDASHManifest(w http.ResponseWriter, r *http.Request, sess *session.Session) {
+	manifest, err := s.hlsController.DASHManifest(r.Context(), sess.ID, s.mediaInput(sess), sess.StartTime, r.URL.Query().Get("token"))
+	if errors.Is(err, hls.ErrSegmentFormatInUse) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		log.Printf("failed to build DASH manifest for session %s: %v", sess.ID, err)
+		http.Error(w, "failed to prepare stream", http.StatusInternalServerError)
+		return
+	}
+	_ = s.sessions.Update(sess.ID, func(sess *session.Session) {
+		sess.SegmentFormat = string(hls.SegmentFormatCMAF)
+	})
+
+	w.Header().Set("Content-Type", "application/dash+xml")
+	w.Header().Set("Cache-Control", "no-store, no-cache, must-revalidate, max-age=0")
+	_, _ = io.WriteString(w, manifest)
+}
+
+// handleVODSegment serves vod/{segment}, transcoding from the segment's
+// boundary if no slice has it.
+func (s *Server) handleVODSegment(w http.ResponseWriter, r *http.Request, sess *session.Session, name string) {
+	fullPath, err := s.hlsController.VODSegment(r.Context(), sess.ID, s.mediaInput(sess), sess.StartTime, name)
+	if errors.Is(err, hls.ErrUnknownSegment) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		log.Printf("failed to prepare VOD segment %s for session %s: %v", name, sess.ID, err)
+		http.Error(w, "failed to prepare stream", http.StatusInternalServerError)
+		return
+	}
+	s.hlsController.NotifyClientAssetRequest(sess.ID)
+
+	timeout := 20 * time.Second
+	if sess.IsTorrent {
+		timeout = 60 * time.Second
+	}
+	if err := waitForFile(r.Context(), fullPath, timeout); err != nil {
+		log.Printf("segment wait failed for %s: %v", fullPath, err)
+		http.Error(w, "segment unavailable", http.StatusServiceUnavailable)
+		return
+	}
+
+	switch path.Ext(name) {
+	case ".m4s":
+		w.Header().Set("Content-Type", "video/iso.segment")
+	case ".mp4":
+		w.Header().Set("Content-Type", "video/mp4")
+	}
+	if strings.HasPrefix(name, "segment") {
+		s.hlsController.MarkSegmentServed(sess.ID, hls.VODSegmentPrefix+name)
+		s.serveSegment(w, r, sess.ID, hls.VODSegmentPrefix+name, fullPath)
+		return
+	}
+	http.ServeFile(w, r, fullPath)
+}